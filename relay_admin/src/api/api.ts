@@ -30,6 +30,20 @@ export interface HistoryStatistic {
   totalRelayOfflineCount: number;
   totalRelayMs: number;
   totalRelayBytes: number;
+  totalRelayIdleTimeoutCount: number;  // Bridges torn down after being idle
+  totalRelayMaxDurationCount: number;  // Bridges torn down at their maximum duration
+  totalRelayKilledCount: number;       // Bridges killed by the admin
+  totalRelayQuotaCount: number;        // Relays refused or cut off by the traffic quota
+  meta: DeviceMeta;
+}
+
+
+export interface DeviceMeta {
+  hostname: string;
+  os: string;
+  appVersion: string;
+  protocolVersion: string;
+  seenAt: string | Date;         // Last connect with metadata, to about a minute; zero time if never reported
 }
 
 
@@ -40,7 +54,25 @@ export interface ActiveConnection {
   activeCount: number;
   probingCount: number;
   denied: boolean;
+  meta: DeviceMeta;
   history: HistoryStatistic;
+  services: ServiceStatus[];     // Per-service breakdown, default service ("") first
+  rttMs: number;                 // Heartbeat round-trip time, 0 if unknown
+  waiterCount: number;           // Relay requests queued for an idle connection
+  longestWaitMs: number;         // How long the oldest queued request has waited
+  bytesRelayed: number;          // Bytes bridged since the device connected, updated live
+}
+
+
+export interface ServiceStatus {
+  service: string;
+  idleCount: number;
+  activeCount: number;
+  probingCount: number;
+  rttMs: number;
+  waiterCount: number;
+  longestWaitMs: number;
+  bytesRelayed: number;
 }
 
 
@@ -67,6 +99,130 @@ export interface ReqUpdateConnection {
 }
 
 
+export interface ReqMailboxList extends PageInfo {
+  id?: string; // target device ID, empty for all devices
+}
+
+
+export interface MailboxBlob {
+  msgId: number;
+  id: string;
+  senderAddr: string;
+  size: number;
+  createdAt: string;
+  expiresAt: string;
+}
+
+
+export type RespMailboxList = PaginatedData<MailboxBlob>;
+
+
+// Bandwidth limits in bytes per second, per bridge direction; 0 means unlimited.
+export interface Bandwidth {
+  globalBytesPerSec: number;
+  deviceDefaultBytesPerSec: number;   // Applies to devices without their own limit
+  keyBytesPerSec: number[];           // Per secret key, in config order
+  devices: DeviceBandwidth[];
+}
+
+
+export interface DeviceBandwidth {
+  id: string;
+  bytesPerSec: number;
+}
+
+
+export interface KeyQuota {
+  keyIndex: number;              // Position of the key in secret_info
+  period: 'daily' | 'monthly';
+  periodKey: string;             // Current period, e.g. "2025-06"
+  usedBytes: number;
+  limitBytes: number;
+  throttleBytesPerSec: number;   // Rate of relays over quota, 0 if they are refused
+  exceeded: boolean;
+}
+
+
+export interface RelaySession {
+  id: number;
+  deviceId: string;
+  service: string;
+  reqAddr: string;               // Address of the requesting side
+  startTime: string;
+  bytes: number;                 // Both directions, updated live
+}
+
+
+export interface DenyEntry {
+  id: string;
+  reason: string;
+  createdBy: string;             // Admin user who denied the ID
+  createdAt: string;
+  expiresAt: string | null;      // null for a permanent entry
+}
+
+
+export interface ReqDenyDevice {
+  id: string;
+  durationSeconds: number;       // 0 denies permanently
+  reason?: string;
+}
+
+
+export interface ACLRule {
+  cidr: string;
+  hits: number;                  // Connections this rule decided
+}
+
+
+export interface ACL {
+  keyIndex: number;              // -1 for the global ACL
+  allow: ACLRule[];
+  deny: ACLRule[];
+  notAllowedHits: number;        // Connections rejected for matching no allow rule
+}
+
+
+export interface ReqUpdateACL {
+  scope: 'global' | 'key';
+  keyIndex?: number;
+  list: 'allow' | 'deny';
+  action: 'add' | 'remove';
+  cidr: string;
+}
+
+
+export interface IPBan {
+  ip: string;
+  strikes: number;               // Bans so far; each doubles the next one
+  bannedUntil: string;
+}
+
+
+export interface ReqRateLimitState {
+  id?: string;
+  ip?: string;
+  keyIndex?: number;             // Position of the secret key in the config
+}
+
+export interface RateLimitState {
+  limiter: 'id' | 'ip' | 'key';
+  subject: string;               // Device ID, IP or tag of the secret key
+  limit: number;                 // 0 is unlimited
+  used: number;
+  rejected: number;
+  windowSeconds: number;
+}
+
+
+export interface ReqUpdateBandwidth {
+  scope: 'global' | 'key' | 'device';
+  keyIndex?: number;   // For scope "key"
+  id?: string;         // For scope "device"
+  bytesPerSec: number;
+}
+
+
 export class ApiClient {
   private axiosInstance: AxiosInstance;
   getAuthToken: (() => string | null) = () => null;
@@ -231,6 +387,227 @@ export class ApiClient {
       throw error;
     }
   }
+
+  /**
+   * Lists blobs held in the mailbox, without their data.
+   * Corresponds to GET /api/mailbox
+   */
+  async listMailbox(params: ReqMailboxList): Promise<RespMailboxList> {
+    try {
+      const response = await this.axiosInstance.get<RespMailboxList>('/mailbox', {
+        params: params,
+      });
+      return response.data;
+    } catch (error) {
+      console.error('Failed to list mailbox:', error);
+      throw error;
+    }
+  }
+
+  /**
+   * Deletes one mailbox blob.
+   * Corresponds to DELETE /api/mailbox/blob/:id
+   */
+  async deleteMailboxBlob(msgId: number): Promise<void> {
+    try {
+      await this.axiosInstance.delete(`/mailbox/blob/${msgId}`);
+    } catch (error) {
+      console.error(`Failed to delete mailbox blob ${msgId}:`, error);
+      throw error;
+    }
+  }
+
+  /**
+   * Deletes every blob held for a device.
+   * Corresponds to DELETE /api/mailbox/device/:id
+   */
+  async purgeMailbox(id: string): Promise<number> {
+    try {
+      const response = await this.axiosInstance.delete<{ deleted: number }>(`/mailbox/device/${id}`);
+      return response.data.deleted;
+    } catch (error) {
+      console.error(`Failed to purge mailbox of ${id}:`, error);
+      throw error;
+    }
+  }
+
+  /**
+   * Gets the bandwidth limits.
+   * Corresponds to GET /api/bandwidth
+   */
+  async getBandwidth(): Promise<Bandwidth> {
+    try {
+      const response = await this.axiosInstance.get<Bandwidth>('/bandwidth');
+      return response.data;
+    } catch (error) {
+      console.error('Failed to get bandwidth limits:', error);
+      throw error;
+    }
+  }
+
+  /**
+   * Changes one bandwidth limit; it applies to bridges in progress too.
+   * Corresponds to POST /api/bandwidth/update
+   */
+  async updateBandwidth(params: ReqUpdateBandwidth): Promise<void> {
+    try {
+      await this.axiosInstance.post('/bandwidth/update', params);
+    } catch (error) {
+      console.error('Failed to update bandwidth limit:', error);
+      throw error;
+    }
+  }
+
+  /**
+   * Gets the traffic quota usage of every secret key with a quota.
+   * Corresponds to GET /api/quota
+   */
+  async getQuotas(): Promise<KeyQuota[]> {
+    try {
+      const response = await this.axiosInstance.get<KeyQuota[]>('/quota');
+      return response.data;
+    } catch (error) {
+      console.error('Failed to get quotas:', error);
+      throw error;
+    }
+  }
+
+  /**
+   * Lists the relay bridges in progress.
+   * Corresponds to GET /api/sessions
+   */
+  async listSessions(): Promise<RelaySession[]> {
+    try {
+      const response = await this.axiosInstance.get<RelaySession[]>('/sessions');
+      return response.data;
+    } catch (error) {
+      console.error('Failed to list sessions:', error);
+      throw error;
+    }
+  }
+
+  /**
+   * Tears down both sides of a relay bridge.
+   * Corresponds to DELETE /api/sessions/:id
+   */
+  async killSession(id: number): Promise<void> {
+    try {
+      await this.axiosInstance.delete(`/sessions/${id}`);
+    } catch (error) {
+      console.error(`Failed to kill session ${id}:`, error);
+      throw error;
+    }
+  }
+
+  /**
+   * Lists the active deny entries, newest first.
+   * Corresponds to GET /api/deny
+   */
+  async listDenyEntries(): Promise<DenyEntry[]> {
+    try {
+      const response = await this.axiosInstance.get<DenyEntry[]>('/deny');
+      return response.data;
+    } catch (error) {
+      console.error('Failed to list deny entries:', error);
+      throw error;
+    }
+  }
+
+  /**
+   * Denies a device ID for a duration, or permanently, and closes its idle connections.
+   * Corresponds to POST /api/deny
+   */
+  async denyDevice(req: ReqDenyDevice): Promise<void> {
+    try {
+      await this.axiosInstance.post('/deny', req);
+    } catch (error) {
+      console.error(`Failed to deny device ${req.id}:`, error);
+      throw error;
+    }
+  }
+
+  /**
+   * Removes the deny entry of a device ID.
+   * Corresponds to DELETE /api/deny/:id
+   */
+  async removeDenyEntry(id: string): Promise<void> {
+    try {
+      await this.axiosInstance.delete(`/deny/${id}`);
+    } catch (error) {
+      console.error(`Failed to remove deny entry ${id}:`, error);
+      throw error;
+    }
+  }
+
+  /**
+   * Fetches the global ACL and that of every secret key, with hit counters.
+   * Corresponds to GET /api/acl
+   */
+  async getACLs(): Promise<ACL[]> {
+    try {
+      const response = await this.axiosInstance.get<ACL[]>('/acl');
+      return response.data;
+    } catch (error) {
+      console.error('Failed to get ACLs:', error);
+      throw error;
+    }
+  }
+
+  /**
+   * Adds or removes a CIDR rule. Changes last until the relay restarts.
+   * Corresponds to POST /api/acl/update
+   */
+  async updateACL(req: ReqUpdateACL): Promise<void> {
+    try {
+      await this.axiosInstance.post('/acl/update', req);
+    } catch (error) {
+      console.error('Failed to update ACL:', error);
+      throw error;
+    }
+  }
+
+  /**
+   * Lists the IPs banned for repeatedly failing to authenticate.
+   * Corresponds to GET /api/bans
+   */
+  async listIPBans(): Promise<IPBan[]> {
+    try {
+      const response = await this.axiosInstance.get<IPBan[]>('/bans');
+      return response.data;
+    } catch (error) {
+      console.error('Failed to list IP bans:', error);
+      throw error;
+    }
+  }
+
+  /**
+   * Lifts the ban of an IP and forgets its failures.
+   * Corresponds to DELETE /api/bans/:ip
+   */
+  async liftIPBan(ip: string): Promise<void> {
+    try {
+      await this.axiosInstance.delete(`/bans/${ip}`);
+    } catch (error) {
+      console.error(`Failed to lift ban of ${ip}:`, error);
+      throw error;
+    }
+  }
+
+  /**
+   * Gets the rate limit state of a device ID, an IP or a secret key.
+   * Corresponds to GET /api/ratelimit
+   */
+  async getRateLimitState(params: ReqRateLimitState): Promise<RateLimitState[]> {
+    try {
+      const response = await this.axiosInstance.get<RateLimitState[]>('/ratelimit', {
+        params: params,
+      });
+      return response.data;
+    } catch (error) {
+      console.error('Failed to get rate limit state:', error);
+      throw error;
+    }
+  }
 }
 
 
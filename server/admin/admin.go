@@ -2,17 +2,22 @@ package admin
 
 import (
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/doraemonkeys/WindSend-Relay/server/admin/dto"
 	"github.com/doraemonkeys/WindSend-Relay/server/config"
+	"github.com/doraemonkeys/WindSend-Relay/server/protocol"
 	"github.com/doraemonkeys/WindSend-Relay/server/relay"
 	"github.com/doraemonkeys/WindSend-Relay/server/storage"
+	"github.com/doraemonkeys/WindSend-Relay/server/storage/acl/model"
 	"github.com/doraemonkeys/WindSend-Relay/server/tool"
 	"github.com/doraemonkeys/doraemon"
 	"github.com/doraemonkeys/doraemon/jwt"
@@ -103,6 +108,23 @@ func (s *AdminServer) SetupRouter() {
 		api.DELETE("/conn/close/:id", s.authMiddleware(), s.handleCloseConnection)
 		api.PUT("/conn/allow/:id", s.authMiddleware(), s.handleAllowConnection)
 		api.POST("/conn/update", s.authMiddleware(), s.handleUpdateConnection)
+		api.GET("/handshake/statistic", s.authMiddleware(), s.handleGetHandshakeStatistic)
+		api.GET("/mailbox", s.authMiddleware(), s.handleListMailbox)
+		api.DELETE("/mailbox/blob/:id", s.authMiddleware(), s.handleDeleteMailboxBlob)
+		api.DELETE("/mailbox/device/:id", s.authMiddleware(), s.handlePurgeMailbox)
+		api.GET("/bandwidth", s.authMiddleware(), s.handleGetBandwidth)
+		api.POST("/bandwidth/update", s.authMiddleware(), s.handleUpdateBandwidth)
+		api.GET("/quota", s.authMiddleware(), s.handleGetQuotas)
+		api.GET("/sessions", s.authMiddleware(), s.handleListSessions)
+		api.DELETE("/sessions/:id", s.authMiddleware(), s.handleKillSession)
+		api.GET("/deny", s.authMiddleware(), s.handleListDenyEntries)
+		api.POST("/deny", s.authMiddleware(), s.handleDenyDevice)
+		api.DELETE("/deny/:id", s.authMiddleware(), s.handleRemoveDenyEntry)
+		api.GET("/acl", s.authMiddleware(), s.handleGetACLs)
+		api.POST("/acl/update", s.authMiddleware(), s.handleUpdateACL)
+		api.GET("/bans", s.authMiddleware(), s.handleListIPBans)
+		api.DELETE("/bans/:ip", s.authMiddleware(), s.handleLiftIPBan)
+		api.GET("/ratelimit", s.authMiddleware(), s.handleGetRateLimitState)
 	}
 
 	// Handle SPA routing fallback *after* static and API routes
@@ -236,7 +258,13 @@ func (s *AdminServer) handleCloseConnection(c *gin.Context) {
 		})
 		return
 	}
-	s.relay.CloseDevice(id)
+	if err := s.relay.CloseDevice(id, c.GetString("username")); err != nil {
+		zap.L().Error("failed to deny device", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "failed to deny device",
+		})
+		return
+	}
 	c.Status(http.StatusOK)
 }
 
@@ -248,7 +276,13 @@ func (s *AdminServer) handleAllowConnection(c *gin.Context) {
 		})
 		return
 	}
-	s.relay.AllowDevice(id)
+	if _, err := s.relay.AllowDevice(id); err != nil {
+		zap.L().Error("failed to allow device", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "failed to allow device",
+		})
+		return
+	}
 	c.Status(http.StatusOK)
 }
 
@@ -265,24 +299,44 @@ func (s *AdminServer) handleGetConnectionStatus(c *gin.Context) {
 			})
 			return
 		}
+		history := toHistoryStatistic(stat)
+		meta := history.Meta
+		if ps.Meta != (protocol.DeviceMeta{}) {
+			meta = dto.DeviceMeta{
+				Hostname:        ps.Meta.Hostname,
+				OS:              ps.Meta.OS,
+				AppVersion:      ps.Meta.AppVersion,
+				ProtocolVersion: ps.Meta.ProtocolVersion,
+				SeenAt:          history.Meta.SeenAt,
+			}
+		}
+		services := make([]dto.ServiceStatus, 0, len(ps.Services))
+		for _, ss := range ps.Services {
+			services = append(services, dto.ServiceStatus{
+				Service:       ss.Service,
+				IdleCount:     ss.IdleCount,
+				ActiveCount:   ss.ActiveCount,
+				ProbingCount:  ss.ProbingCount,
+				RTTMs:         durationMs(ss.RTT),
+				WaiterCount:   ss.WaiterCount,
+				LongestWaitMs: durationMs(ss.LongestWait),
+				BytesRelayed:  ss.BytesRelayed,
+			})
+		}
 		resp = append(resp, dto.ActiveConnection{
-			ID:           ps.ID,
-			CustomName:   stat.CustomName,
-			IdleCount:    ps.IdleCount,
-			ActiveCount:  ps.ActiveCount,
-			ProbingCount: ps.ProbingCount,
-			Denied:       ps.Denied,
-			History: dto.HistoryStatistic{
-				ID:                     stat.ID,
-				CustomName:             stat.CustomName,
-				CreatedAt:              stat.CreatedAt,
-				UpdatedAt:              stat.UpdatedAt,
-				TotalRelayCount:        stat.TotalRelayCount,
-				TotalRelayErrCount:     stat.TotalRelayErrCount,
-				TotalRelayOfflineCount: stat.TotalRelayOfflineCount,
-				TotalRelayMs:           stat.TotalRelayMs,
-				TotalRelayBytes:        stat.TotalRelayBytes,
-			},
+			ID:            ps.ID,
+			CustomName:    stat.CustomName,
+			IdleCount:     ps.IdleCount,
+			ActiveCount:   ps.ActiveCount,
+			ProbingCount:  ps.ProbingCount,
+			Denied:        ps.Denied,
+			Meta:          meta,
+			History:       history,
+			Services:      services,
+			RTTMs:         durationMs(ps.RTT),
+			WaiterCount:   ps.WaiterCount,
+			LongestWaitMs: durationMs(ps.LongestWait),
+			BytesRelayed:  ps.BytesRelayed,
 		})
 	}
 	c.JSON(http.StatusOK, resp)
@@ -311,22 +365,42 @@ func (s *AdminServer) handleGetConnectionStatistic(c *gin.Context) {
 	}
 	var list = make([]dto.HistoryStatistic, 0)
 	for _, stat := range stats {
-		list = append(list, dto.HistoryStatistic{
-			ID:                     stat.ID,
-			CustomName:             stat.CustomName,
-			CreatedAt:              stat.CreatedAt,
-			UpdatedAt:              stat.UpdatedAt,
-			TotalRelayCount:        stat.TotalRelayCount,
-			TotalRelayErrCount:     stat.TotalRelayErrCount,
-			TotalRelayOfflineCount: stat.TotalRelayOfflineCount,
-			TotalRelayMs:           stat.TotalRelayMs,
-			TotalRelayBytes:        stat.TotalRelayBytes,
-		})
+		list = append(list, toHistoryStatistic(stat))
 	}
 	resp.List = list
 	c.JSON(http.StatusOK, resp)
 }
 
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func toHistoryStatistic(stat *model.RelayStatistic) dto.HistoryStatistic {
+	return dto.HistoryStatistic{
+		ID:                     stat.ID,
+		CustomName:             stat.CustomName,
+		CreatedAt:              stat.CreatedAt,
+		UpdatedAt:              stat.UpdatedAt,
+		TotalRelayCount:        stat.TotalRelayCount,
+		TotalRelayErrCount:     stat.TotalRelayErrCount,
+		TotalRelayOfflineCount: stat.TotalRelayOfflineCount,
+		TotalRelayMs:           stat.TotalRelayMs,
+		TotalRelayBytes:        stat.TotalRelayBytes,
+
+		TotalRelayIdleTimeoutCount: stat.TotalRelayIdleTimeoutCount,
+		TotalRelayMaxDurationCount: stat.TotalRelayMaxDurationCount,
+		TotalRelayKilledCount:      stat.TotalRelayKilledCount,
+		TotalRelayQuotaCount:       stat.TotalRelayQuotaCount,
+		Meta: dto.DeviceMeta{
+			Hostname:        stat.Hostname,
+			OS:              stat.OS,
+			AppVersion:      stat.AppVersion,
+			ProtocolVersion: stat.ProtocolVersion,
+			SeenAt:          stat.SeenAt,
+		},
+	}
+}
+
 func (s *AdminServer) handleUpdateConnection(c *gin.Context) {
 	var req = dto.ReqUpdateConnection{}
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -352,3 +426,367 @@ func (s *AdminServer) handleUpdateConnection(c *gin.Context) {
 	}
 	c.Status(http.StatusOK)
 }
+
+func (s *AdminServer) handleGetHandshakeStatistic(c *gin.Context) {
+	c.JSON(http.StatusOK, dto.HandshakeStatistic{
+		Failures: s.relay.GetHandshakeFailures(),
+	})
+}
+
+func (s *AdminServer) handleListMailbox(c *gin.Context) {
+	req := dto.ReqMailboxList{}
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid request",
+		})
+		return
+	}
+	blobs, total, err := s.storage.ListMailboxBlobs(req.ID, req.Page, req.PageSize)
+	if err != nil {
+		zap.L().Error("failed to list mailbox blobs", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "failed to list mailbox blobs",
+		})
+		return
+	}
+	resp := dto.RespMailboxList{
+		Total:    total,
+		Page:     req.Page,
+		PageSize: req.PageSize,
+	}
+	var list = make([]dto.MailboxBlob, 0)
+	for _, blob := range blobs {
+		list = append(list, dto.MailboxBlob{
+			MsgID:      blob.ID,
+			ID:         blob.DeviceID,
+			SenderAddr: blob.SenderAddr,
+			Size:       blob.Size,
+			CreatedAt:  blob.CreatedAt,
+			ExpiresAt:  blob.ExpiresAt,
+		})
+	}
+	resp.List = list
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *AdminServer) handleDeleteMailboxBlob(c *gin.Context) {
+	msgID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid id",
+		})
+		return
+	}
+	ok, err := s.storage.DeleteMailboxBlob(msgID)
+	if err != nil {
+		zap.L().Error("failed to delete mailbox blob", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "failed to delete mailbox blob",
+		})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "blob not found",
+		})
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+func (s *AdminServer) handlePurgeMailbox(c *gin.Context) {
+	id := c.Param("id")
+	if id == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "id is required",
+		})
+		return
+	}
+	n, err := s.storage.PurgeMailbox(id)
+	if err != nil {
+		zap.L().Error("failed to purge mailbox", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "failed to purge mailbox",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, dto.RespMailboxPurge{Deleted: n})
+}
+
+func (s *AdminServer) handleGetBandwidth(c *gin.Context) {
+	bw := s.relay.GetBandwidth()
+	resp := dto.Bandwidth{
+		GlobalBytesPerSec:        bw.Global,
+		DeviceDefaultBytesPerSec: bw.DeviceDefault,
+		KeyBytesPerSec:           bw.Keys,
+		Devices:                  make([]dto.DeviceBandwidth, 0, len(bw.Devices)),
+	}
+	if resp.KeyBytesPerSec == nil {
+		resp.KeyBytesPerSec = []int64{}
+	}
+	for id, rate := range bw.Devices {
+		resp.Devices = append(resp.Devices, dto.DeviceBandwidth{ID: id, BytesPerSec: rate})
+	}
+	slices.SortFunc(resp.Devices, func(a, b dto.DeviceBandwidth) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *AdminServer) handleUpdateBandwidth(c *gin.Context) {
+	var req dto.ReqUpdateBandwidth
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid request",
+		})
+		return
+	}
+	switch req.Scope {
+	case "global":
+		s.relay.SetGlobalBandwidth(req.BytesPerSec)
+	case "key":
+		if !s.relay.SetKeyBandwidth(req.KeyIndex, req.BytesPerSec) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"message": "secret key not found",
+			})
+			return
+		}
+	case "device":
+		if req.ID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "device ID is required",
+			})
+			return
+		}
+		s.relay.SetDeviceBandwidth(req.ID, req.BytesPerSec)
+	}
+	zap.L().Info("bandwidth limit updated", zap.String("scope", req.Scope),
+		zap.Int("keyIndex", req.KeyIndex), zap.String("id", req.ID), zap.Int64("bytesPerSec", req.BytesPerSec))
+	c.Status(http.StatusOK)
+}
+
+func (s *AdminServer) handleGetQuotas(c *gin.Context) {
+	quotas := s.relay.GetQuotas()
+	resp := make([]dto.KeyQuota, 0, len(quotas))
+	for _, q := range quotas {
+		resp = append(resp, dto.KeyQuota{
+			KeyIndex:            q.KeyIndex,
+			Period:              q.Period,
+			PeriodKey:           q.PeriodKey,
+			UsedBytes:           q.UsedBytes,
+			LimitBytes:          q.LimitBytes,
+			ThrottleBytesPerSec: q.ThrottleRate,
+			Exceeded:            q.QuotaExceeded,
+		})
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *AdminServer) handleListSessions(c *gin.Context) {
+	sessions := s.relay.GetSessions()
+	resp := make([]dto.RelaySession, 0, len(sessions))
+	for _, ss := range sessions {
+		resp = append(resp, dto.RelaySession{
+			ID:        ss.ID,
+			DeviceID:  ss.DeviceID,
+			Service:   ss.Service,
+			ReqAddr:   ss.ReqAddr,
+			StartTime: ss.Start,
+			Bytes:     ss.Bytes,
+		})
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *AdminServer) handleKillSession(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid session id",
+		})
+		return
+	}
+	if !s.relay.KillSession(id) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "session not found",
+		})
+		return
+	}
+	zap.L().Info("relay session killed by admin", zap.Uint64("session", id))
+	c.Status(http.StatusOK)
+}
+
+func (s *AdminServer) handleListDenyEntries(c *gin.Context) {
+	entries := s.relay.GetDenyList()
+	resp := make([]dto.DenyEntry, 0, len(entries))
+	for _, e := range entries {
+		entry := dto.DenyEntry{
+			ID:        e.ID,
+			Reason:    e.Reason,
+			CreatedBy: e.CreatedBy,
+			CreatedAt: e.CreatedAt,
+		}
+		if !e.ExpiresAt.IsZero() {
+			entry.ExpiresAt = &e.ExpiresAt
+		}
+		resp = append(resp, entry)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *AdminServer) handleDenyDevice(c *gin.Context) {
+	var req dto.ReqDenyDevice
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid request",
+		})
+		return
+	}
+	ttl := time.Duration(req.DurationSeconds) * time.Second
+	if err := s.relay.DenyDevice(req.ID, ttl, req.Reason, c.GetString("username")); err != nil {
+		zap.L().Error("failed to deny device", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "failed to deny device",
+		})
+		return
+	}
+	zap.L().Info("device denied by admin", zap.String("id", req.ID),
+		zap.Int64("durationSeconds", req.DurationSeconds), zap.String("reason", req.Reason))
+	c.Status(http.StatusOK)
+}
+
+func (s *AdminServer) handleRemoveDenyEntry(c *gin.Context) {
+	id := c.Param("id")
+	found, err := s.relay.AllowDevice(id)
+	if err != nil {
+		zap.L().Error("failed to remove deny entry", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "failed to remove deny entry",
+		})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "deny entry not found",
+		})
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+func (s *AdminServer) handleGetACLs(c *gin.Context) {
+	acls := s.relay.GetACLs()
+	rules := func(list []relay.ACLRuleStatus) []dto.ACLRule {
+		out := make([]dto.ACLRule, 0, len(list))
+		for _, r := range list {
+			out = append(out, dto.ACLRule{CIDR: r.CIDR, Hits: r.Hits})
+		}
+		return out
+	}
+	resp := make([]dto.ACL, 0, len(acls))
+	for _, a := range acls {
+		resp = append(resp, dto.ACL{
+			KeyIndex:       a.KeyIndex,
+			Allow:          rules(a.Allow),
+			Deny:           rules(a.Deny),
+			NotAllowedHits: a.NotAllowed,
+		})
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *AdminServer) handleUpdateACL(c *gin.Context) {
+	var req dto.ReqUpdateACL
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid request",
+		})
+		return
+	}
+	keyIndex := -1
+	if req.Scope == "key" {
+		keyIndex = req.KeyIndex
+		if keyIndex < 0 {
+			c.JSON(http.StatusNotFound, gin.H{
+				"message": "secret key not found",
+			})
+			return
+		}
+	}
+	err := s.relay.UpdateACL(keyIndex, req.List == "deny", req.CIDR, req.Action == "remove")
+	switch {
+	case errors.Is(err, relay.ErrACLKeyNotFound), errors.Is(err, relay.ErrACLRuleNotFound):
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": err.Error(),
+		})
+		return
+	case errors.Is(err, relay.ErrACLRuleExists):
+		c.JSON(http.StatusConflict, gin.H{
+			"message": err.Error(),
+		})
+		return
+	case err != nil:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid CIDR",
+		})
+		return
+	}
+	zap.L().Info("acl updated", zap.String("scope", req.Scope), zap.Int("keyIndex", req.KeyIndex),
+		zap.String("list", req.List), zap.String("action", req.Action), zap.String("cidr", req.CIDR))
+	c.Status(http.StatusOK)
+}
+
+func (s *AdminServer) handleListIPBans(c *gin.Context) {
+	bans := s.relay.GetIPBans()
+	resp := make([]dto.IPBan, 0, len(bans))
+	for _, b := range bans {
+		resp = append(resp, dto.IPBan{IP: b.IP, Strikes: b.Strikes, BannedUntil: b.BannedUntil})
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *AdminServer) handleLiftIPBan(c *gin.Context) {
+	ip := c.Param("ip")
+	found, err := s.relay.LiftIPBan(ip)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid IP",
+		})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "IP not banned",
+		})
+		return
+	}
+	zap.L().Info("IP ban lifted by admin", zap.String("ip", ip))
+	c.Status(http.StatusOK)
+}
+
+func (s *AdminServer) handleGetRateLimitState(c *gin.Context) {
+	req := dto.ReqRateLimitState{}
+	if err := c.ShouldBindQuery(&req); err != nil || (req.ID == "" && req.IP == "" && req.KeyIndex == nil) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid request",
+		})
+		return
+	}
+	keyIndex := -1
+	if req.KeyIndex != nil {
+		keyIndex = *req.KeyIndex
+	}
+	states := s.relay.GetRateLimitState(req.ID, req.IP, keyIndex)
+	resp := make([]dto.RateLimitState, 0, len(states))
+	for _, st := range states {
+		resp = append(resp, dto.RateLimitState{
+			Limiter:       st.Limiter,
+			Subject:       st.Subject,
+			Limit:         st.Limit,
+			Used:          st.Used,
+			Rejected:      st.Rejected,
+			WindowSeconds: st.WindowSeconds,
+		})
+	}
+	c.JSON(http.StatusOK, resp)
+}
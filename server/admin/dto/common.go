@@ -23,15 +23,32 @@ type PaginatedData[T any] struct {
 }
 
 type HistoryStatistic struct {
-	ID                     string    `json:"id"`
-	CustomName             string    `json:"customName"`
-	TotalRelayCount        int       `json:"totalRelayCount"`
-	TotalRelayErrCount     int       `json:"totalRelayErrCount"`
-	TotalRelayOfflineCount int       `json:"totalRelayOfflineCount"`
-	TotalRelayMs           int64     `json:"totalRelayMs"`
-	TotalRelayBytes        int64     `json:"totalRelayBytes"`
-	CreatedAt              time.Time `json:"createdAt"`
-	UpdatedAt              time.Time `json:"updatedAt"`
+	ID                         string    `json:"id"`
+	CustomName                 string    `json:"customName"`
+	TotalRelayCount            int       `json:"totalRelayCount"`
+	TotalRelayErrCount         int       `json:"totalRelayErrCount"`
+	TotalRelayOfflineCount     int       `json:"totalRelayOfflineCount"`
+	TotalRelayMs               int64     `json:"totalRelayMs"`
+	TotalRelayBytes            int64     `json:"totalRelayBytes"`
+	TotalRelayIdleTimeoutCount int       `json:"totalRelayIdleTimeoutCount"`
+	TotalRelayMaxDurationCount int       `json:"totalRelayMaxDurationCount"`
+	TotalRelayKilledCount      int       `json:"totalRelayKilledCount"`
+	TotalRelayQuotaCount       int       `json:"totalRelayQuotaCount"`
+	CreatedAt                  time.Time `json:"createdAt"`
+	UpdatedAt                  time.Time `json:"updatedAt"`
+	// Meta is the last metadata the device reported.
+	Meta DeviceMeta `json:"meta"`
+}
+
+// DeviceMeta is the optional self-description a device sends on connect.
+type DeviceMeta struct {
+	Hostname        string `json:"hostname"`
+	OS              string `json:"os"`
+	AppVersion      string `json:"appVersion"`
+	ProtocolVersion string `json:"protocolVersion"`
+	// SeenAt is when the device last connected with metadata, accurate to
+	// about a minute; zero if it never reported any.
+	SeenAt time.Time `json:"seenAt"`
 }
 
 // ActiveConnection is the per-ID aggregated status returned by the admin status endpoint.
@@ -42,7 +59,32 @@ type ActiveConnection struct {
 	ActiveCount  int              `json:"activeCount"`
 	ProbingCount int              `json:"probingCount"`
 	Denied       bool             `json:"denied"`
+	Meta         DeviceMeta       `json:"meta"`
 	History      HistoryStatistic `json:"history"`
+	// Services breaks the counts down per service name.
+	Services []ServiceStatus `json:"services"`
+	// RTTMs is the heartbeat round-trip time in milliseconds, 0 if unknown.
+	RTTMs float64 `json:"rttMs"`
+	// WaiterCount is the number of queued relay requests and LongestWaitMs
+	// how long the oldest has waited, in milliseconds.
+	WaiterCount   int     `json:"waiterCount"`
+	LongestWaitMs float64 `json:"longestWaitMs"`
+	// BytesRelayed counts the bytes bridged since the device connected,
+	// including relays still in progress.
+	BytesRelayed int64 `json:"bytesRelayed"`
+}
+
+// ServiceStatus is the pool status of one service of a device. The default
+// service has an empty name.
+type ServiceStatus struct {
+	Service       string  `json:"service"`
+	IdleCount     int     `json:"idleCount"`
+	ActiveCount   int     `json:"activeCount"`
+	ProbingCount  int     `json:"probingCount"`
+	RTTMs         float64 `json:"rttMs"`
+	WaiterCount   int     `json:"waiterCount"`
+	LongestWaitMs float64 `json:"longestWaitMs"`
+	BytesRelayed  int64   `json:"bytesRelayed"`
 }
 
 type ReqHistoryStatistic struct {
@@ -57,3 +99,160 @@ type ReqUpdateConnection struct {
 	ID         string `json:"id"`
 	CustomName string `json:"customName"`
 }
+
+// HandshakeStatistic reports failed handshakes since startup.
+type HandshakeStatistic struct {
+	// Failures maps a failure reason (e.g. "bad_salt", "bad_selector") to its count.
+	Failures map[string]int64 `json:"failures"`
+}
+
+type ReqMailboxList struct {
+	PageInfo
+	// ID filters by target device, empty means all devices.
+	ID string `json:"id" form:"id"`
+}
+
+// MailboxBlob describes a held blob; the data itself is never exposed.
+type MailboxBlob struct {
+	MsgID      uint64    `json:"msgId"`
+	ID         string    `json:"id"`
+	SenderAddr string    `json:"senderAddr"`
+	Size       int       `json:"size"`
+	CreatedAt  time.Time `json:"createdAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+type RespMailboxList = PaginatedData[MailboxBlob]
+
+type RespMailboxPurge struct {
+	Deleted int64 `json:"deleted"`
+}
+
+// Bandwidth reports the bandwidth limits in bytes per second. Each limit
+// applies to both directions of a bridge separately; 0 means unlimited.
+type Bandwidth struct {
+	GlobalBytesPerSec int64 `json:"globalBytesPerSec"`
+	// DeviceDefaultBytesPerSec applies to devices without their own limit.
+	DeviceDefaultBytesPerSec int64 `json:"deviceDefaultBytesPerSec"`
+	// KeyBytesPerSec lists the limit of each secret key in config order.
+	KeyBytesPerSec []int64           `json:"keyBytesPerSec"`
+	Devices        []DeviceBandwidth `json:"devices"`
+}
+
+type DeviceBandwidth struct {
+	ID          string `json:"id"`
+	BytesPerSec int64  `json:"bytesPerSec"`
+}
+
+// ReqUpdateBandwidth changes one limit: the global one, that of the secret
+// key at KeyIndex or that of the device ID.
+type ReqUpdateBandwidth struct {
+	Scope       string `json:"scope" binding:"required,oneof=global key device"`
+	KeyIndex    int    `json:"keyIndex"`
+	ID          string `json:"id"`
+	BytesPerSec int64  `json:"bytesPerSec" binding:"min=0"`
+}
+
+// KeyQuota is the traffic quota of a secret key and its usage in the
+// current period.
+type KeyQuota struct {
+	// KeyIndex is the position of the key in the secret_info config.
+	KeyIndex int `json:"keyIndex"`
+	// Period is "daily" or "monthly"; PeriodKey names the current one,
+	// e.g. "2025-06".
+	Period     string `json:"period"`
+	PeriodKey  string `json:"periodKey"`
+	UsedBytes  int64  `json:"usedBytes"`
+	LimitBytes int64  `json:"limitBytes"`
+	// ThrottleBytesPerSec is the rate relays over quota are limited to, 0
+	// if they are refused.
+	ThrottleBytesPerSec int64 `json:"throttleBytesPerSec"`
+	Exceeded            bool  `json:"exceeded"`
+}
+
+// RelaySession is a bridge in progress.
+type RelaySession struct {
+	ID       uint64 `json:"id"`
+	DeviceID string `json:"deviceId"`
+	Service  string `json:"service"`
+	// ReqAddr is the address of the requesting side.
+	ReqAddr   string    `json:"reqAddr"`
+	StartTime time.Time `json:"startTime"`
+	// Bytes counts both directions, updated while the bridge runs.
+	Bytes int64 `json:"bytes"`
+}
+
+// DenyEntry is a device ID denied by an admin.
+type DenyEntry struct {
+	ID        string    `json:"id"`
+	Reason    string    `json:"reason"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+	// ExpiresAt is null for a permanent entry.
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+// ReqDenyDevice denies a device ID for DurationSeconds, or permanently if
+// it is 0.
+type ReqDenyDevice struct {
+	ID              string `json:"id" binding:"required"`
+	DurationSeconds int64  `json:"durationSeconds" binding:"min=0"`
+	Reason          string `json:"reason"`
+}
+
+// ACLRule is one CIDR of an ACL and how many connections it matched.
+type ACLRule struct {
+	CIDR string `json:"cidr"`
+	Hits int64  `json:"hits"`
+}
+
+// ACL is the global ACL (keyIndex -1) or that of a secret key.
+type ACL struct {
+	KeyIndex int       `json:"keyIndex"`
+	Allow    []ACLRule `json:"allow"`
+	Deny     []ACLRule `json:"deny"`
+	// NotAllowedHits counts the connections rejected for matching no allow
+	// rule.
+	NotAllowedHits int64 `json:"notAllowedHits"`
+}
+
+// ReqUpdateACL adds a CIDR to or removes it from the allow or deny list of
+// the global ACL or of the secret key at KeyIndex.
+type ReqUpdateACL struct {
+	Scope    string `json:"scope" binding:"required,oneof=global key"`
+	KeyIndex int    `json:"keyIndex"`
+	List     string `json:"list" binding:"required,oneof=allow deny"`
+	Action   string `json:"action" binding:"required,oneof=add remove"`
+	CIDR     string `json:"cidr" binding:"required"`
+}
+
+// IPBan is an IP banned for repeatedly failing to authenticate.
+type IPBan struct {
+	IP string `json:"ip"`
+	// Strikes is how many times the IP was banned; each ban doubles the
+	// next one.
+	Strikes     int       `json:"strikes"`
+	BannedUntil time.Time `json:"bannedUntil"`
+}
+
+// ReqRateLimitState selects the subjects whose rate limit state is
+// reported; at least one must be set.
+type ReqRateLimitState struct {
+	ID string `json:"id" form:"id"`
+	IP string `json:"ip" form:"ip"`
+	// KeyIndex is the position of the secret key in the config.
+	KeyIndex *int `json:"keyIndex" form:"keyIndex" binding:"omitempty,min=0"`
+}
+
+// RateLimitState is the use of the ID, IP or key rate limit by one subject.
+type RateLimitState struct {
+	// Limiter is "id", "ip" or "key".
+	Limiter string `json:"limiter"`
+	// Subject is the device ID, the IP or the tag of the secret key.
+	Subject string `json:"subject"`
+	// Limit is the limit of the last request, 0 if unlimited.
+	Limit         int   `json:"limit"`
+	Used          int   `json:"used"`
+	Rejected      int64 `json:"rejected"`
+	WindowSeconds int   `json:"windowSeconds"`
+}
@@ -26,6 +26,9 @@ func main() {
 	g.ApplyBasic(
 		model.RelayStatistic{},
 		model.KeyValue{},
+		model.MailboxBlob{},
+		model.KeyTraffic{},
+		model.DenyEntry{},
 	)
 
 	// g.GenerateAllTable()
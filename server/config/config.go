@@ -2,9 +2,14 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"math"
+	"net/netip"
 	"os"
+	"strings"
 
 	"github.com/caarlos0/env/v11"
 	"github.com/doraemonkeys/WindSend-Relay/server/version"
@@ -16,8 +21,42 @@ const WebStaticDir = "static/web"
 type SecretInfo struct {
 	SecretKey string `json:"secret_key" env:"KEY,notEmpty"`
 	MaxConn   int    `json:"max_conn" env:"MAX_CONN" envDefault:"5"`
+	// MailboxMaxBlobSize and MailboxMaxTTLSeconds override the mailbox
+	// limits for this key. 0 means use the global value.
+	MailboxMaxBlobSize   int `json:"mailbox_max_blob_size" env:"MAILBOX_MAX_BLOB_SIZE"`
+	MailboxMaxTTLSeconds int `json:"mailbox_max_ttl_seconds" env:"MAILBOX_MAX_TTL_SECONDS"`
+	// The pool limits below override Config.Pool for devices registered
+	// with this key. 0 means use the global value.
+	MaxConnsPerDevice   int `json:"max_conns_per_device" env:"MAX_CONNS_PER_DEVICE"`
+	MaxWaitersPerDevice int `json:"max_waiters_per_device" env:"MAX_WAITERS_PER_DEVICE"`
+	WaitTimeoutMs       int `json:"wait_timeout_ms" env:"WAIT_TIMEOUT_MS"`
+	ReconnectWindowMs   int `json:"reconnect_window_ms" env:"RECONNECT_WINDOW_MS"`
+	// BandwidthBytesPerSec limits each direction of all bridges to devices
+	// registered with this key together. 0 means unlimited.
+	BandwidthBytesPerSec int64 `json:"bandwidth_bytes_per_sec" env:"BANDWIDTH_BYTES_PER_SEC"`
+	// QuotaBytes caps the bytes relayed to devices of this key per
+	// QuotaPeriod, "daily" or "monthly" (the default). 0 means no quota.
+	QuotaBytes  int64  `json:"quota_bytes" env:"QUOTA_BYTES"`
+	QuotaPeriod string `json:"quota_period" env:"QUOTA_PERIOD"`
+	// QuotaThrottleBytesPerSec, if set, throttles relays over quota to this
+	// rate instead of refusing them.
+	QuotaThrottleBytesPerSec int64 `json:"quota_throttle_bytes_per_sec" env:"QUOTA_THROTTLE_BYTES_PER_SEC"`
+	// AllowCIDRs and DenyCIDRs restrict the addresses that may authenticate
+	// with this key, on top of Config.ACL. See ACLConfig.
+	AllowCIDRs []string `json:"allow_cidrs" env:"ALLOW_CIDRS" envSeparator:","`
+	DenyCIDRs  []string `json:"deny_cidrs" env:"DENY_CIDRS" envSeparator:","`
+	// RateLimitID and RateLimitKey override Config.RateLimit for requests
+	// authenticated with this key. 0 means use the global value; a negative
+	// value is unlimited.
+	RateLimitID  int `json:"rate_limit_id" env:"RATE_LIMIT_ID"`
+	RateLimitKey int `json:"rate_limit_key" env:"RATE_LIMIT_KEY"`
 }
 
+const (
+	QuotaDaily   = "daily"
+	QuotaMonthly = "monthly"
+)
+
 type Config struct {
 	ListenAddr  string       `json:"listen_addr" env:"WS_LISTEN_ADDR,notEmpty" envDefault:"0.0.0.0:16779"`
 	MaxConn     int          `json:"max_conn" env:"WS_MAX_CONN" envDefault:"100"`
@@ -26,6 +65,148 @@ type Config struct {
 	EnableAuth  bool         `json:"enable_auth" env:"WS_ENABLE_AUTH" envDefault:"false"`
 	LogLevel    string       `json:"log_level" env:"WS_LOG_LEVEL" envDefault:"INFO"`
 	AdminConfig AdminConfig  `json:"admin_config" envPrefix:"WS_ADMIN_"`
+	// HandshakeMaxRetries is how many times a client may retry the handshake
+	// after being sent the KDF salt. Values below 1 are raised to 1.
+	HandshakeMaxRetries int           `json:"handshake_max_retries" env:"WS_HANDSHAKE_MAX_RETRIES" envDefault:"1"`
+	Mailbox             MailboxConfig `json:"mailbox" envPrefix:"WS_MAILBOX_"`
+	// AcquireStrategy picks the idle connection a relay gets: "fifo" (oldest
+	// first), "lifo" (freshest first) or "recent_probe" (most recently
+	// proven alive first).
+	AcquireStrategy string `json:"acquire_strategy" env:"WS_ACQUIRE_STRATEGY" envDefault:"fifo"`
+	// MaxIdleAgeSeconds retires idle device connections older than this, so
+	// that the device replaces them before a NAT mapping times out. 0
+	// disables it.
+	MaxIdleAgeSeconds int             `json:"max_idle_age_seconds" env:"WS_MAX_IDLE_AGE_SECONDS" envDefault:"0"`
+	Heartbeat         HeartbeatConfig `json:"heartbeat" envPrefix:"WS_HEARTBEAT_"`
+	Pool              PoolConfig      `json:"pool" envPrefix:"WS_POOL_"`
+	Bandwidth         BandwidthConfig `json:"bandwidth" envPrefix:"WS_BANDWIDTH_"`
+	Session           SessionConfig   `json:"session" envPrefix:"WS_SESSION_"`
+	ACL               ACLConfig       `json:"acl" envPrefix:"WS_ACL_"`
+	Ban               BanConfig       `json:"ban" envPrefix:"WS_BAN_"`
+	IPLimit           IPLimitConfig   `json:"ip_limit" envPrefix:"WS_IP_LIMIT_"`
+	RateLimit         RateLimitConfig `json:"rate_limit" envPrefix:"WS_RATE_LIMIT_"`
+}
+
+// RateLimitConfig limits the requests per window of each device ID, each
+// source IP and each secret key. A limit of 0 is unlimited.
+type RateLimitConfig struct {
+	WindowSeconds int `json:"window_seconds" env:"WINDOW_SECONDS" envDefault:"60"`
+	// IDLimit counts the requests naming a device ID.
+	IDLimit int `json:"id_limit" env:"ID_LIMIT" envDefault:"120"`
+	// IPLimit counts the connections from an IP, before the handshake.
+	IPLimit int `json:"ip_limit" env:"IP_LIMIT" envDefault:"1000"`
+	// KeyLimit counts the requests authenticated with a secret key.
+	KeyLimit int `json:"key_limit" env:"KEY_LIMIT" envDefault:"0"`
+}
+
+// IPLimitConfig caps what one source IP may hold at once. 0 is unlimited.
+type IPLimitConfig struct {
+	// MaxConns caps the registered device connections of an IP.
+	MaxConns int `json:"max_conns" env:"MAX_CONNS" envDefault:"0"`
+	// MaxBridges caps the relays an IP requested that are in progress.
+	MaxBridges int `json:"max_bridges" env:"MAX_BRIDGES" envDefault:"0"`
+	// Overrides set other limits for the IPs in a range; the most specific
+	// matching range wins.
+	Overrides []IPLimitOverride `json:"overrides" envPrefix:"OVERRIDES"`
+}
+
+// IPLimitOverride sets the limits of the IPs in CIDR. 0 means use the
+// global value; a negative value is unlimited.
+type IPLimitOverride struct {
+	CIDR       string `json:"cidr" env:"CIDR,notEmpty"`
+	MaxConns   int    `json:"max_conns" env:"MAX_CONNS"`
+	MaxBridges int    `json:"max_bridges" env:"MAX_BRIDGES"`
+}
+
+// BanConfig configures the temporary bans of IPs that keep failing to
+// authenticate. Each ban of the same IP lasts twice as long as the last,
+// up to MaxBanSeconds.
+type BanConfig struct {
+	// MaxFailures auth failures within WindowSeconds ban the IP. 0 disables
+	// banning.
+	MaxFailures   int `json:"max_failures" env:"MAX_FAILURES" envDefault:"5"`
+	WindowSeconds int `json:"window_seconds" env:"WINDOW_SECONDS" envDefault:"60"`
+	// BanSeconds is the length of the first ban.
+	BanSeconds    int `json:"ban_seconds" env:"BAN_SECONDS" envDefault:"60"`
+	MaxBanSeconds int `json:"max_ban_seconds" env:"MAX_BAN_SECONDS" envDefault:"86400"`
+}
+
+// ACLConfig restricts the client addresses by CIDR, e.g. "10.0.0.0/8"; a
+// bare IP is a single address. An address in a Deny range is rejected. If
+// Allow is not empty, only addresses in one of its ranges are admitted.
+type ACLConfig struct {
+	Allow []string `json:"allow" env:"ALLOW" envSeparator:","`
+	Deny  []string `json:"deny" env:"DENY" envSeparator:","`
+}
+
+// SessionConfig bounds the lifetime of relay bridges. 0 disables a limit.
+type SessionConfig struct {
+	// IdleTimeoutSeconds tears down a bridge that relayed no bytes in either
+	// direction for this long.
+	IdleTimeoutSeconds int `json:"idle_timeout_seconds" env:"IDLE_TIMEOUT_SECONDS" envDefault:"300"`
+	// MaxDurationSeconds tears down a bridge this long after it started,
+	// whether or not it is busy.
+	MaxDurationSeconds int `json:"max_duration_seconds" env:"MAX_DURATION_SECONDS" envDefault:"0"`
+	// DrainTimeoutSeconds tears down a bridge one side of which finished
+	// sending once the other direction relayed no bytes for this long,
+	// whatever IdleTimeoutSeconds is. It cannot be disabled.
+	DrainTimeoutSeconds int `json:"drain_timeout_seconds" env:"DRAIN_TIMEOUT_SECONDS" envDefault:"30"`
+}
+
+// BandwidthConfig configures the bandwidth limits of relay bridges, in
+// bytes per second. Each limit applies to both directions separately; 0
+// means unlimited.
+type BandwidthConfig struct {
+	// GlobalBytesPerSec limits all bridges together.
+	GlobalBytesPerSec int64 `json:"global_bytes_per_sec" env:"GLOBAL_BYTES_PER_SEC" envDefault:"0"`
+	// DeviceBytesPerSec limits the bridges to one device ID together.
+	DeviceBytesPerSec int64 `json:"device_bytes_per_sec" env:"DEVICE_BYTES_PER_SEC" envDefault:"0"`
+}
+
+// PoolConfig configures the connection pool of each device service.
+type PoolConfig struct {
+	// MaxConnsPerDevice caps the connections (idle, active and probing) of
+	// one service of a device.
+	MaxConnsPerDevice int `json:"max_conns_per_device" env:"MAX_CONNS_PER_DEVICE" envDefault:"16"`
+	// MaxWaitersPerDevice caps the relay requests that may wait for an idle
+	// connection; further requests get DEVICE_BUSY at once.
+	MaxWaitersPerDevice int `json:"max_waiters_per_device" env:"MAX_WAITERS_PER_DEVICE" envDefault:"8"`
+	// WaitTimeoutMs is how long a relay request waits for an idle connection.
+	WaitTimeoutMs int `json:"wait_timeout_ms" env:"WAIT_TIMEOUT_MS" envDefault:"3000"`
+	// ReconnectWindowMs is how long after the last relay an empty pool is
+	// still reported BUSY rather than OFFLINE, while the device reconnects.
+	ReconnectWindowMs int `json:"reconnect_window_ms" env:"RECONNECT_WINDOW_MS" envDefault:"5000"`
+	// DenyTTLSeconds is how long a device ID closed by an admin stays
+	// rejected. Entries created with a duration of their own ignore it.
+	DenyTTLSeconds int `json:"deny_ttl_seconds" env:"DENY_TTL_SECONDS" envDefault:"300"`
+}
+
+// HeartbeatConfig configures the liveness probes of idle device connections.
+type HeartbeatConfig struct {
+	// IntervalSeconds is how often every idle connection is probed. The
+	// probes of one scan are spread over the interval.
+	IntervalSeconds int `json:"interval_seconds" env:"INTERVAL_SECONDS" envDefault:"60"`
+	// TimeoutMs is how long a probe waits for the heartbeat reply.
+	TimeoutMs int `json:"timeout_ms" env:"TIMEOUT_MS" envDefault:"2000"`
+	// JitterPercent randomly lengthens or shortens each interval by up to
+	// this percentage, so that scans do not stay in lockstep with clients.
+	JitterPercent int `json:"jitter_percent" env:"JITTER_PERCENT" envDefault:"10"`
+}
+
+// MailboxConfig configures the store-and-forward mailbox for offline devices.
+type MailboxConfig struct {
+	Enable bool `json:"enable" env:"ENABLE" envDefault:"false"`
+	// MaxBlobSize is the largest blob accepted, in bytes.
+	MaxBlobSize int `json:"max_blob_size" env:"MAX_BLOB_SIZE" envDefault:"65536"`
+	// MaxTTLSeconds is the longest a blob is held.
+	MaxTTLSeconds int `json:"max_ttl_seconds" env:"MAX_TTL_SECONDS" envDefault:"86400"`
+	// MaxBlobsPerDevice caps the number of blobs waiting for one device.
+	MaxBlobsPerDevice int `json:"max_blobs_per_device" env:"MAX_BLOBS_PER_DEVICE" envDefault:"16"`
+	// MaxBytesPerKey caps the bytes held for one secret key across all
+	// devices. Senders without a key share one budget.
+	MaxBytesPerKey int64 `json:"max_bytes_per_key" env:"MAX_BYTES_PER_KEY" envDefault:"16777216"`
+	// MaxTotalBytes caps the bytes held in the whole mailbox.
+	MaxTotalBytes int64 `json:"max_total_bytes" env:"MAX_TOTAL_BYTES" envDefault:"268435456"`
 }
 
 type AdminConfig struct {
@@ -44,6 +225,41 @@ func ParseConfig() *Config {
 	flag.StringVar(&config.AdminConfig.Addr, "admin-addr", "0.0.0.0:16780", "admin address")
 	flag.IntVar(&config.MaxConn, "max-conn", 100, "max connection")
 	flag.StringVar(&config.LogLevel, "log-level", "INFO", "log level")
+	flag.BoolVar(&config.Mailbox.Enable, "mailbox", false, "enable the mailbox for offline devices")
+	flag.IntVar(&config.HandshakeMaxRetries, "handshake-max-retries", 1, "max handshake retries after the KDF salt is sent")
+	flag.IntVar(&config.Heartbeat.IntervalSeconds, "heartbeat-interval", 60, "heartbeat interval in seconds")
+	flag.IntVar(&config.Heartbeat.TimeoutMs, "heartbeat-timeout", 2000, "heartbeat timeout in milliseconds")
+	flag.IntVar(&config.Heartbeat.JitterPercent, "heartbeat-jitter", 10, "heartbeat interval jitter in percent")
+	flag.IntVar(&config.MaxIdleAgeSeconds, "max-idle-age", 0, "max idle connection age in seconds, 0 disables rotation")
+	flag.IntVar(&config.Pool.MaxConnsPerDevice, "max-conns-per-device", 16, "max connections per device service")
+	flag.IntVar(&config.Pool.MaxWaitersPerDevice, "max-waiters-per-device", 8, "max relay requests waiting for a device service")
+	flag.IntVar(&config.Pool.WaitTimeoutMs, "wait-timeout", 3000, "how long a relay request waits for an idle connection, in milliseconds")
+	flag.IntVar(&config.Pool.ReconnectWindowMs, "reconnect-window", 5000, "how long an empty pool is reported busy after the last relay, in milliseconds")
+	flag.IntVar(&config.Pool.DenyTTLSeconds, "deny-ttl", 300, "how long an admin-denied device ID stays rejected, in seconds")
+	flag.Int64Var(&config.Bandwidth.GlobalBytesPerSec, "bandwidth-global", 0, "bandwidth limit of all bridges in bytes per second, 0 is unlimited")
+	flag.Int64Var(&config.Bandwidth.DeviceBytesPerSec, "bandwidth-device", 0, "bandwidth limit per device in bytes per second, 0 is unlimited")
+	flag.IntVar(&config.Session.IdleTimeoutSeconds, "session-idle-timeout", 300, "tear down relay bridges idle for this many seconds, 0 disables it")
+	flag.IntVar(&config.Session.MaxDurationSeconds, "session-max-duration", 0, "tear down relay bridges after this many seconds, 0 disables it")
+	flag.IntVar(&config.Session.DrainTimeoutSeconds, "session-drain-timeout", 30, "tear down half-closed relay bridges idle for this many seconds")
+	flag.IntVar(&config.Ban.MaxFailures, "ban-max-failures", 5, "auth failures within the ban window that ban an IP, 0 disables bans")
+	flag.IntVar(&config.Ban.WindowSeconds, "ban-window", 60, "window of the auth failures counted for a ban, in seconds")
+	flag.IntVar(&config.Ban.BanSeconds, "ban-duration", 60, "length of the first ban of an IP in seconds, doubled for each further ban")
+	flag.IntVar(&config.Ban.MaxBanSeconds, "ban-max-duration", 86400, "longest ban of an IP in seconds")
+	flag.IntVar(&config.IPLimit.MaxConns, "ip-max-conns", 0, "max registered connections per source IP, 0 is unlimited")
+	flag.IntVar(&config.IPLimit.MaxBridges, "ip-max-bridges", 0, "max relays in progress requested per source IP, 0 is unlimited")
+	flag.IntVar(&config.RateLimit.WindowSeconds, "rate-limit-window", 60, "window of the request rate limits in seconds")
+	flag.IntVar(&config.RateLimit.IDLimit, "rate-limit-id", 120, "requests per window for each device ID, 0 is unlimited")
+	flag.IntVar(&config.RateLimit.IPLimit, "rate-limit-ip", 1000, "connections per window from each IP, 0 is unlimited")
+	flag.IntVar(&config.RateLimit.KeyLimit, "rate-limit-key", 0, "requests per window for each secret key, 0 is unlimited")
+	flag.Func("acl-allow", "comma separated CIDRs to admit clients from, all if empty; may be repeated", func(v string) error {
+		config.ACL.Allow = append(config.ACL.Allow, strings.Split(v, ",")...)
+		return nil
+	})
+	flag.Func("acl-deny", "comma separated CIDRs to reject clients from; may be repeated", func(v string) error {
+		config.ACL.Deny = append(config.ACL.Deny, strings.Split(v, ",")...)
+		return nil
+	})
+	flag.StringVar(&config.AcquireStrategy, "acquire-strategy", "fifo", "idle connection selection: fifo, lifo or recent_probe")
 	showVersion := flag.Bool("version", false, "show version")
 	flag.Parse()
 
@@ -82,12 +298,286 @@ func amendConfig(config *Config) {
 		config.AdminConfig.User = "admin"
 		log.Println("generated admin user", config.AdminConfig.User)
 	}
+	if config.HandshakeMaxRetries < 1 {
+		config.HandshakeMaxRetries = 1
+	}
+	if config.Mailbox.MaxBlobSize <= 0 {
+		config.Mailbox.MaxBlobSize = 64 * 1024
+	}
+	if config.Mailbox.MaxTTLSeconds <= 0 {
+		config.Mailbox.MaxTTLSeconds = 24 * 60 * 60
+	}
+	if config.Mailbox.MaxBlobsPerDevice <= 0 {
+		config.Mailbox.MaxBlobsPerDevice = 16
+	}
+	if config.Mailbox.MaxBytesPerKey <= 0 {
+		config.Mailbox.MaxBytesPerKey = 16 << 20
+	}
+	if config.Mailbox.MaxTotalBytes <= 0 {
+		config.Mailbox.MaxTotalBytes = 256 << 20
+	}
+	if err := validateMailboxConfig(config); err != nil {
+		log.Fatal("invalid mailbox config: ", err)
+	}
+	if config.Heartbeat.IntervalSeconds <= 0 {
+		config.Heartbeat.IntervalSeconds = 60
+	}
+	if config.Heartbeat.TimeoutMs <= 0 {
+		config.Heartbeat.TimeoutMs = 2000
+	}
+	config.Heartbeat.JitterPercent = min(max(config.Heartbeat.JitterPercent, 0), 50)
+	if config.MaxIdleAgeSeconds < 0 {
+		config.MaxIdleAgeSeconds = 0
+	}
+	config.Session.IdleTimeoutSeconds = max(config.Session.IdleTimeoutSeconds, 0)
+	config.Session.MaxDurationSeconds = max(config.Session.MaxDurationSeconds, 0)
+	if config.Session.DrainTimeoutSeconds <= 0 {
+		config.Session.DrainTimeoutSeconds = 30
+	}
+	config.AcquireStrategy = strings.ToLower(config.AcquireStrategy)
+	if config.AcquireStrategy == "" {
+		config.AcquireStrategy = "fifo"
+	}
+	amendPoolConfig(&config.Pool)
+	if err := validatePoolConfig(config); err != nil {
+		log.Fatal("invalid pool config: ", err)
+	}
+	if err := validateBandwidthConfig(config); err != nil {
+		log.Fatal("invalid bandwidth config: ", err)
+	}
+	for i := range config.SecretInfo {
+		amendQuota(&config.SecretInfo[i])
+	}
+	if err := validateQuotaConfig(config); err != nil {
+		log.Fatal("invalid quota config: ", err)
+	}
+	if err := validateACLConfig(config); err != nil {
+		log.Fatal("invalid acl config: ", err)
+	}
+	if err := validateIPLimitConfig(config.IPLimit); err != nil {
+		log.Fatal("invalid ip limit config: ", err)
+	}
+	amendRateLimitConfig(&config.RateLimit)
+	if err := validateRateLimitConfig(config.RateLimit); err != nil {
+		log.Fatal("invalid rate limit config: ", err)
+	}
+	amendBanConfig(&config.Ban)
+	if err := validateBanConfig(config.Ban); err != nil {
+		log.Fatal("invalid ban config: ", err)
+	}
 	const adminPasswordLength = 12
 	if config.AdminConfig.Password != "" && len(config.AdminConfig.Password) < adminPasswordLength {
 		log.Fatal("password must be at least", adminPasswordLength, "characters")
 	}
 }
 
+// amendPoolConfig fills in the default for every unset pool limit.
+func amendPoolConfig(pool *PoolConfig) {
+	if pool.MaxConnsPerDevice == 0 {
+		pool.MaxConnsPerDevice = 16
+	}
+	if pool.MaxWaitersPerDevice == 0 {
+		pool.MaxWaitersPerDevice = 8
+	}
+	if pool.WaitTimeoutMs == 0 {
+		pool.WaitTimeoutMs = 3000
+	}
+	if pool.ReconnectWindowMs == 0 {
+		pool.ReconnectWindowMs = 5000
+	}
+	if pool.DenyTTLSeconds == 0 {
+		pool.DenyTTLSeconds = 300
+	}
+}
+
+// maxWaitTimeoutMs bounds the wait of a relay request, which holds the
+// sender's connection open.
+const maxWaitTimeoutMs = 60 * 1000
+
+// validatePoolConfig checks the global pool limits and the overrides of
+// every secret key.
+func validatePoolConfig(config *Config) error {
+	check := func(where string, conns, waiters, waitMs, reconnectMs int) error {
+		switch {
+		case conns < 0:
+			return fmt.Errorf("%s: max_conns_per_device must not be negative", where)
+		case waiters < 0 || waiters > math.MaxInt32:
+			return fmt.Errorf("%s: max_waiters_per_device out of range", where)
+		case waitMs < 0 || waitMs > maxWaitTimeoutMs:
+			return fmt.Errorf("%s: wait_timeout_ms must be between 0 and %d", where, maxWaitTimeoutMs)
+		case reconnectMs < 0:
+			return fmt.Errorf("%s: reconnect_window_ms must not be negative", where)
+		}
+		return nil
+	}
+	pool := config.Pool
+	if err := check("pool", pool.MaxConnsPerDevice, pool.MaxWaitersPerDevice, pool.WaitTimeoutMs, pool.ReconnectWindowMs); err != nil {
+		return err
+	}
+	if pool.DenyTTLSeconds < 0 {
+		return errors.New("pool: deny_ttl_seconds must not be negative")
+	}
+	for i, secret := range config.SecretInfo {
+		where := fmt.Sprintf("secret_info[%d]", i)
+		if err := check(where, secret.MaxConnsPerDevice, secret.MaxWaitersPerDevice, secret.WaitTimeoutMs, secret.ReconnectWindowMs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateBandwidthConfig rejects negative bandwidth limits.
+func validateBandwidthConfig(config *Config) error {
+	if config.Bandwidth.GlobalBytesPerSec < 0 || config.Bandwidth.DeviceBytesPerSec < 0 {
+		return errors.New("bandwidth: limits must not be negative")
+	}
+	for i, secret := range config.SecretInfo {
+		if secret.BandwidthBytesPerSec < 0 {
+			return fmt.Errorf("secret_info[%d]: bandwidth_bytes_per_sec must not be negative", i)
+		}
+	}
+	return nil
+}
+
+// maxMailboxBlobSize bounds every mailbox blob size limit, as a put buffers
+// the whole blob in memory.
+const maxMailboxBlobSize = 16 << 20
+
+// validateMailboxConfig checks the global blob size and the mailbox overrides
+// of every secret key.
+func validateMailboxConfig(config *Config) error {
+	if config.Mailbox.MaxBlobSize > maxMailboxBlobSize {
+		return fmt.Errorf("mailbox: max_blob_size must not exceed %d", maxMailboxBlobSize)
+	}
+	for i, secret := range config.SecretInfo {
+		switch {
+		case secret.MailboxMaxBlobSize < 0 || secret.MailboxMaxBlobSize > maxMailboxBlobSize:
+			return fmt.Errorf("secret_info[%d]: mailbox_max_blob_size must be between 0 and %d", i, maxMailboxBlobSize)
+		case secret.MailboxMaxTTLSeconds < 0:
+			return fmt.Errorf("secret_info[%d]: mailbox_max_ttl_seconds must not be negative", i)
+		}
+	}
+	return nil
+}
+
+func amendQuota(secret *SecretInfo) {
+	secret.QuotaPeriod = strings.ToLower(secret.QuotaPeriod)
+	if secret.QuotaPeriod == "" {
+		secret.QuotaPeriod = QuotaMonthly
+	}
+}
+
+// validateQuotaConfig checks the traffic quota of every secret key.
+func validateQuotaConfig(config *Config) error {
+	for i, secret := range config.SecretInfo {
+		switch {
+		case secret.QuotaBytes < 0 || secret.QuotaThrottleBytesPerSec < 0:
+			return fmt.Errorf("secret_info[%d]: quota must not be negative", i)
+		case secret.QuotaPeriod != QuotaDaily && secret.QuotaPeriod != QuotaMonthly:
+			return fmt.Errorf("secret_info[%d]: unknown quota_period %q", i, secret.QuotaPeriod)
+		}
+	}
+	return nil
+}
+
+// ParseCIDR parses an ACL range; a bare IP is a single address.
+func ParseCIDR(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if prefix.Addr().Is4In6() {
+		return netip.Prefix{}, fmt.Errorf("%s: use the IPv4 form", s)
+	}
+	return prefix.Masked(), nil
+}
+
+// validateACLConfig checks every CIDR of the global and per key lists.
+func validateACLConfig(config *Config) error {
+	check := func(where string, cidrs []string) error {
+		for _, cidr := range cidrs {
+			if _, err := ParseCIDR(cidr); err != nil {
+				return fmt.Errorf("%s: invalid CIDR %q: %w", where, cidr, err)
+			}
+		}
+		return nil
+	}
+	if err := check("acl.allow", config.ACL.Allow); err != nil {
+		return err
+	}
+	if err := check("acl.deny", config.ACL.Deny); err != nil {
+		return err
+	}
+	for i, secret := range config.SecretInfo {
+		if err := check(fmt.Sprintf("secret_info[%d].allow_cidrs", i), secret.AllowCIDRs); err != nil {
+			return err
+		}
+		if err := check(fmt.Sprintf("secret_info[%d].deny_cidrs", i), secret.DenyCIDRs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateIPLimitConfig rejects negative global limits and invalid ranges.
+func validateIPLimitConfig(limit IPLimitConfig) error {
+	if limit.MaxConns < 0 || limit.MaxBridges < 0 {
+		return errors.New("ip_limit: limits must not be negative")
+	}
+	for i, o := range limit.Overrides {
+		if _, err := ParseCIDR(o.CIDR); err != nil {
+			return fmt.Errorf("ip_limit.overrides[%d]: invalid CIDR %q: %w", i, o.CIDR, err)
+		}
+	}
+	return nil
+}
+
+// amendRateLimitConfig fills in the default window.
+func amendRateLimitConfig(limit *RateLimitConfig) {
+	if limit.WindowSeconds == 0 {
+		limit.WindowSeconds = 60
+	}
+}
+
+func validateRateLimitConfig(limit RateLimitConfig) error {
+	if limit.WindowSeconds < 0 || limit.IDLimit < 0 || limit.IPLimit < 0 || limit.KeyLimit < 0 {
+		return errors.New("rate_limit: values must not be negative")
+	}
+	return nil
+}
+
+// amendBanConfig fills in the default for every unset ban duration.
+func amendBanConfig(ban *BanConfig) {
+	if ban.WindowSeconds == 0 {
+		ban.WindowSeconds = 60
+	}
+	if ban.BanSeconds == 0 {
+		ban.BanSeconds = 60
+	}
+	if ban.MaxBanSeconds == 0 {
+		ban.MaxBanSeconds = max(24*60*60, ban.BanSeconds)
+	}
+}
+
+func validateBanConfig(ban BanConfig) error {
+	switch {
+	case ban.MaxFailures < 0 || ban.WindowSeconds < 0 || ban.BanSeconds < 0:
+		return errors.New("ban: values must not be negative")
+	case ban.MaxBanSeconds < ban.BanSeconds:
+		return errors.New("ban: max_ban_seconds must not be less than ban_seconds")
+	}
+	return nil
+}
+
 func parseEnv() *Config {
 	var config, err = env.ParseAs[Config]()
 	if err != nil {
@@ -1 +1,173 @@
 package config
+
+import "testing"
+
+func TestValidatePoolConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{name: "defaults", config: Config{}},
+		{
+			name:   "custom",
+			config: Config{Pool: PoolConfig{MaxConnsPerDevice: 64, MaxWaitersPerDevice: 32, WaitTimeoutMs: 10000}},
+		},
+		{name: "negative conns", config: Config{Pool: PoolConfig{MaxConnsPerDevice: -1}}, wantErr: true},
+		{name: "wait too long", config: Config{Pool: PoolConfig{WaitTimeoutMs: maxWaitTimeoutMs + 1}}, wantErr: true},
+		{name: "negative deny ttl", config: Config{Pool: PoolConfig{DenyTTLSeconds: -1}}, wantErr: true},
+		{
+			name:   "secret override",
+			config: Config{SecretInfo: []SecretInfo{{SecretKey: "k", MaxWaitersPerDevice: 16, ReconnectWindowMs: 30000}}},
+		},
+		{
+			name:    "negative secret override",
+			config:  Config{SecretInfo: []SecretInfo{{SecretKey: "k", ReconnectWindowMs: -1}}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			amendPoolConfig(&tt.config.Pool)
+			err := validatePoolConfig(&tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validatePoolConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAmendPoolConfigDefaults(t *testing.T) {
+	var pool PoolConfig
+	amendPoolConfig(&pool)
+	want := PoolConfig{MaxConnsPerDevice: 16, MaxWaitersPerDevice: 8, WaitTimeoutMs: 3000, ReconnectWindowMs: 5000, DenyTTLSeconds: 300}
+	if pool != want {
+		t.Fatalf("amended pool = %+v, want %+v", pool, want)
+	}
+}
+
+func TestValidateBandwidthConfig(t *testing.T) {
+	valid := Config{Bandwidth: BandwidthConfig{GlobalBytesPerSec: 10 << 20}, SecretInfo: []SecretInfo{{BandwidthBytesPerSec: 1 << 20}}}
+	if err := validateBandwidthConfig(&valid); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []Config{
+		{Bandwidth: BandwidthConfig{DeviceBytesPerSec: -1}},
+		{SecretInfo: []SecretInfo{{BandwidthBytesPerSec: -1}}},
+	} {
+		if err := validateBandwidthConfig(&c); err == nil {
+			t.Fatalf("validateBandwidthConfig(%+v) accepted a negative limit", c)
+		}
+	}
+}
+
+func TestValidateMailboxConfig(t *testing.T) {
+	valid := Config{Mailbox: MailboxConfig{MaxBlobSize: 64 << 10}, SecretInfo: []SecretInfo{{MailboxMaxBlobSize: 1 << 20, MailboxMaxTTLSeconds: 60}}}
+	if err := validateMailboxConfig(&valid); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []Config{
+		{Mailbox: MailboxConfig{MaxBlobSize: maxMailboxBlobSize + 1}},
+		{SecretInfo: []SecretInfo{{MailboxMaxBlobSize: -1}}},
+		{SecretInfo: []SecretInfo{{MailboxMaxBlobSize: maxMailboxBlobSize + 1}}},
+		{SecretInfo: []SecretInfo{{MailboxMaxTTLSeconds: -1}}},
+	} {
+		if err := validateMailboxConfig(&c); err == nil {
+			t.Fatalf("validateMailboxConfig(%+v) accepted an invalid limit", c)
+		}
+	}
+}
+
+func TestValidateQuotaConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  SecretInfo
+		wantErr bool
+	}{
+		{name: "no quota", secret: SecretInfo{}},
+		{name: "daily", secret: SecretInfo{QuotaBytes: 1 << 30, QuotaPeriod: "Daily"}},
+		{name: "throttled", secret: SecretInfo{QuotaBytes: 1 << 30, QuotaThrottleBytesPerSec: 64 << 10}},
+		{name: "unknown period", secret: SecretInfo{QuotaBytes: 1 << 30, QuotaPeriod: "weekly"}, wantErr: true},
+		{name: "negative", secret: SecretInfo{QuotaBytes: -1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			amendQuota(&tt.secret)
+			err := validateQuotaConfig(&Config{SecretInfo: []SecretInfo{tt.secret}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateQuotaConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateACLConfig(t *testing.T) {
+	valid := Config{
+		ACL:        ACLConfig{Allow: []string{"10.0.0.0/8", "2001:db8::/32"}, Deny: []string{"10.66.0.1"}},
+		SecretInfo: []SecretInfo{{AllowCIDRs: []string{" 192.168.0.0/16"}}},
+	}
+	if err := validateACLConfig(&valid); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []Config{
+		{ACL: ACLConfig{Deny: []string{"10.0.0.0/33"}}},
+		{ACL: ACLConfig{Allow: []string{"office"}}},
+		{SecretInfo: []SecretInfo{{DenyCIDRs: []string{"::ffff:10.0.0.0/104"}}}},
+	} {
+		if err := validateACLConfig(&c); err == nil {
+			t.Fatalf("validateACLConfig(%+v) accepted an invalid CIDR", c)
+		}
+	}
+	if prefix, err := ParseCIDR("10.1.2.3/8"); err != nil || prefix.String() != "10.0.0.0/8" {
+		t.Fatalf("ParseCIDR = %v, %v; want the masked prefix", prefix, err)
+	}
+}
+
+func TestBanConfig(t *testing.T) {
+	var ban BanConfig
+	amendBanConfig(&ban)
+	want := BanConfig{WindowSeconds: 60, BanSeconds: 60, MaxBanSeconds: 86400}
+	if ban != want {
+		t.Fatalf("amended ban = %+v, want %+v", ban, want)
+	}
+	if err := validateBanConfig(ban); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []BanConfig{
+		{MaxFailures: -1, WindowSeconds: 60, BanSeconds: 60, MaxBanSeconds: 60},
+		{MaxFailures: 5, WindowSeconds: 60, BanSeconds: 600, MaxBanSeconds: 60},
+	} {
+		if err := validateBanConfig(b); err == nil {
+			t.Fatalf("validateBanConfig(%+v) accepted an invalid config", b)
+		}
+	}
+}
+
+func TestValidateIPLimitConfig(t *testing.T) {
+	limit := IPLimitConfig{MaxConns: 4, Overrides: []IPLimitOverride{{CIDR: "10.0.0.0/8", MaxConns: -1}}}
+	if err := validateIPLimitConfig(limit); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range []IPLimitConfig{
+		{MaxBridges: -1},
+		{Overrides: []IPLimitOverride{{CIDR: "office"}}},
+	} {
+		if err := validateIPLimitConfig(l); err == nil {
+			t.Fatalf("validateIPLimitConfig(%+v) accepted an invalid config", l)
+		}
+	}
+}
+
+func TestRateLimitConfig(t *testing.T) {
+	limit := RateLimitConfig{IDLimit: 120}
+	amendRateLimitConfig(&limit)
+	if want := (RateLimitConfig{WindowSeconds: 60, IDLimit: 120}); limit != want {
+		t.Fatalf("amended rate limit = %+v, want %+v", limit, want)
+	}
+	if err := validateRateLimitConfig(limit); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateRateLimitConfig(RateLimitConfig{WindowSeconds: 60, KeyLimit: -1}); err == nil {
+		t.Fatal("validateRateLimitConfig accepted a negative limit")
+	}
+}
@@ -39,34 +39,37 @@ func handleHandshakeReq(req HandshakeReq, authenticator *auth.Authentication, en
 	if authenticator == nil {
 		if req.AuthFieldB64 != "" {
 			// Relay server has no configured keys, but the client sent an authentication message
-			return nil, nil, nil, fmt.Errorf("invalid handshake request: invalid auth field")
+			return nil, nil, nil, fmt.Errorf("%w: invalid auth field", ErrServerNoKey)
 		}
 		if req.KDFSaltB64 != "" {
-			return nil, nil, nil, fmt.Errorf("invalid handshake request: invalid kdf salt")
+			return nil, nil, nil, fmt.Errorf("%w: invalid kdf salt", ErrServerNoKey)
 		}
 	}
 	if enableAuth && req.AuthFieldB64 == "" {
-		return nil, nil, nil, fmt.Errorf("invalid handshake request: no auth field")
+		return nil, nil, nil, ErrMissingAuthField
 	}
 	if req.AuthFieldB64 != "" && req.AuthAAD == "" {
 		// Force the client to send the auth aad
-		return nil, nil, nil, fmt.Errorf("invalid handshake request: no auth aad")
+		return nil, nil, nil, ErrMissingAuthAAD
 	}
 	// As long as AuthFieldB64 is not empty, authentication is performed
 	if req.AuthFieldB64 != "" && authenticator != nil {
 		authField, err := base64.StdEncoding.DecodeString(req.AuthFieldB64)
 		if err != nil {
-			return nil, nil, nil, fmt.Errorf("failed to decode auth field: %w", err)
+			return nil, nil, nil, fmt.Errorf("%w: decode auth field: %w", ErrAuthDecrypt, err)
 		}
-		ok, key := authenticator.Auth(req.SecretKeySelector, authField, []byte(req.AuthAAD))
-		if !ok {
-			return nil, nil, nil, fmt.Errorf("failed to authenticate")
+		key, err := authenticator.Auth(req.SecretKeySelector, authField, []byte(req.AuthAAD))
+		if errors.Is(err, auth.ErrUnknownSelector) {
+			return nil, nil, nil, ErrBadSelector
+		}
+		if err != nil {
+			return nil, nil, nil, ErrAuthDecrypt
 		}
 		authKey = key
 	}
 	ecdhPublicKey, shared, err := handshakeECDH(req)
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("handshake ECDH: %w", err)
+		return nil, nil, nil, fmt.Errorf("%w: handshake ECDH: %w", ErrBadHandshakeReq, err)
 	}
 	ecdhPublicKeyBytes := ecdhPublicKey.Bytes()
 	if authKey != nil {
@@ -86,45 +89,150 @@ func handleHandshakeReq(req HandshakeReq, authenticator *auth.Authentication, en
 	}, shared, authKey, nil
 }
 
-var ErrEmptyKDFSalt = errors.New("empty kdf salt")
+// Handshake failure reasons. Every error returned by Handshake wraps exactly
+// one of them, see HandshakeFailReason.
+var (
+	// ErrBadHandshakeReq means the request could not be read or decoded.
+	ErrBadHandshakeReq = errors.New("invalid handshake request")
+	// ErrEmptyKDFSalt means the client sent no KDF salt, usually because it
+	// has not learned it yet.
+	ErrEmptyKDFSalt = errors.New("empty kdf salt")
+	// ErrKDFSaltMismatch means the client sent a KDF salt other than ours.
+	ErrKDFSaltMismatch = errors.New("kdf salt mismatch")
+	// ErrBadSelector means no configured key matches the secret key selector.
+	ErrBadSelector = errors.New("unknown secret key selector")
+	// ErrAuthDecrypt means the auth field could not be decrypted with any
+	// key matching the selector.
+	ErrAuthDecrypt = errors.New("failed to decrypt auth field")
+	// ErrMissingAuthAAD means the auth field was sent without its AAD.
+	ErrMissingAuthAAD = errors.New("no auth aad")
+	// ErrMissingAuthField means auth is enforced but the client sent none.
+	ErrMissingAuthField = errors.New("no auth field")
+	// ErrServerNoKey means the client tried to authenticate against a
+	// server that has no secret keys.
+	ErrServerNoKey = errors.New("server not set key")
+)
 
-// nil authenticator means no authentication,return nil authKey
-func Handshake(conn net.Conn, authenticator *auth.Authentication, enableAuth bool) (cipher crypto.SymmetricCipher, authKey tool.AES192Key, err error) {
-	req, err := ReadHandshakeReq(conn)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to read handshake request: %w", err)
-	}
-	if req.AuthFieldB64 != "" && authenticator == nil {
-		_ = SendHandshakeResp(conn, HandshakeResp{
-			Code: StatusAuthFailed,
-			Msg:  "Server not set key",
-		})
-		return nil, nil, fmt.Errorf("server not set key")
-	}
-	if req.AuthFieldB64 != "" && (req.KDFSaltB64 == "" || req.KDFSaltB64 != authenticator.GetSaltB64()) {
-		zap.L().Debug("kdf salt mismatch", zap.String("kdf salt", req.KDFSaltB64),
-			zap.String("expected", authenticator.GetSaltB64()))
-		_ = SendHandshakeResp(conn, HandshakeResp{
-			Code:       StatusKDFSaltMismatch,
-			KDFSaltB64: authenticator.GetSaltB64(),
-		})
-		return nil, nil, ErrEmptyKDFSalt
+var handshakeFailReasons = []struct {
+	err    error
+	reason string
+}{
+	{ErrBadHandshakeReq, "bad_request"},
+	{ErrEmptyKDFSalt, "empty_salt"},
+	{ErrKDFSaltMismatch, "bad_salt"},
+	{ErrBadSelector, "bad_selector"},
+	{ErrAuthDecrypt, "decrypt_failed"},
+	{ErrMissingAuthAAD, "missing_aad"},
+	{ErrMissingAuthField, "missing_auth"},
+	{ErrServerNoKey, "server_no_key"},
+}
+
+// HandshakeFailReasonOther is reported for errors that wrap none of the
+// known failure reasons, such as write errors.
+const HandshakeFailReasonOther = "other"
+
+// HandshakeFailReasons returns every reason HandshakeFailReason can report.
+func HandshakeFailReasons() []string {
+	reasons := make([]string, 0, len(handshakeFailReasons)+1)
+	for _, r := range handshakeFailReasons {
+		reasons = append(reasons, r.reason)
 	}
-	resp, sharedKey, authKey, err := handleHandshakeReq(req, authenticator, enableAuth)
-	if err != nil {
-		_ = SendHandshakeResp(conn, HandshakeResp{
-			Code: StatusAuthFailed,
-			Msg:  err.Error(),
-		})
-		return nil, nil, fmt.Errorf("handle handshake request: %w", err)
+	return append(reasons, HandshakeFailReasonOther)
+}
+
+// IsAuthFailure reports whether err, returned by Handshake, means the
+// client failed to authenticate, as opposed to a malformed request or an I/O
+// error.
+func IsAuthFailure(err error) bool {
+	for _, target := range []error{ErrBadSelector, ErrAuthDecrypt, ErrMissingAuthAAD, ErrMissingAuthField} {
+		if errors.Is(err, target) {
+			return true
+		}
 	}
-	err = SendHandshakeResp(conn, *resp)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to send handshake response: %w", err)
+	return false
+}
+
+// HandshakeFailReason maps an error returned by Handshake to a short,
+// stable reason name suitable for metrics.
+func HandshakeFailReason(err error) string {
+	for _, r := range handshakeFailReasons {
+		if errors.Is(err, r.err) {
+			return r.reason
+		}
 	}
-	cipher, err = crypto.NewAESGCM(sharedKey)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create AESGCM: %w", err)
+	return HandshakeFailReasonOther
+}
+
+type handshakeState int
+
+const (
+	// handshakeAwaitReq waits for the first request of the connection.
+	handshakeAwaitReq handshakeState = iota
+	// handshakeAwaitSaltRetry waits for a request carrying the KDF salt the
+	// server has just sent.
+	handshakeAwaitSaltRetry
+	handshakeDone
+)
+
+// Handshake runs the server side of the handshake.
+//
+// A request with an empty or mismatched KDF salt is answered with the current
+// salt, and the client may try again up to maxSaltRetries times. Once the
+// salt has been sent, a client that still gets it wrong fails with
+// ErrKDFSaltMismatch rather than ErrEmptyKDFSalt.
+//
+// nil authenticator means no authentication,return nil authKey
+func Handshake(conn net.Conn, authenticator *auth.Authentication, enableAuth bool, maxSaltRetries int) (cipher crypto.SymmetricCipher, authKey tool.AES192Key, err error) {
+	state := handshakeAwaitReq
+	saltRetries := 0
+	for state != handshakeDone {
+		req, err := ReadHandshakeReq(conn)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: failed to read handshake request: %w", ErrBadHandshakeReq, err)
+		}
+		if req.AuthFieldB64 != "" && authenticator == nil {
+			_ = SendHandshakeResp(conn, HandshakeResp{
+				Code: StatusAuthFailed,
+				Msg:  "Server not set key",
+			})
+			return nil, nil, ErrServerNoKey
+		}
+		if req.AuthFieldB64 != "" && req.KDFSaltB64 != authenticator.GetSaltB64() {
+			saltErr := ErrKDFSaltMismatch
+			if req.KDFSaltB64 == "" && state == handshakeAwaitReq {
+				saltErr = ErrEmptyKDFSalt
+			}
+			zap.L().Debug("kdf salt mismatch", zap.String("kdf salt", req.KDFSaltB64),
+				zap.String("expected", authenticator.GetSaltB64()))
+			_ = SendHandshakeResp(conn, HandshakeResp{
+				Code:       StatusKDFSaltMismatch,
+				KDFSaltB64: authenticator.GetSaltB64(),
+			})
+			if saltRetries >= maxSaltRetries {
+				return nil, nil, saltErr
+			}
+			saltRetries++
+			state = handshakeAwaitSaltRetry
+			continue
+		}
+		resp, sharedKey, key, err := handleHandshakeReq(req, authenticator, enableAuth)
+		if err != nil {
+			_ = SendHandshakeResp(conn, HandshakeResp{
+				Code: StatusAuthFailed,
+				Msg:  err.Error(),
+			})
+			return nil, nil, fmt.Errorf("handle handshake request: %w", err)
+		}
+		err = SendHandshakeResp(conn, *resp)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to send handshake response: %w", err)
+		}
+		cipher, err = crypto.NewAESGCM(sharedKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create AESGCM: %w", err)
+		}
+		authKey = key
+		state = handshakeDone
 	}
 	return cipher, authKey, nil
 }
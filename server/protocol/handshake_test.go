@@ -1 +1,347 @@
 package protocol
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+
+	"github.com/doraemonkeys/WindSend-Relay/server/relay/auth"
+	"github.com/doraemonkeys/WindSend-Relay/server/tool"
+	"github.com/doraemonkeys/doraemon"
+	"github.com/doraemonkeys/doraemon/crypto"
+)
+
+const testSecretKey = "protocol-test-secret"
+
+func newTestAuthenticator(t testing.TB) *auth.Authentication {
+	t.Helper()
+	return auth.NewAuthentication([]string{testSecretKey})
+}
+
+func randomECDHPublicKeyB64(t testing.TB) string {
+	t.Helper()
+	sk, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(sk.PublicKey().Bytes())
+}
+
+// validHandshakeReq builds the request a correctly configured client would send.
+func validHandshakeReq(t testing.TB, at *auth.Authentication) HandshakeReq {
+	t.Helper()
+	key := tool.AES192KeyKDF(testSecretKey, at.GetRandomSalt())
+	cipher, err := crypto.NewAESGCM(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const aad = "relay-aad"
+	authField, err := cipher.EncryptAuth([]byte("AUTH"+doraemon.GenRandomAsciiString(16)), []byte(aad))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return HandshakeReq{
+		SecretKeySelector: doraemon.ComputeSHA256Hex(bytes.NewReader(key)).Unwrap()[:8],
+		AuthFieldB64:      base64.StdEncoding.EncodeToString(authField),
+		AuthAAD:           aad,
+		KDFSaltB64:        at.GetSaltB64(),
+		EcdhPublicKeyB64:  randomECDHPublicKeyB64(t),
+	}
+}
+
+func TestHandleHandshakeReqValid(t *testing.T) {
+	at := newTestAuthenticator(t)
+	req := validHandshakeReq(t, at)
+
+	resp, shared, authKey, err := handleHandshakeReq(req, at, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != StatusSuccess {
+		t.Fatalf("code = %d, want %d", resp.Code, StatusSuccess)
+	}
+	if len(shared) != 192/8 {
+		t.Fatalf("shared key len = %d", len(shared))
+	}
+	if !bytes.Equal(authKey, at.GetAllAuthKeys()[testSecretKey]) {
+		t.Fatal("authenticated with an unexpected key")
+	}
+}
+
+func FuzzHandleHandshakeReq(f *testing.F) {
+	at := newTestAuthenticator(f)
+	valid := validHandshakeReq(f, at)
+	f.Add(valid.SecretKeySelector, valid.AuthFieldB64, valid.AuthAAD, valid.KDFSaltB64, valid.EcdhPublicKeyB64, true, true)
+	f.Add(valid.SecretKeySelector, valid.AuthFieldB64, valid.AuthAAD, valid.KDFSaltB64, valid.EcdhPublicKeyB64, false, true)
+	f.Add("", "", "", "", valid.EcdhPublicKeyB64, false, false)
+	f.Add("", "", "", "", valid.EcdhPublicKeyB64, true, true)
+	f.Add(valid.SecretKeySelector, "QUJD", "", "", "", true, true)
+	f.Add("zzzzzzzz", valid.AuthFieldB64, "x", "", "AAAA", false, true)
+	f.Add("", "!!", "x", "", "", false, false)
+	f.Fuzz(func(t *testing.T, selector, authField, aad, salt, pk string, enableAuth, withAuthenticator bool) {
+		req := HandshakeReq{
+			SecretKeySelector: selector,
+			AuthFieldB64:      authField,
+			AuthAAD:           aad,
+			KDFSaltB64:        salt,
+			EcdhPublicKeyB64:  pk,
+		}
+		var authenticator *auth.Authentication
+		if withAuthenticator {
+			authenticator = at
+		}
+		resp, shared, authKey, err := handleHandshakeReq(req, authenticator, enableAuth)
+		if err != nil {
+			if resp != nil || shared != nil || authKey != nil {
+				t.Fatal("non-nil results returned alongside an error")
+			}
+			if reason := HandshakeFailReason(err); reason == HandshakeFailReasonOther {
+				t.Fatalf("unclassified handshake error: %v", err)
+			}
+			return
+		}
+		if resp == nil || resp.Code != StatusSuccess {
+			t.Fatalf("success without a success response: %+v", resp)
+		}
+		if len(shared) != 192/8 {
+			t.Fatalf("shared key len = %d", len(shared))
+		}
+		if _, err := base64.StdEncoding.DecodeString(resp.EcdhPublicKeyB64); err != nil {
+			t.Fatalf("response public key is not base64: %v", err)
+		}
+		if authenticator == nil && authKey != nil {
+			t.Fatal("authenticated without an authenticator")
+		}
+		if authField != "" && authenticator != nil && authKey == nil {
+			t.Fatal("auth field was present but authentication was skipped")
+		}
+		if enableAuth && authKey == nil {
+			t.Fatal("auth is enabled but the handshake succeeded without authentication")
+		}
+	})
+}
+
+// FuzzHandshake drives the full server side of the handshake over a raw byte
+// stream, including the KDF salt negotiation branch.
+func FuzzHandshake(f *testing.F) {
+	at := newTestAuthenticator(f)
+	seed := func(req HandshakeReq, enableAuth, withAuthenticator bool) {
+		b, err := json.Marshal(req)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(lenPrefixed(b), enableAuth, withAuthenticator)
+	}
+	valid := validHandshakeReq(f, at)
+	seed(valid, true, true)
+	noSalt := valid
+	noSalt.KDFSaltB64 = ""
+	seed(noSalt, true, true)
+	seed(valid, false, false)
+	seed(HandshakeReq{EcdhPublicKeyB64: randomECDHPublicKeyB64(f)}, false, false)
+	seed(HandshakeReq{EcdhPublicKeyB64: randomECDHPublicKeyB64(f)}, true, true)
+	f.Add([]byte{0xff, 0xff, 0xff, 0x7f}, true, true)
+	f.Fuzz(func(t *testing.T, data []byte, enableAuth, withAuthenticator bool) {
+		var authenticator *auth.Authentication
+		if withAuthenticator {
+			authenticator = at
+		}
+		conn := newMemConn(data)
+		cipher, authKey, err := Handshake(conn, authenticator, enableAuth, 1)
+		if err == nil {
+			if cipher == nil {
+				t.Fatal("handshake succeeded without a session cipher")
+			}
+			if enableAuth && authKey == nil {
+				t.Fatal("auth is enabled but the handshake succeeded without authentication")
+			}
+		}
+		if conn.w.Len() == 0 {
+			return
+		}
+		// Whatever the server wrote must be a sequence of well-formed response frames.
+		out := conn.replay()
+		var last HandshakeResp
+		for {
+			resp, readErr := readHandshakeResp(out)
+			if readErr == io.EOF {
+				break
+			}
+			if readErr != nil {
+				t.Fatalf("server wrote a malformed response: %v", readErr)
+			}
+			last = resp
+		}
+		if err == nil && last.Code != StatusSuccess {
+			t.Fatalf("handshake succeeded but responded with code %d", last.Code)
+		}
+	})
+}
+
+func readHandshakeResp(r io.Reader) (HandshakeResp, error) {
+	var resp HandshakeResp
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return resp, err
+	}
+	body := make([]byte, binary.LittleEndian.Uint32(lenBuf[:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return resp, err
+	}
+	err := json.Unmarshal(body, &resp)
+	return resp, err
+}
+
+func TestHandshakeSaltRetry(t *testing.T) {
+	at := newTestAuthenticator(t)
+	valid := validHandshakeReq(t, at)
+	noSalt := valid
+	noSalt.KDFSaltB64 = ""
+	wrongSalt := valid
+	wrongSalt.KDFSaltB64 = "d3Jvbmcgc2FsdA=="
+
+	tests := []struct {
+		name       string
+		reqs       []HandshakeReq
+		maxRetries int
+		wantErr    error
+		wantResps  []StatusCode
+	}{
+		{
+			name:       "salt up front",
+			reqs:       []HandshakeReq{valid},
+			maxRetries: 1,
+			wantResps:  []StatusCode{StatusSuccess},
+		},
+		{
+			name:       "client learns the salt",
+			reqs:       []HandshakeReq{noSalt, valid},
+			maxRetries: 1,
+			wantResps:  []StatusCode{StatusKDFSaltMismatch, StatusSuccess},
+		},
+		{
+			name:       "stale salt is corrected",
+			reqs:       []HandshakeReq{wrongSalt, valid},
+			maxRetries: 1,
+			wantResps:  []StatusCode{StatusKDFSaltMismatch, StatusSuccess},
+		},
+		{
+			name:       "no retries allowed",
+			reqs:       []HandshakeReq{noSalt},
+			maxRetries: 0,
+			wantErr:    ErrEmptyKDFSalt,
+			wantResps:  []StatusCode{StatusKDFSaltMismatch},
+		},
+		{
+			name:       "client keeps sending a wrong salt",
+			reqs:       []HandshakeReq{wrongSalt, wrongSalt},
+			maxRetries: 1,
+			wantErr:    ErrKDFSaltMismatch,
+			wantResps:  []StatusCode{StatusKDFSaltMismatch, StatusKDFSaltMismatch},
+		},
+		{
+			name:       "client ignores the salt it was sent",
+			reqs:       []HandshakeReq{noSalt, noSalt},
+			maxRetries: 1,
+			wantErr:    ErrKDFSaltMismatch,
+			wantResps:  []StatusCode{StatusKDFSaltMismatch, StatusKDFSaltMismatch},
+		},
+		{
+			name:       "retries are bounded",
+			reqs:       []HandshakeReq{noSalt, wrongSalt, wrongSalt, valid},
+			maxRetries: 2,
+			wantErr:    ErrKDFSaltMismatch,
+			wantResps:  []StatusCode{StatusKDFSaltMismatch, StatusKDFSaltMismatch, StatusKDFSaltMismatch},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var in []byte
+			for _, req := range tt.reqs {
+				b, err := json.Marshal(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				in = append(in, lenPrefixed(b)...)
+			}
+			conn := newMemConn(in)
+			cipher, _, err := Handshake(conn, at, true, tt.maxRetries)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && cipher == nil {
+				t.Fatal("handshake succeeded without a session cipher")
+			}
+			out := conn.replay()
+			var got []StatusCode
+			for {
+				resp, err := readHandshakeResp(out)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if resp.Code == StatusKDFSaltMismatch && resp.KDFSaltB64 != at.GetSaltB64() {
+					t.Fatalf("salt mismatch response carries salt %q", resp.KDFSaltB64)
+				}
+				got = append(got, resp.Code)
+			}
+			if !slices.Equal(got, tt.wantResps) {
+				t.Fatalf("responses = %v, want %v", got, tt.wantResps)
+			}
+		})
+	}
+}
+
+func TestHandshakeFailReason(t *testing.T) {
+	at := newTestAuthenticator(t)
+	valid := validHandshakeReq(t, at)
+
+	badSelector := valid
+	badSelector.SecretKeySelector = "ffffffff"
+	badField := valid
+	badField.AuthFieldB64 = base64.StdEncoding.EncodeToString(make([]byte, 40))
+	noAAD := valid
+	noAAD.AuthAAD = ""
+	noAuth := valid
+	noAuth.AuthFieldB64 = ""
+	badPK := valid
+	badPK.EcdhPublicKeyB64 = "AAAA"
+
+	tests := []struct {
+		name          string
+		req           HandshakeReq
+		authenticator *auth.Authentication
+		want          string
+		authFailure   bool
+	}{
+		{"bad selector", badSelector, at, "bad_selector", true},
+		{"decrypt failure", badField, at, "decrypt_failed", true},
+		{"missing aad", noAAD, at, "missing_aad", true},
+		{"missing auth", noAuth, at, "missing_auth", true},
+		{"bad public key", badPK, at, "bad_request", false},
+		{"server has no key", valid, nil, "server_no_key", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, _, err := handleHandshakeReq(tt.req, tt.authenticator, tt.authenticator != nil)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if got := HandshakeFailReason(err); got != tt.want {
+				t.Fatalf("reason = %q, want %q (err: %v)", got, tt.want, err)
+			}
+			if got := IsAuthFailure(err); got != tt.authFailure {
+				t.Fatalf("IsAuthFailure = %v, want %v", got, tt.authFailure)
+			}
+		})
+	}
+}
@@ -1,5 +1,7 @@
 package protocol
 
+import "slices"
+
 type StatusCode int32
 
 const (
@@ -14,6 +16,10 @@ const (
 	// StatusDeviceOffline indicates the target device has no connections at all.
 	// The sender (Flutter) should not retry.
 	StatusDeviceOffline StatusCode = 4
+	// StatusQuotaExceeded indicates the traffic quota of the device's secret
+	// key is used up for the current period. The sender should not retry
+	// before the quota resets.
+	StatusQuotaExceeded StatusCode = 5
 )
 
 type HandshakeReq struct {
@@ -64,6 +70,22 @@ type CommonReq struct {
 }
 type ConnectionReq struct {
 	CommonReq
+	// Service names the endpoint this connection serves. Empty is the
+	// default service, which is what old clients use.
+	Service string `json:"service"`
+	// Meta is optional; old clients do not send it.
+	Meta DeviceMeta `json:"meta"`
+	// AcceptMailbox asks the server to deliver held mailbox blobs on this
+	// connection (ActionMailbox) right after the OK response.
+	AcceptMailbox bool `json:"acceptMailbox"`
+}
+
+// DeviceMeta describes the device behind a connection. All fields are optional.
+type DeviceMeta struct {
+	Hostname        string `json:"hostname"`
+	OS              string `json:"os"`
+	AppVersion      string `json:"appVersion"`
+	ProtocolVersion string `json:"protocolVersion"`
 }
 
 type Action string
@@ -75,6 +97,21 @@ const (
 	// ActionClose is used to close the long connection
 	ActionClose     Action = "close"
 	ActionHeartbeat Action = "heartbeat"
+	// ActionSubscribe opens a long-lived connection that receives
+	// ActionPresence events for a list of device IDs.
+	ActionSubscribe Action = "subscribe"
+	// ActionPresence is pushed by the server on a subscribe connection.
+	ActionPresence Action = "presence"
+	// ActionMulticast relays one stream to several devices.
+	ActionMulticast Action = "multicast"
+	// ActionRendezvous exchanges peer addresses for a direct connection
+	// attempt, falling back to a relay bridge.
+	ActionRendezvous Action = "rendezvous"
+	// ActionMailboxPut deposits a blob for an offline device.
+	ActionMailboxPut Action = "mailbox_put"
+	// ActionMailbox delivers a held blob on a device connection. The device
+	// acknowledges each blob by sending back a head with the same action.
+	ActionMailbox Action = "mailbox"
 )
 
 type HeartbeatReq struct {
@@ -88,12 +125,179 @@ type HeartbeatReq struct {
 
 type RelayReq struct {
 	CommonReq
+	// Service selects the endpoint of the device, empty for the default one.
+	Service string `json:"service"`
 }
 
-// type PingReq struct {
-// 	CommonReq
-// }
+// Rendezvous flow, between a sender, the server and an idle device connection:
+//
+//  1. sender -> server: ActionRendezvous head + RendezvousReq.
+//  2. server -> device: ActionRendezvous head without body.
+//  3. device -> server: ActionRendezvous head + RendezvousCandidates.
+//  4. server -> both: a RendezvousOffer with the other peer's candidates,
+//     as a request head to the device and an OK response head to the sender.
+//     Busy and offline devices are reported to the sender as in ActionRelay.
+//  5. Both peers try to connect to each other DelayMs after receiving the
+//     offer, ideally from the local port they use to reach the server.
+//  6. sender -> server -> device: ActionRendezvous head + RendezvousResult.
+//     If Direct is false, the connections are bridged as in ActionRelay
+//     right after the result.
 
-// type PingResp struct {
-// 	CommonResp
-// }
+// RendezvousReq starts a rendezvous with the device SecretKeyID.
+type RendezvousReq struct {
+	CommonReq
+	// Service selects the endpoint of the device, as in RelayReq.
+	Service string `json:"service"`
+	// Candidates are the sender's own addresses ("ip:port"), e.g. LAN
+	// addresses. The server adds the address it observes.
+	Candidates []string `json:"candidates"`
+}
+
+// RendezvousCandidates is the device's answer to a rendezvous query.
+type RendezvousCandidates struct {
+	Candidates []string `json:"candidates"`
+}
+
+type RendezvousOffer struct {
+	// Candidates are the peer's addresses, the one observed by the server
+	// first.
+	Candidates []string `json:"candidates"`
+	// DelayMs is when to start connecting, relative to receiving the offer.
+	DelayMs int `json:"delayMs"`
+}
+
+type RendezvousResult struct {
+	Direct bool `json:"direct"`
+}
+
+// MulticastReq asks the server to relay the sender's stream to every device
+// in IDs. The server answers with a MulticastResp, and once the stream ends
+// sends a second MulticastResp with the delivery outcome of each target, to
+// a sender that half-closed its side.
+type MulticastReq struct {
+	IDs []string `json:"ids"`
+}
+
+type MulticastResp struct {
+	Results []MulticastResult `json:"results"`
+}
+
+// MulticastResult is the outcome for one target of a multicast.
+type MulticastResult struct {
+	ID   string     `json:"id"`
+	Code StatusCode `json:"code"`
+	Msg  string     `json:"msg"`
+	// DataLen is the number of bytes delivered, set in the final response.
+	DataLen int64 `json:"dataLen"`
+}
+
+// Feature names a protocol capability of the relay server.
+type Feature string
+
+const (
+	// FeaturePingInfo: ping replies carry a PingResp body.
+	FeaturePingInfo Feature = "ping_info"
+	// FeatureDevicePresence: ping can report the presence of a device.
+	FeatureDevicePresence Feature = "device_presence"
+	// FeatureKDFSaltRetry: the handshake may be retried after StatusKDFSaltMismatch.
+	FeatureKDFSaltRetry Feature = "kdf_salt_retry"
+	// FeatureSubscribe: ActionSubscribe is available.
+	FeatureSubscribe Feature = "subscribe"
+	// FeatureMulticast: ActionMulticast is available.
+	FeatureMulticast Feature = "multicast"
+	// FeatureRendezvous: ActionRendezvous is available.
+	FeatureRendezvous Feature = "rendezvous"
+	// FeatureMailbox: ActionMailboxPut is available.
+	FeatureMailbox Feature = "mailbox"
+)
+
+// ServerFeatures lists every feature this server supports.
+var ServerFeatures = []Feature{
+	FeaturePingInfo,
+	FeatureDevicePresence,
+	FeatureKDFSaltRetry,
+	FeatureSubscribe,
+	FeatureMulticast,
+	FeatureRendezvous,
+	FeatureMailbox,
+}
+
+// NegotiateFeatures returns the server features also listed by the client,
+// or all server features if the client listed none.
+func NegotiateFeatures(client []Feature) []Feature {
+	if len(client) == 0 {
+		return slices.Clone(ServerFeatures)
+	}
+	features := make([]Feature, 0, len(ServerFeatures))
+	for _, f := range ServerFeatures {
+		if slices.Contains(client, f) {
+			features = append(features, f)
+		}
+	}
+	return features
+}
+
+// DevicePresence is the state of a device as a relay request would see it,
+// the best over all services the device registered.
+type DevicePresence string
+
+const (
+	// PresenceIdle means the device has an idle connection; a relay would start at once.
+	PresenceIdle DevicePresence = "idle"
+	// PresenceBusy means every connection is in use or reconnecting; a relay would wait.
+	PresenceBusy DevicePresence = "busy"
+	// PresenceOffline means the device has no connections; a relay would fail.
+	PresenceOffline DevicePresence = "offline"
+)
+
+// PingReq is the optional body of an ActionPing request.
+// Old clients send ping without a body.
+type PingReq struct {
+	// SecretKeyID, if not empty, asks for the presence of that device.
+	CommonReq
+	// Features the client supports. Empty means the client did not say,
+	// and the response lists every server feature.
+	Features []Feature `json:"features"`
+}
+
+type PingResp struct {
+	Version string `json:"version"`
+	// Features supported by both sides.
+	Features   []Feature `json:"features"`
+	KDFSaltB64 string    `json:"kdfSaltB64"`
+	// Presence of PingReq.SecretKeyID, empty if none was asked for or the
+	// caller is not authorized for that device.
+	Presence DevicePresence `json:"presence,omitempty"`
+}
+
+type SubscribeReq struct {
+	// IDs are the device IDs to watch.
+	IDs []string `json:"ids"`
+}
+
+// PresenceEvent reports a change in the presence of a subscribed device.
+// PresenceIdle means the device is online and ready.
+type PresenceEvent struct {
+	ID       string         `json:"id"`
+	Presence DevicePresence `json:"presence"`
+}
+
+// MailboxPutReq is followed by DataLen bytes of blob data. The blob should
+// be end-to-end encrypted; the relay stores it as is.
+type MailboxPutReq struct {
+	// SecretKeyID is the target device.
+	CommonReq
+	DataLen int `json:"dataLen"`
+	// TTLSeconds is how long the blob may wait for the device. Zero or
+	// more than the server limit means the server limit.
+	TTLSeconds int `json:"ttlSeconds"`
+}
+
+// MailboxItem is the body of an ActionMailbox head and is followed by
+// DataLen bytes of blob data.
+type MailboxItem struct {
+	MsgID uint64 `json:"msgId"`
+	// CreatedAt is the deposit time in Unix milliseconds.
+	CreatedAt int64 `json:"createdAt"`
+	DataLen   int   `json:"dataLen"`
+}
@@ -149,6 +149,37 @@ func sendReqHeadWithBody[T any](conn net.Conn, action Action, body T, cipher ...
 	return nil
 }
 
+// sendRespHeadWithBody writes a response head followed by a body.
+// RespHead.DataLen is the length of the (encrypted) body.
+func sendRespHeadWithBody[T any](conn net.Conn, action Action, code StatusCode, msg string, body T, cipher ...crypto.SymmetricCipher) error {
+	jsonResp, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("marshal resp with body failed, err: %w", err)
+	}
+	if len(cipher) != 0 {
+		var err error
+		jsonResp, err = cipher[0].Encrypt(jsonResp)
+		if err != nil {
+			return fmt.Errorf("encrypt resp with body failed, err: %w", err)
+		}
+	}
+
+	var head RespHead
+	head.Code = code
+	head.Msg = msg
+	head.Action = action
+	head.DataLen = len(jsonResp)
+	err = sendStruct(conn, head, cipher...)
+	if err != nil {
+		return fmt.Errorf("send resp head failed, err: %w", err)
+	}
+	_, err = conn.Write(jsonResp)
+	if err != nil {
+		return fmt.Errorf("write resp with body failed, err: %w", err)
+	}
+	return nil
+}
+
 func SendHandshakeResp(conn net.Conn, resp HandshakeResp) error {
 	return sendStruct(conn, resp)
 }
@@ -202,6 +233,67 @@ func SendRespHead(conn net.Conn, action Action, code StatusCode, msg string, cip
 	return sendStruct(conn, head, cipher...)
 }
 
+func SendPingResp(conn net.Conn, resp PingResp, cipher ...crypto.SymmetricCipher) error {
+	return sendRespHeadWithBody(conn, ActionPing, StatusSuccess, "OK", resp, cipher...)
+}
+
+// SendMulticastResp answers a multicast request. code is StatusSuccess if at
+// least one target is relaying.
+func SendMulticastResp(conn net.Conn, code StatusCode, msg string, resp MulticastResp, cipher ...crypto.SymmetricCipher) error {
+	return sendRespHeadWithBody(conn, ActionMulticast, code, msg, resp, cipher...)
+}
+
+func SendPresenceEvent(conn net.Conn, event PresenceEvent, cipher ...crypto.SymmetricCipher) error {
+	return sendReqHeadWithBody(conn, ActionPresence, event, cipher...)
+}
+
+// SendMailboxItem writes an ActionMailbox head, its MailboxItem body and
+// then the raw blob data.
+func SendMailboxItem(conn net.Conn, item MailboxItem, data []byte, cipher ...crypto.SymmetricCipher) error {
+	item.DataLen = len(data)
+	err := sendReqHeadWithBody(conn, ActionMailbox, item, cipher...)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(data); err != nil {
+		return fmt.Errorf("write mailbox data failed, err: %w", err)
+	}
+	return nil
+}
+
+// SendRendezvousQuery asks a device for its rendezvous candidates.
+func SendRendezvousQuery(conn net.Conn, cipher ...crypto.SymmetricCipher) error {
+	var head ReqHead
+	head.Action = ActionRendezvous
+	return sendStruct(conn, head, cipher...)
+}
+
+func SendRendezvousCandidates(conn net.Conn, candidates RendezvousCandidates, cipher ...crypto.SymmetricCipher) error {
+	return sendReqHeadWithBody(conn, ActionRendezvous, candidates, cipher...)
+}
+
+// SendRendezvousOffer sends an offer to the device side of a rendezvous.
+func SendRendezvousOffer(conn net.Conn, offer RendezvousOffer, cipher ...crypto.SymmetricCipher) error {
+	return sendReqHeadWithBody(conn, ActionRendezvous, offer, cipher...)
+}
+
+// SendRendezvousOfferResp answers the sender of a rendezvous with an offer.
+func SendRendezvousOfferResp(conn net.Conn, offer RendezvousOffer, cipher ...crypto.SymmetricCipher) error {
+	return sendRespHeadWithBody(conn, ActionRendezvous, StatusSuccess, "OK", offer, cipher...)
+}
+
+func SendRendezvousResult(conn net.Conn, result RendezvousResult, cipher ...crypto.SymmetricCipher) error {
+	return sendReqHeadWithBody(conn, ActionRendezvous, result, cipher...)
+}
+
+// SendClose asks the peer to close a long connection; a device opens a new
+// one in its place.
+func SendClose(conn net.Conn, cipher ...crypto.SymmetricCipher) error {
+	var head ReqHead
+	head.Action = ActionClose
+	return sendStruct(conn, head, cipher...)
+}
+
 func SendRelayStart(conn net.Conn, cipher ...crypto.SymmetricCipher) error {
 	var head ReqHead
 	head.Action = ActionRelay
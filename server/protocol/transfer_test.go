@@ -0,0 +1,358 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/doraemonkeys/WindSend-Relay/server/tool"
+	"github.com/doraemonkeys/doraemon/crypto"
+)
+
+// maxFuzzFieldsLen bounds the total length of string fields in round-trip
+// targets so that the encoded frame (JSON escaping can expand a byte to six,
+// plus AES-GCM overhead) always stays under the 10KB frame limit.
+const maxFuzzFieldsLen = 1024
+
+// memConn is an in-memory net.Conn: reads drain r, writes append to w.
+type memConn struct {
+	r *bytes.Reader
+	w bytes.Buffer
+}
+
+func newMemConn(data []byte) *memConn {
+	return &memConn{r: bytes.NewReader(data)}
+}
+
+func (c *memConn) Read(b []byte) (int, error)       { return c.r.Read(b) }
+func (c *memConn) Write(b []byte) (int, error)      { return c.w.Write(b) }
+func (c *memConn) Close() error                     { return nil }
+func (c *memConn) LocalAddr() net.Addr              { return &net.TCPAddr{} }
+func (c *memConn) RemoteAddr() net.Addr             { return &net.TCPAddr{} }
+func (c *memConn) SetDeadline(time.Time) error      { return nil }
+func (c *memConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *memConn) SetWriteDeadline(time.Time) error { return nil }
+
+// replay returns a new memConn whose read side is everything written to c.
+func (c *memConn) replay() *memConn {
+	return newMemConn(bytes.Clone(c.w.Bytes()))
+}
+
+func lenPrefixed(payload []byte) []byte {
+	buf := binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))
+	return append(buf, payload...)
+}
+
+func testCipher(t testing.TB) crypto.SymmetricCipher {
+	t.Helper()
+	c, err := crypto.NewAESGCM(tool.HashToAES192Key([]byte("protocol-test")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func FuzzReadHandshakeReq(f *testing.F) {
+	f.Add(lenPrefixed([]byte(`{"secretKeySelector":"01234567","authFieldB64":"QUJD","authAAD":"x","kdfSaltB64":"c2FsdA==","ecdhPublicKeyB64":"AAAA"}`)))
+	f.Add(lenPrefixed([]byte(`{}`)))
+	f.Add(lenPrefixed([]byte(`null`)))
+	f.Add(lenPrefixed([]byte(`{"authFieldB64":1}`)))
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0x00, 0x28, 0x00, 0x00})
+	f.Add([]byte{0x01})
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if _, err := ReadHandshakeReq(newMemConn(data)); err != nil {
+			return
+		}
+		// Anything accepted must have come from a frame within the length limit.
+		n := int32(binary.LittleEndian.Uint32(data[:4]))
+		if n <= 0 || n > 1024*10 || int(n) > len(data)-4 {
+			t.Fatalf("accepted frame with invalid length %d (input %d bytes)", n, len(data))
+		}
+	})
+}
+
+func FuzzReadReqHead(f *testing.F) {
+	cipher := testCipher(f)
+	seed := func(plain []byte, encrypt bool) {
+		if encrypt {
+			enc, err := cipher.Encrypt(plain)
+			if err != nil {
+				f.Fatal(err)
+			}
+			plain = enc
+		}
+		f.Add(lenPrefixed(plain), encrypt)
+	}
+	seed([]byte(`{"action":"relay","dataLen":12}`), false)
+	seed([]byte(`{"action":"relay","dataLen":12}`), true)
+	seed([]byte(`{"action":"heartbeat","dataLen":0}`), true)
+	seed([]byte(`{"dataLen":-1}`), false)
+	seed([]byte(`[]`), true)
+	f.Add([]byte{0x04, 0x00, 0x00, 0x00, 'n', 'u', 'l', 'l'}, true)
+	f.Add([]byte{0x80, 0x00, 0x00, 0x00}, false)
+	f.Fuzz(func(t *testing.T, data []byte, encrypt bool) {
+		var c crypto.SymmetricCipher
+		if encrypt {
+			c = cipher
+		}
+		if _, err := ReadReqHead(newMemConn(data), c); err != nil {
+			return
+		}
+		n := int32(binary.LittleEndian.Uint32(data[:4]))
+		if n <= 0 || n > 1024*10 || int(n) > len(data)-4 {
+			t.Fatalf("accepted frame with invalid length %d (input %d bytes)", n, len(data))
+		}
+	})
+}
+
+func FuzzReadReq(f *testing.F) {
+	cipher := testCipher(f)
+	f.Add([]byte(`{"id":"device-a"}`), 17, false)
+	f.Add([]byte(`{"id":"device-a","needResp":true}`), 33, false)
+	f.Add([]byte(`{"id":`), 6, false)
+	f.Add([]byte(`{"id":"device-a"}`), 1<<20, false)
+	f.Add([]byte(`{"id":"device-a"}`), -1, true)
+	f.Add([]byte{}, 0, true)
+	f.Fuzz(func(t *testing.T, data []byte, dataLen int, encrypt bool) {
+		var ciphers []crypto.SymmetricCipher
+		if encrypt {
+			ciphers = append(ciphers, cipher)
+		}
+		if _, err := ReadReq[RelayReq](newMemConn(data), dataLen, ciphers...); err == nil {
+			if dataLen <= 0 || dataLen > 1024*10 || dataLen > len(data) {
+				t.Fatalf("accepted request with invalid dataLen %d (input %d bytes)", dataLen, len(data))
+			}
+		}
+		if _, err := ReadReq[HeartbeatReq](newMemConn(data), dataLen, ciphers...); err == nil {
+			if dataLen <= 0 || dataLen > 1024*10 || dataLen > len(data) {
+				t.Fatalf("accepted request with invalid dataLen %d (input %d bytes)", dataLen, len(data))
+			}
+		}
+	})
+}
+
+// FuzzHandshakeReqRoundTrip checks that any request the client can encode is
+// decoded back to the same value by ReadHandshakeReq.
+func FuzzHandshakeReqRoundTrip(f *testing.F) {
+	f.Add("01234567", "QUJD", "aad", "c2FsdA==", "AAAA")
+	f.Add("", "", "", "", "")
+	f.Add("\x00", "\"", "\\", " ", "\U0001f600")
+	f.Fuzz(func(t *testing.T, selector, authField, aad, salt, pk string) {
+		in := HandshakeReq{
+			SecretKeySelector: selector,
+			AuthFieldB64:      authField,
+			AuthAAD:           aad,
+			KDFSaltB64:        salt,
+			EcdhPublicKeyB64:  pk,
+		}
+		if !allValidUTF8(selector, authField, aad, salt, pk) {
+			// encoding/json replaces invalid UTF-8, so equality does not hold.
+			return
+		}
+		if len(selector)+len(authField)+len(aad)+len(salt)+len(pk) > maxFuzzFieldsLen {
+			return
+		}
+		conn := newMemConn(nil)
+		if err := sendStruct(conn, in); err != nil {
+			t.Fatal(err)
+		}
+		framed := conn.replay()
+		out, err := ReadHandshakeReq(framed)
+		if err != nil {
+			t.Fatalf("read back failed: %v", err)
+		}
+		if out != in {
+			t.Fatalf("round trip mismatch:\n got  %+v\n want %+v", out, in)
+		}
+	})
+}
+
+// FuzzReqRoundTrip checks sendReqHeadWithBody against ReadReqHead + ReadReq,
+// with and without encryption.
+func FuzzReqRoundTrip(f *testing.F) {
+	cipher := testCipher(f)
+	f.Add(string(ActionRelay), "device-a", false)
+	f.Add(string(ActionConnect), "device-b", true)
+	f.Add("", "", true)
+	f.Add("\t", "\x7f", false)
+	f.Fuzz(func(t *testing.T, action, id string, encrypt bool) {
+		if !allValidUTF8(action, id) || len(action)+len(id) > maxFuzzFieldsLen {
+			return
+		}
+		var ciphers []crypto.SymmetricCipher
+		if encrypt {
+			ciphers = append(ciphers, cipher)
+		}
+		in := RelayReq{CommonReq: CommonReq{SecretKeyID: id}}
+		conn := newMemConn(nil)
+		if err := sendReqHeadWithBody(conn, Action(action), in, ciphers...); err != nil {
+			t.Fatal(err)
+		}
+		framed := conn.replay()
+		head, err := ReadReqHead(framed, cipherOrNil(ciphers))
+		if err != nil {
+			t.Fatalf("read head failed: %v", err)
+		}
+		if head.Action != Action(action) {
+			t.Fatalf("action = %q, want %q", head.Action, action)
+		}
+		out, err := ReadReq[RelayReq](framed, head.DataLen, ciphers...)
+		if err != nil {
+			t.Fatalf("read body failed: %v", err)
+		}
+		if !reflect.DeepEqual(out, in) {
+			t.Fatalf("round trip mismatch:\n got  %+v\n want %+v", out, in)
+		}
+		if framed.r.Len() != 0 {
+			t.Fatalf("%d trailing bytes left on the stream", framed.r.Len())
+		}
+	})
+}
+
+func TestHeartbeatRoundTrip(t *testing.T) {
+	cipher := testCipher(t)
+
+	conn := newMemConn(nil)
+	if err := SendHeartbeat(conn, "device-a", cipher); err != nil {
+		t.Fatal(err)
+	}
+	if err := SendHeartbeatNoResp(conn, cipher); err != nil {
+		t.Fatal(err)
+	}
+	framed := conn.replay()
+
+	head, err := ReadReqHead(framed, cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Action != ActionHeartbeat {
+		t.Fatalf("action = %q, want %q", head.Action, ActionHeartbeat)
+	}
+	req, err := ReadReq[HeartbeatReq](framed, head.DataLen, cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.SecretKeyID != "device-a" || !req.NeedResp {
+		t.Fatalf("unexpected heartbeat request: %+v", req)
+	}
+
+	head, err = ReadReqHead(framed, cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Action != ActionHeartbeat || head.DataLen != 0 {
+		t.Fatalf("unexpected no-resp heartbeat head: %+v", head)
+	}
+}
+
+func TestRespHeadRoundTrip(t *testing.T) {
+	cipher := testCipher(t)
+	tests := []struct {
+		name string
+		send func(net.Conn) error
+		want RespHead
+	}{
+		{
+			name: "ok",
+			send: func(c net.Conn) error { return SendRespHeadOk(c, ActionPing, cipher) },
+			want: RespHead{Code: StatusSuccess, Msg: "OK", Action: ActionPing},
+		},
+		{
+			name: "ok with msg",
+			send: func(c net.Conn) error { return SendRespHeadOKWithMsg(c, ActionRelay, "Relay start", cipher) },
+			want: RespHead{Code: StatusSuccess, Msg: "Relay start", Action: ActionRelay},
+		},
+		{
+			name: "error",
+			send: func(c net.Conn) error { return SendRespHeadError(c, ActionConnect, "Too many connections", cipher) },
+			want: RespHead{Code: StatusError, Msg: "Too many connections", Action: ActionConnect},
+		},
+		{
+			name: "busy",
+			send: func(c net.Conn) error {
+				return SendRespHead(c, ActionRelay, StatusDeviceBusy, "device busy", cipher)
+			},
+			want: RespHead{Code: StatusDeviceBusy, Msg: "device busy", Action: ActionRelay},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := newMemConn(nil)
+			if err := tt.send(conn); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readRespHead(conn.replay(), cipher)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPingRespRoundTrip(t *testing.T) {
+	cipher := testCipher(t)
+	want := PingResp{
+		Version:    "1.2.3",
+		Features:   NegotiateFeatures([]Feature{FeatureDevicePresence, "unknown"}),
+		KDFSaltB64: "c2FsdA==",
+		Presence:   PresenceBusy,
+	}
+	conn := newMemConn(nil)
+	if err := SendPingResp(conn, want, cipher); err != nil {
+		t.Fatal(err)
+	}
+	framed := conn.replay()
+	head, err := readRespHead(framed, cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Code != StatusSuccess || head.Action != ActionPing {
+		t.Fatalf("unexpected head: %+v", head)
+	}
+	got, err := ReadReq[PingResp](framed, head.DataLen, cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	if !slices.Equal(got.Features, []Feature{FeatureDevicePresence}) {
+		t.Fatalf("negotiated features = %v", got.Features)
+	}
+}
+
+// readRespHead mirrors what clients do to parse a RespHead frame.
+func readRespHead(conn net.Conn, cipher crypto.SymmetricCipher) (RespHead, error) {
+	var buf [4]byte
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		return RespHead{}, err
+	}
+	return ReadReq[RespHead](conn, int(binary.LittleEndian.Uint32(buf[:])), cipher)
+}
+
+func cipherOrNil(ciphers []crypto.SymmetricCipher) crypto.SymmetricCipher {
+	if len(ciphers) == 0 {
+		return nil
+	}
+	return ciphers[0]
+}
+
+func allValidUTF8(ss ...string) bool {
+	for _, s := range ss {
+		if !utf8.ValidString(s) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,217 @@
+package relay
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/doraemonkeys/WindSend-Relay/server/config"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrACLRuleExists   = errors.New("acl rule already exists")
+	ErrACLRuleNotFound = errors.New("acl rule not found")
+	ErrACLKeyNotFound  = errors.New("secret key not found")
+)
+
+// aclRule is one CIDR of an ACL with the number of connections it matched.
+type aclRule struct {
+	prefix netip.Prefix
+	hits   atomic.Int64
+}
+
+// acl admits or rejects client addresses by CIDR. A deny rule wins over an
+// allow rule; with no allow rules every address not denied is admitted.
+// The rules can be changed at runtime.
+type acl struct {
+	mu    sync.RWMutex
+	allow []*aclRule
+	deny  []*aclRule
+	// notAllowed counts the addresses rejected for matching no allow rule.
+	notAllowed atomic.Int64
+}
+
+// newACL builds an ACL from CIDRs checked by config.validateACLConfig.
+func newACL(allow, deny []string) *acl {
+	a := &acl{}
+	for _, cidr := range allow {
+		if prefix, err := config.ParseCIDR(cidr); err == nil {
+			_ = a.add(false, prefix)
+		}
+	}
+	for _, cidr := range deny {
+		if prefix, err := config.ParseCIDR(cidr); err == nil {
+			_ = a.add(true, prefix)
+		}
+	}
+	return a
+}
+
+func (a *acl) list(deny bool) *[]*aclRule {
+	if deny {
+		return &a.deny
+	}
+	return &a.allow
+}
+
+// add appends a rule to the deny or allow list.
+func (a *acl) add(deny bool, prefix netip.Prefix) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	rules := a.list(deny)
+	if slices.ContainsFunc(*rules, func(r *aclRule) bool { return r.prefix == prefix }) {
+		return ErrACLRuleExists
+	}
+	*rules = append(*rules, &aclRule{prefix: prefix})
+	return nil
+}
+
+// remove deletes a rule from the deny or allow list.
+func (a *acl) remove(deny bool, prefix netip.Prefix) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	rules := a.list(deny)
+	i := slices.IndexFunc(*rules, func(r *aclRule) bool { return r.prefix == prefix })
+	if i < 0 {
+		return ErrACLRuleNotFound
+	}
+	*rules = slices.Delete(*rules, i, i+1)
+	return nil
+}
+
+// admit reports whether addr passes the ACL and counts the hit on the rule
+// that decided it. An invalid addr only passes an ACL without rules.
+func (a *acl) admit(addr netip.Addr) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if len(a.allow) == 0 && len(a.deny) == 0 {
+		return true
+	}
+	for _, r := range a.deny {
+		if r.prefix.Contains(addr) {
+			r.hits.Add(1)
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return addr.IsValid()
+	}
+	for _, r := range a.allow {
+		if r.prefix.Contains(addr) {
+			r.hits.Add(1)
+			return true
+		}
+	}
+	a.notAllowed.Add(1)
+	return false
+}
+
+// remoteIP returns the IP of the remote end of conn, invalid if conn is not
+// an IP connection.
+func remoteIP(conn net.Conn) netip.Addr {
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return tcpAddr.AddrPort().Addr().Unmap()
+	}
+	return netip.Addr{}
+}
+
+// admitAddr checks the address of a new connection against the global ACL.
+func (r *Relay) admitAddr(conn net.Conn) bool {
+	if r.globalACL.admit(remoteIP(conn)) {
+		return true
+	}
+	zap.L().Info("Connection rejected by ACL", zap.String("addr", conn.RemoteAddr().String()))
+	return false
+}
+
+// admitKeyAddr checks the address of an authenticated connection against
+// the ACL of its key.
+func (r *Relay) admitKeyAddr(conn net.Conn, authKeyB64 string) bool {
+	sl := r.getSecretLimit(authKeyB64)
+	if sl == nil || sl.acl == nil || sl.acl.admit(remoteIP(conn)) {
+		return true
+	}
+	zap.L().Info("Connection rejected by key ACL", zap.String("addr", conn.RemoteAddr().String()))
+	return false
+}
+
+// keyACL returns the ACL of the secret key at index in the config, nil if
+// there is no such key.
+func (r *Relay) keyACL(index int) *acl {
+	if index < 0 || index >= len(r.secretKeyOrder) {
+		return nil
+	}
+	if sl := r.getSecretLimit(r.secretKeyOrder[index]); sl != nil {
+		return sl.acl
+	}
+	return nil
+}
+
+// ACLRuleStatus is one CIDR of an ACL and how many connections it matched.
+type ACLRuleStatus struct {
+	CIDR string
+	Hits int64
+}
+
+// ACLStatus lists the rules of an ACL.
+type ACLStatus struct {
+	// KeyIndex is the position of the secret key in the config, -1 for the
+	// global ACL.
+	KeyIndex int
+	Allow    []ACLRuleStatus
+	Deny     []ACLRuleStatus
+	// NotAllowed counts the connections rejected for matching no allow rule.
+	NotAllowed int64
+}
+
+func (a *acl) status(keyIndex int) ACLStatus {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	rules := func(list []*aclRule) []ACLRuleStatus {
+		out := make([]ACLRuleStatus, 0, len(list))
+		for _, r := range list {
+			out = append(out, ACLRuleStatus{CIDR: r.prefix.String(), Hits: r.hits.Load()})
+		}
+		return out
+	}
+	return ACLStatus{
+		KeyIndex:   keyIndex,
+		Allow:      rules(a.allow),
+		Deny:       rules(a.deny),
+		NotAllowed: a.notAllowed.Load(),
+	}
+}
+
+// GetACLs returns the global ACL followed by that of every secret key.
+func (r *Relay) GetACLs() []ACLStatus {
+	statuses := []ACLStatus{r.globalACL.status(-1)}
+	for i := range r.secretKeyOrder {
+		if a := r.keyACL(i); a != nil {
+			statuses = append(statuses, a.status(i))
+		}
+	}
+	return statuses
+}
+
+// UpdateACL adds or removes a rule of the global ACL (keyIndex -1) or of
+// the ACL of the secret key at keyIndex. Changes are not persisted.
+func (r *Relay) UpdateACL(keyIndex int, deny bool, cidr string, remove bool) error {
+	prefix, err := config.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	a := r.globalACL
+	if keyIndex >= 0 {
+		if a = r.keyACL(keyIndex); a == nil {
+			return ErrACLKeyNotFound
+		}
+	}
+	if remove {
+		return a.remove(deny, prefix)
+	}
+	return a.add(deny, prefix)
+}
@@ -0,0 +1,95 @@
+package relay
+
+import (
+	"errors"
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestACLAdmit(t *testing.T) {
+	a := newACL([]string{"10.0.0.0/8", "192.168.1.7"}, []string{"10.66.0.0/16"})
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"192.168.1.7", true},
+		{"10.66.1.1", false}, // deny wins over allow
+		{"192.168.1.8", false},
+		{"2001:db8::1", false},
+	}
+	for _, tt := range tests {
+		if got := a.admit(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("admit(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+	status := a.status(-1)
+	if status.Allow[0].Hits != 1 || status.Allow[1].Hits != 1 || status.Deny[0].Hits != 1 || status.NotAllowed != 2 {
+		t.Fatalf("hits = %+v", status)
+	}
+
+	if !newACL(nil, nil).admit(netip.Addr{}) {
+		t.Fatal("an empty ACL rejected an address")
+	}
+	if newACL(nil, []string{"10.0.0.0/8"}).admit(netip.Addr{}) {
+		t.Fatal("an ACL with rules admitted a non-IP address")
+	}
+}
+
+func TestUpdateACL(t *testing.T) {
+	r := newTestRelay(t)
+	r.secretKeyOrder = []string{"office-key"}
+	r.keyConnLimit["office-key"] = &SecretLimit{acl: newACL(nil, nil)}
+	office := netip.MustParseAddr("203.0.113.9")
+
+	if err := r.UpdateACL(0, false, "203.0.113.0/24", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.UpdateACL(0, false, "203.0.113.1/24", false); !errors.Is(err, ErrACLRuleExists) {
+		t.Fatalf("adding a rule twice: err = %v", err)
+	}
+	if !r.keyConnLimit["office-key"].acl.admit(office) || r.keyConnLimit["office-key"].acl.admit(netip.MustParseAddr("198.51.100.1")) {
+		t.Fatal("key ACL does not follow the added allow rule")
+	}
+	if err := r.UpdateACL(1, false, "203.0.113.0/24", false); !errors.Is(err, ErrACLKeyNotFound) {
+		t.Fatalf("update of an unknown key: err = %v", err)
+	}
+	if err := r.UpdateACL(-1, true, "not-a-cidr", false); err == nil {
+		t.Fatal("an invalid CIDR was accepted")
+	}
+	if err := r.UpdateACL(0, false, "203.0.113.0/24", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.UpdateACL(0, false, "203.0.113.0/24", true); !errors.Is(err, ErrACLRuleNotFound) {
+		t.Fatalf("removing a missing rule: err = %v", err)
+	}
+	if statuses := r.GetACLs(); len(statuses) != 2 || statuses[1].KeyIndex != 0 || len(statuses[1].Allow) != 0 {
+		t.Fatalf("acls = %+v", statuses)
+	}
+}
+
+func TestMainProcessRejectsDeniedAddress(t *testing.T) {
+	r := newTestRelay(t)
+	r.globalACL = newACL(nil, []string{"127.0.0.0/8", "::1"})
+	client, server := tcpPair(t)
+
+	done := make(chan struct{})
+	go func() {
+		r.mainProcess(server)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("mainProcess started a handshake with a denied address")
+	}
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("read from a rejected connection: err = %v, want EOF", err)
+	}
+	if hits := r.globalACL.status(-1).Deny[0].Hits + r.globalACL.status(-1).Deny[1].Hits; hits != 1 {
+		t.Fatalf("deny hits = %d, want 1", hits)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"sync"
 
@@ -76,12 +77,20 @@ func getAES192KeySelector(key tool.AES192Key) string {
 	return hash[:8]
 }
 
-func (a *Authentication) Auth(selector string, authField []byte, additionalData ...[]byte) (bool, tool.AES192Key) {
+var (
+	// ErrUnknownSelector means no configured key matches the selector.
+	ErrUnknownSelector = errors.New("unknown secret key selector")
+	// ErrDecryptFailed means the selector matched, but no key could decrypt
+	// the auth field into a valid "AUTH" message.
+	ErrDecryptFailed = errors.New("failed to decrypt auth field")
+)
+
+func (a *Authentication) Auth(selector string, authField []byte, additionalData ...[]byte) (tool.AES192Key, error) {
 	a.selectorMu.RLock()
 	ks, ok := a.KeySelectors[selector]
 	a.selectorMu.RUnlock()
 	if !ok {
-		return false, nil
+		return nil, ErrUnknownSelector
 	}
 	for _, k := range ks {
 		cipher, err := crypto.NewAESGCM(k)
@@ -93,8 +102,8 @@ func (a *Authentication) Auth(selector string, authField []byte, additionalData
 			continue
 		}
 		if bytes.HasPrefix(plaintext, []byte("AUTH")) {
-			return true, k
+			return k, nil
 		}
 	}
-	return false, nil
+	return nil, ErrDecryptFailed
 }
@@ -2,6 +2,8 @@ package relay
 
 import (
 	"net"
+	"net/netip"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -15,44 +17,69 @@ import (
 // In the new multi-connection model, Connection no longer has a Relaying flag
 // or a per-connection mutex: "in pool = idle, out of pool = busy/closed".
 type Connection struct {
-	ID         string
+	ID string
+	// Service is the named endpoint of the device this connection serves,
+	// empty for the default one.
+	Service    string
 	AuthkeyB64 string
 	Cipher     crypto.SymmetricCipher
 
 	Conn        net.Conn
 	ConnectTime time.Time
+	// LastHeartbeat is when the connection last proved alive: its
+	// registration or its last successful heartbeat probe. Only written
+	// while the connection is out of the pool.
+	LastHeartbeat time.Time
+	// LastRTT is the round-trip time of the last successful heartbeat probe,
+	// zero before the first one. Written like LastHeartbeat.
+	LastRTT time.Duration
+	// Meta is the metadata sent with the connection request, if any.
+	Meta protocol.DeviceMeta
+	// ip is the source IP the connection is counted against, invalid if
+	// it is not an IP connection.
+	ip netip.Addr
 }
 
-// sendMsgDetectAlive sends a heartbeat and waits for a response to probe liveness.
+// sendMsgDetectAlive sends a heartbeat and waits up to timeout for a response
+// to probe liveness, returning the round-trip time.
 // Must NOT be called while the connection is in the pool (caller must have
 // removed it first to avoid concurrent writes on net.Conn).
-func (c *Connection) sendMsgDetectAlive() (alive bool) {
+func (c *Connection) sendMsgDetectAlive(timeout time.Duration) (rtt time.Duration, alive bool) {
 	l := zap.L().With(zap.String("id", c.ID), zap.String("addr", c.Conn.RemoteAddr().String()))
 
+	start := time.Now()
+	// Use a deadline instead of a goroutine+select so we never leak a
+	// goroutine blocked on ReadReqHead after the timeout elapses.
+	_ = c.Conn.SetDeadline(start.Add(timeout))
+	defer func() { _ = c.Conn.SetDeadline(time.Time{}) }()
+
 	err := protocol.SendHeartbeat(c.Conn, c.ID, c.Cipher)
 	if err != nil {
 		l.Warn("sent heartbeat failed(detect alive)", zap.Error(err))
-		return false
+		return 0, false
 	}
 
-	// Use a read deadline instead of a goroutine+select so we never leak a
-	// goroutine blocked on ReadReqHead after the timeout elapses.
-	_ = c.Conn.SetReadDeadline(time.Now().Add(2 * time.Second))
-	defer func() { _ = c.Conn.SetReadDeadline(time.Time{}) }()
-
 	head, err := protocol.ReadReqHead(c.Conn, c.Cipher)
 	if err != nil {
 		l.Warn("Failed to receive heartbeat", zap.Error(err))
-		return false
+		return 0, false
 	}
 	if head.Action != protocol.ActionHeartbeat {
 		l.Warn("unexpected action during heartbeat probe", zap.Any("action", head.Action))
-		return false
+		return 0, false
 	}
-	return true
+	return time.Since(start), true
+}
+
+// poolKey identifies a DeviceConnPool: one device ID can register a pool
+// per service name.
+type poolKey struct {
+	id      string
+	service string
 }
 
-// DeviceConnPool manages a pool of idle connections for a single device ID.
+// DeviceConnPool manages a pool of idle connections for a single device ID
+// and service.
 //
 // # Connection lifecycle ("use-once, replenish immediately")
 //
@@ -72,13 +99,17 @@ func (c *Connection) sendMsgDetectAlive() (alive bool) {
 //
 // "In pool = idle": connections leave the pool via tryAcquire (for relay)
 // or borrow-out (for heartbeat probing). No Relaying flag is needed.
+//
+// A connection that becomes idle while relay requests are waiting is handed
+// straight to the oldest waiter instead of entering the pool, so conns and
+// waiters are never both non-empty.
 type DeviceConnPool struct {
 	mu    sync.Mutex
 	conns []*Connection
 
-	// notifyCh is a buffered-1 channel used to wake waiters when a new
-	// idle connection becomes available (registration, cascade, probe return).
-	notifyCh chan struct{}
+	// waiters are the relay requests waiting for an idle connection, oldest
+	// first. Protected by mu.
+	waiters []*connWaiter
 
 	// activeCount tracks connections that have been popped by tryAcquire
 	// and are currently in a relay bridge.
@@ -92,10 +123,6 @@ type DeviceConnPool struct {
 	// heartbeat scanner and are currently being probed.
 	probingCount atomic.Int32
 
-	// waiterCount tracks goroutines blocked in waitForConnection, used to
-	// prevent pool cleanup from orphaning waiters and to cap goroutine buildup.
-	waiterCount atomic.Int32
-
 	// lastRelayTime records the timestamp (UnixMilli) of the most recent
 	// activeCount decrement. Used for BUSY vs OFFLINE determination and to
 	// delay pool cleanup during the Rust reconnect window.
@@ -105,55 +132,222 @@ type DeviceConnPool struct {
 	// epoch consistency to prevent stale connections from being re-inserted
 	// after an admin wipe.
 	epoch atomic.Int64
+
+	// meta is the most recent non-empty metadata sent by any connection of
+	// this device, and metaSavedAt when it was last persisted. Protected by mu.
+	meta        protocol.DeviceMeta
+	metaSavedAt time.Time
+
+	// retiring is the idle connection rotateIdle found too old while it was
+	// the only one. activate retires it once another connection is idle.
+	// Protected by mu.
+	retiring *Connection
+
+	// ownerKeyB64 is the auth key of the connection that created the pool,
+	// empty if it did not authenticate. Set before the pool is published in
+	// Relay.connections and never changed afterwards.
+	ownerKeyB64 string
+
+	// service is the service name the pool was created for. Set before the
+	// pool is published and never changed afterwards.
+	service string
+
+	// bytesRelayed counts the bytes bridged through the pool's connections,
+	// updated while the relays run.
+	bytesRelayed atomic.Int64
+
+	// lastRTT is the most recent heartbeat round-trip time (nanoseconds) of
+	// any connection of the pool, 0 before the first probe.
+	lastRTT atomic.Int64
+
+	// strategy selects the connection taken by tryAcquire. Set before the
+	// pool is published and never changed afterwards.
+	strategy acquireStrategy
+
+	// limits are the pool limits of the owner's secret key. Set before the
+	// pool is published and never changed afterwards.
+	limits poolLimits
+}
+
+func (p *DeviceConnPool) recordRTT(rtt time.Duration) {
+	p.lastRTT.Store(int64(rtt))
+}
+
+// connWaiter is a relay request waiting in DeviceConnPool.waiters.
+type connWaiter struct {
+	// ch receives the handed-over connection. Buffered so that the hand-off
+	// never blocks while holding the pool lock.
+	ch    chan *Connection
+	since time.Time
 }
 
 func newDeviceConnPool() *DeviceConnPool {
 	return &DeviceConnPool{
-		conns:    make([]*Connection, 0, 2),
-		notifyCh: make(chan struct{}, 1),
+		conns:  make([]*Connection, 0, 2),
+		limits: defaultPoolLimits,
 	}
 }
 
-// tryAcquire pops the head connection from the pool. Returns nil if pool is empty.
-// On success, activeCount is incremented. If the pool still has remaining connections
-// after the pop, a cascade notification is sent to wake the next waiter.
+// tryAcquire pops the connection chosen by the pool strategy. Returns nil if pool is empty.
+// On success, activeCount is incremented.
 func (p *DeviceConnPool) tryAcquire() *Connection {
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	return p.tryAcquireLocked()
+}
+
+func (p *DeviceConnPool) tryAcquireLocked() *Connection {
 	if len(p.conns) == 0 {
 		return nil
 	}
-	conn := p.conns[0]
-	p.conns[0] = nil // Allow GC of the Connection before backing array is reclaimed.
-	p.conns = p.conns[1:]
-	p.activeCount.Add(1)
-	// Cascade notify: if pool still has idle connections, wake the next waiter.
-	// Prevents waiter starvation when multiple connections register rapidly
-	// and the buffer-1 channel drops notifications.
-	if len(p.conns) > 0 {
-		select {
-		case p.notifyCh <- struct{}{}:
-		default:
-		}
+	i := p.strategy.pick(p.conns)
+	conn := p.conns[i]
+	if i == 0 {
+		p.conns[0] = nil // Allow GC of the Connection before backing array is reclaimed.
+		p.conns = p.conns[1:]
+	} else {
+		p.conns = slices.Delete(p.conns, i, i+1)
 	}
+	p.activeCount.Add(1)
 	return conn
 }
 
-// activate inserts a previously-reserved connection into the idle queue and
-// notifies waiters. Must be called only after the client has acknowledged OK,
-// so the connection is truly ready for relay.
-func (p *DeviceConnPool) activate(c *Connection) {
+// putIdleLocked hands c to the oldest waiter, or puts it in the pool if
+// nobody waits. The caller holds p.mu.
+func (p *DeviceConnPool) putIdleLocked(c *Connection) {
+	if len(p.waiters) == 0 {
+		p.conns = append(p.conns, c)
+		return
+	}
+	w := p.waiters[0]
+	p.waiters[0] = nil
+	p.waiters = p.waiters[1:]
+	p.activeCount.Add(1)
+	w.ch <- c
+}
+
+// enqueueWaiterLocked takes an idle connection if there is one; otherwise it
+// appends a waiter, unless maxWaiters are already waiting. The caller holds p.mu.
+func (p *DeviceConnPool) enqueueWaiterLocked() (*Connection, *connWaiter, error) {
+	if conn := p.tryAcquireLocked(); conn != nil {
+		return conn, nil, nil
+	}
+	if len(p.waiters) >= int(p.limits.maxWaiters) {
+		return nil, nil, errDeviceBusy
+	}
+	w := &connWaiter{ch: make(chan *Connection, 1), since: time.Now()}
+	p.waiters = append(p.waiters, w)
+	return nil, w, nil
+}
+
+// leaveQueue removes w after its wait timed out. If a connection was handed
+// to w in the meantime, leaveQueue returns it and the caller owns it.
+func (p *DeviceConnPool) leaveQueue(w *connWaiter) *Connection {
 	p.mu.Lock()
+	defer p.mu.Unlock()
+	if i := slices.Index(p.waiters, w); i >= 0 {
+		p.waiters = slices.Delete(p.waiters, i, i+1)
+		return nil
+	}
+	return <-w.ch
+}
+
+// longestWaitLocked is how long the oldest waiter has been waiting. The
+// caller holds p.mu.
+func (p *DeviceConnPool) longestWaitLocked() time.Duration {
+	if len(p.waiters) == 0 {
+		return 0
+	}
+	return time.Since(p.waiters[0].since)
+}
+
+// activate hands a previously-reserved connection to the oldest waiter or
+// inserts it into the idle queue. Must be called only after the client has
+// acknowledged OK, so the connection is truly ready for relay.
+//
+// If the pool holds a connection marked for rotation, it is borrowed out
+// like a probe and returned; the caller must retire it with
+// Relay.retireIdle.
+func (p *DeviceConnPool) activate(c *Connection) (retired *Connection) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	// Keep the reservation visible until the idle connection is actually present
 	// in the pool. Otherwise cleanup can observe "no pending + no idle" and
 	// delete a just-created pool while activation is still blocked on p.mu.
 	p.pendingCount.Add(-1)
-	p.conns = append(p.conns, c)
+	p.putIdleLocked(c)
+	if p.retiring == nil {
+		return nil
+	}
+	i := slices.Index(p.conns, p.retiring)
+	if i < 0 || len(p.conns) < 2 {
+		// Taken by a relay or a probe meanwhile, or still the only one.
+		if i < 0 {
+			p.retiring = nil
+		}
+		return nil
+	}
+	retired, p.retiring = p.retiring, nil
+	p.conns = slices.Delete(p.conns, i, i+1)
+	p.probingCount.Add(1)
+	return retired
+}
+
+// busyOrOffline decides, for a pool with no idle connection, whether the
+// device should be reported BUSY (connections exist or Rust is within the
+// reconnect window) or OFFLINE.
+func (p *DeviceConnPool) busyOrOffline() error {
+	if p.activeCount.Load() > 0 || p.probingCount.Load() > 0 || p.pendingCount.Load() > 0 {
+		return errDeviceBusy
+	}
+	if p.awaitingReconnect() {
+		return errDeviceBusy
+	}
+	return errDeviceOffline
+}
+
+// awaitingReconnect reports whether a relay ended less than reconnectWindow
+// ago, so that Rust is expected to open a replacement connection.
+func (p *DeviceConnPool) awaitingReconnect() bool {
+	lrt := p.lastRelayTime.Load()
+	return lrt > 0 && time.Since(time.UnixMilli(lrt)) < p.limits.reconnectWindow
+}
+
+// presence reports what a relay request arriving now would see, without
+// acquiring a connection.
+func (p *DeviceConnPool) presence() protocol.DevicePresence {
+	p.mu.Lock()
+	idle := len(p.conns)
 	p.mu.Unlock()
-	select {
-	case p.notifyCh <- struct{}{}:
-	default:
+	if idle > 0 {
+		return protocol.PresenceIdle
+	}
+	if p.busyOrOffline() == errDeviceBusy {
+		return protocol.PresenceBusy
+	}
+	return protocol.PresenceOffline
+}
+
+// deviceMetaSeenInterval is how often the time a device was last seen is
+// persisted while its metadata does not change: Rust reconnects after every
+// relay, so saving on each connect would write once per relay.
+const deviceMetaSeenInterval = time.Minute
+
+// updateMeta records meta, reported at now, as the latest device metadata
+// and reports whether it must be persisted: it differs from the previous
+// value, or was last persisted more than deviceMetaSeenInterval ago. Empty
+// metadata is ignored.
+func (p *DeviceConnPool) updateMeta(meta protocol.DeviceMeta, now time.Time) (save bool) {
+	if meta == (protocol.DeviceMeta{}) {
+		return false
 	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.meta == meta && now.Sub(p.metaSavedAt) < deviceMetaSeenInterval {
+		return false
+	}
+	p.meta, p.metaSavedAt = meta, now
+	return true
 }
 
 // totalLocked returns the total connection count while the caller already holds p.mu.
@@ -1,8 +1,16 @@
 package relay
 
 import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
 	"testing"
 	"time"
+
+	"github.com/doraemonkeys/WindSend-Relay/server/config"
+	"github.com/doraemonkeys/WindSend-Relay/server/protocol"
+	"github.com/doraemonkeys/WindSend-Relay/server/storage"
 )
 
 func TestActivateKeepsPendingReservationUntilPoolInsert(t *testing.T) {
@@ -52,3 +60,302 @@ func TestActivateKeepsPendingReservationUntilPoolInsert(t *testing.T) {
 		t.Fatal("activate did not insert the connection into the idle pool")
 	}
 }
+
+func TestDeviceConnPoolPresence(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(p *DeviceConnPool)
+		want  protocol.DevicePresence
+	}{
+		{
+			name:  "idle connection",
+			setup: func(p *DeviceConnPool) { p.conns = append(p.conns, &Connection{ID: "device-a"}) },
+			want:  protocol.PresenceIdle,
+		},
+		{
+			name:  "all connections active",
+			setup: func(p *DeviceConnPool) { p.activeCount.Store(1) },
+			want:  protocol.PresenceBusy,
+		},
+		{
+			name:  "connection pending",
+			setup: func(p *DeviceConnPool) { p.pendingCount.Store(1) },
+			want:  protocol.PresenceBusy,
+		},
+		{
+			name:  "within reconnect window",
+			setup: func(p *DeviceConnPool) { p.lastRelayTime.Store(time.Now().UnixMilli()) },
+			want:  protocol.PresenceBusy,
+		},
+		{
+			name: "reconnect window elapsed",
+			setup: func(p *DeviceConnPool) {
+				p.lastRelayTime.Store(time.Now().Add(-defaultPoolLimits.reconnectWindow).UnixMilli())
+			},
+			want: protocol.PresenceOffline,
+		},
+		{
+			name:  "never used",
+			setup: func(p *DeviceConnPool) {},
+			want:  protocol.PresenceOffline,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := newDeviceConnPool()
+			tt.setup(pool)
+			if got := pool.presence(); got != tt.want {
+				t.Fatalf("presence = %q, want %q", got, tt.want)
+			}
+
+			// A relay request must agree with presence.
+			r := newTestRelay(t)
+			pool.limits.waitTimeout = 50 * time.Millisecond
+			r.connections[poolKey{id: "device-a"}] = pool
+			_, _, err := r.acquireConnection("device-a", "")
+			want := map[protocol.DevicePresence]error{
+				protocol.PresenceIdle:    nil,
+				protocol.PresenceBusy:    errDeviceBusy,
+				protocol.PresenceOffline: errDeviceOffline,
+			}[tt.want]
+			if !errors.Is(err, want) {
+				t.Fatalf("acquireConnection = %v, want %v", err, want)
+			}
+		})
+	}
+}
+
+func TestUpdateMetaRefreshesSeenAt(t *testing.T) {
+	pool := newDeviceConnPool()
+	meta := protocol.DeviceMeta{Hostname: "laptop", OS: "linux"}
+	now := time.Now()
+
+	if pool.updateMeta(protocol.DeviceMeta{}, now) {
+		t.Fatal("empty metadata must not be saved")
+	}
+	if !pool.updateMeta(meta, now) {
+		t.Fatal("first metadata not saved")
+	}
+	// A reconnect right after a relay does not write again...
+	if pool.updateMeta(meta, now.Add(time.Second)) {
+		t.Fatal("unchanged metadata saved again within the interval")
+	}
+	// ...unless the metadata changed...
+	meta.AppVersion = "2.0"
+	if !pool.updateMeta(meta, now.Add(2*time.Second)) {
+		t.Fatal("changed metadata not saved")
+	}
+	// ...or the last save is old enough to refresh when it was seen.
+	if !pool.updateMeta(meta, now.Add(2*time.Second+deviceMetaSeenInterval)) {
+		t.Fatal("seen time not refreshed after the interval")
+	}
+}
+
+func TestServicesArePooledSeparately(t *testing.T) {
+	r := newTestRelay(t)
+	r.storage = storage.NewStorage(filepath.Join(t.TempDir(), "relay.db"))
+	register := func(service string) *Connection {
+		t.Helper()
+		conn, peer := net.Pipe()
+		t.Cleanup(func() { _ = peer.Close() })
+		c := &Connection{ID: "device-a", Service: service, Conn: conn}
+		pool, err := r.registerConnectionPending("device-a", c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.globalConnCount.Add(1)
+		pool.activate(c)
+		return c
+	}
+	register("")
+	aux := register("aux")
+	register("aux")
+
+	status, ok := r.GetConnectionStatus("device-a")
+	if !ok || status.IdleCount != 3 || len(status.Services) != 2 {
+		t.Fatalf("status = %+v", status)
+	}
+	if status.Services[0].Service != "" || status.Services[0].IdleCount != 1 ||
+		status.Services[1].Service != "aux" || status.Services[1].IdleCount != 2 {
+		t.Fatalf("services = %+v", status.Services)
+	}
+
+	pool, c, err := r.acquireConnection("device-a", "aux")
+	if err != nil || c != aux {
+		t.Fatalf("acquire aux = %v, %v", c, err)
+	}
+	r.releaseActiveConnection(pool, c)
+	if _, _, err := r.acquireConnection("device-a", "other"); !errors.Is(err, errDeviceOffline) {
+		t.Fatalf("acquire of an unknown service: err = %v", err)
+	}
+
+	if err := r.CloseDevice("device-a", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	status, _ = r.GetConnectionStatus("device-a")
+	if status.IdleCount != 0 || !status.Denied {
+		t.Fatalf("status after close = %+v", status)
+	}
+}
+
+func TestPoolLimitsDecideBusyOrOffline(t *testing.T) {
+	r := newTestRelay(t)
+	r.config.Pool = config.PoolConfig{MaxConnsPerDevice: 2, WaitTimeoutMs: 50, ReconnectWindowMs: 100}
+	const officeKey = "office-key"
+	r.keyConnLimit[officeKey] = &SecretLimit{
+		limit:      100,
+		poolLimits: overridePoolLimits(globalPoolLimits(r.config.Pool), 3, 1, 0, 10000),
+	}
+
+	register := func(id, key string) (*DeviceConnPool, error) {
+		t.Helper()
+		conn, peer := net.Pipe()
+		t.Cleanup(func() { _ = conn.Close(); _ = peer.Close() })
+		c := &Connection{ID: id, Conn: conn, AuthkeyB64: key}
+		pool, err := r.registerConnectionPending(id, c)
+		if err != nil {
+			return nil, err
+		}
+		pool.activate(c)
+		return pool, nil
+	}
+
+	// The per-device connection cap follows the config and the key override.
+	for i := range 3 {
+		_, homeErr := register("home", "")
+		_, officeErr := register("office", officeKey)
+		if (homeErr != nil) != (i == 2) || officeErr != nil {
+			t.Fatalf("register #%d: home err = %v, office err = %v", i, homeErr, officeErr)
+		}
+	}
+	if _, err := register("office", officeKey); err == nil {
+		t.Fatal("office registered past its connection cap")
+	}
+
+	// Drain both pools: each relay takes one connection and ends at once.
+	for _, id := range []string{"home", "office"} {
+		for {
+			pool, c, err := r.acquireConnection(id, "")
+			if err != nil {
+				break
+			}
+			r.releaseActiveConnection(pool, c)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	// home's reconnect window (100ms) has elapsed: OFFLINE without waiting.
+	// office's (10s) has not: the request waits and then gets BUSY.
+	start := time.Now()
+	if _, _, err := r.acquireConnection("home", ""); !errors.Is(err, errDeviceOffline) {
+		t.Fatalf("home: err = %v, want offline", err)
+	}
+	if _, _, err := r.acquireConnection("office", ""); !errors.Is(err, errDeviceBusy) {
+		t.Fatalf("office: err = %v, want busy", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("configured wait timeout ignored, took %v", elapsed)
+	}
+
+	// office allows a single waiter; a second request is BUSY at once.
+	r.connectionsMu.RLock()
+	office := r.connections[poolKey{id: "office"}]
+	r.connectionsMu.RUnlock()
+	office.mu.Lock()
+	_, _, err := office.enqueueWaiterLocked()
+	office.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start = time.Now()
+	if _, _, err := r.acquireConnection("office", ""); !errors.Is(err, errDeviceBusy) || time.Since(start) > 25*time.Millisecond {
+		t.Fatalf("office with a waiter: err = %v after %v", err, time.Since(start))
+	}
+}
+
+// waitInQueue starts n relay requests on pool one after another, each queued
+// before the next starts, and returns the connections they get in order.
+func waitInQueue(t *testing.T, r *Relay, pool *DeviceConnPool, n int) []chan *Connection {
+	t.Helper()
+	got := make([]chan *Connection, n)
+	for i := range got {
+		got[i] = make(chan *Connection, 1)
+		go func() {
+			c, _ := r.waitForConnection(pool)
+			got[i] <- c
+		}()
+		for deadline := time.Now().Add(time.Second); ; {
+			pool.mu.Lock()
+			queued := len(pool.waiters)
+			pool.mu.Unlock()
+			if queued == i+1 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("waiter %d not queued", i)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	return got
+}
+
+func TestWaitQueueIsFIFO(t *testing.T) {
+	r := newTestRelay(t)
+	pool := newDeviceConnPool()
+	pool.activeCount.Store(1)
+	got := waitInQueue(t, r, pool, 3)
+
+	status := DevicePoolStatus{}
+	status.addService(pool)
+	if status.WaiterCount != 3 || status.LongestWait <= 0 {
+		t.Fatalf("status = %+v", status)
+	}
+
+	for i := range got {
+		c := &Connection{ID: fmt.Sprintf("conn-%d", i)}
+		pool.pendingCount.Add(1)
+		pool.activate(c)
+		select {
+		case conn := <-got[i]:
+			if conn != c {
+				t.Fatalf("waiter %d got %v, want %v", i, conn.ID, c.ID)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("waiter %d got nothing", i)
+		}
+	}
+	if len(pool.conns) != 0 || pool.activeCount.Load() != 4 {
+		t.Fatalf("idle = %d, active = %d", len(pool.conns), pool.activeCount.Load())
+	}
+}
+
+func TestWaiterLeavesQueueOnTimeout(t *testing.T) {
+	r := newTestRelay(t)
+	pool := newDeviceConnPool()
+	pool.limits.waitTimeout = 50 * time.Millisecond
+	pool.activeCount.Store(1)
+	got := waitInQueue(t, r, pool, 1)
+
+	select {
+	case conn := <-got[0]:
+		if conn != nil {
+			t.Fatalf("waiter got %v", conn.ID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiter did not time out")
+	}
+	pool.mu.Lock()
+	queued := len(pool.waiters)
+	pool.mu.Unlock()
+	if queued != 0 {
+		t.Fatalf("%d waiters left in queue", queued)
+	}
+
+	// A connection arriving after the timeout stays idle in the pool.
+	pool.pendingCount.Add(1)
+	pool.activate(&Connection{ID: "late"})
+	if len(pool.conns) != 1 || pool.activeCount.Load() != 1 {
+		t.Fatalf("idle = %d, active = %d", len(pool.conns), pool.activeCount.Load())
+	}
+}
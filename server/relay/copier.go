@@ -0,0 +1,128 @@
+package relay
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// copyBufSize is the size of the pooled buffers of the user-space path.
+	copyBufSize = 32 * 1024
+	// spliceChunk bounds one splice call, so that the byte counters advance
+	// at least every spliceChunk bytes while the kernel does the copying.
+	spliceChunk = 256 * 1024
+)
+
+var errInvalidWrite = errors.New("invalid write result")
+
+var copyBufPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, copyBufSize)
+		return &buf
+	},
+}
+
+// copier copies one direction of a relay bridge. Between two TCP
+// connections it splices what arrived, at most spliceChunk at once; otherwise it copies
+// through a buffer from copyBufPool. A copier may be reused once copy
+// has returned.
+type copier struct {
+	// counters receive the bytes written to dst while the copy is running.
+	counters []*atomic.Int64
+	// throttle is waited on after every chunk; its limits are read again
+	// for each chunk, so changes apply to a copy in progress.
+	throttle throttle
+	// charge, if set, is called with the bytes written after every chunk,
+	// e.g. to charge them to a traffic quota. An error ends the copy.
+	charge func(n int64) error
+}
+
+// copy copies src to dst until EOF or an error and returns the bytes
+// written. A clean EOF is not an error.
+func (c *copier) copy(dst io.Writer, src net.Conn) (int64, error) {
+	if spliceSupported {
+		if dstTCP, ok := dst.(*net.TCPConn); ok {
+			if srcTCP, ok := src.(*net.TCPConn); ok {
+				return c.splice(dstTCP, srcTCP)
+			}
+		}
+	}
+	return c.buffered(dst, src)
+}
+
+// add counts n bytes written to dst and charges them.
+func (c *copier) add(n int64) error {
+	for _, counter := range c.counters {
+		counter.Add(n)
+	}
+	if c.charge == nil || n <= 0 {
+		return nil
+	}
+	return c.charge(n)
+}
+
+// splice relies on TCPConn.ReadFrom, which splices from an
+// *io.LimitedReader wrapping a TCPConn. ReadFrom only returns once the limit
+// is reached, so each chunk is cut to the bytes already queued on src: the
+// counters then advance with every burst, however small. A short chunk
+// without error is EOF.
+func (c *copier) splice(dst, src *net.TCPConn) (int64, error) {
+	var written int64
+	lr := io.LimitedReader{R: src}
+	for {
+		avail, err := queued(src)
+		if err != nil || avail == 0 {
+			return written, err
+		}
+		chunk := min(throttleChunk(c.throttle.minRate(), spliceChunk), avail)
+		lr.N = chunk
+		n, err := dst.ReadFrom(&lr)
+		written += n
+		if errCharge := c.add(n); errCharge != nil {
+			return written, errCharge
+		}
+		if err != nil || n < chunk {
+			return written, err
+		}
+		c.throttle.wait(n)
+	}
+}
+
+func (c *copier) buffered(dst io.Writer, src net.Conn) (written int64, err error) {
+	bufp := copyBufPool.Get().(*[]byte)
+	defer copyBufPool.Put(bufp)
+	buf := *bufp
+	for {
+		chunk := throttleChunk(c.throttle.minRate(), int64(len(buf)))
+		nr, er := src.Read(buf[:chunk])
+		if nr > 0 {
+			nw, ew := dst.Write(buf[:nr])
+			if nw < 0 || nr < nw {
+				nw = 0
+				if ew == nil {
+					ew = errInvalidWrite
+				}
+			}
+			written += int64(nw)
+			if errCharge := c.add(int64(nw)); errCharge != nil && ew == nil {
+				ew = errCharge
+			}
+			if ew != nil {
+				return written, ew
+			}
+			if nr != nw {
+				return written, io.ErrShortWrite
+			}
+			c.throttle.wait(int64(nw))
+		}
+		if er != nil {
+			if er == io.EOF {
+				return written, nil
+			}
+			return written, er
+		}
+	}
+}
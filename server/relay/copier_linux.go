@@ -0,0 +1,49 @@
+package relay
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// spliceSupported reports whether net.TCPConn.ReadFrom splices between two
+// TCP connections; elsewhere it would copy through a fresh buffer.
+const spliceSupported = true
+
+// queued waits until src has data to read or is at EOF and returns the
+// bytes in its receive queue, 0 at EOF. Like Read, it fails once the read
+// deadline passes or src is closed.
+func queued(src *net.TCPConn) (int64, error) {
+	raw, err := src.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	var opErr error
+	err = raw.Read(func(fd uintptr) bool {
+		for {
+			n, opErr = unix.IoctlGetInt(int(fd), unix.SIOCINQ)
+			if opErr != nil || n > 0 {
+				return true
+			}
+			// Nothing queued: either no data yet or EOF, which peeking tells.
+			var b [1]byte
+			n, _, opErr = unix.Recvfrom(int(fd), b[:], unix.MSG_PEEK|unix.MSG_DONTWAIT)
+			switch opErr {
+			case unix.EINTR:
+				continue
+			case unix.EAGAIN:
+				return false
+			}
+			if opErr != nil || n == 0 {
+				n = 0
+				return true
+			}
+			// Data arrived since the ioctl; count it again.
+		}
+	})
+	if err == nil {
+		err = opErr
+	}
+	return int64(n), err
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package relay
+
+import (
+	"errors"
+	"net"
+)
+
+// spliceSupported reports whether net.TCPConn.ReadFrom splices between two
+// TCP connections; elsewhere it would copy through a fresh buffer.
+const spliceSupported = false
+
+func queued(*net.TCPConn) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,166 @@
+package relay
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// bridgePair returns the two ends a copier connects and the peers that feed
+// and drain them.
+func bridgePair(tb testing.TB, tcp bool) (src, dst, feed, drain net.Conn) {
+	tb.Helper()
+	if tcp {
+		feed, src = tcpPair(tb)
+		dst, drain = tcpPair(tb)
+		return src, dst, feed, drain
+	}
+	feed, src = net.Pipe()
+	dst, drain = net.Pipe()
+	tb.Cleanup(func() {
+		for _, c := range []net.Conn{feed, src, dst, drain} {
+			_ = c.Close()
+		}
+	})
+	return src, dst, feed, drain
+}
+
+// closeWrite signals EOF to the other end of c.
+func closeWrite(c net.Conn) {
+	if tc, ok := c.(*net.TCPConn); ok {
+		_ = tc.CloseWrite()
+		return
+	}
+	_ = c.Close()
+}
+
+func TestCopierCounts(t *testing.T) {
+	payload := bytes.Repeat([]byte("windsend"), spliceChunk/4+123)
+	for _, tcp := range []bool{false, true} {
+		name := "pipe"
+		if tcp {
+			name = "tcp"
+		}
+		t.Run(name, func(t *testing.T) {
+			src, dst, feed, drain := bridgePair(t, tcp)
+			go func() {
+				_, _ = feed.Write(payload)
+				closeWrite(feed)
+			}()
+			received := make(chan []byte, 1)
+			go func() {
+				data, _ := io.ReadAll(drain)
+				received <- data
+			}()
+
+			var a, b atomic.Int64
+			c := copier{counters: []*atomic.Int64{&a, &b}}
+			n, err := c.copy(dst, src)
+			closeWrite(dst)
+			if err != nil || n != int64(len(payload)) {
+				t.Fatalf("copy = %d, %v; want %d", n, err, len(payload))
+			}
+			if a.Load() != n || b.Load() != n {
+				t.Fatalf("counters = %d, %d; want %d", a.Load(), b.Load(), n)
+			}
+			if data := <-received; !bytes.Equal(data, payload) {
+				t.Fatalf("received %d bytes, want %d", len(data), len(payload))
+			}
+		})
+	}
+}
+
+// TestCopierCountsLive checks that a small write is counted as soon as it
+// is through, not when the copy ends.
+func TestCopierCountsLive(t *testing.T) {
+	for _, tcp := range []bool{false, true} {
+		name := "pipe"
+		if tcp {
+			name = "tcp"
+		}
+		t.Run(name, func(t *testing.T) {
+			src, dst, feed, drain := bridgePair(t, tcp)
+			var counter atomic.Int64
+			c := copier{counters: []*atomic.Int64{&counter}}
+			done := make(chan error, 1)
+			go func() {
+				_, err := c.copy(dst, src)
+				done <- err
+			}()
+
+			msg := []byte("clipboard")
+			for i := range 3 {
+				go func() { _, _ = feed.Write(msg) }()
+				if _, err := io.ReadFull(drain, make([]byte, len(msg))); err != nil {
+					t.Fatal(err)
+				}
+				want := int64((i + 1) * len(msg))
+				deadline := time.Now().Add(time.Second)
+				for counter.Load() != want && time.Now().Before(deadline) {
+					time.Sleep(time.Millisecond)
+				}
+				if got := counter.Load(); got != want {
+					t.Fatalf("counter = %d after write %d, want %d", got, i+1, want)
+				}
+			}
+			closeWrite(feed)
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+const benchPayloadSize = 4 << 20
+
+// benchmarkBridge copies benchPayloadSize bytes through a fresh bridge per
+// iteration with copyFn.
+func benchmarkBridge(b *testing.B, tcp bool, copyFn func(dst io.Writer, src net.Conn) (int64, error)) {
+	payload := make([]byte, benchPayloadSize)
+	b.SetBytes(benchPayloadSize)
+	b.ReportAllocs()
+	for b.Loop() {
+		b.StopTimer()
+		src, dst, feed, drain := bridgePair(b, tcp)
+		done := make(chan struct{})
+		go func() {
+			_, _ = feed.Write(payload)
+			closeWrite(feed)
+		}()
+		go func() {
+			_, _ = io.Copy(io.Discard, drain)
+			close(done)
+		}()
+		b.StartTimer()
+
+		if n, err := copyFn(dst, src); err != nil || n != benchPayloadSize {
+			b.Fatalf("copy = %d, %v", n, err)
+		}
+		closeWrite(dst)
+		<-done
+	}
+}
+
+// BenchmarkBridge compares the copier with the plain io.Copy the bridge
+// used before.
+func BenchmarkBridge(b *testing.B) {
+	for _, tcp := range []bool{false, true} {
+		name := "pipe"
+		if tcp {
+			name = "tcp"
+		}
+		b.Run(name+"/io.Copy", func(b *testing.B) {
+			benchmarkBridge(b, tcp, func(dst io.Writer, src net.Conn) (int64, error) {
+				return io.Copy(dst, src)
+			})
+		})
+		b.Run(name+"/copier", func(b *testing.B) {
+			var counter atomic.Int64
+			c := copier{counters: []*atomic.Int64{&counter}}
+			benchmarkBridge(b, tcp, c.copy)
+		})
+	}
+}
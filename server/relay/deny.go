@@ -0,0 +1,106 @@
+package relay
+
+import (
+	"cmp"
+	"slices"
+	"time"
+
+	"github.com/doraemonkeys/WindSend-Relay/server/storage/acl/model"
+	"go.uber.org/zap"
+)
+
+// DenyEntry is a device ID denied by an admin. Entries are persisted, so a
+// restart does not lift them.
+type DenyEntry struct {
+	ID        string
+	CreatedAt time.Time
+	// ExpiresAt is when the entry lapses; zero means never.
+	ExpiresAt time.Time
+	Reason    string
+	CreatedBy string
+}
+
+func (e DenyEntry) active(now time.Time) bool {
+	return e.ExpiresAt.IsZero() || now.Before(e.ExpiresAt)
+}
+
+// loadDenyList restores the unexpired deny entries from storage.
+func (r *Relay) loadDenyList() {
+	entries, err := r.storage.ListDenyEntries()
+	if err != nil {
+		zap.L().Error("Failed to load deny list", zap.Error(err))
+		return
+	}
+	r.denyListMu.Lock()
+	defer r.denyListMu.Unlock()
+	for _, e := range entries {
+		r.denyList[e.ID] = DenyEntry{
+			ID:        e.ID,
+			CreatedAt: e.CreatedAt,
+			ExpiresAt: e.ExpiresAt,
+			Reason:    e.Reason,
+			CreatedBy: e.CreatedBy,
+		}
+	}
+	zap.L().Info("Loaded deny list", zap.Int("entries", len(entries)))
+}
+
+// isDenied reports whether id is denied by an admin.
+func (r *Relay) isDenied(id string) bool {
+	r.denyListMu.RLock()
+	defer r.denyListMu.RUnlock()
+	e, ok := r.denyList[id]
+	return ok && e.active(time.Now())
+}
+
+// addDenyEntry persists e and applies it.
+func (r *Relay) addDenyEntry(e DenyEntry) error {
+	err := r.storage.SaveDenyEntry(&model.DenyEntry{
+		ID:        e.ID,
+		CreatedAt: e.CreatedAt,
+		ExpiresAt: e.ExpiresAt,
+		Reason:    e.Reason,
+		CreatedBy: e.CreatedBy,
+	})
+	if err != nil {
+		return err
+	}
+	r.denyListMu.Lock()
+	r.denyList[e.ID] = e
+	r.denyListMu.Unlock()
+	return nil
+}
+
+// purgeDenyList drops the expired deny entries.
+func (r *Relay) purgeDenyList() {
+	now := time.Now()
+	r.denyListMu.Lock()
+	for id, e := range r.denyList {
+		if !e.active(now) {
+			delete(r.denyList, id)
+		}
+	}
+	r.denyListMu.Unlock()
+	if n, err := r.storage.PurgeExpiredDenyEntries(); err != nil {
+		zap.L().Error("Failed to purge expired deny entries", zap.Error(err))
+	} else if n > 0 {
+		zap.L().Debug("Purged expired deny entries", zap.Int64("count", n))
+	}
+}
+
+// GetDenyList returns the active deny entries, newest first.
+func (r *Relay) GetDenyList() []DenyEntry {
+	now := time.Now()
+	r.denyListMu.RLock()
+	entries := make([]DenyEntry, 0, len(r.denyList))
+	for _, e := range r.denyList {
+		if e.active(now) {
+			entries = append(entries, e)
+		}
+	}
+	r.denyListMu.RUnlock()
+	slices.SortFunc(entries, func(a, b DenyEntry) int {
+		return cmp.Or(b.CreatedAt.Compare(a.CreatedAt), cmp.Compare(a.ID, b.ID))
+	})
+	return entries
+}
@@ -0,0 +1,60 @@
+package relay
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/doraemonkeys/WindSend-Relay/server/storage"
+)
+
+func TestDenyListSurvivesRestart(t *testing.T) {
+	st := storage.NewStorage(filepath.Join(t.TempDir(), "relay.db"))
+	r := newTestRelay(t)
+	r.storage = st
+
+	if err := r.DenyDevice("abuser", 0, "spam", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.DenyDevice("short", time.Hour, "", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.DenyDevice("lapsed", time.Millisecond, "", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if r.isDenied("lapsed") || !r.isDenied("abuser") {
+		t.Fatal("deny entries not applied")
+	}
+
+	// A restarted relay loads the unexpired entries.
+	restarted := newTestRelay(t)
+	restarted.storage = st
+	restarted.loadDenyList()
+	entries := restarted.GetDenyList()
+	if len(entries) != 2 {
+		t.Fatalf("deny list after restart = %+v, want abuser and short", entries)
+	}
+	byID := map[string]DenyEntry{}
+	for _, e := range entries {
+		byID[e.ID] = e
+	}
+	if e := byID["abuser"]; !e.ExpiresAt.IsZero() || e.Reason != "spam" || e.CreatedBy != "admin" {
+		t.Fatalf("abuser entry = %+v", e)
+	}
+	if e := byID["short"]; e.ExpiresAt.IsZero() {
+		t.Fatalf("short entry = %+v, want an expiry", e)
+	}
+
+	if found, err := restarted.AllowDevice("abuser"); err != nil || !found {
+		t.Fatalf("AllowDevice = %v, %v", found, err)
+	}
+	if found, err := restarted.AllowDevice("unknown"); err != nil || found {
+		t.Fatalf("AllowDevice of an unknown ID = %v, %v", found, err)
+	}
+	restarted.purgeDenyList()
+	stored, err := st.ListDenyEntries()
+	if err != nil || len(stored) != 1 || stored[0].ID != "short" {
+		t.Fatalf("stored entries = %+v, %v; want short only", stored, err)
+	}
+}
@@ -0,0 +1,114 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tcpBridge runs r.relay over loopback TCP on both sides and returns the
+// requester and device peers and the result of relay.
+func tcpBridge(t *testing.T, r *Relay) (reqPeer, devPeer *net.TCPConn, relayDataLen *atomic.Int64, done <-chan error) {
+	t.Helper()
+	req, reqConn := tcpPair(t)
+	targetConn, dev := tcpPair(t)
+	pool := newDeviceConnPool()
+	target := &Connection{ID: "dev", Conn: targetConn}
+
+	relayDataLen = new(atomic.Int64)
+	result := make(chan error, 1)
+	go func() { result <- r.relay(pool, target, reqConn, relayDataLen) }()
+	return req.(*net.TCPConn), dev.(*net.TCPConn), relayDataLen, result
+}
+
+// readToEOF reads c until EOF, failing on any other end.
+func readToEOF(t *testing.T, c net.Conn) []byte {
+	t.Helper()
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatalf("read until EOF: %v", err)
+	}
+	return data
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	request := bytes.Repeat([]byte("req"), 100_000)
+	response := bytes.Repeat([]byte("resp"), 100_000)
+
+	t.Run("requester finishes first", func(t *testing.T) {
+		r := newTestRelay(t)
+		req, dev, relayDataLen, done := tcpBridge(t, r)
+
+		go func() {
+			_, _ = req.Write(request)
+			_ = req.CloseWrite()
+		}()
+		// The device sees the request EOF and only then streams its response.
+		if got := readToEOF(t, dev); !bytes.Equal(got, request) {
+			t.Fatalf("device got %d bytes, want %d", len(got), len(request))
+		}
+		go func() {
+			_, _ = dev.Write(response)
+			_ = dev.CloseWrite()
+		}()
+		if got := readToEOF(t, req); !bytes.Equal(got, response) {
+			t.Fatalf("requester got %d bytes, want %d", len(got), len(response))
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("relay = %v", err)
+		}
+		if n := relayDataLen.Load(); n != int64(len(request)+len(response)) {
+			t.Fatalf("relayed %d bytes, want %d", n, len(request)+len(response))
+		}
+	})
+
+	t.Run("device finishes first", func(t *testing.T) {
+		r := newTestRelay(t)
+		req, dev, relayDataLen, done := tcpBridge(t, r)
+
+		go func() {
+			_, _ = dev.Write(response)
+			_ = dev.CloseWrite()
+		}()
+		if got := readToEOF(t, req); !bytes.Equal(got, response) {
+			t.Fatalf("requester got %d bytes, want %d", len(got), len(response))
+		}
+		// The requester keeps sending after the response EOF.
+		go func() {
+			_, _ = req.Write(request)
+			_ = req.CloseWrite()
+		}()
+		if got := readToEOF(t, dev); !bytes.Equal(got, request) {
+			t.Fatalf("device got %d bytes, want %d", len(got), len(request))
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("relay = %v", err)
+		}
+		if n := relayDataLen.Load(); n != int64(len(request)+len(response)) {
+			t.Fatalf("relayed %d bytes, want %d", n, len(request)+len(response))
+		}
+	})
+
+	t.Run("half-closed side idles out", func(t *testing.T) {
+		r := newTestRelay(t)
+		r.config.Session.IdleTimeoutSeconds = 1
+		req, dev, _, done := tcpBridge(t, r)
+
+		_ = req.CloseWrite()
+		readToEOF(t, dev)
+		// The device never finishes; the idle timeout ends the drain.
+		select {
+		case err := <-done:
+			if !errors.Is(err, errSessionIdle) {
+				t.Fatalf("relay = %v, want errSessionIdle", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("half-closed bridge not torn down")
+		}
+	})
+}
@@ -0,0 +1,129 @@
+package relay
+
+import (
+	"cmp"
+	"net/netip"
+	"slices"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ipBan tracks the auth failures of one IP and its current ban.
+type ipBan struct {
+	// failures are the times of the failures within the ban window.
+	failures []time.Time
+	// strikes is the number of bans so far; each doubles the next one.
+	strikes     int
+	bannedUntil time.Time
+}
+
+// banDuration is the length of the ban after strikes bans.
+func (r *Relay) banDuration(strikes int) time.Duration {
+	ban := time.Duration(r.config.Ban.BanSeconds) * time.Second
+	maxBan := time.Duration(r.config.Ban.MaxBanSeconds) * time.Second
+	for range strikes - 1 {
+		if ban >= maxBan/2 {
+			return maxBan
+		}
+		ban *= 2
+	}
+	return min(ban, maxBan)
+}
+
+// ipBanned reports whether addr is banned for failing to authenticate.
+func (r *Relay) ipBanned(addr netip.Addr) bool {
+	r.ipBansMu.Lock()
+	defer r.ipBansMu.Unlock()
+	b, ok := r.ipBans[addr]
+	return ok && time.Now().Before(b.bannedUntil)
+}
+
+// recordAuthFailure counts a failed handshake of addr and bans it once it
+// failed MaxFailures times within the window.
+func (r *Relay) recordAuthFailure(addr netip.Addr) {
+	if r.config.Ban.MaxFailures <= 0 || !addr.IsValid() {
+		return
+	}
+	now := time.Now()
+	window := time.Duration(r.config.Ban.WindowSeconds) * time.Second
+	r.ipBansMu.Lock()
+	defer r.ipBansMu.Unlock()
+	b, ok := r.ipBans[addr]
+	if !ok {
+		b = &ipBan{}
+		r.ipBans[addr] = b
+	}
+	b.failures = append(slices.DeleteFunc(b.failures, func(t time.Time) bool {
+		return now.Sub(t) >= window
+	}), now)
+	if len(b.failures) < r.config.Ban.MaxFailures {
+		return
+	}
+	b.failures = nil
+	b.strikes++
+	ban := r.banDuration(b.strikes)
+	b.bannedUntil = now.Add(ban)
+	zap.L().Warn("IP banned after repeated auth failures", zap.Stringer("ip", addr),
+		zap.Int("strikes", b.strikes), zap.Duration("ban", ban))
+}
+
+// purgeIPBans forgets the IPs that are not banned and whose strikes have
+// aged out: they failed no handshake for the longest ban.
+func (r *Relay) purgeIPBans() {
+	now := time.Now()
+	forget := time.Duration(max(r.config.Ban.MaxBanSeconds, r.config.Ban.WindowSeconds)) * time.Second
+	r.ipBansMu.Lock()
+	defer r.ipBansMu.Unlock()
+	for addr, b := range r.ipBans {
+		last := b.bannedUntil
+		if n := len(b.failures); n > 0 && b.failures[n-1].After(last) {
+			last = b.failures[n-1]
+		}
+		if now.Sub(last) >= forget {
+			delete(r.ipBans, addr)
+		}
+	}
+}
+
+// IPBanStatus is an IP banned for failing to authenticate.
+type IPBanStatus struct {
+	IP          string
+	Strikes     int
+	BannedUntil time.Time
+}
+
+// GetIPBans returns the IPs banned now, longest ban first.
+func (r *Relay) GetIPBans() []IPBanStatus {
+	now := time.Now()
+	r.ipBansMu.Lock()
+	bans := make([]IPBanStatus, 0)
+	for addr, b := range r.ipBans {
+		if now.Before(b.bannedUntil) {
+			bans = append(bans, IPBanStatus{IP: addr.String(), Strikes: b.strikes, BannedUntil: b.bannedUntil})
+		}
+	}
+	r.ipBansMu.Unlock()
+	slices.SortFunc(bans, func(a, b IPBanStatus) int {
+		return cmp.Or(b.BannedUntil.Compare(a.BannedUntil), cmp.Compare(a.IP, b.IP))
+	})
+	return bans
+}
+
+// LiftIPBan lifts the ban of ip and forgets its failures and strikes. It
+// returns false if ip is not banned.
+func (r *Relay) LiftIPBan(ip string) (bool, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false, err
+	}
+	addr = addr.Unmap()
+	r.ipBansMu.Lock()
+	defer r.ipBansMu.Unlock()
+	b, ok := r.ipBans[addr]
+	if !ok || !time.Now().Before(b.bannedUntil) {
+		return false, nil
+	}
+	delete(r.ipBans, addr)
+	return true, nil
+}
@@ -0,0 +1,103 @@
+package relay
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/doraemonkeys/WindSend-Relay/server/config"
+)
+
+func TestBanDurationBacksOff(t *testing.T) {
+	r := newTestRelay(t)
+	r.config.Ban = config.BanConfig{BanSeconds: 60, MaxBanSeconds: 300}
+	want := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute}
+	for i, w := range want {
+		if got := r.banDuration(i + 1); got != w {
+			t.Errorf("banDuration(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+	if got := r.banDuration(1000); got != 5*time.Minute {
+		t.Errorf("banDuration(1000) = %v, want the maximum", got)
+	}
+}
+
+func TestAuthFailuresBanIP(t *testing.T) {
+	r := newTestRelay(t)
+	r.config.Ban = config.BanConfig{MaxFailures: 3, WindowSeconds: 60, BanSeconds: 60, MaxBanSeconds: 3600}
+	ip := netip.MustParseAddr("198.51.100.7")
+
+	r.recordAuthFailure(ip)
+	r.recordAuthFailure(ip)
+	// A failure that left the window no longer counts.
+	r.ipBans[ip].failures[0] = time.Now().Add(-2 * time.Minute)
+	r.recordAuthFailure(ip)
+	if r.ipBanned(ip) {
+		t.Fatal("banned with a failure outside the window")
+	}
+	r.recordAuthFailure(ip)
+	if !r.ipBanned(ip) {
+		t.Fatal("not banned after 3 failures within the window")
+	}
+	if r.ipBanned(netip.MustParseAddr("198.51.100.8")) {
+		t.Fatal("another IP is banned")
+	}
+
+	bans := r.GetIPBans()
+	if len(bans) != 1 || bans[0].IP != ip.String() || bans[0].Strikes != 1 {
+		t.Fatalf("bans = %+v", bans)
+	}
+	if left := time.Until(bans[0].BannedUntil); left <= 0 || left > time.Minute {
+		t.Fatalf("ban lasts %v, want 1 minute", left)
+	}
+
+	// The second ban of the same IP is twice as long.
+	r.ipBans[ip].bannedUntil = time.Now().Add(-time.Second)
+	for range 3 {
+		r.recordAuthFailure(ip)
+	}
+	if bans := r.GetIPBans(); len(bans) != 1 || bans[0].Strikes != 2 || time.Until(bans[0].BannedUntil) <= time.Minute {
+		t.Fatalf("second ban = %+v, want 2 minutes", bans)
+	}
+
+	if lifted, err := r.LiftIPBan("::ffff:198.51.100.7"); err != nil || !lifted {
+		t.Fatalf("LiftIPBan = %v, %v", lifted, err)
+	}
+	if r.ipBanned(ip) || len(r.GetIPBans()) != 0 {
+		t.Fatal("ban not lifted")
+	}
+	if lifted, err := r.LiftIPBan(ip.String()); err != nil || lifted {
+		t.Fatalf("LiftIPBan of an IP not banned = %v, %v", lifted, err)
+	}
+	if _, err := r.LiftIPBan("not-an-ip"); err == nil {
+		t.Fatal("LiftIPBan accepted an invalid IP")
+	}
+}
+
+func TestAuthFailuresIgnoredWhenBansDisabled(t *testing.T) {
+	r := newTestRelay(t)
+	ip := netip.MustParseAddr("198.51.100.7")
+	for range 10 {
+		r.recordAuthFailure(ip)
+	}
+	if r.ipBanned(ip) || len(r.ipBans) != 0 {
+		t.Fatal("failures tracked with bans disabled")
+	}
+}
+
+func TestPurgeIPBansForgetsOldStrikes(t *testing.T) {
+	r := newTestRelay(t)
+	r.config.Ban = config.BanConfig{MaxFailures: 1, WindowSeconds: 60, BanSeconds: 60, MaxBanSeconds: 600}
+	old, recent := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+	r.recordAuthFailure(old)
+	r.recordAuthFailure(recent)
+	r.ipBans[old].bannedUntil = time.Now().Add(-11 * time.Minute)
+
+	r.purgeIPBans()
+	if _, ok := r.ipBans[old]; ok {
+		t.Fatal("strikes of an IP quiet for the longest ban were kept")
+	}
+	if !r.ipBanned(recent) {
+		t.Fatal("a current ban was purged")
+	}
+}
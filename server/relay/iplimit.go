@@ -0,0 +1,106 @@
+package relay
+
+import (
+	"cmp"
+	"net/netip"
+	"slices"
+
+	"github.com/doraemonkeys/WindSend-Relay/server/config"
+)
+
+// ipUsage is what one source IP holds at the moment.
+type ipUsage struct {
+	conns   int
+	bridges int
+}
+
+// ipLimitOverride sets the limits of the IPs in prefix, as in
+// config.IPLimitOverride.
+type ipLimitOverride struct {
+	prefix     netip.Prefix
+	maxConns   int
+	maxBridges int
+}
+
+// newIPLimitOverrides parses overrides checked by config.validateIPLimitConfig,
+// most specific range first.
+func newIPLimitOverrides(overrides []config.IPLimitOverride) []ipLimitOverride {
+	out := make([]ipLimitOverride, 0, len(overrides))
+	for _, o := range overrides {
+		prefix, err := config.ParseCIDR(o.CIDR)
+		if err != nil {
+			continue
+		}
+		out = append(out, ipLimitOverride{prefix: prefix, maxConns: o.MaxConns, maxBridges: o.MaxBridges})
+	}
+	slices.SortStableFunc(out, func(a, b ipLimitOverride) int {
+		return cmp.Compare(b.prefix.Bits(), a.prefix.Bits())
+	})
+	return out
+}
+
+// ipLimitsFor returns the connection and bridge limits of addr, 0 meaning
+// unlimited.
+func (r *Relay) ipLimitsFor(addr netip.Addr) (maxConns, maxBridges int) {
+	maxConns, maxBridges = r.config.IPLimit.MaxConns, r.config.IPLimit.MaxBridges
+	for _, o := range r.ipLimitOverrides {
+		if !o.prefix.Contains(addr) {
+			continue
+		}
+		if o.maxConns != 0 {
+			maxConns = max(o.maxConns, 0)
+		}
+		if o.maxBridges != 0 {
+			maxBridges = max(o.maxBridges, 0)
+		}
+		break
+	}
+	return maxConns, maxBridges
+}
+
+// reserveIP takes a registered connection (bridge false) or a bridge of
+// addr, reporting false if addr already holds its limit. An invalid addr
+// is not limited.
+func (r *Relay) reserveIP(addr netip.Addr, bridge bool) bool {
+	if !addr.IsValid() {
+		return true
+	}
+	maxConns, maxBridges := r.ipLimitsFor(addr)
+	r.ipUsageMu.Lock()
+	defer r.ipUsageMu.Unlock()
+	u, ok := r.ipUsage[addr]
+	if !ok {
+		u = &ipUsage{}
+	}
+	count, limit := &u.conns, maxConns
+	if bridge {
+		count, limit = &u.bridges, maxBridges
+	}
+	if limit > 0 && *count >= limit {
+		return false
+	}
+	*count++
+	r.ipUsage[addr] = u
+	return true
+}
+
+// releaseIP gives back what reserveIP took.
+func (r *Relay) releaseIP(addr netip.Addr, bridge bool) {
+	if !addr.IsValid() {
+		return
+	}
+	r.ipUsageMu.Lock()
+	defer r.ipUsageMu.Unlock()
+	u, ok := r.ipUsage[addr]
+	if !ok {
+		return
+	}
+	if bridge {
+		u.bridges = max(u.bridges-1, 0)
+	} else {
+		u.conns = max(u.conns-1, 0)
+	}
+	if u.conns == 0 && u.bridges == 0 {
+		delete(r.ipUsage, addr)
+	}
+}
@@ -0,0 +1,100 @@
+package relay
+
+import (
+	"net/netip"
+	"path/filepath"
+	"testing"
+
+	"github.com/doraemonkeys/WindSend-Relay/server/config"
+	"github.com/doraemonkeys/WindSend-Relay/server/protocol"
+	"github.com/doraemonkeys/WindSend-Relay/server/storage"
+)
+
+func TestIPLimitOverrides(t *testing.T) {
+	r := newTestRelay(t)
+	r.config.IPLimit = config.IPLimitConfig{MaxConns: 2, MaxBridges: 1}
+	r.ipLimitOverrides = newIPLimitOverrides([]config.IPLimitOverride{
+		{CIDR: "10.0.0.0/8", MaxConns: 10},
+		{CIDR: "10.1.0.0/16", MaxConns: -1, MaxBridges: 3},
+	})
+	tests := []struct {
+		addr                 string
+		maxConns, maxBridges int
+	}{
+		{"192.0.2.1", 2, 1},
+		{"10.2.0.1", 10, 1}, // 0 keeps the global bridge limit
+		{"10.1.0.1", 0, 3},  // the most specific range wins; negative is unlimited
+	}
+	for _, tt := range tests {
+		maxConns, maxBridges := r.ipLimitsFor(netip.MustParseAddr(tt.addr))
+		if maxConns != tt.maxConns || maxBridges != tt.maxBridges {
+			t.Errorf("ipLimitsFor(%s) = %d, %d; want %d, %d", tt.addr, maxConns, maxBridges, tt.maxConns, tt.maxBridges)
+		}
+	}
+
+	ip := netip.MustParseAddr("192.0.2.1")
+	if !r.reserveIP(ip, false) || !r.reserveIP(ip, false) || r.reserveIP(ip, false) {
+		t.Fatal("connection limit of 2 not enforced")
+	}
+	if !r.reserveIP(ip, true) || r.reserveIP(ip, true) {
+		t.Fatal("bridge limit of 1 not enforced apart from connections")
+	}
+	r.releaseIP(ip, false)
+	if !r.reserveIP(ip, false) {
+		t.Fatal("a released connection was not given back")
+	}
+	r.releaseIP(ip, false)
+	r.releaseIP(ip, false)
+	r.releaseIP(ip, true)
+	if len(r.ipUsage) != 0 {
+		t.Fatalf("usage of an IP holding nothing was kept: %+v", r.ipUsage[ip])
+	}
+	if !r.reserveIP(netip.Addr{}, true) {
+		t.Fatal("a non-IP connection was limited")
+	}
+}
+
+func TestHandleConnectRollsBackIPLimit(t *testing.T) {
+	r := newTestRelay(t)
+	r.storage = storage.NewStorage(filepath.Join(t.TempDir(), "relay.db"))
+	r.config.IPLimit.MaxConns = 1
+	cipher := newTestCipher(t)
+
+	connect := func(id string) protocol.RespHead {
+		t.Helper()
+		body := encryptBody(t, cipher, protocol.ConnectionReq{CommonReq: protocol.CommonReq{SecretKeyID: id}})
+		client, server := tcpPair(t)
+		go r.handleConnect(server, protocol.ReqHead{Action: protocol.ActionConnect, DataLen: len(body)}, cipher, nil)
+		if _, err := client.Write(body); err != nil {
+			t.Fatal(err)
+		}
+		var resp protocol.RespHead
+		readFrame(t, client, cipher, &resp)
+		return resp
+	}
+
+	if resp := connect("device-a"); resp.Code != protocol.StatusSuccess {
+		t.Fatalf("first connection failed: %+v", resp)
+	}
+	// Another device ID from the same address is refused.
+	if resp := connect("device-b"); resp.Code == protocol.StatusSuccess {
+		t.Fatal("second connection from the same IP accepted")
+	}
+	if n := r.globalConnCount.Load(); n != 1 {
+		t.Fatalf("global count = %d after the refusal, want 1", n)
+	}
+
+	// Releasing the registered connection frees the address.
+	pool, c, err := r.acquireConnection("device-a", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.releaseActiveConnection(pool, c)
+	r.tryCleanupPool("device-a", pool)
+	if len(r.ipUsage) != 0 || r.globalConnCount.Load() != 0 {
+		t.Fatalf("usage = %v, global = %d after release", r.ipUsage, r.globalConnCount.Load())
+	}
+	if resp := connect("device-b"); resp.Code != protocol.StatusSuccess {
+		t.Fatalf("connection after release failed: %+v", resp)
+	}
+}
@@ -1,16 +1,30 @@
 package relay
 
 import (
+	"math/rand/v2"
+	"slices"
 	"sync"
 	"time"
 
+	"github.com/doraemonkeys/WindSend-Relay/server/protocol"
 	"go.uber.org/zap"
 )
 
+// heartbeatCycle returns the length of the next scan: the configured
+// interval, randomly shifted by up to JitterPercent.
+func (r *Relay) heartbeatCycle() time.Duration {
+	interval := time.Duration(r.config.Heartbeat.IntervalSeconds) * time.Second
+	jitter := int64(interval) * int64(r.config.Heartbeat.JitterPercent) / 100
+	if jitter <= 0 {
+		return interval
+	}
+	return interval + time.Duration(rand.Int64N(2*jitter+1)-jitter)
+}
+
 func (r *Relay) detectConnectionAlive() {
-	const detectInterval = time.Second * 60
 	for {
-		time.Sleep(detectInterval)
+		cycle := r.heartbeatCycle()
+		start := time.Now()
 
 		// Snapshot all pool pointers + device IDs under the read lock.
 		r.connectionsMu.RLock()
@@ -19,23 +33,33 @@ func (r *Relay) detectConnectionAlive() {
 			pool *DeviceConnPool
 		}
 		entries := make([]poolEntry, 0, len(r.connections))
-		for id, pool := range r.connections {
-			entries = append(entries, poolEntry{id: id, pool: pool})
+		for key, pool := range r.connections {
+			entries = append(entries, poolEntry{id: key.id, pool: pool})
 		}
 		r.connectionsMu.RUnlock()
 
-		for _, entry := range entries {
+		// Spread the pools over the cycle instead of probing them all in one
+		// burst.
+		for i, entry := range entries {
+			time.Sleep(time.Until(start.Add(cycle * time.Duration(i+1) / time.Duration(len(entries)))))
 			r.probePool(entry.id, entry.pool)
+			r.rotateIdle(entry.id, entry.pool)
 		}
+		time.Sleep(time.Until(start.Add(cycle)))
 
 		// denyList TTL cleanup at the end of each scan cycle.
-		r.denyListMu.Lock()
-		for id, deniedAt := range r.denyList {
-			if time.Since(time.UnixMilli(deniedAt)) >= denyTTL {
-				delete(r.denyList, id)
+		r.purgeDenyList()
+		r.purgeIPBans()
+		r.purgeRateLimits()
+		r.flushQuotas()
+
+		if r.config.Mailbox.Enable {
+			if n, err := r.storage.PurgeExpiredMailboxBlobs(); err != nil {
+				zap.L().Error("Failed to purge expired mailbox blobs", zap.Error(err))
+			} else if n > 0 {
+				zap.L().Info("Purged expired mailbox blobs", zap.Int64("count", n))
 			}
 		}
-		r.denyListMu.Unlock()
 	}
 }
 
@@ -58,6 +82,7 @@ func (r *Relay) probePool(deviceID string, pool *DeviceConnPool) {
 	pool.probingCount.Add(int32(len(probing)))
 	epochSnapshot := pool.epoch.Load()
 	pool.mu.Unlock()
+	timeout := time.Duration(r.config.Heartbeat.TimeoutMs) * time.Millisecond
 
 	// Probe all connections concurrently to avoid serial 2-second timeouts
 	// compounding into O(N * timeout) worst-case latency.
@@ -71,7 +96,12 @@ func (r *Relay) probePool(deviceID string, pool *DeviceConnPool) {
 		wg.Add(1)
 		go func(idx int, conn *Connection) {
 			defer wg.Done()
-			results[idx] = probeResult{conn: conn, alive: conn.sendMsgDetectAlive()}
+			rtt, alive := conn.sendMsgDetectAlive(timeout)
+			if alive {
+				conn.LastHeartbeat = time.Now()
+				conn.LastRTT = rtt
+			}
+			results[idx] = probeResult{conn: conn, alive: alive}
 		}(i, c)
 	}
 	wg.Wait()
@@ -79,6 +109,7 @@ func (r *Relay) probePool(deviceID string, pool *DeviceConnPool) {
 	var alive, dead []*Connection
 	for _, res := range results {
 		if res.alive {
+			pool.recordRTT(res.conn.LastRTT)
 			alive = append(alive, res.conn)
 		} else {
 			dead = append(dead, res.conn)
@@ -89,8 +120,11 @@ func (r *Relay) probePool(deviceID string, pool *DeviceConnPool) {
 	pool.mu.Lock()
 	pool.probingCount.Add(-int32(len(probing)))
 	if pool.epoch.Load() == epochSnapshot {
-		// Epoch unchanged — safe to return alive connections.
-		pool.conns = append(pool.conns, alive...)
+		// Epoch unchanged — safe to return alive connections, serving
+		// waiters first.
+		for _, c := range alive {
+			pool.putIdleLocked(c)
+		}
 	} else {
 		// Epoch changed (admin close/:id during probing) — don't re-insert.
 		dead = append(dead, alive...)
@@ -98,14 +132,6 @@ func (r *Relay) probePool(deviceID string, pool *DeviceConnPool) {
 	}
 	pool.mu.Unlock()
 
-	// Notify waiter if we returned any alive connections.
-	if len(alive) > 0 {
-		select {
-		case pool.notifyCh <- struct{}{}:
-		default:
-		}
-	}
-
 	// Close dead connections (decrement global/per-secret counters).
 	for _, c := range dead {
 		r.releaseConnection(c)
@@ -116,3 +142,57 @@ func (r *Relay) probePool(deviceID string, pool *DeviceConnPool) {
 	// Trigger pool cleanup after probing (in case all connections died).
 	r.tryCleanupPool(deviceID, pool)
 }
+
+// rotateIdle gracefully closes the oldest idle connection of pool if it is
+// older than MaxIdleAgeSeconds, so that the device opens a fresh one. At most
+// one connection is retired per pool and scan, and only while another idle
+// connection remains, so the pool never drops to zero idle connections. A
+// lone old connection is marked instead and retired by activate once a fresh
+// one is idle.
+func (r *Relay) rotateIdle(deviceID string, pool *DeviceConnPool) {
+	maxAge := time.Duration(r.config.MaxIdleAgeSeconds) * time.Second
+	if maxAge <= 0 {
+		return
+	}
+
+	pool.mu.Lock()
+	if len(pool.conns) == 0 {
+		pool.mu.Unlock()
+		return
+	}
+	oldest := 0
+	for i, c := range pool.conns {
+		if c.ConnectTime.Before(pool.conns[oldest].ConnectTime) {
+			oldest = i
+		}
+	}
+	c := pool.conns[oldest]
+	if time.Since(c.ConnectTime) < maxAge {
+		pool.mu.Unlock()
+		return
+	}
+	if len(pool.conns) < 2 {
+		pool.retiring = c
+		pool.mu.Unlock()
+		return
+	}
+	// Borrow it out like a probe, so the pool counts stay consistent.
+	pool.conns = slices.Delete(pool.conns, oldest, oldest+1)
+	pool.probingCount.Add(1)
+	pool.mu.Unlock()
+
+	r.retireIdle(deviceID, pool, c)
+}
+
+// retireIdle closes c, borrowed out of pool like a probe, with ActionClose
+// so that the device reconnects a fresh one.
+func (r *Relay) retireIdle(deviceID string, pool *DeviceConnPool, c *Connection) {
+	_ = c.Conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	err := protocol.SendClose(c.Conn, c.Cipher)
+	r.releaseConnection(c)
+	pool.probingCount.Add(-1)
+	r.tryCleanupPool(deviceID, pool)
+	zap.L().Info("rotated idle connection", zap.String("id", deviceID),
+		zap.String("addr", c.Conn.RemoteAddr().String()),
+		zap.Duration("age", time.Since(c.ConnectTime)), zap.Error(err))
+}
@@ -0,0 +1,159 @@
+package relay
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/doraemonkeys/WindSend-Relay/server/protocol"
+)
+
+func TestRotateIdleRetiresOldestAndKeepsOne(t *testing.T) {
+	r := newTestRelay(t)
+	r.config.MaxIdleAgeSeconds = 60
+	cipher := newTestCipher(t)
+
+	pool := newDeviceConnPool()
+	now := time.Now()
+	peers := map[string]net.Conn{}
+	for _, c := range []struct {
+		id  string
+		age time.Duration
+	}{{"young", time.Minute / 2}, {"oldest", 3 * time.Minute}, {"old", 2 * time.Minute}} {
+		conn, peer := net.Pipe()
+		t.Cleanup(func() { _ = peer.Close() })
+		peers[c.id] = peer
+		pool.conns = append(pool.conns, &Connection{ID: c.id, Conn: conn, Cipher: cipher, ConnectTime: now.Add(-c.age)})
+		r.globalConnCount.Add(1)
+	}
+
+	closed := make(chan protocol.ReqHead, 1)
+	go func() {
+		var head protocol.ReqHead
+		readFrame(t, peers["oldest"], cipher, &head)
+		closed <- head
+	}()
+	r.rotateIdle("device", pool)
+	if head := <-closed; head.Action != protocol.ActionClose {
+		t.Fatalf("action = %q, want %q", head.Action, protocol.ActionClose)
+	}
+	if len(pool.conns) != 2 || pool.probingCount.Load() != 0 || r.globalConnCount.Load() != 2 {
+		t.Fatalf("idle = %d, probing = %d, global = %d", len(pool.conns), pool.probingCount.Load(), r.globalConnCount.Load())
+	}
+
+	// "old" is next, leaving only the young connection; then rotation stops.
+	go func() { _, _ = io.Copy(io.Discard, peers["old"]) }()
+	r.rotateIdle("device", pool)
+	r.rotateIdle("device", pool)
+	if len(pool.conns) != 1 || pool.conns[0].ID != "young" {
+		t.Fatalf("idle after rotations = %d", len(pool.conns))
+	}
+}
+
+func TestRotateIdleLastConnection(t *testing.T) {
+	r := newTestRelay(t)
+	r.config.MaxIdleAgeSeconds = 1
+	cipher := newTestCipher(t)
+	conn, peer := net.Pipe()
+	t.Cleanup(func() { _ = peer.Close() })
+	old := &Connection{ID: "device", Conn: conn, Cipher: cipher, ConnectTime: time.Now().Add(-time.Hour)}
+	pool := newDeviceConnPool()
+	pool.conns = []*Connection{old}
+	r.connections[poolKey{id: "device"}] = pool
+	r.globalConnCount.Add(1)
+
+	// The only idle connection is kept until a fresh one is active.
+	r.rotateIdle("device", pool)
+	if len(pool.conns) != 1 || pool.retiring != old {
+		t.Fatalf("idle = %d, retiring = %v; want the lone connection kept and marked", len(pool.conns), pool.retiring)
+	}
+	if presence, _ := r.devicePresence("device", ""); presence != protocol.PresenceIdle {
+		t.Fatalf("presence = %q, want idle", presence)
+	}
+
+	closed := make(chan protocol.ReqHead, 1)
+	go func() {
+		var head protocol.ReqHead
+		readFrame(t, peer, cipher, &head)
+		closed <- head
+	}()
+	fresh := &Connection{ID: "device", ConnectTime: time.Now()}
+	r.globalConnCount.Add(1)
+	pool.pendingCount.Add(1)
+	retired := pool.activate(fresh)
+	if retired != old {
+		t.Fatal("activate did not hand back the marked connection")
+	}
+	r.retireIdle("device", pool, retired)
+	if head := <-closed; head.Action != protocol.ActionClose {
+		t.Fatalf("action = %q, want %q", head.Action, protocol.ActionClose)
+	}
+	if len(pool.conns) != 1 || pool.conns[0] != fresh || pool.retiring != nil ||
+		pool.probingCount.Load() != 0 || r.globalConnCount.Load() != 1 {
+		t.Fatalf("idle = %d, probing = %d, global = %d after the rotation",
+			len(pool.conns), pool.probingCount.Load(), r.globalConnCount.Load())
+	}
+
+	// A marked connection taken by a relay is forgotten.
+	pool.retiring = fresh
+	if pool.tryAcquire() != fresh {
+		t.Fatal("expected the fresh connection")
+	}
+	pool.pendingCount.Add(1)
+	if retired := pool.activate(&Connection{ID: "device"}); retired != nil || pool.retiring != nil {
+		t.Fatalf("retired = %v, retiring = %v; want none", retired, pool.retiring)
+	}
+}
+
+func TestProbePoolRecordsRTT(t *testing.T) {
+	r := newTestRelay(t)
+	r.config.Heartbeat.TimeoutMs = 1000
+	cipher := newTestCipher(t)
+
+	conn, peer := net.Pipe()
+	t.Cleanup(func() { _ = peer.Close() })
+	c := &Connection{ID: "device", Conn: conn, Cipher: cipher}
+	pool := newDeviceConnPool()
+	pool.conns = append(pool.conns, c)
+	r.connections[poolKey{id: "device"}] = pool
+
+	go func() {
+		head, err := protocol.ReadReqHead(peer, cipher)
+		if err != nil {
+			return
+		}
+		if _, err := protocol.ReadReq[protocol.HeartbeatReq](peer, head.DataLen, cipher); err != nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+		_ = protocol.SendHeartbeatNoResp(peer, cipher)
+	}()
+	r.probePool("device", pool)
+
+	if len(pool.conns) != 1 {
+		t.Fatal("alive connection was not returned to the pool")
+	}
+	if c.LastRTT < 10*time.Millisecond || c.LastHeartbeat.IsZero() {
+		t.Fatalf("rtt = %v, last heartbeat = %v", c.LastRTT, c.LastHeartbeat)
+	}
+	status, _ := r.GetConnectionStatus("device")
+	if status.RTT != c.LastRTT || status.Services[0].RTT != c.LastRTT {
+		t.Fatalf("status rtt = %v, want %v", status.RTT, c.LastRTT)
+	}
+}
+
+func TestHeartbeatCycleJitter(t *testing.T) {
+	r := newTestRelay(t)
+	r.config.Heartbeat.IntervalSeconds = 10
+	r.config.Heartbeat.JitterPercent = 20
+	for range 100 {
+		if d := r.heartbeatCycle(); d < 8*time.Second || d > 12*time.Second {
+			t.Fatalf("cycle = %v out of 10s ± 20%%", d)
+		}
+	}
+	r.config.Heartbeat.JitterPercent = 0
+	if d := r.heartbeatCycle(); d != 10*time.Second {
+		t.Fatalf("cycle without jitter = %v", d)
+	}
+}
@@ -0,0 +1,198 @@
+package relay
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/doraemonkeys/WindSend-Relay/server/protocol"
+	"github.com/doraemonkeys/WindSend-Relay/server/storage"
+	"github.com/doraemonkeys/WindSend-Relay/server/storage/acl/model"
+	"github.com/doraemonkeys/WindSend-Relay/server/tool"
+	"github.com/doraemonkeys/doraemon/crypto"
+	"go.uber.org/zap"
+)
+
+const (
+	// mailboxReadTimeout bounds reading the blob of a mailbox put.
+	mailboxReadTimeout = 30 * time.Second
+	// mailboxAckTimeout bounds the wait for the device to acknowledge one
+	// delivered blob.
+	mailboxAckTimeout = 10 * time.Second
+)
+
+// mailboxLimits returns the blob size and TTL limits for authKeyB64.
+func (r *Relay) mailboxLimits(authKeyB64 string) (maxBlobSize int, maxTTLSeconds int) {
+	maxBlobSize = r.config.Mailbox.MaxBlobSize
+	maxTTLSeconds = r.config.Mailbox.MaxTTLSeconds
+	if sl := r.getSecretLimit(authKeyB64); sl != nil {
+		if sl.mailboxMaxBlobSize > 0 {
+			maxBlobSize = sl.mailboxMaxBlobSize
+		}
+		if sl.mailboxMaxTTLSeconds > 0 {
+			maxTTLSeconds = sl.mailboxMaxTTLSeconds
+		}
+	}
+	return maxBlobSize, maxTTLSeconds
+}
+
+// --- handleMailboxPut ---
+
+func (r *Relay) handleMailboxPut(conn net.Conn, head protocol.ReqHead, cipher crypto.SymmetricCipher, authKey tool.AES192Key) {
+	defer conn.Close()
+
+	l := zap.L().With(zap.String("Action", "MailboxPut"), zap.String("addr", conn.RemoteAddr().String()))
+	if !r.config.Mailbox.Enable {
+		l.Info("Mailbox disabled")
+		_ = protocol.SendRespHeadError(conn, head.Action, "mailbox disabled", cipher)
+		return
+	}
+
+	req, err := protocol.ReadReq[protocol.MailboxPutReq](conn, head.DataLen, cipher)
+	if err != nil {
+		l.Error("Failed to read mailbox put request", zap.Error(err))
+		return
+	}
+	deviceID := req.SecretKeyID
+	l = l.With(zap.String("id", deviceID))
+
+	if !r.allowID(deviceID, authKey) {
+		l.Error("ID rate limit exceeded")
+		_ = protocol.SendRespHeadError(conn, head.Action, "ID rate limit exceeded", cipher)
+		return
+	}
+
+	if r.isDenied(deviceID) {
+		l.Info("Device denied by admin")
+		_ = protocol.SendRespHeadError(conn, head.Action, "device denied by admin", cipher)
+		return
+	}
+
+	authKeyB64 := ""
+	if authKey != nil {
+		authKeyB64 = base64.StdEncoding.EncodeToString(authKey)
+	}
+	maxBlobSize, maxTTLSeconds := r.mailboxLimits(authKeyB64)
+	if req.DataLen <= 0 || req.DataLen > maxBlobSize {
+		l.Error("Invalid mailbox blob size", zap.Int("size", req.DataLen), zap.Int("max", maxBlobSize))
+		_ = protocol.SendRespHeadError(conn, head.Action, fmt.Sprintf("blob size must be 1..%d bytes", maxBlobSize), cipher)
+		return
+	}
+	ttlSeconds := req.TTLSeconds
+	if ttlSeconds <= 0 || ttlSeconds > maxTTLSeconds {
+		ttlSeconds = maxTTLSeconds
+	}
+
+	// Checked again when the blob is stored; this only spares reading the
+	// data of a put that cannot succeed.
+	count, err := r.storage.CountMailboxBlobs(deviceID)
+	if err != nil {
+		l.Error("Failed to count mailbox blobs", zap.Error(err))
+		_ = protocol.SendRespHeadError(conn, head.Action, "internal error", cipher)
+		return
+	}
+	if count >= int64(r.config.Mailbox.MaxBlobsPerDevice) {
+		l.Info("Mailbox full", zap.Int64("count", count))
+		_ = protocol.SendRespHeadError(conn, head.Action, "mailbox full", cipher)
+		return
+	}
+
+	data := make([]byte, req.DataLen)
+	_ = conn.SetReadDeadline(time.Now().Add(mailboxReadTimeout))
+	if _, err := io.ReadFull(conn, data); err != nil {
+		l.Error("Failed to read mailbox blob", zap.Error(err))
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	now := time.Now()
+	blob := &model.MailboxBlob{
+		CreatedAt:  now,
+		DeviceID:   deviceID,
+		KeyTag:     keyTag(authKeyB64),
+		SenderAddr: conn.RemoteAddr().String(),
+		Size:       len(data),
+		Data:       data,
+		ExpiresAt:  now.Add(time.Duration(ttlSeconds) * time.Second),
+	}
+	err = r.storage.AddMailboxBlob(blob, storage.MailboxLimits{
+		MaxBlobsPerDevice: r.config.Mailbox.MaxBlobsPerDevice,
+		MaxBytesPerKey:    r.config.Mailbox.MaxBytesPerKey,
+		MaxTotalBytes:     r.config.Mailbox.MaxTotalBytes,
+	})
+	if errors.Is(err, storage.ErrMailboxFull) || errors.Is(err, storage.ErrMailboxOverBudget) {
+		l.Info("Mailbox blob rejected", zap.Error(err))
+		_ = protocol.SendRespHeadError(conn, head.Action, err.Error(), cipher)
+		return
+	}
+	if err != nil {
+		l.Error("Failed to store mailbox blob", zap.Error(err))
+		_ = protocol.SendRespHeadError(conn, head.Action, "internal error", cipher)
+		return
+	}
+
+	err = protocol.SendRespHeadOk(conn, head.Action, cipher)
+	if err != nil {
+		l.Error("Failed to send OK", zap.Error(err))
+		return
+	}
+	l.Info("Mailbox blob stored", zap.Uint64("msgID", blob.ID), zap.Int("size", blob.Size))
+}
+
+// --- mailbox delivery ---
+
+// errMailboxBadAck is returned when the device answers a delivered blob with
+// anything but an ActionMailbox head.
+var errMailboxBadAck = errors.New("unexpected mailbox ack")
+
+// deliverMailbox sends the blobs held for c.ID on c, oldest first, and
+// deletes each one once the device acknowledges it. Blobs not acknowledged
+// stay in the mailbox for the next connection.
+//
+// It is called on a pending connection, after the connect OK and before
+// activation, so no relay can interleave with the delivery.
+func (r *Relay) deliverMailbox(c *Connection) error {
+	// Another connection of this device is already delivering; it will take
+	// the blobs, and anything left is picked up by the next connect.
+	if _, busy := r.mailboxDelivering.LoadOrStore(c.ID, struct{}{}); busy {
+		return nil
+	}
+	defer r.mailboxDelivering.Delete(c.ID)
+
+	blobs, err := r.storage.GetMailboxBlobs(c.ID, keyTag(c.AuthkeyB64))
+	if err != nil {
+		// The connection itself is fine; try again on the next connect.
+		zap.L().Error("Failed to load mailbox blobs", zap.Error(err), zap.String("id", c.ID))
+		return nil
+	}
+	if len(blobs) == 0 {
+		return nil
+	}
+	defer func() {
+		_ = c.Conn.SetDeadline(time.Time{})
+	}()
+
+	for _, blob := range blobs {
+		_ = c.Conn.SetDeadline(time.Now().Add(mailboxAckTimeout))
+		item := protocol.MailboxItem{MsgID: blob.ID, CreatedAt: blob.CreatedAt.UnixMilli()}
+		if err := protocol.SendMailboxItem(c.Conn, item, blob.Data, c.Cipher); err != nil {
+			return err
+		}
+		head, err := protocol.ReadReqHead(c.Conn, c.Cipher)
+		if err != nil {
+			return fmt.Errorf("read mailbox ack failed, err: %w", err)
+		}
+		if head.Action != protocol.ActionMailbox || head.DataLen != 0 {
+			return fmt.Errorf("%w: %s", errMailboxBadAck, head.Action)
+		}
+		if _, err := r.storage.DeleteMailboxBlob(blob.ID); err != nil {
+			zap.L().Error("Failed to delete delivered mailbox blob", zap.Error(err),
+				zap.String("id", c.ID), zap.Uint64("msgID", blob.ID))
+		}
+	}
+	zap.L().Info("Mailbox delivered", zap.String("id", c.ID), zap.Int("count", len(blobs)))
+	return nil
+}
@@ -0,0 +1,236 @@
+package relay
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/doraemonkeys/WindSend-Relay/server/config"
+	"github.com/doraemonkeys/WindSend-Relay/server/protocol"
+	"github.com/doraemonkeys/WindSend-Relay/server/storage"
+	"github.com/doraemonkeys/WindSend-Relay/server/storage/acl/model"
+	"github.com/doraemonkeys/WindSend-Relay/server/tool"
+	"github.com/doraemonkeys/doraemon/crypto"
+)
+
+func newTestMailboxRelay(t *testing.T) *Relay {
+	t.Helper()
+	r := newTestRelay(t)
+	r.storage = storage.NewStorage(filepath.Join(t.TempDir(), "relay.db"))
+	r.config.Mailbox = config.MailboxConfig{
+		Enable:            true,
+		MaxBlobSize:       16,
+		MaxTTLSeconds:     60,
+		MaxBlobsPerDevice: 2,
+		MaxBytesPerKey:    1 << 20,
+		MaxTotalBytes:     1 << 20,
+	}
+	return r
+}
+
+// writeFrame writes v as one length-prefixed, encrypted JSON frame.
+func writeFrame(t *testing.T, conn net.Conn, cipher crypto.SymmetricCipher, v any) {
+	t.Helper()
+	body, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = cipher.Encrypt(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lenBuf [4]byte
+	binary.LittleEndian.PutUint32(lenBuf[:], uint32(len(body)))
+	if _, err := conn.Write(append(lenBuf[:], body...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func encryptBody(t *testing.T, cipher crypto.SymmetricCipher, v any) []byte {
+	t.Helper()
+	body, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = cipher.Encrypt(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func mailboxPut(t *testing.T, r *Relay, cipher crypto.SymmetricCipher, authKey tool.AES192Key, id string, data []byte) protocol.RespHead {
+	t.Helper()
+	body := encryptBody(t, cipher, protocol.MailboxPutReq{
+		CommonReq: protocol.CommonReq{SecretKeyID: id},
+		DataLen:   len(data),
+	})
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.handleMailboxPut(server, protocol.ReqHead{Action: protocol.ActionMailboxPut, DataLen: len(body)}, cipher, authKey)
+	}()
+	if _, err := client.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	// A rejected put is answered before the data is read.
+	go func() { _, _ = client.Write(data) }()
+	var resp protocol.RespHead
+	readFrame(t, client, cipher, &resp)
+	<-done
+	return resp
+}
+
+func TestMailboxPutAndDeliver(t *testing.T) {
+	r := newTestMailboxRelay(t)
+	cipher := newTestCipher(t)
+	keyA := tool.HashToAES192Key([]byte("key-a"))
+
+	if resp := mailboxPut(t, r, cipher, nil, "laptop", []byte("no key")); resp.Code != protocol.StatusSuccess {
+		t.Fatalf("put without key failed: %+v", resp)
+	}
+	if resp := mailboxPut(t, r, cipher, keyA, "laptop", []byte("for key a")); resp.Code != protocol.StatusSuccess {
+		t.Fatalf("put with key failed: %+v", resp)
+	}
+	if resp := mailboxPut(t, r, cipher, keyA, "laptop", []byte("x")); resp.Code == protocol.StatusSuccess {
+		t.Fatal("put accepted into a full mailbox")
+	}
+	if resp := mailboxPut(t, r, cipher, keyA, "phone", make([]byte, 17)); resp.Code == protocol.StatusSuccess {
+		t.Fatal("oversized blob accepted")
+	}
+
+	blobs, total, err := r.storage.ListMailboxBlobs("laptop", 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 || len(blobs) != 2 || blobs[0].Data != nil {
+		t.Fatalf("list: total=%d blobs=%+v", total, blobs)
+	}
+
+	// The device connects with key A and only receives the blob sent with it.
+	body := encryptBody(t, cipher, protocol.ConnectionReq{
+		CommonReq:     protocol.CommonReq{SecretKeyID: "laptop"},
+		AcceptMailbox: true,
+	})
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.handleConnect(server, protocol.ReqHead{Action: protocol.ActionConnect, DataLen: len(body)}, cipher, keyA)
+	}()
+	if _, err := client.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	var resp protocol.RespHead
+	readFrame(t, client, cipher, &resp)
+	if resp.Code != protocol.StatusSuccess {
+		t.Fatalf("connect failed: %+v", resp)
+	}
+
+	var head protocol.ReqHead
+	readFrame(t, client, cipher, &head)
+	if head.Action != protocol.ActionMailbox {
+		t.Fatalf("action = %q, want %q", head.Action, protocol.ActionMailbox)
+	}
+	item, err := protocol.ReadReq[protocol.MailboxItem](client, head.DataLen, cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, item.DataLen)
+	if _, err := io.ReadFull(client, data); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "for key a" {
+		t.Fatalf("delivered %q", data)
+	}
+	writeFrame(t, client, cipher, protocol.ReqHead{Action: protocol.ActionMailbox})
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handleConnect did not finish after the last ack")
+	}
+	if status, ok := r.GetConnectionStatus("laptop"); !ok || status.IdleCount != 1 {
+		t.Fatalf("status = %+v, ok = %v", status, ok)
+	}
+	count, err := r.storage.CountMailboxBlobs("laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("blobs left = %d, want 1", count)
+	}
+}
+
+func TestMailboxConcurrentPutsRespectLimit(t *testing.T) {
+	r := newTestMailboxRelay(t)
+
+	const puts = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, puts)
+	for range puts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			now := time.Now()
+			errs <- r.storage.AddMailboxBlob(&model.MailboxBlob{
+				CreatedAt: now,
+				DeviceID:  "laptop",
+				Size:      1,
+				Data:      []byte("x"),
+				ExpiresAt: now.Add(time.Minute),
+			}, storage.MailboxLimits{MaxBlobsPerDevice: 2, MaxBytesPerKey: 1 << 20, MaxTotalBytes: 1 << 20})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	stored := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			stored++
+		case !errors.Is(err, storage.ErrMailboxFull):
+			t.Fatal(err)
+		}
+	}
+	count, err := r.storage.CountMailboxBlobs("laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != r.config.Mailbox.MaxBlobsPerDevice || count != int64(stored) {
+		t.Fatalf("stored %d, count %d, want %d", stored, count, r.config.Mailbox.MaxBlobsPerDevice)
+	}
+}
+
+func TestMailboxByteBudgets(t *testing.T) {
+	r := newTestMailboxRelay(t)
+	r.config.Mailbox.MaxBytesPerKey = 20
+	r.config.Mailbox.MaxTotalBytes = 30
+	cipher := newTestCipher(t)
+	keyA := tool.HashToAES192Key([]byte("key-a"))
+	keyB := tool.HashToAES192Key([]byte("key-b"))
+
+	// Rotating device IDs does not escape the budget of the key.
+	if resp := mailboxPut(t, r, cipher, keyA, "dev-1", make([]byte, 12)); resp.Code != protocol.StatusSuccess {
+		t.Fatalf("first put failed: %+v", resp)
+	}
+	if resp := mailboxPut(t, r, cipher, keyA, "dev-2", make([]byte, 12)); resp.Code == protocol.StatusSuccess {
+		t.Fatal("put accepted over the per-key budget")
+	}
+	if resp := mailboxPut(t, r, cipher, keyB, "dev-3", make([]byte, 12)); resp.Code != protocol.StatusSuccess {
+		t.Fatalf("put with another key failed: %+v", resp)
+	}
+	if resp := mailboxPut(t, r, cipher, nil, "dev-4", make([]byte, 12)); resp.Code == protocol.StatusSuccess {
+		t.Fatal("put accepted over the total budget")
+	}
+}
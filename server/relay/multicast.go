@@ -0,0 +1,327 @@
+package relay
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/doraemonkeys/WindSend-Relay/server/protocol"
+	"github.com/doraemonkeys/WindSend-Relay/server/tool"
+	"github.com/doraemonkeys/doraemon/crypto"
+	"go.uber.org/zap"
+)
+
+const (
+	// maxMulticastTargets caps the number of device IDs in one multicast.
+	maxMulticastTargets = 16
+	// multicastWriteTimeout bounds one write to a target, so that a stalled
+	// device is dropped instead of holding up the others.
+	multicastWriteTimeout = 10 * time.Second
+)
+
+var errMulticastNoTarget = errors.New("no multicast target left")
+
+// multicastTarget is one device of a multicast.
+type multicastTarget struct {
+	result protocol.MulticastResult
+	pool   *DeviceConnPool
+	conn   *Connection
+	// err is set once the target failed; it then receives no more data.
+	err error
+	// written is the live byte count of the target, shown in its session.
+	written atomic.Int64
+	session *relaySession
+	// charge charges the bytes written to the quota of the device's key.
+	charge func(n int64) error
+}
+
+// multicastWriter copies each write to every target that has not failed.
+// A failing target, or one whose key used up its quota, is dropped; Write
+// only fails once no target is left.
+type multicastWriter struct {
+	targets []*multicastTarget
+	// sent counts the bytes of the sender's stream.
+	sent atomic.Int64
+}
+
+func (w *multicastWriter) Write(p []byte) (int, error) {
+	alive := 0
+	for _, t := range w.targets {
+		if t.err != nil {
+			continue
+		}
+		_ = t.conn.Conn.SetWriteDeadline(time.Now().Add(multicastWriteTimeout))
+		n, err := t.conn.Conn.Write(p)
+		t.written.Add(int64(n))
+		if err == nil && t.charge != nil && n > 0 {
+			err = t.charge(int64(n))
+		}
+		if err != nil {
+			t.err = err
+			continue
+		}
+		alive++
+	}
+	if alive == 0 {
+		return 0, errMulticastNoTarget
+	}
+	w.sent.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// --- handleMulticast ---
+
+func (r *Relay) handleMulticast(conn net.Conn, head protocol.ReqHead, cipher crypto.SymmetricCipher, authKey tool.AES192Key) {
+	defer conn.Close()
+
+	now := time.Now()
+	l := zap.L().With(zap.String("Action", "Multicast"), zap.String("ReqAddr", conn.RemoteAddr().String()))
+	req, err := protocol.ReadReq[protocol.MulticastReq](conn, head.DataLen, cipher)
+	if err != nil {
+		l.Error("Failed to read multicast request", zap.Error(err))
+		return
+	}
+
+	ids := make([]string, 0, len(req.IDs))
+	seen := make(map[string]bool, len(req.IDs))
+	for _, id := range req.IDs {
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 || len(ids) > maxMulticastTargets {
+		l.Error("Invalid multicast ID count", zap.Int("count", len(ids)))
+		_ = protocol.SendRespHeadError(conn, head.Action, "invalid multicast ID count", cipher)
+		return
+	}
+	for _, id := range ids {
+		if !r.allowID(id, authKey) {
+			l.Error("ID rate limit exceeded", zap.String("id", id))
+			_ = protocol.SendRespHeadError(conn, head.Action, "ID rate limit exceeded", cipher)
+			return
+		}
+	}
+	l = l.With(zap.Strings("IDs", ids))
+	l.Info("Multicast request")
+
+	ip := remoteIP(conn)
+	if !r.reserveIP(ip, true) {
+		l.Info("Too many relays from this address")
+		_ = protocol.SendRespHeadError(conn, head.Action, "too many relays from this address", cipher)
+		return
+	}
+	defer r.releaseIP(ip, true)
+
+	authKeyB64 := ""
+	if authKey != nil {
+		authKeyB64 = base64.StdEncoding.EncodeToString(authKey)
+	}
+
+	// Acquire all targets concurrently, so that one busy device costs at
+	// most a single waitTimeout.
+	targets := make([]*multicastTarget, len(ids))
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		t := &multicastTarget{result: protocol.MulticastResult{ID: id}}
+		targets[i] = t
+		wg.Go(func() {
+			// Devices registered with another secret key look offline, as in ping.
+			if _, ok := r.devicePresence(id, authKeyB64); !ok {
+				t.err = errDeviceOffline
+			} else if r.overQuota(r.poolOwner(id, "")) {
+				t.err = errQuotaExceeded
+			} else {
+				t.pool, t.conn, t.err = r.acquireConnection(id, "")
+			}
+			switch {
+			case t.err == nil:
+				t.result.Code = protocol.StatusSuccess
+			case errors.Is(t.err, errDeviceDenied):
+				t.result.Code, t.result.Msg = protocol.StatusError, "device denied by admin"
+			case errors.Is(t.err, errDeviceOffline):
+				t.result.Code, t.result.Msg = protocol.StatusDeviceOffline, "device not online"
+			case errors.Is(t.err, errQuotaExceeded):
+				t.result.Code, t.result.Msg = protocol.StatusQuotaExceeded, "traffic quota exceeded"
+			default:
+				t.result.Code, t.result.Msg = protocol.StatusDeviceBusy, "device busy"
+			}
+		})
+	}
+	wg.Wait()
+
+	var copyErr error
+	defer func() {
+		ms := int(time.Since(now).Milliseconds())
+		for _, t := range targets {
+			if t.conn != nil {
+				r.releaseActiveConnection(t.pool, t.conn)
+				r.tryCleanupPool(t.result.ID, t.pool)
+			}
+			success := t.conn != nil && t.err == nil && copyErr == nil
+			offline := errors.Is(t.err, errDeviceOffline) && t.conn == nil
+			// Each target is classified by how its own session ended, or
+			// else by its own error.
+			outcomeErr := t.err
+			if t.session != nil {
+				if err := t.session.terminated(); err != nil {
+					outcomeErr = err
+				}
+			}
+			r.storage.AddRelayStatistic(t.result.ID, relayOutcome(success, offline, outcomeErr), ms, t.written.Load())
+		}
+	}()
+
+	// Send relay-start to every acquired device; see handleRelay for the
+	// write deadline.
+	var started []*multicastTarget
+	for _, t := range targets {
+		if t.conn == nil {
+			continue
+		}
+		_ = t.conn.Conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		err := protocol.SendRelayStart(t.conn.Conn, t.conn.Cipher)
+		_ = t.conn.Conn.SetWriteDeadline(time.Time{})
+		if err != nil {
+			l.Error("Failed to send relay start to target", zap.String("id", t.result.ID), zap.Error(err))
+			t.err = err
+			t.result.Code, t.result.Msg = protocol.StatusError, "relay start failed"
+			continue
+		}
+		started = append(started, t)
+	}
+
+	resp := protocol.MulticastResp{Results: make([]protocol.MulticastResult, len(targets))}
+	for i, t := range targets {
+		resp.Results[i] = t.result
+	}
+	if len(started) == 0 {
+		l.Info("No multicast target available")
+		copyErr = errMulticastNoTarget
+		_ = protocol.SendMulticastResp(conn, multicastFailCode(targets), "no target available", resp, cipher)
+		return
+	}
+	err = protocol.SendMulticastResp(conn, protocol.StatusSuccess, "Multicast start", resp, cipher)
+	if err != nil {
+		l.Error("Failed to reply to client multicast start", zap.Error(err))
+		copyErr = err
+		return
+	}
+
+	if tc, ok := conn.(*net.TCPConn); ok {
+		_ = tc.SetKeepAliveConfig(net.KeepAliveConfig{
+			Enable: true, Idle: 2 * time.Second, Interval: 1 * time.Second, Count: 3,
+		})
+	}
+
+	// Every target is a session of its own. They all share the sender's
+	// connection, so killing one of them ends the whole multicast. They
+	// are idle together when the sender is, so one watchdog serves them all.
+	w := &multicastWriter{targets: started}
+	for _, t := range started {
+		t.session = r.startSession(t.pool, t.conn, conn, &t.written)
+		t.session.activity = &w.sent
+	}
+	watchDone := make(chan struct{})
+	go r.watchSession(started[0].session, watchDone)
+
+	// The stream is held to the bandwidth limits of every target, and
+	// charged to the quota of each target's key.
+	var up throttle
+	for _, t := range started {
+		tu, _, release := r.bridgeThrottles(t.result.ID, t.pool.ownerKeyB64)
+		defer release()
+		up = up.merge(tu)
+		t.charge = r.quotaCharger(t.pool.ownerKeyB64)
+		defer r.flushQuota(t.pool.ownerKeyB64)
+	}
+
+	// The devices' replies are discarded: there is no meaningful way to
+	// merge them. They are still read, since closing a connection with
+	// unread data resets it and may lose the tail of the stream.
+	var drains sync.WaitGroup
+	for _, t := range started {
+		drains.Go(func() { _, _ = io.Copy(io.Discard, t.conn.Conn) })
+	}
+
+	// Copy the sender's stream to all started targets.
+	c := copier{throttle: up}
+	_, copyErr = c.copy(w, conn)
+
+	// A session torn down by the watchdog or an admin cut the sender's
+	// stream, so it ended the sessions of every target still receiving
+	// for the same reason.
+	var cut error
+	for _, t := range started {
+		if cut = t.session.terminated(); cut != nil {
+			break
+		}
+	}
+	if cut != nil {
+		for _, t := range started {
+			if t.err == nil {
+				t.session.terminate(cut)
+			}
+		}
+	}
+
+	// After the sender's EOF, pass the FIN on to every target still
+	// receiving and let it finish, for at most the drain timeout. The
+	// others are cut at once.
+	drainDeadline := time.Now().Add(time.Duration(r.config.Session.DrainTimeoutSeconds) * time.Second)
+	for _, t := range started {
+		deadline := time.Now().Add(-time.Second)
+		if copyErr == nil && t.err == nil && halfClose(t.conn.Conn) {
+			deadline = drainDeadline
+		}
+		_ = t.conn.Conn.SetReadDeadline(deadline)
+	}
+	drains.Wait()
+	close(watchDone)
+	for _, t := range started {
+		r.endSession(t.session)
+	}
+	if copyErr != nil {
+		l.Error("multicast data failed", zap.Error(copyErr))
+	}
+
+	for _, t := range started {
+		t.result.DataLen = t.written.Load()
+		switch {
+		case errors.Is(t.err, errQuotaExceeded):
+			t.result.Code, t.result.Msg = protocol.StatusQuotaExceeded, "traffic quota exceeded"
+		case t.err != nil:
+			t.result.Code, t.result.Msg = protocol.StatusError, "delivery failed"
+		case copyErr != nil:
+			t.result.Code, t.result.Msg = protocol.StatusError, "sender stream failed"
+		}
+	}
+	for i, t := range targets {
+		resp.Results[i] = t.result
+	}
+	// The sender may have closed without waiting for the final report.
+	_ = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_ = protocol.SendMulticastResp(conn, protocol.StatusSuccess, "Multicast done", resp, cipher)
+	l.Info("Multicast done", zap.Int("started", len(started)))
+}
+
+// multicastFailCode picks the response code when no target could be
+// started: offline only if every target was offline, busy if any was busy.
+func multicastFailCode(targets []*multicastTarget) protocol.StatusCode {
+	code := protocol.StatusDeviceOffline
+	for _, t := range targets {
+		switch t.result.Code {
+		case protocol.StatusDeviceBusy:
+			return protocol.StatusDeviceBusy
+		case protocol.StatusDeviceOffline:
+		default:
+			code = protocol.StatusError
+		}
+	}
+	return code
+}
@@ -0,0 +1,354 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/doraemonkeys/WindSend-Relay/server/protocol"
+	"github.com/doraemonkeys/WindSend-Relay/server/storage"
+	"github.com/doraemonkeys/doraemon/crypto"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t testing.TB) (client, server net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+	client, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = <-accepted
+	if server == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client, server
+}
+
+// addIdleDevice registers an idle connection for id and returns a channel
+// that yields everything the device receives after relay-start.
+func addIdleDevice(r *Relay, id string, cipher crypto.SymmetricCipher) <-chan string {
+	devClient, devServer := net.Pipe()
+	pool := newDeviceConnPool()
+	pool.conns = append(pool.conns, &Connection{ID: id, Conn: devServer, Cipher: cipher})
+	r.connections[poolKey{id: id}] = pool
+
+	received := make(chan string, 1)
+	go func() {
+		defer devClient.Close()
+		head, err := protocol.ReadReqHead(devClient, cipher)
+		if err != nil || head.Action != protocol.ActionRelay {
+			received <- "no relay start"
+			return
+		}
+		data, _ := io.ReadAll(devClient)
+		received <- string(data)
+	}()
+	return received
+}
+
+func readMulticastResp(t *testing.T, conn net.Conn, cipher crypto.SymmetricCipher) (protocol.RespHead, map[string]protocol.MulticastResult) {
+	t.Helper()
+	var head protocol.RespHead
+	readFrame(t, conn, cipher, &head)
+	resp, err := protocol.ReadReq[protocol.MulticastResp](conn, head.DataLen, cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := make(map[string]protocol.MulticastResult, len(resp.Results))
+	for _, res := range resp.Results {
+		results[res.ID] = res
+	}
+	return head, results
+}
+
+func TestMulticast(t *testing.T) {
+	r := newTestRelay(t)
+	r.storage = storage.NewStorage(filepath.Join(t.TempDir(), "relay.db"))
+	cipher := newTestCipher(t)
+
+	gotA := addIdleDevice(r, "a", cipher)
+	gotB := addIdleDevice(r, "b", cipher)
+
+	body := encryptBody(t, cipher, protocol.MulticastReq{IDs: []string{"a", "b", "c", "a"}})
+	client, server := tcpPair(t)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.handleMulticast(server, protocol.ReqHead{Action: protocol.ActionMulticast, DataLen: len(body)}, cipher, nil)
+	}()
+	if _, err := client.Write(body); err != nil {
+		t.Fatal(err)
+	}
+
+	head, results := readMulticastResp(t, client, cipher)
+	if head.Code != protocol.StatusSuccess {
+		t.Fatalf("multicast failed: %+v", head)
+	}
+	if len(results) != 3 || results["a"].Code != protocol.StatusSuccess ||
+		results["b"].Code != protocol.StatusSuccess || results["c"].Code != protocol.StatusDeviceOffline {
+		t.Fatalf("start results = %+v", results)
+	}
+
+	if _, err := client.Write([]byte("clipboard")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	head, results = readMulticastResp(t, client, cipher)
+	if head.Code != protocol.StatusSuccess {
+		t.Fatalf("final report: %+v", head)
+	}
+	for _, id := range []string{"a", "b"} {
+		if res := results[id]; res.Code != protocol.StatusSuccess || res.DataLen != int64(len("clipboard")) {
+			t.Fatalf("final result of %s = %+v", id, res)
+		}
+	}
+	for id, got := range map[string]<-chan string{"a": gotA, "b": gotB} {
+		select {
+		case data := <-got:
+			if data != "clipboard" {
+				t.Fatalf("device %s received %q", id, data)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("device %s received nothing", id)
+		}
+	}
+	<-done
+
+	stat, err := r.storage.GetHistoryStatisticByID("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.TotalRelayOfflineCount != 1 {
+		t.Fatalf("offline count of c = %d", stat.TotalRelayOfflineCount)
+	}
+}
+
+func TestMulticastNoTarget(t *testing.T) {
+	r := newTestRelay(t)
+	r.storage = storage.NewStorage(filepath.Join(t.TempDir(), "relay.db"))
+	cipher := newTestCipher(t)
+
+	body := encryptBody(t, cipher, protocol.MulticastReq{IDs: []string{"x", "y"}})
+	client, server := net.Pipe()
+	defer client.Close()
+	go r.handleMulticast(server, protocol.ReqHead{Action: protocol.ActionMulticast, DataLen: len(body)}, cipher, nil)
+	if _, err := client.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	head, results := readMulticastResp(t, client, cipher)
+	if head.Code != protocol.StatusDeviceOffline || len(results) != 2 {
+		t.Fatalf("head = %+v, results = %+v", head, results)
+	}
+}
+
+func TestMulticastSessions(t *testing.T) {
+	r := newTestRelay(t)
+	r.storage = storage.NewStorage(filepath.Join(t.TempDir(), "relay.db"))
+	cipher := newTestCipher(t)
+	addIdleDevice(r, "a", cipher)
+	addIdleDevice(r, "b", cipher)
+
+	body := encryptBody(t, cipher, protocol.MulticastReq{IDs: []string{"a", "b"}})
+	client, server := tcpPair(t)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.handleMulticast(server, protocol.ReqHead{Action: protocol.ActionMulticast, DataLen: len(body)}, cipher, nil)
+	}()
+	if _, err := client.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	if head, _ := readMulticastResp(t, client, cipher); head.Code != protocol.StatusSuccess {
+		t.Fatalf("multicast failed: %+v", head)
+	}
+	if _, err := client.Write([]byte("clip")); err != nil {
+		t.Fatal(err)
+	}
+
+	var sessions []SessionStatus
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		sessions = r.GetSessions()
+		if len(sessions) == 2 && sessions[0].Bytes == 4 && sessions[1].Bytes == 4 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(sessions) != 2 || sessions[0].DeviceID == sessions[1].DeviceID || sessions[0].Bytes != 4 || sessions[1].Bytes != 4 {
+		t.Fatalf("sessions = %+v, want one per target with 4 bytes", sessions)
+	}
+
+	if !r.KillSession(sessions[0].ID) {
+		t.Fatal("KillSession failed")
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("multicast still running after KillSession")
+	}
+	if sessions := r.GetSessions(); len(sessions) != 0 {
+		t.Fatalf("sessions = %+v after kill, want none", sessions)
+	}
+}
+
+func TestMulticastIdleTimeout(t *testing.T) {
+	r := newTestRelay(t)
+	r.storage = storage.NewStorage(filepath.Join(t.TempDir(), "relay.db"))
+	r.config.Session.IdleTimeoutSeconds = 1
+	cipher := newTestCipher(t)
+	addIdleDevice(r, "a", cipher)
+	addIdleDevice(r, "b", cipher)
+	// c is busy: it is not part of the idle sessions.
+	busy := newDeviceConnPool()
+	busy.activeCount.Store(1)
+	busy.limits.waitTimeout = 100 * time.Millisecond
+	r.connections[poolKey{id: "c"}] = busy
+
+	body := encryptBody(t, cipher, protocol.MulticastReq{IDs: []string{"a", "b", "c"}})
+	client, server := tcpPair(t)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.handleMulticast(server, protocol.ReqHead{Action: protocol.ActionMulticast, DataLen: len(body)}, cipher, nil)
+	}()
+	if _, err := client.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	if head, _ := readMulticastResp(t, client, cipher); head.Code != protocol.StatusSuccess {
+		t.Fatalf("multicast failed: %+v", head)
+	}
+
+	// The sender goes quiet while holding both devices.
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle multicast not torn down")
+	}
+	for _, id := range []string{"a", "b"} {
+		stat, err := r.storage.GetHistoryStatisticByID(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.TotalRelayIdleTimeoutCount != 1 {
+			t.Fatalf("idle timeouts of %s = %d, want 1", id, stat.TotalRelayIdleTimeoutCount)
+		}
+	}
+	stat, err := r.storage.GetHistoryStatisticByID("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.TotalRelayErrCount != 1 || stat.TotalRelayIdleTimeoutCount != 0 {
+		t.Fatalf("busy target: errors = %d, idle timeouts = %d; want 1, 0",
+			stat.TotalRelayErrCount, stat.TotalRelayIdleTimeoutCount)
+	}
+	if n := r.connections[poolKey{id: "a"}].activeCount.Load(); n != 0 {
+		t.Fatalf("active connections of a = %d after the timeout", n)
+	}
+}
+
+// addTCPDevice registers an idle TCP connection for id. The device answers
+// relay-start with a reply the relay never uses, then reads until EOF and
+// reports what it received and the read error. It closes its side when
+// hold is closed.
+func addTCPDevice(t *testing.T, r *Relay, id string, cipher crypto.SymmetricCipher, hold <-chan struct{}) <-chan error {
+	devServer, devClient := tcpPair(t)
+	pool := newDeviceConnPool()
+	pool.conns = append(pool.conns, &Connection{ID: id, Conn: devServer, Cipher: cipher})
+	r.connections[poolKey{id: id}] = pool
+
+	done := make(chan error, 1)
+	go func() {
+		defer devClient.Close()
+		head, err := protocol.ReadReqHead(devClient, cipher)
+		if err != nil || head.Action != protocol.ActionRelay {
+			done <- errors.New("no relay start")
+			return
+		}
+		if _, err := devClient.Write([]byte("reply")); err != nil {
+			done <- err
+			return
+		}
+		data, err := io.ReadAll(devClient)
+		if err == nil && len(data) != 1<<20 {
+			err = fmt.Errorf("received %d bytes", len(data))
+		}
+		done <- err
+		<-hold
+	}()
+	return done
+}
+
+func TestMulticastDrainsTargets(t *testing.T) {
+	r := newTestRelay(t)
+	r.storage = storage.NewStorage(filepath.Join(t.TempDir(), "relay.db"))
+	r.config.Session.DrainTimeoutSeconds = 1
+	cipher := newTestCipher(t)
+
+	// a closes as soon as it has read everything; b never does.
+	closed := make(chan struct{})
+	close(closed)
+	never := make(chan struct{})
+	defer close(never)
+	gotA := addTCPDevice(t, r, "a", cipher, closed)
+	gotB := addTCPDevice(t, r, "b", cipher, never)
+
+	body := encryptBody(t, cipher, protocol.MulticastReq{IDs: []string{"a", "b"}})
+	client, server := tcpPair(t)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.handleMulticast(server, protocol.ReqHead{Action: protocol.ActionMulticast, DataLen: len(body)}, cipher, nil)
+	}()
+	if _, err := client.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	if head, _ := readMulticastResp(t, client, cipher); head.Code != protocol.StatusSuccess {
+		t.Fatalf("multicast failed: %+v", head)
+	}
+	if _, err := client.Write(make([]byte, 1<<20)); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+
+	// Both devices get the FIN after the whole stream, although their
+	// replies were never used.
+	for id, got := range map[string]<-chan error{"a": gotA, "b": gotB} {
+		if err := <-got; err != nil {
+			t.Fatalf("device %s: %v", id, err)
+		}
+	}
+	_, results := readMulticastResp(t, client, cipher)
+	for _, id := range []string{"a", "b"} {
+		if res := results[id]; res.Code != protocol.StatusSuccess || res.DataLen != 1<<20 {
+			t.Fatalf("final result of %s = %+v", id, res)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond || elapsed > 3*time.Second {
+		t.Fatalf("final report after %v, want after the 1s drain timeout of b", elapsed)
+	}
+	<-done
+}
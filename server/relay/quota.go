@@ -0,0 +1,247 @@
+package relay
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/doraemonkeys/WindSend-Relay/server/config"
+	"go.uber.org/zap"
+)
+
+var errQuotaExceeded = errors.New("traffic quota exceeded")
+
+// keyQuota is the traffic quota of a secret key. The usage of the current
+// period is cached and charged as bytes move; storage holds the usage up
+// to the last flush. Relayed bytes are only charged in memory: flushQuotas
+// and the end of each bridge write them to storage, and move the key to a
+// new period once one began.
+type keyQuota struct {
+	tag    string
+	limit  int64
+	period string
+	// throttleRate is the rate relays over quota are downgraded to; 0
+	// means they are refused.
+	throttleRate int64
+	// throttle is drawn from by every bridge of the key when throttleRate
+	// is set. It is unlimited while the key is within its quota.
+	throttle *bandwidth
+
+	// ioMu serializes the storage reads and writes of the quota. It is
+	// never taken while relaying, so a slow write does not stall bridges.
+	ioMu sync.Mutex
+	mu   sync.Mutex
+	// current is the period used and pending belong to.
+	current string
+	// loaded reports whether the stored usage of current is part of used.
+	loaded bool
+	used   int64
+	// pending is the part of used not written to storage yet.
+	pending int64
+}
+
+func newKeyQuota(tag string, secret config.SecretInfo) *keyQuota {
+	if secret.QuotaBytes <= 0 {
+		return nil
+	}
+	q := &keyQuota{tag: tag, limit: secret.QuotaBytes, period: secret.QuotaPeriod}
+	if secret.QuotaThrottleBytesPerSec > 0 {
+		q.throttleRate = secret.QuotaThrottleBytesPerSec
+		q.throttle = newBandwidth(0)
+	}
+	return q
+}
+
+// periodKey names the quota period containing now. Periods start at
+// midnight UTC, on the first of the month for monthly quotas.
+func (q *keyQuota) periodKey(now time.Time) string {
+	if q.period == config.QuotaDaily {
+		return now.UTC().Format("2006-01-02")
+	}
+	return now.UTC().Format("2006-01")
+}
+
+// updateThrottleLocked turns the throttle of q on once it is used up.
+func (q *keyQuota) updateThrottleLocked() {
+	if q.throttle == nil {
+		return
+	}
+	if q.used >= q.limit {
+		q.throttle.setRate(q.throttleRate)
+	} else {
+		q.throttle.setRate(0)
+	}
+}
+
+// syncPeriod moves q to the current period, writing what is pending for the
+// previous one and loading the usage of the new one. If the usage cannot be
+// loaded, bytes charged meanwhile stay pending and the load is retried on
+// the next call. The caller holds q.ioMu.
+func (r *Relay) syncPeriod(q *keyQuota) {
+	period := q.periodKey(time.Now())
+	q.mu.Lock()
+	current, loaded := q.current, q.loaded
+	q.mu.Unlock()
+	if current == period && loaded {
+		return
+	}
+	if current != period {
+		r.writePending(q)
+	}
+	stored, err := r.storage.GetKeyTraffic(q.tag, period)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	// Bytes charged since the write above belong to the new period.
+	q.current = period
+	q.loaded = err == nil
+	q.used = stored + q.pending
+	q.updateThrottleLocked()
+	if err != nil {
+		zap.L().Error("Failed to load key traffic", zap.String("keyTag", q.tag), zap.Error(err))
+	}
+}
+
+// writePending writes the pending usage of q to storage. It stays pending if
+// the write fails, to be retried by the next flush. The caller holds q.ioMu.
+func (r *Relay) writePending(q *keyQuota) {
+	q.mu.Lock()
+	period, pending := q.current, q.pending
+	if period == "" || pending <= 0 {
+		q.mu.Unlock()
+		return
+	}
+	q.pending = 0
+	q.mu.Unlock()
+
+	if err := r.storage.AddKeyTraffic(q.tag, period, pending); err != nil {
+		zap.L().Error("Failed to add key traffic", zap.String("keyTag", q.tag), zap.Error(err))
+		q.mu.Lock()
+		q.pending += pending
+		q.mu.Unlock()
+	}
+}
+
+// quotaUsage returns the bytes used in the current period, loading them from
+// storage when a new period began.
+func (r *Relay) quotaUsage(q *keyQuota) (period string, used int64) {
+	q.ioMu.Lock()
+	r.syncPeriod(q)
+	q.ioMu.Unlock()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.current, q.used
+}
+
+// keyQuotaOf returns the quota of authKeyB64, nil if it has none.
+func (r *Relay) keyQuotaOf(authKeyB64 string) *keyQuota {
+	if sl := r.getSecretLimit(authKeyB64); sl != nil {
+		return sl.quota
+	}
+	return nil
+}
+
+// overQuota reports whether relays to devices of authKeyB64 must be
+// refused because the key used up its quota without a throttled fallback.
+func (r *Relay) overQuota(authKeyB64 string) bool {
+	q := r.keyQuotaOf(authKeyB64)
+	if q == nil || q.throttle != nil {
+		return false
+	}
+	_, used := r.quotaUsage(q)
+	return used >= q.limit
+}
+
+// quotaThrottle returns the bandwidth bridges of authKeyB64 draw from to be
+// downgraded once the key is over quota, nil if over quota relays are
+// refused.
+func (r *Relay) quotaThrottle(authKeyB64 string) *bandwidth {
+	q := r.keyQuotaOf(authKeyB64)
+	if q == nil || q.throttle == nil {
+		return nil
+	}
+	// Brings the throttle up to date if a new period began.
+	r.quotaUsage(q)
+	return q.throttle
+}
+
+// chargeQuota adds bytes relayed for q to its usage. Once q is used up it
+// turns on the throttle of q, or returns errQuotaExceeded if q has none.
+// It runs for every chunk relayed and does not touch storage.
+func (r *Relay) chargeQuota(q *keyQuota, bytes int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.used += bytes
+	q.pending += bytes
+	q.updateThrottleLocked()
+	if q.throttle == nil && q.used >= q.limit {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// quotaCharger returns the copier hook charging bytes relayed to a device
+// of authKeyB64, nil if the key has no quota.
+func (r *Relay) quotaCharger(authKeyB64 string) func(int64) error {
+	q := r.keyQuotaOf(authKeyB64)
+	if q == nil {
+		return nil
+	}
+	return func(n int64) error { return r.chargeQuota(q, n) }
+}
+
+// flushQuota writes the pending usage of authKeyB64 to storage, moving the
+// key to a new period first if one began.
+func (r *Relay) flushQuota(authKeyB64 string) {
+	q := r.keyQuotaOf(authKeyB64)
+	if q == nil {
+		return
+	}
+	q.ioMu.Lock()
+	defer q.ioMu.Unlock()
+	r.syncPeriod(q)
+	r.writePending(q)
+}
+
+// flushQuotas writes the pending usage of every key to storage.
+func (r *Relay) flushQuotas() {
+	for _, key := range r.secretKeyOrder {
+		r.flushQuota(key)
+	}
+}
+
+// QuotaStatus is the traffic quota of one secret key.
+type QuotaStatus struct {
+	// KeyIndex is the position of the key in the config.
+	KeyIndex int
+	Period   string
+	// PeriodKey names the current period, e.g. "2025-06".
+	PeriodKey     string
+	UsedBytes     int64
+	LimitBytes    int64
+	ThrottleRate  int64
+	QuotaExceeded bool
+}
+
+// GetQuotas returns the quota of every secret key that has one.
+func (r *Relay) GetQuotas() []QuotaStatus {
+	var quotas []QuotaStatus
+	for i, key := range r.secretKeyOrder {
+		q := r.keyQuotaOf(key)
+		if q == nil {
+			continue
+		}
+		period, used := r.quotaUsage(q)
+		status := QuotaStatus{
+			KeyIndex:      i,
+			Period:        q.period,
+			PeriodKey:     period,
+			UsedBytes:     used,
+			LimitBytes:    q.limit,
+			QuotaExceeded: used >= q.limit,
+		}
+		status.ThrottleRate = q.throttleRate
+		quotas = append(quotas, status)
+	}
+	return quotas
+}
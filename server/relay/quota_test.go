@@ -0,0 +1,273 @@
+package relay
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/doraemonkeys/WindSend-Relay/server/config"
+	"github.com/doraemonkeys/WindSend-Relay/server/protocol"
+	"github.com/doraemonkeys/WindSend-Relay/server/storage"
+	"github.com/doraemonkeys/WindSend-Relay/server/tool"
+)
+
+func newQuotaRelay(t *testing.T, dbPath string, secret config.SecretInfo) *Relay {
+	t.Helper()
+	r := newTestRelay(t)
+	r.storage = storage.NewStorage(dbPath)
+	r.keyConnLimit["key"] = &SecretLimit{
+		limit:     100,
+		bandwidth: newBandwidth(0),
+		quota:     newKeyQuota(keyTag("key"), secret),
+	}
+	r.secretKeyOrder = []string{"key"}
+	return r
+}
+
+func TestQuotaExceededRefusesRelay(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "relay.db")
+	secret := config.SecretInfo{QuotaBytes: 1000, QuotaPeriod: config.QuotaMonthly}
+	r := newQuotaRelay(t, dbPath, secret)
+	cipher := newTestCipher(t)
+	addIdleDevice(r, "device", cipher)
+	r.connections[poolKey{id: "device"}].ownerKeyB64 = "key"
+
+	q := r.keyQuotaOf("key")
+	if err := r.chargeQuota(q, 600); err != nil || r.overQuota("key") {
+		t.Fatalf("over quota after 600 of 1000 bytes: %v", err)
+	}
+	if err := r.chargeQuota(q, 400); !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("charging the last 400 bytes = %v, want errQuotaExceeded", err)
+	}
+
+	body := encryptBody(t, cipher, protocol.RelayReq{CommonReq: protocol.CommonReq{SecretKeyID: "device"}})
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.handleRelay(server, protocol.ReqHead{Action: protocol.ActionRelay, DataLen: len(body)}, cipher, nil)
+	}()
+	_ = client.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	var head protocol.RespHead
+	readFrame(t, client, cipher, &head)
+	if head.Code != protocol.StatusQuotaExceeded {
+		t.Fatalf("head = %+v, want quota exceeded", head)
+	}
+	if idle := len(r.connections[poolKey{id: "device"}].conns); idle != 1 {
+		t.Fatalf("refused relay took a connection, %d idle left", idle)
+	}
+	<-done
+	// A refused relay is not counted as an error.
+	stat, err := r.storage.GetHistoryStatisticByID("device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.TotalRelayQuotaCount != 1 || stat.TotalRelayErrCount != 0 {
+		t.Fatalf("quota refusals = %d, errors = %d; want 1, 0", stat.TotalRelayQuotaCount, stat.TotalRelayErrCount)
+	}
+
+	// The usage survives a restart once flushed.
+	r.flushQuotas()
+	restarted := newQuotaRelay(t, dbPath, secret)
+	quotas := restarted.GetQuotas()
+	if len(quotas) != 1 || quotas[0].UsedBytes != 1000 || !quotas[0].QuotaExceeded ||
+		quotas[0].PeriodKey != time.Now().UTC().Format("2006-01") {
+		t.Fatalf("quotas after restart = %+v", quotas)
+	}
+}
+
+func TestQuotaChargedInMemoryUntilFlush(t *testing.T) {
+	secret := config.SecretInfo{QuotaBytes: 1 << 30, QuotaPeriod: config.QuotaMonthly}
+	r := newQuotaRelay(t, filepath.Join(t.TempDir(), "relay.db"), secret)
+	q := r.keyQuotaOf("key")
+	period, _ := r.quotaUsage(q)
+
+	for range 64 {
+		if err := r.chargeQuota(q, 64<<10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stored, err := r.storage.GetKeyTraffic(q.tag, period); err != nil || stored != 0 {
+		t.Fatalf("stored while relaying = %d, %v; want nothing before a flush", stored, err)
+	}
+	if _, used := r.quotaUsage(q); used != 4<<20 {
+		t.Fatalf("used = %d, want %d", used, 4<<20)
+	}
+
+	r.flushQuotas()
+	if stored, err := r.storage.GetKeyTraffic(q.tag, period); err != nil || stored != 4<<20 {
+		t.Fatalf("stored after flush = %d, %v; want %d", stored, err, 4<<20)
+	}
+	if _, used := r.quotaUsage(q); used != 4<<20 {
+		t.Fatalf("used after flush = %d, want %d", used, 4<<20)
+	}
+}
+
+func TestQuotaExceededThrottlesRelay(t *testing.T) {
+	secret := config.SecretInfo{QuotaBytes: 1000, QuotaPeriod: config.QuotaDaily, QuotaThrottleBytesPerSec: 4096}
+	r := newQuotaRelay(t, filepath.Join(t.TempDir(), "relay.db"), secret)
+
+	up, _, release := r.bridgeThrottles("device", "key")
+	release()
+	if rate := up.minRate(); rate != 0 {
+		t.Fatalf("rate within quota = %d, want unlimited", rate)
+	}
+	if err := r.chargeQuota(r.keyQuotaOf("key"), 1000); err != nil {
+		t.Fatal(err)
+	}
+	if r.overQuota("key") {
+		t.Fatal("relay refused although a throttle is configured")
+	}
+	up, down, release := r.bridgeThrottles("device", "key")
+	defer release()
+	if up.minRate() != 4096 || down.minRate() != 4096 {
+		t.Fatalf("rates over quota = %d, %d; want 4096", up.minRate(), down.minRate())
+	}
+	if quotas := r.GetQuotas(); len(quotas) != 1 || quotas[0].PeriodKey != time.Now().UTC().Format("2006-01-02") {
+		t.Fatalf("quotas = %+v", quotas)
+	}
+}
+
+func TestQuotaChargedDuringRelay(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "relay.db")
+	secret := config.SecretInfo{QuotaBytes: 1000, QuotaPeriod: config.QuotaMonthly}
+	r := newQuotaRelay(t, dbPath, secret)
+	reqPeer, devPeer, done := startOwnedBridge(t, r, true, "key")
+
+	buf := make([]byte, 600)
+	if _, err := reqPeer.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(devPeer, buf); err != nil {
+		t.Fatal(err)
+	}
+	if quotas := r.GetQuotas(); quotas[0].UsedBytes != 600 {
+		t.Fatalf("used bytes while relaying = %d, want 600", quotas[0].UsedBytes)
+	}
+
+	// Crossing the quota ends the bridge.
+	if _, err := reqPeer.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, errQuotaExceeded) {
+			t.Fatalf("relay = %v, want errQuotaExceeded", err)
+		}
+		if got := relayOutcome(false, false, err); got != storage.RelayQuotaExceeded {
+			t.Fatalf("outcome = %v, want %v", got, storage.RelayQuotaExceeded)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("relay still running over quota")
+	}
+
+	quotas := newQuotaRelay(t, dbPath, secret).GetQuotas()
+	if quotas[0].UsedBytes != 1200 {
+		t.Fatalf("stored usage = %d, want 1200", quotas[0].UsedBytes)
+	}
+}
+
+func TestQuotaThrottlesRunningRelay(t *testing.T) {
+	secret := config.SecretInfo{QuotaBytes: 1000, QuotaPeriod: config.QuotaMonthly, QuotaThrottleBytesPerSec: 2000}
+	r := newQuotaRelay(t, filepath.Join(t.TempDir(), "relay.db"), secret)
+	reqPeer, devPeer, done := startOwnedBridge(t, r, true, "key")
+
+	buf := make([]byte, 1000)
+	if _, err := reqPeer.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(devPeer, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// The bridge is now over quota and held to 2000 bytes per second.
+	start := time.Now()
+	go func() { _, _ = reqPeer.Write(make([]byte, 3000)) }()
+	if _, err := io.ReadFull(devPeer, make([]byte, 3000)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 700*time.Millisecond {
+		t.Fatalf("3000 bytes over quota took %v, want about 1s", elapsed)
+	}
+	_ = reqPeer.Close()
+	_ = devPeer.Close()
+	<-done
+}
+
+func TestQuotaMulticast(t *testing.T) {
+	r := newTestRelay(t)
+	r.storage = storage.NewStorage(filepath.Join(t.TempDir(), "relay.db"))
+	authKey := tool.HashToAES192Key([]byte("quota"))
+	keyB64 := base64.StdEncoding.EncodeToString(authKey)
+	r.keyConnLimit[keyB64] = &SecretLimit{
+		quota: newKeyQuota(keyTag(keyB64), config.SecretInfo{QuotaBytes: 1000, QuotaPeriod: config.QuotaMonthly}),
+	}
+	r.secretKeyOrder = []string{keyB64}
+	cipher := newTestCipher(t)
+
+	multicast := func(ids ...string) (net.Conn, <-chan struct{}) {
+		body := encryptBody(t, cipher, protocol.MulticastReq{IDs: ids})
+		client, server := tcpPair(t)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			r.handleMulticast(server, protocol.ReqHead{Action: protocol.ActionMulticast, DataLen: len(body)}, cipher, authKey)
+		}()
+		if _, err := client.Write(body); err != nil {
+			t.Fatal(err)
+		}
+		return client, done
+	}
+
+	// a crosses the quota of its key partway and is dropped after the
+	// write that used it up; b has no quota.
+	gotA := addIdleDevice(r, "a", cipher)
+	r.connections[poolKey{id: "a"}].ownerKeyB64 = keyB64
+	gotB := addIdleDevice(r, "b", cipher)
+	client, done := multicast("a", "b")
+	if head, results := readMulticastResp(t, client, cipher); head.Code != protocol.StatusSuccess || len(results) != 2 {
+		t.Fatalf("start = %+v, %+v", head, results)
+	}
+	if _, err := client.Write(make([]byte, 1200)); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	_, results := readMulticastResp(t, client, cipher)
+	if res := results["a"]; res.Code != protocol.StatusQuotaExceeded || res.DataLen != 1200 {
+		t.Fatalf("final result of a = %+v", res)
+	}
+	if res := results["b"]; res.Code != protocol.StatusSuccess {
+		t.Fatalf("final result of b = %+v", res)
+	}
+	<-gotA
+	<-gotB
+	<-done
+	if quotas := r.GetQuotas(); quotas[0].UsedBytes != 1200 {
+		t.Fatalf("used bytes = %d, want 1200", quotas[0].UsedBytes)
+	}
+
+	// Now a is refused up front.
+	addIdleDevice(r, "a", cipher)
+	r.connections[poolKey{id: "a"}].ownerKeyB64 = keyB64
+	addIdleDevice(r, "b", cipher)
+	client, done = multicast("a", "b")
+	_, results = readMulticastResp(t, client, cipher)
+	if results["a"].Code != protocol.StatusQuotaExceeded || results["b"].Code != protocol.StatusSuccess {
+		t.Fatalf("start results over quota = %+v", results)
+	}
+	if idle := len(r.connections[poolKey{id: "a"}].conns); idle != 1 {
+		t.Fatalf("refused target took a connection, %d idle left", idle)
+	}
+	_ = client.Close()
+	<-done
+}
@@ -0,0 +1,216 @@
+package relay
+
+import (
+	"encoding/base64"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/doraemonkeys/WindSend-Relay/server/tool"
+	"go.uber.org/zap"
+)
+
+const (
+	// rateLimitBuckets is how many buckets a rate limit window is split into.
+	rateLimitBuckets = 6
+	// defaultRateLimitWindow replaces a window too short to be split into
+	// buckets, e.g. an unset one.
+	defaultRateLimitWindow = time.Minute
+)
+
+// rateLimiter counts the requests of each subject, e.g. a device ID, in a
+// sliding window made of rateLimitBuckets buckets.
+type rateLimiter struct {
+	window time.Duration
+	mu     sync.Mutex
+	counts map[string]*rateCount
+}
+
+// rateCount holds the buckets of one subject. Bucket i counts the requests
+// of bucket number seqs[i], numbered from the Unix epoch.
+type rateCount struct {
+	counts [rateLimitBuckets]int
+	seqs   [rateLimitBuckets]int64
+	// limit is the limit the last request was checked against.
+	limit int
+	// rejected counts the requests refused since the subject was tracked.
+	rejected int64
+}
+
+func newRateLimiter(window time.Duration) *rateLimiter {
+	// bucketSeq divides by the bucket length, so the window must split into
+	// buckets of at least one nanosecond.
+	if window/rateLimitBuckets <= 0 {
+		window = defaultRateLimitWindow
+	}
+	return &rateLimiter{window: window, counts: make(map[string]*rateCount)}
+}
+
+func (l *rateLimiter) bucketSeq(now time.Time) int64 {
+	return now.UnixNano() / int64(l.window/rateLimitBuckets)
+}
+
+// usedLocked sums the buckets of c still in the window ending at seq.
+func (c *rateCount) usedLocked(seq int64) int {
+	used := 0
+	for i, s := range c.seqs {
+		if seq-s < rateLimitBuckets {
+			used += c.counts[i]
+		}
+	}
+	return used
+}
+
+// allow counts a request of subject and reports whether it is within limit.
+// A limit of 0 is unlimited; such requests are still counted.
+func (l *rateLimiter) allow(subject string, limit int) bool {
+	seq := l.bucketSeq(time.Now())
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c, ok := l.counts[subject]
+	if !ok {
+		c = &rateCount{}
+		l.counts[subject] = c
+	}
+	c.limit = limit
+	if limit > 0 && c.usedLocked(seq) >= limit {
+		c.rejected++
+		return false
+	}
+	i := seq % rateLimitBuckets
+	if c.seqs[i] != seq {
+		c.seqs[i], c.counts[i] = seq, 0
+	}
+	c.counts[i]++
+	return true
+}
+
+// purge forgets the subjects with no request in the window.
+func (l *rateLimiter) purge() {
+	seq := l.bucketSeq(time.Now())
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for subject, c := range l.counts {
+		if c.usedLocked(seq) == 0 {
+			delete(l.counts, subject)
+		}
+	}
+}
+
+// RateLimitState is the use of a rate limit by one subject.
+type RateLimitState struct {
+	// Limiter is "id", "ip" or "key".
+	Limiter string
+	Subject string
+	// Limit is the limit of the last request, 0 if unlimited.
+	Limit int
+	// Used counts the requests admitted in the current window.
+	Used          int
+	Rejected      int64
+	WindowSeconds int
+}
+
+func (l *rateLimiter) state(limiter, subject string) (RateLimitState, bool) {
+	seq := l.bucketSeq(time.Now())
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c, ok := l.counts[subject]
+	if !ok {
+		return RateLimitState{}, false
+	}
+	return RateLimitState{
+		Limiter:       limiter,
+		Subject:       subject,
+		Limit:         c.limit,
+		Used:          c.usedLocked(seq),
+		Rejected:      c.rejected,
+		WindowSeconds: int(l.window / time.Second),
+	}, true
+}
+
+// rateLimitOverride resolves a per-key rate limit override: 0 means use
+// the global limit and a negative value is unlimited.
+func rateLimitOverride(global, override int) int {
+	switch {
+	case override < 0:
+		return 0
+	case override > 0:
+		return override
+	}
+	return global
+}
+
+// ipRateSubject is the subject of the IP rate limit of conn: its IP, or
+// its whole address if it is not an IP connection.
+func ipRateSubject(conn net.Conn) string {
+	if ip := remoteIP(conn); ip.IsValid() {
+		return ip.String()
+	}
+	return conn.RemoteAddr().String()
+}
+
+// allowIP counts a new connection against the rate limit of its IP.
+func (r *Relay) allowIP(conn net.Conn) bool {
+	return r.ipRateLimiter.allow(ipRateSubject(conn), r.config.RateLimit.IPLimit)
+}
+
+// allowID counts a request naming id against its rate limit, overridden by
+// the secret key the request was authenticated with.
+func (r *Relay) allowID(id string, authKey tool.AES192Key) bool {
+	limit := r.config.RateLimit.IDLimit
+	if authKey != nil {
+		if sl := r.getSecretLimit(base64.StdEncoding.EncodeToString(authKey)); sl != nil {
+			limit = sl.idRateLimit
+		}
+	}
+	return r.idRateLimiter.allow(id, limit)
+}
+
+// allowKey counts a request authenticated with authKeyB64 against the rate
+// limit of the key.
+func (r *Relay) allowKey(authKeyB64 string) bool {
+	limit := r.config.RateLimit.KeyLimit
+	if sl := r.getSecretLimit(authKeyB64); sl != nil {
+		limit = sl.keyRateLimit
+	}
+	if r.keyRateLimiter.allow(keyTag(authKeyB64), limit) {
+		return true
+	}
+	zap.L().Info("Key rate limit exceeded", zap.String("key", keyTag(authKeyB64)))
+	return false
+}
+
+// purgeRateLimits forgets the subjects idle for a whole window.
+func (r *Relay) purgeRateLimits() {
+	r.idRateLimiter.purge()
+	r.ipRateLimiter.purge()
+	r.keyRateLimiter.purge()
+}
+
+// GetRateLimitState returns the state of the ID rate limit of id, the IP
+// rate limit of ip and the key rate limit of the secret key at keyIndex in
+// the config, skipping empty arguments, a negative keyIndex and subjects
+// with no recent request.
+func (r *Relay) GetRateLimitState(id, ip string, keyIndex int) []RateLimitState {
+	states := make([]RateLimitState, 0, 3)
+	if id != "" {
+		if s, ok := r.idRateLimiter.state("id", id); ok {
+			states = append(states, s)
+		}
+	}
+	if ip != "" {
+		if addr, err := netip.ParseAddr(ip); err == nil {
+			ip = addr.Unmap().String()
+		}
+		if s, ok := r.ipRateLimiter.state("ip", ip); ok {
+			states = append(states, s)
+		}
+	}
+	if keyIndex >= 0 && keyIndex < len(r.secretKeyOrder) {
+		if s, ok := r.keyRateLimiter.state("key", keyTag(r.secretKeyOrder[keyIndex])); ok {
+			states = append(states, s)
+		}
+	}
+	return states
+}
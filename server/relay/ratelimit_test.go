@@ -0,0 +1,140 @@
+package relay
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/doraemonkeys/WindSend-Relay/server/tool"
+)
+
+func TestRateLimiterSlidingWindow(t *testing.T) {
+	l := newRateLimiter(time.Minute)
+	for i := range 3 {
+		if !l.allow("laptop", 3) {
+			t.Fatalf("request %d refused under the limit", i+1)
+		}
+	}
+	if l.allow("laptop", 3) {
+		t.Fatal("request over the limit admitted")
+	}
+	if !l.allow("phone", 3) {
+		t.Fatal("another subject shares the limit")
+	}
+	if !l.allow("laptop", 0) {
+		t.Fatal("an unlimited request was refused")
+	}
+
+	// Requests of buckets that left the window no longer count.
+	c := l.counts["laptop"]
+	for i := range c.seqs {
+		c.seqs[i] -= rateLimitBuckets
+	}
+	if !l.allow("laptop", 3) {
+		t.Fatal("request refused after the window slid past the old ones")
+	}
+
+	s, ok := l.state("id", "laptop")
+	if !ok || s.Used != 1 || s.Limit != 3 || s.Rejected != 1 || s.WindowSeconds != 60 {
+		t.Fatalf("state = %+v, %v", s, ok)
+	}
+
+	for i := range l.counts["phone"].seqs {
+		l.counts["phone"].seqs[i] -= rateLimitBuckets
+	}
+	l.purge()
+	if _, ok := l.state("id", "phone"); ok {
+		t.Fatal("an idle subject was kept")
+	}
+	if _, ok := l.state("id", "laptop"); !ok {
+		t.Fatal("an active subject was purged")
+	}
+}
+
+func TestRateLimiterZeroWindow(t *testing.T) {
+	for _, window := range []time.Duration{-time.Second, rateLimitBuckets - 1} {
+		if l := newRateLimiter(window); l.window != defaultRateLimitWindow {
+			t.Fatalf("window %v became %v, want %v", window, l.window, defaultRateLimitWindow)
+		}
+	}
+	if l := newRateLimiter(rateLimitBuckets); l.window != rateLimitBuckets {
+		t.Fatalf("window of one nanosecond per bucket became %v", l.window)
+	}
+	l := newRateLimiter(0)
+	if l.window != defaultRateLimitWindow {
+		t.Fatalf("window = %v, want %v", l.window, defaultRateLimitWindow)
+	}
+	if !l.allow("laptop", 1) || l.allow("laptop", 1) {
+		t.Fatal("a limiter with an unset window does not limit")
+	}
+	if s, ok := l.state("id", "laptop"); !ok || s.WindowSeconds != 60 {
+		t.Fatalf("state = %+v, %v", s, ok)
+	}
+}
+
+func TestRateLimitsPerKey(t *testing.T) {
+	r := newTestRelay(t)
+	r.config.RateLimit.IDLimit = 1
+	r.config.RateLimit.KeyLimit = 2
+	keyA := tool.HashToAES192Key([]byte("key-a"))
+	keyB := tool.HashToAES192Key([]byte("key-b"))
+	keyAB64, keyBB64 := base64.StdEncoding.EncodeToString(keyA), base64.StdEncoding.EncodeToString(keyB)
+	r.secretKeyOrder = []string{keyAB64, keyBB64}
+	r.keyConnLimit[keyAB64] = &SecretLimit{
+		idRateLimit:  rateLimitOverride(1, 3),
+		keyRateLimit: rateLimitOverride(2, -1),
+	}
+	r.keyConnLimit[keyBB64] = &SecretLimit{
+		idRateLimit:  rateLimitOverride(1, 0),
+		keyRateLimit: rateLimitOverride(2, 0),
+	}
+
+	for i := range 3 {
+		if !r.allowID("laptop", keyA) {
+			t.Fatalf("request %d of key A refused under its ID limit of 3", i+1)
+		}
+	}
+	if r.allowID("laptop", keyA) {
+		t.Fatal("request of key A over its ID limit admitted")
+	}
+	if !r.allowID("phone", nil) || r.allowID("phone", nil) {
+		t.Fatal("a request without key does not use the global ID limit of 1")
+	}
+	if !r.allowID("tablet", keyB) || r.allowID("tablet", keyB) {
+		t.Fatal("key B does not use the global ID limit of 1")
+	}
+
+	for range 5 {
+		if !r.allowKey(keyAB64) {
+			t.Fatal("a request of key A, which is unlimited, was refused")
+		}
+	}
+	if !r.allowKey(keyBB64) || !r.allowKey(keyBB64) || r.allowKey(keyBB64) {
+		t.Fatal("key B does not use the global key limit of 2")
+	}
+
+	states := r.GetRateLimitState("laptop", "", 1)
+	if len(states) != 2 || states[0].Limiter != "id" || states[0].Used != 3 || states[0].Rejected != 1 ||
+		states[1].Limiter != "key" || states[1].Subject != keyTag(keyBB64) || states[1].Used != 2 {
+		t.Fatalf("states = %+v", states)
+	}
+	if states := r.GetRateLimitState("", "", 5); len(states) != 0 {
+		t.Fatalf("state of an unknown key = %+v", states)
+	}
+}
+
+func TestIPRateLimitIgnoresPort(t *testing.T) {
+	r := newTestRelay(t)
+	r.config.RateLimit.IPLimit = 1
+	_, first := tcpPair(t)
+	_, second := tcpPair(t)
+	if !r.allowIP(first) {
+		t.Fatal("first connection refused")
+	}
+	if r.allowIP(second) {
+		t.Fatal("second connection from the same IP admitted")
+	}
+	if states := r.GetRateLimitState("", "::ffff:127.0.0.1", -1); len(states) != 1 || states[0].Rejected != 1 {
+		t.Fatalf("states = %+v", states)
+	}
+}
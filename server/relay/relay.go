@@ -1,12 +1,16 @@
 package relay
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"io"
 	"math"
 	"net"
+	"net/netip"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -15,37 +19,75 @@ import (
 	"github.com/doraemonkeys/WindSend-Relay/server/protocol"
 	"github.com/doraemonkeys/WindSend-Relay/server/relay/auth"
 	"github.com/doraemonkeys/WindSend-Relay/server/storage"
+	"github.com/doraemonkeys/WindSend-Relay/server/storage/acl/model"
 	"github.com/doraemonkeys/WindSend-Relay/server/tool"
-	"github.com/doraemonkeys/doraemon"
+	"github.com/doraemonkeys/WindSend-Relay/server/version"
 	"github.com/doraemonkeys/doraemon/crypto"
 	"go.uber.org/zap"
 )
 
 const (
-	// maxConnsPerDevice is the per-ID total connection cap (idle + active + probing).
-	maxConnsPerDevice = 16
-	// maxWaitersPerDevice caps the number of goroutines that may block waiting
+	// maxServiceNameLen caps the service name in a connection request.
+	maxServiceNameLen = 64
+)
+
+// poolLimits are the limits of one DeviceConnPool, resolved from
+// config.PoolConfig and the overrides of the pool owner's secret key.
+type poolLimits struct {
+	// maxConns is the per-pool total connection cap (idle + active +
+	// probing), so each service of a device has its own.
+	maxConns int
+	// maxWaiters caps the number of goroutines that may block waiting
 	// for an idle connection before returning DEVICE_BUSY immediately.
-	maxWaitersPerDevice int32 = 8
+	maxWaiters int32
 	// waitTimeout is how long a relay request will wait for a new idle connection.
-	waitTimeout = 3 * time.Second
+	waitTimeout time.Duration
 	// reconnectWindow is the grace period after the last relay ends, during which
 	// we assume Rust is reconnecting. Prevents premature OFFLINE verdicts and
 	// premature pool cleanup.
-	reconnectWindow = 5 * time.Second
-	// denyTTL is how long an admin-denied device ID stays rejected.
-	denyTTL = 5 * time.Minute
-)
+	reconnectWindow time.Duration
+}
+
+// defaultPoolLimits apply wherever neither the config nor a secret key sets
+// a limit.
+var defaultPoolLimits = poolLimits{
+	maxConns:        16,
+	maxWaiters:      8,
+	waitTimeout:     3 * time.Second,
+	reconnectWindow: 5 * time.Second,
+}
+
+// defaultDenyTTL is how long an admin-denied device ID stays rejected unless
+// configured otherwise.
+const defaultDenyTTL = 5 * time.Minute
 
 // Sentinel errors for the wait path.
 var (
 	errDeviceBusy    = errors.New("device busy")
 	errDeviceOffline = errors.New("device offline")
+	errDeviceDenied  = errors.New("device denied by admin")
 )
 
 type SecretLimit struct {
 	count atomic.Int32
 	limit int
+	// Mailbox limits for this key; 0 means use the global value.
+	mailboxMaxBlobSize   int
+	mailboxMaxTTLSeconds int
+	// poolLimits apply to pools created by connections with this key.
+	poolLimits poolLimits
+	// bandwidth is shared by the bridges to devices of this key; nil for
+	// keys not in the config.
+	bandwidth *bandwidth
+	// quota is the traffic quota of this key, nil if it has none.
+	quota *keyQuota
+	// acl restricts the addresses using this key; nil for keys not in the
+	// config.
+	acl *acl
+	// idRateLimit and keyRateLimit are the rate limits of requests
+	// authenticated with this key, 0 if unlimited.
+	idRateLimit  int
+	keyRateLimit int
 }
 
 type Relay struct {
@@ -54,8 +96,8 @@ type Relay struct {
 	authenticator *auth.Authentication
 	storage       storage.Storage
 
-	// ID -> DeviceConnPool
-	connections   map[string]*DeviceConnPool
+	// (ID, service) -> DeviceConnPool
+	connections   map[poolKey]*DeviceConnPool
 	connectionsMu sync.RWMutex
 
 	// globalConnCount tracks the true total number of registered connections
@@ -64,15 +106,56 @@ type Relay struct {
 
 	keyConnLimit   map[string]*SecretLimit
 	keyConnLimitMu sync.RWMutex
-
-	// denyList stores device IDs that have been administratively denied.
-	// Value is the Unix-milli timestamp when the deny was issued.
+	// secretKeyOrder lists the auth keys of config.SecretInfo in order.
+	secretKeyOrder []string
+
+	// globalBandwidth is shared by all bridges; deviceBandwidths holds the
+	// limit of every device ID given a limit or being relayed to.
+	globalBandwidth  *bandwidth
+	deviceBandwidths map[string]*deviceLimit
+	bandwidthMu      sync.Mutex
+
+	// globalACL restricts the addresses of all connections; keys have their
+	// own in SecretLimit.
+	globalACL *acl
+	// ipBans tracks the IPs failing to authenticate and bans them.
+	ipBans   map[netip.Addr]*ipBan
+	ipBansMu sync.Mutex
+	// ipUsage counts the connections and bridges held by each source IP,
+	// limited per config.IPLimit.
+	ipUsage          map[netip.Addr]*ipUsage
+	ipUsageMu        sync.Mutex
+	ipLimitOverrides []ipLimitOverride
+
+	// sessions holds the bridges in progress by session ID.
+	sessions      map[uint64]*relaySession
+	sessionsMu    sync.RWMutex
+	nextSessionID atomic.Uint64
+
+	// denyList stores device IDs that have been administratively denied,
+	// mirroring the entries persisted in storage.
 	// Protected by denyListMu; independent of DeviceConnPool lifecycle.
-	denyList   map[string]int64
+	denyList   map[string]DenyEntry
 	denyListMu sync.RWMutex
 
-	idRateLimiter *doraemon.RateLimiter
-	ipRateLimiter *doraemon.RateLimiter
+	idRateLimiter  *rateLimiter
+	ipRateLimiter  *rateLimiter
+	keyRateLimiter *rateLimiter
+
+	// subscribers maps a device ID to the subscriptions watching it.
+	subscribers   map[string]map[*subscriber]struct{}
+	subscribersMu sync.RWMutex
+
+	// acquireStrategy is given to every new DeviceConnPool.
+	acquireStrategy acquireStrategy
+
+	// mailboxDelivering holds the device IDs whose mailbox is being delivered,
+	// so that two connections of one device never get the same blob.
+	mailboxDelivering sync.Map
+
+	// handshakeFailures counts failed handshakes by protocol.HandshakeFailReason.
+	// The map is fully populated in NewRelay and never written afterwards.
+	handshakeFailures map[string]*atomic.Int64
 }
 
 func NewRelay(config config.Config, storage storage.Storage) *Relay {
@@ -89,24 +172,63 @@ func NewRelay(config config.Config, storage storage.Storage) *Relay {
 		at = nil
 	}
 	connLimit := make(map[string]*SecretLimit, len(rawSecretKeys))
+	secretKeyOrder := make([]string, 0, len(rawSecretKeys))
 	for _, secret := range config.SecretInfo {
 		authKeyB64 := base64.StdEncoding.EncodeToString(rawKeyToAES192Key[secret.SecretKey])
-		connLimit[authKeyB64] = &SecretLimit{count: atomic.Int32{}, limit: secret.MaxConn}
+		secretKeyOrder = append(secretKeyOrder, authKeyB64)
+		connLimit[authKeyB64] = &SecretLimit{
+			count:                atomic.Int32{},
+			limit:                secret.MaxConn,
+			mailboxMaxBlobSize:   secret.MailboxMaxBlobSize,
+			mailboxMaxTTLSeconds: secret.MailboxMaxTTLSeconds,
+			poolLimits: overridePoolLimits(globalPoolLimits(config.Pool), secret.MaxConnsPerDevice,
+				secret.MaxWaitersPerDevice, secret.WaitTimeoutMs, secret.ReconnectWindowMs),
+			bandwidth:    newBandwidth(secret.BandwidthBytesPerSec),
+			quota:        newKeyQuota(keyTag(authKeyB64), secret),
+			acl:          newACL(secret.AllowCIDRs, secret.DenyCIDRs),
+			idRateLimit:  rateLimitOverride(config.RateLimit.IDLimit, secret.RateLimitID),
+			keyRateLimit: rateLimitOverride(config.RateLimit.KeyLimit, secret.RateLimitKey),
+		}
 	}
 
 	if config.EnableAuth && len(rawSecretKeys) == 0 {
 		zap.L().Fatal("Enable authentication but no secret keys")
 	}
-	return &Relay{
-		config:        config,
-		authenticator: at,
-		storage:       storage,
-		keyConnLimit:  connLimit,
-		connections:   make(map[string]*DeviceConnPool),
-		denyList:      make(map[string]int64),
-		idRateLimiter: doraemon.NewRateLimiter(120, time.Minute, 6),
-		ipRateLimiter: doraemon.NewRateLimiter(1000, time.Minute, 6),
+	strategy, err := parseAcquireStrategy(config.AcquireStrategy)
+	if err != nil {
+		zap.L().Fatal("Invalid acquire strategy", zap.Error(err))
+	}
+	handshakeFailures := make(map[string]*atomic.Int64)
+	for _, reason := range protocol.HandshakeFailReasons() {
+		handshakeFailures[reason] = &atomic.Int64{}
+	}
+	rateWindow := time.Duration(config.RateLimit.WindowSeconds) * time.Second
+	r := &Relay{
+		config:         config,
+		authenticator:  at,
+		storage:        storage,
+		keyConnLimit:   connLimit,
+		connections:    make(map[poolKey]*DeviceConnPool),
+		denyList:       make(map[string]DenyEntry),
+		subscribers:    make(map[string]map[*subscriber]struct{}),
+		idRateLimiter:  newRateLimiter(rateWindow),
+		ipRateLimiter:  newRateLimiter(rateWindow),
+		keyRateLimiter: newRateLimiter(rateWindow),
+
+		secretKeyOrder:   secretKeyOrder,
+		globalBandwidth:  newBandwidth(config.Bandwidth.GlobalBytesPerSec),
+		globalACL:        newACL(config.ACL.Allow, config.ACL.Deny),
+		ipBans:           make(map[netip.Addr]*ipBan),
+		ipUsage:          make(map[netip.Addr]*ipUsage),
+		ipLimitOverrides: newIPLimitOverrides(config.IPLimit.Overrides),
+		deviceBandwidths: make(map[string]*deviceLimit),
+		sessions:         make(map[uint64]*relaySession),
+
+		acquireStrategy:   strategy,
+		handshakeFailures: handshakeFailures,
 	}
+	r.loadDenyList()
+	return r
 }
 
 func (r *Relay) Run() {
@@ -132,52 +254,118 @@ func (r *Relay) Run() {
 
 // --- Status types for admin API ---
 
+// DevicePoolStatus is the status of a device; the counts are summed over
+// its services.
 type DevicePoolStatus struct {
-	ID            string
+	ID           string
+	IdleCount    int
+	ActiveCount  int
+	ProbingCount int
+	// WaiterCount is the number of queued relay requests and LongestWait
+	// how long the oldest of them has waited, over all services.
+	WaiterCount   int
+	LongestWait   time.Duration
+	LastRelayTime int64
+	// BytesRelayed counts the bytes bridged since the pools were created,
+	// including relays still in progress.
+	BytesRelayed int64
+	Denied       bool
+	Meta         protocol.DeviceMeta
+	// Services lists the pool of each service, the default one ("") first.
+	Services []ServicePoolStatus
+	// RTT is the lowest heartbeat round-trip time among the services, 0 if
+	// none was probed yet.
+	RTT time.Duration
+}
+
+type ServicePoolStatus struct {
+	Service       string
 	IdleCount     int
 	ActiveCount   int
 	ProbingCount  int
+	WaiterCount   int
+	LongestWait   time.Duration
 	LastRelayTime int64
-	Denied        bool
+	BytesRelayed  int64
+	// RTT is the last heartbeat round-trip time, 0 if not probed yet.
+	RTT time.Duration
+}
+
+// addService adds the counts of pool to s. The metadata of the default
+// service wins over that of the other services.
+func (s *DevicePoolStatus) addService(pool *DeviceConnPool) {
+	pool.mu.Lock()
+	idle := len(pool.conns)
+	waiters := len(pool.waiters)
+	longestWait := pool.longestWaitLocked()
+	meta := pool.meta
+	pool.mu.Unlock()
+	service := ServicePoolStatus{
+		Service:       pool.service,
+		IdleCount:     idle,
+		ActiveCount:   int(pool.activeCount.Load()),
+		ProbingCount:  int(pool.probingCount.Load()),
+		WaiterCount:   waiters,
+		LongestWait:   longestWait,
+		BytesRelayed:  pool.bytesRelayed.Load(),
+		LastRelayTime: pool.lastRelayTime.Load(),
+		RTT:           time.Duration(pool.lastRTT.Load()),
+	}
+	s.Services = append(s.Services, service)
+	if service.RTT > 0 && (s.RTT == 0 || service.RTT < s.RTT) {
+		s.RTT = service.RTT
+	}
+	s.IdleCount += service.IdleCount
+	s.ActiveCount += service.ActiveCount
+	s.ProbingCount += service.ProbingCount
+	s.WaiterCount += service.WaiterCount
+	s.LongestWait = max(s.LongestWait, service.LongestWait)
+	s.BytesRelayed += service.BytesRelayed
+	s.LastRelayTime = max(s.LastRelayTime, service.LastRelayTime)
+	if meta != (protocol.DeviceMeta{}) && (s.Meta == (protocol.DeviceMeta{}) || pool.service == "") {
+		s.Meta = meta
+	}
+}
+
+func (s *DevicePoolStatus) sortServices() {
+	slices.SortFunc(s.Services, func(a, b ServicePoolStatus) int {
+		return strings.Compare(a.Service, b.Service)
+	})
 }
 
 func (r *Relay) GetAllStatus() []DevicePoolStatus {
 	r.connectionsMu.RLock()
-	statuses := make([]DevicePoolStatus, 0, len(r.connections))
-	for id, pool := range r.connections {
-		pool.mu.Lock()
-		idle := len(pool.conns)
-		pool.mu.Unlock()
-		statuses = append(statuses, DevicePoolStatus{
-			ID:            id,
-			IdleCount:     idle,
-			ActiveCount:   int(pool.activeCount.Load()),
-			ProbingCount:  int(pool.probingCount.Load()),
-			LastRelayTime: pool.lastRelayTime.Load(),
-		})
+	byID := make(map[string]*DevicePoolStatus, len(r.connections))
+	for key, pool := range r.connections {
+		status := byID[key.id]
+		if status == nil {
+			status = &DevicePoolStatus{ID: key.id}
+			byID[key.id] = status
+		}
+		status.addService(pool)
 	}
 	r.connectionsMu.RUnlock()
 
+	statuses := make([]DevicePoolStatus, 0, len(byID))
+	for _, status := range byID {
+		status.sortServices()
+		statuses = append(statuses, *status)
+	}
+
 	// Annotate denied status from the independent denyList.
+	now := time.Now()
 	r.denyListMu.RLock()
 	for i := range statuses {
-		if deniedAt, ok := r.denyList[statuses[i].ID]; ok && time.Since(time.UnixMilli(deniedAt)) < denyTTL {
+		if e, ok := r.denyList[statuses[i].ID]; ok && e.active(now) {
 			statuses[i].Denied = true
 		}
 	}
 	// Also include denied IDs that have no pool (pool was cleaned up but deny persists).
-	for id, deniedAt := range r.denyList {
-		if time.Since(time.UnixMilli(deniedAt)) >= denyTTL {
+	for id, e := range r.denyList {
+		if !e.active(now) {
 			continue
 		}
-		found := false
-		for _, s := range statuses {
-			if s.ID == id {
-				found = true
-				break
-			}
-		}
-		if !found {
+		if _, found := byID[id]; !found {
 			statuses = append(statuses, DevicePoolStatus{
 				ID:     id,
 				Denied: true,
@@ -190,50 +378,62 @@ func (r *Relay) GetAllStatus() []DevicePoolStatus {
 }
 
 func (r *Relay) GetConnectionStatus(id string) (DevicePoolStatus, bool) {
-	r.connectionsMu.RLock()
-	pool, ok := r.connections[id]
-	r.connectionsMu.RUnlock()
-	if !ok {
+	pools := r.devicePools(id)
+	if len(pools) == 0 {
 		// Check if the ID is at least in the denyList.
-		r.denyListMu.RLock()
-		deniedAt, denied := r.denyList[id]
-		r.denyListMu.RUnlock()
-		if denied && time.Since(time.UnixMilli(deniedAt)) < denyTTL {
+		if r.isDenied(id) {
 			return DevicePoolStatus{ID: id, Denied: true}, true
 		}
 		return DevicePoolStatus{}, false
 	}
-	pool.mu.Lock()
-	idle := len(pool.conns)
-	pool.mu.Unlock()
-	status := DevicePoolStatus{
-		ID:            id,
-		IdleCount:     idle,
-		ActiveCount:   int(pool.activeCount.Load()),
-		ProbingCount:  int(pool.probingCount.Load()),
-		LastRelayTime: pool.lastRelayTime.Load(),
-	}
-	r.denyListMu.RLock()
-	if deniedAt, ok := r.denyList[id]; ok && time.Since(time.UnixMilli(deniedAt)) < denyTTL {
-		status.Denied = true
+	status := DevicePoolStatus{ID: id}
+	for _, pool := range pools {
+		status.addService(pool)
 	}
-	r.denyListMu.RUnlock()
+	status.sortServices()
+	status.Denied = r.isDenied(id)
 	return status, true
 }
 
+// GetHandshakeFailures returns the number of failed handshakes per reason.
+func (r *Relay) GetHandshakeFailures() map[string]int64 {
+	failures := make(map[string]int64, len(r.handshakeFailures))
+	for reason, count := range r.handshakeFailures {
+		failures[reason] = count.Load()
+	}
+	return failures
+}
+
 func (r *Relay) mainProcess(conn net.Conn) {
-	if !r.ipRateLimiter.Allow(conn.RemoteAddr().String()) {
+	if !r.allowIP(conn) {
 		zap.L().Error("IP rate limit exceeded", zap.String("addr", conn.RemoteAddr().String()))
 		_ = conn.Close()
 		return
 	}
 
-	cipher, authKey, err := protocol.Handshake(conn, r.authenticator, r.config.EnableAuth)
-	if err == protocol.ErrEmptyKDFSalt {
-		cipher, authKey, err = protocol.Handshake(conn, r.authenticator, r.config.EnableAuth)
+	if !r.admitAddr(conn) {
+		_ = conn.Close()
+		return
 	}
+	ip := remoteIP(conn)
+	if r.ipBanned(ip) {
+		zap.L().Info("Connection from banned IP", zap.String("addr", conn.RemoteAddr().String()))
+		_ = conn.Close()
+		return
+	}
+
+	cipher, authKey, err := protocol.Handshake(conn, r.authenticator, r.config.EnableAuth, r.config.HandshakeMaxRetries)
 	if err != nil {
-		zap.L().Info("handshake failed", zap.Error(err))
+		reason := protocol.HandshakeFailReason(err)
+		r.handshakeFailures[reason].Add(1)
+		zap.L().Info("handshake failed", zap.String("reason", reason), zap.Error(err))
+		if protocol.IsAuthFailure(err) {
+			r.recordAuthFailure(ip)
+		}
+		_ = conn.Close()
+		return
+	}
+	if authKey != nil && !r.admitKeyAddr(conn, base64.StdEncoding.EncodeToString(authKey)) {
 		_ = conn.Close()
 		return
 	}
@@ -243,14 +443,27 @@ func (r *Relay) mainProcess(conn net.Conn) {
 		_ = conn.Close()
 		return
 	}
+	if authKey != nil && !r.allowKey(base64.StdEncoding.EncodeToString(authKey)) {
+		_ = protocol.SendRespHeadError(conn, head.Action, "key rate limit exceeded", cipher)
+		_ = conn.Close()
+		return
+	}
 
 	switch head.Action {
 	case protocol.ActionConnect:
 		r.handleConnect(conn, head, cipher, authKey)
 	case protocol.ActionPing:
-		r.handlePing(conn, head, cipher)
+		r.handlePing(conn, head, cipher, authKey)
 	case protocol.ActionRelay:
-		r.handleRelay(conn, head, cipher)
+		r.handleRelay(conn, head, cipher, authKey)
+	case protocol.ActionSubscribe:
+		r.handleSubscribe(conn, head, cipher, authKey)
+	case protocol.ActionMulticast:
+		r.handleMulticast(conn, head, cipher, authKey)
+	case protocol.ActionRendezvous:
+		r.handleRendezvous(conn, head, cipher, authKey)
+	case protocol.ActionMailboxPut:
+		r.handleMailboxPut(conn, head, cipher, authKey)
 	default:
 		zap.L().Error("Unknown action", zap.Any("action", head.Action))
 		_ = protocol.SendRespHeadError(conn, head.Action, "Unknown action")
@@ -260,6 +473,16 @@ func (r *Relay) mainProcess(conn net.Conn) {
 
 // --- Secret limit helpers ---
 
+// keyTag identifies a secret key in storage without storing the key
+// itself, e.g. the key a mailbox blob was sent with. Empty for no key.
+func keyTag(authKeyB64 string) string {
+	if authKeyB64 == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(authKeyB64))
+	return hex.EncodeToString(sum[:8])
+}
+
 func (r *Relay) getSecretLimit(authKeyB64 string) *SecretLimit {
 	if authKeyB64 == "" {
 		return nil
@@ -278,7 +501,13 @@ func (r *Relay) getSecretLimit(authKeyB64 string) *SecretLimit {
 			return nil
 		}
 		// No-auth mode: lazily create with max limit.
-		v = &SecretLimit{count: atomic.Int32{}, limit: math.MaxInt32}
+		v = &SecretLimit{
+			count:        atomic.Int32{},
+			limit:        math.MaxInt32,
+			poolLimits:   globalPoolLimits(r.config.Pool),
+			idRateLimit:  r.config.RateLimit.IDLimit,
+			keyRateLimit: r.config.RateLimit.KeyLimit,
+		}
 		r.keyConnLimitMu.Lock()
 		// Double-check after acquiring write lock.
 		if existing, ok := r.keyConnLimit[authKeyB64]; ok {
@@ -291,10 +520,51 @@ func (r *Relay) getSecretLimit(authKeyB64 string) *SecretLimit {
 	return v
 }
 
+// globalPoolLimits resolves the deployment-wide pool limits.
+func globalPoolLimits(pool config.PoolConfig) poolLimits {
+	return overridePoolLimits(defaultPoolLimits, pool.MaxConnsPerDevice,
+		pool.MaxWaitersPerDevice, pool.WaitTimeoutMs, pool.ReconnectWindowMs)
+}
+
+// overridePoolLimits replaces each limit of base whose override is positive.
+func overridePoolLimits(base poolLimits, maxConns, maxWaiters, waitTimeoutMs, reconnectWindowMs int) poolLimits {
+	if maxConns > 0 {
+		base.maxConns = maxConns
+	}
+	if maxWaiters > 0 {
+		base.maxWaiters = int32(maxWaiters)
+	}
+	if waitTimeoutMs > 0 {
+		base.waitTimeout = time.Duration(waitTimeoutMs) * time.Millisecond
+	}
+	if reconnectWindowMs > 0 {
+		base.reconnectWindow = time.Duration(reconnectWindowMs) * time.Millisecond
+	}
+	return base
+}
+
+// poolLimitsFor returns the limits of a pool created by a connection
+// authenticated with authKeyB64.
+func (r *Relay) poolLimitsFor(authKeyB64 string) poolLimits {
+	if sl := r.getSecretLimit(authKeyB64); sl != nil {
+		return sl.poolLimits
+	}
+	return globalPoolLimits(r.config.Pool)
+}
+
+// denyTTL is how long a device ID closed by an admin stays rejected when no
+// duration is given.
+func (r *Relay) denyTTL() time.Duration {
+	if r.config.Pool.DenyTTLSeconds > 0 {
+		return time.Duration(r.config.Pool.DenyTTLSeconds) * time.Second
+	}
+	return defaultDenyTTL
+}
+
 // --- Connection release helpers ---
 
-// releaseConnection closes a connection and decrements the global and per-secret
-// quota counters, pairing with the atomic reservation during registration (1.5).
+// releaseConnection closes a connection and decrements the global, per-secret
+// and per-IP quota counters, pairing with the reservation during registration (1.5).
 // The caller must separately decrement activeCount or probingCount.
 func (r *Relay) releaseConnection(conn *Connection) {
 	_ = conn.Conn.Close()
@@ -302,6 +572,7 @@ func (r *Relay) releaseConnection(conn *Connection) {
 	if sl := r.getSecretLimit(conn.AuthkeyB64); sl != nil {
 		sl.count.Add(-1)
 	}
+	r.releaseIP(conn.ip, false)
 }
 
 // releaseActiveConnection releases a connection that was in active relay:
@@ -310,6 +581,9 @@ func (r *Relay) releaseActiveConnection(pool *DeviceConnPool, conn *Connection)
 	r.releaseConnection(conn)
 	pool.activeCount.Add(-1)
 	pool.lastRelayTime.Store(time.Now().UnixMilli())
+	// If the device does not reconnect within the window, the pool can go
+	// and subscribers must see it offline without waiting for a heartbeat.
+	time.AfterFunc(pool.limits.reconnectWindow, func() { r.tryCleanupPool(conn.ID, pool) })
 }
 
 // --- Pool cleanup ---
@@ -318,19 +592,23 @@ func (r *Relay) releaseActiveConnection(pool *DeviceConnPool, conn *Connection)
 // Deletion requires all five conditions to be satisfied simultaneously, plus
 // pointer identity (the pool in the map must be the same object we hold).
 func (r *Relay) tryCleanupPool(deviceID string, p *DeviceConnPool) {
+	// Subscribers see every pool change that ends here, whether or not the
+	// pool was actually removed.
+	defer r.notifyPresence(deviceID)
+
 	r.connectionsMu.Lock()
 	defer r.connectionsMu.Unlock()
+	key := poolKey{id: deviceID, service: p.service}
 	// Pointer identity check: prevent deleting a pool that was replaced by a new one.
-	if r.connections[deviceID] != p {
+	if r.connections[key] != p {
 		return
 	}
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	if len(p.conns) == 0 && p.activeCount.Load() == 0 &&
 		p.pendingCount.Load() == 0 && p.probingCount.Load() == 0 &&
-		p.waiterCount.Load() == 0 &&
-		time.Since(time.UnixMilli(p.lastRelayTime.Load())) >= reconnectWindow {
-		delete(r.connections, deviceID)
+		len(p.waiters) == 0 && !p.awaitingReconnect() {
+		delete(r.connections, key)
 	}
 }
 
@@ -351,12 +629,18 @@ func (r *Relay) handleConnect(conn net.Conn, head protocol.ReqHead, cipher crypt
 	}
 	zap.L().Debug("Connection request", zap.String("secretKey ID", req.SecretKeyID))
 
-	if !r.idRateLimiter.Allow(req.SecretKeyID) {
+	if !r.allowID(req.SecretKeyID, authKey) {
 		zap.L().Error("ID rate limit exceeded", zap.String("secretKey ID", req.SecretKeyID))
 		_ = protocol.SendRespHeadError(conn, head.Action, "ID rate limit exceeded", cipher)
 		return
 	}
 
+	if len(req.Service) > maxServiceNameLen {
+		zap.L().Error("Service name too long", zap.String("secretKey ID", req.SecretKeyID))
+		_ = protocol.SendRespHeadError(conn, head.Action, "service name too long", cipher)
+		return
+	}
+
 	deviceID := req.SecretKeyID
 	authKeyB64 := ""
 	if authKey != nil {
@@ -364,14 +648,11 @@ func (r *Relay) handleConnect(conn net.Conn, head protocol.ReqHead, cipher crypt
 	}
 
 	// Step 0: denyList check (independent of pool, checked first)
-	r.denyListMu.RLock()
-	if deniedAt, ok := r.denyList[deviceID]; ok && time.Since(time.UnixMilli(deniedAt)) < denyTTL {
-		r.denyListMu.RUnlock()
+	if r.isDenied(deviceID) {
 		zap.L().Info("Device denied by admin", zap.String("id", deviceID))
 		_ = protocol.SendRespHeadError(conn, protocol.ActionConnect, "device denied by admin", cipher)
 		return
 	}
-	r.denyListMu.RUnlock()
 
 	// Step 1: Global quota reservation (atomic increment, rollback on failure)
 	if r.globalConnCount.Add(1) > int32(r.config.MaxConn) {
@@ -400,8 +681,21 @@ func (r *Relay) handleConnect(conn net.Conn, head protocol.ReqHead, cipher crypt
 		}
 	}
 
-	// rollbackQuota undoes steps 1 and 2
+	// Step 2.5: Per-IP quota reservation
+	ip := remoteIP(conn)
+	if !r.reserveIP(ip, false) {
+		if secretLimit != nil {
+			secretLimit.count.Add(-1) // rollback step 2
+		}
+		r.globalConnCount.Add(-1) // rollback step 1
+		zap.L().Error("Too many connections (per-IP)", zap.String("id", deviceID), zap.Stringer("ip", ip))
+		_ = protocol.SendRespHeadError(conn, protocol.ActionConnect, "Too many connections", cipher)
+		return
+	}
+
+	// rollbackQuota undoes steps 1 to 2.5
 	rollbackQuota := func() {
+		r.releaseIP(ip, false)
 		if secretLimit != nil {
 			secretLimit.count.Add(-1)
 		}
@@ -409,12 +703,18 @@ func (r *Relay) handleConnect(conn net.Conn, head protocol.ReqHead, cipher crypt
 	}
 
 	// Build the Connection object before taking locks.
+	now := time.Now()
 	c := &Connection{
 		ID:          deviceID,
+		Service:     req.Service,
 		Conn:        conn,
-		ConnectTime: time.Now(),
+		ConnectTime: now,
 		AuthkeyB64:  authKeyB64,
 		Cipher:      cipher,
+		Meta:        sanitizeDeviceMeta(req.Meta),
+
+		LastHeartbeat: now,
+		ip:            ip,
 	}
 
 	if tc, ok := conn.(*net.TCPConn); ok {
@@ -444,24 +744,74 @@ func (r *Relay) handleConnect(conn net.Conn, head protocol.ReqHead, cipher crypt
 		return
 	}
 
+	// Held blobs go out before the connection becomes available for relay.
+	if req.AcceptMailbox && r.config.Mailbox.Enable {
+		if err = r.deliverMailbox(c); err != nil {
+			zap.L().Error("Failed to deliver mailbox", zap.Error(err), zap.String("id", deviceID))
+			pool.pendingCount.Add(-1)
+			rollbackQuota()
+			r.tryCleanupPool(deviceID, pool)
+			return
+		}
+	}
+
 	// Activate: insert into the idle queue and notify waiters.
-	pool.activate(c)
+	retired := pool.activate(c)
+	r.notifyPresence(deviceID)
+	if retired != nil {
+		r.retireIdle(deviceID, pool, retired)
+	}
+
+	// Rust reconnects after every relay, so unchanged metadata is only
+	// persisted now and then to refresh when the device was last seen.
+	if pool.updateMeta(c.Meta, c.ConnectTime) {
+		err = r.storage.UpdateDeviceMeta(deviceID, model.DeviceMeta{
+			Hostname:        c.Meta.Hostname,
+			OS:              c.Meta.OS,
+			AppVersion:      c.Meta.AppVersion,
+			ProtocolVersion: c.Meta.ProtocolVersion,
+			SeenAt:          c.ConnectTime,
+		})
+		if err != nil {
+			zap.L().Error("Failed to save device meta", zap.Error(err), zap.String("id", deviceID))
+		}
+	}
 
 	zap.L().Info("Connection established", zap.String("id", deviceID),
 		zap.String("addr", conn.RemoteAddr().String()))
 	success = true
 }
 
+// maxDeviceMetaFieldLen caps each device metadata field, since it is shown
+// in the admin panel and persisted.
+const maxDeviceMetaFieldLen = 128
+
+func sanitizeDeviceMeta(meta protocol.DeviceMeta) protocol.DeviceMeta {
+	truncate := func(s string) string {
+		if len(s) <= maxDeviceMetaFieldLen {
+			return s
+		}
+		return strings.ToValidUTF8(s[:maxDeviceMetaFieldLen], "")
+	}
+	return protocol.DeviceMeta{
+		Hostname:        truncate(meta.Hostname),
+		OS:              truncate(meta.OS),
+		AppVersion:      truncate(meta.AppVersion),
+		ProtocolVersion: truncate(meta.ProtocolVersion),
+	}
+}
+
 // registerConnectionPending reserves a slot in the pool for the given device
 // without inserting the connection. The caller must call pool.activate(c) after
 // the client acknowledges OK, or pool.pendingCount.Add(-1) on failure.
 func (r *Relay) registerConnectionPending(deviceID string, c *Connection) (*DeviceConnPool, error) {
+	key := poolKey{id: deviceID, service: c.Service}
 	// Fast path: pool already exists, read lock suffices.
 	r.connectionsMu.RLock()
-	pool := r.connections[deviceID]
+	pool := r.connections[key]
 	if pool != nil {
 		pool.mu.Lock()
-		if pool.totalLocked() >= maxConnsPerDevice {
+		if pool.totalLocked() >= pool.limits.maxConns {
 			pool.mu.Unlock()
 			r.connectionsMu.RUnlock()
 			return nil, errors.New("per-device connection limit reached")
@@ -474,14 +824,19 @@ func (r *Relay) registerConnectionPending(deviceID string, c *Connection) (*Devi
 	r.connectionsMu.RUnlock()
 
 	// Slow path: pool doesn't exist, upgrade to write lock to create it.
+	limits := r.poolLimitsFor(c.AuthkeyB64)
 	r.connectionsMu.Lock()
-	pool = r.connections[deviceID]
+	pool = r.connections[key]
 	if pool == nil {
 		pool = newDeviceConnPool()
-		r.connections[deviceID] = pool
+		pool.ownerKeyB64 = c.AuthkeyB64
+		pool.service = c.Service
+		pool.strategy = r.acquireStrategy
+		pool.limits = limits
+		r.connections[key] = pool
 	}
 	pool.mu.Lock()
-	if pool.totalLocked() >= maxConnsPerDevice {
+	if pool.totalLocked() >= pool.limits.maxConns {
 		pool.mu.Unlock()
 		r.connectionsMu.Unlock()
 		return nil, errors.New("per-device connection limit reached")
@@ -494,27 +849,102 @@ func (r *Relay) registerConnectionPending(deviceID string, c *Connection) (*Devi
 
 // --- handlePing ---
 
-func (r *Relay) handlePing(conn net.Conn, _ protocol.ReqHead, cipher crypto.SymmetricCipher) {
+func (r *Relay) handlePing(conn net.Conn, head protocol.ReqHead, cipher crypto.SymmetricCipher, authKey tool.AES192Key) {
 	defer conn.Close()
 
 	l := zap.L().With(zap.String("Action", "Ping"), zap.String("addr", conn.RemoteAddr().String()))
 	l.Info("Ping request")
-	err := protocol.SendRespHeadOk(conn, protocol.ActionPing, cipher)
+
+	// Old clients send ping without a body.
+	var req protocol.PingReq
+	if head.DataLen > 0 {
+		var err error
+		req, err = protocol.ReadReq[protocol.PingReq](conn, head.DataLen, cipher)
+		if err != nil {
+			l.Error("Failed to read ping request", zap.Error(err))
+			return
+		}
+	}
+
+	resp := protocol.PingResp{
+		Version:  version.Version,
+		Features: protocol.NegotiateFeatures(req.Features),
+	}
+	if !r.config.Mailbox.Enable {
+		resp.Features = slices.DeleteFunc(resp.Features, func(f protocol.Feature) bool {
+			return f == protocol.FeatureMailbox
+		})
+	}
+	if r.authenticator != nil {
+		resp.KDFSaltB64 = r.authenticator.GetSaltB64()
+	}
+	if req.SecretKeyID != "" {
+		authKeyB64 := ""
+		if authKey != nil {
+			authKeyB64 = base64.StdEncoding.EncodeToString(authKey)
+		}
+		if presence, ok := r.devicePresence(req.SecretKeyID, authKeyB64); ok {
+			resp.Presence = presence
+		} else {
+			l.Info("Ping presence not authorized", zap.String("id", req.SecretKeyID))
+		}
+	}
+
+	err := protocol.SendPingResp(conn, resp, cipher)
 	if err != nil {
-		l.Error("Failed to send OK", zap.Error(err))
+		l.Error("Failed to send ping response", zap.Error(err))
 		return
 	}
 }
 
+// devicePresence reports the presence of deviceID to a caller that
+// authenticated with authKeyB64 (empty if it did not), as a relay request
+// would see it: the best presence over the pools of all its services that
+// the caller may use. ok is false if the device is registered only with
+// other secret keys.
+func (r *Relay) devicePresence(deviceID string, authKeyB64 string) (presence protocol.DevicePresence, ok bool) {
+	pools := r.devicePools(deviceID)
+	presence = protocol.PresenceOffline
+	visible := false
+	for _, pool := range pools {
+		if pool.ownerKeyB64 != "" && pool.ownerKeyB64 != authKeyB64 {
+			continue
+		}
+		visible = true
+		if p := pool.presence(); presenceRank(p) > presenceRank(presence) {
+			presence = p
+		}
+	}
+	if !visible && len(pools) > 0 {
+		return "", false
+	}
+	if r.isDenied(deviceID) {
+		return protocol.PresenceOffline, true
+	}
+	return presence, true
+}
+
+// presenceRank orders presences from offline to idle.
+func presenceRank(p protocol.DevicePresence) int {
+	switch p {
+	case protocol.PresenceIdle:
+		return 2
+	case protocol.PresenceBusy:
+		return 1
+	}
+	return 0
+}
+
 // --- handleRelay ---
 
-func (r *Relay) handleRelay(conn net.Conn, head protocol.ReqHead, cipher crypto.SymmetricCipher) {
+func (r *Relay) handleRelay(conn net.Conn, head protocol.ReqHead, cipher crypto.SymmetricCipher, authKey tool.AES192Key) {
 	defer conn.Close()
 
 	now := time.Now()
 	relaySuccess := false
-	relayDataLen := int64(0)
+	var relayDataLen atomic.Int64
 	relayOffline := false
+	var bridgeErr error
 
 	l := zap.L().With(zap.String("Action", "Relay"), zap.String("ReqAddr", conn.RemoteAddr().String()))
 	req, err := protocol.ReadReq[protocol.RelayReq](conn, head.DataLen, cipher)
@@ -523,7 +953,7 @@ func (r *Relay) handleRelay(conn net.Conn, head protocol.ReqHead, cipher crypto.
 		return
 	}
 
-	if !r.idRateLimiter.Allow(req.SecretKeyID) {
+	if !r.allowID(req.SecretKeyID, authKey) {
 		zap.L().Error("ID rate limit exceeded", zap.String("id", req.SecretKeyID))
 		_ = protocol.SendRespHeadError(conn, head.Action, "ID rate limit exceeded", cipher)
 		return
@@ -533,65 +963,38 @@ func (r *Relay) handleRelay(conn net.Conn, head protocol.ReqHead, cipher crypto.
 	l = l.With(zap.String("ID", deviceID))
 	l.Info("Relay request")
 	defer func() {
-		r.storage.AddRelayStatistic(deviceID, relaySuccess, relayOffline, int(time.Since(now).Milliseconds()), relayDataLen)
+		outcome := relayOutcome(relaySuccess, relayOffline, bridgeErr)
+		r.storage.AddRelayStatistic(deviceID, outcome, int(time.Since(now).Milliseconds()), relayDataLen.Load())
 	}()
 
-	// DenyList check: reject relays to administratively denied devices even if
-	// the pool still has leftover connections from before the deny was issued.
-	r.denyListMu.RLock()
-	if deniedAt, ok := r.denyList[deviceID]; ok && time.Since(time.UnixMilli(deniedAt)) < denyTTL {
-		r.denyListMu.RUnlock()
-		l.Info("Device denied by admin", zap.String("id", deviceID))
-		_ = protocol.SendRespHeadError(conn, protocol.ActionRelay, "device denied by admin", cipher)
+	if r.overQuota(r.poolOwner(deviceID, req.Service)) {
+		l.Info("Traffic quota exceeded")
+		bridgeErr = errQuotaExceeded
+		_ = protocol.SendRespHead(conn, protocol.ActionRelay, protocol.StatusQuotaExceeded, "traffic quota exceeded", cipher)
 		return
 	}
-	r.denyListMu.RUnlock()
-
-	// Look up the pool.
-	r.connectionsMu.RLock()
-	pool := r.connections[deviceID]
-	r.connectionsMu.RUnlock()
-	if pool == nil {
-		l.Info("device not online", zap.String("id", deviceID))
-		relayOffline = true
-		_ = protocol.SendRespHead(conn, protocol.ActionRelay, protocol.StatusDeviceOffline, "device not online", cipher)
+	ip := remoteIP(conn)
+	if !r.reserveIP(ip, true) {
+		l.Info("Too many relays from this address")
+		_ = protocol.SendRespHeadError(conn, protocol.ActionRelay, "too many relays from this address", cipher)
 		return
 	}
+	defer r.releaseIP(ip, true)
 
-	// Try to acquire an idle connection.
-	targetConn := pool.tryAcquire()
-	if targetConn == nil {
-		// Fast offline: if the pool is completely drained (no idle, no active,
-		// no probing) and the reconnect window has elapsed, skip the wait path
-		// to avoid a needless waitTimeout delay.
-		if pool.activeCount.Load() == 0 && pool.probingCount.Load() == 0 {
-			lrt := pool.lastRelayTime.Load()
-			if lrt == 0 || time.Since(time.UnixMilli(lrt)) >= reconnectWindow {
-				relayOffline = true
-				l.Info("device offline (stale empty pool)", zap.String("id", deviceID))
-				_ = protocol.SendRespHead(conn, protocol.ActionRelay, protocol.StatusDeviceOffline, "device not online", cipher)
-				r.tryCleanupPool(deviceID, pool)
-				return
-			}
-		}
-
-		// Enter wait path.
-		var waitErr error
-		targetConn, waitErr = r.waitForConnection(pool)
-		if waitErr != nil {
-			if errors.Is(waitErr, errDeviceOffline) {
-				relayOffline = true
-				l.Info("device offline (wait timeout)", zap.String("id", deviceID))
-				_ = protocol.SendRespHead(conn, protocol.ActionRelay, protocol.StatusDeviceOffline, "device not online", cipher)
-			} else {
-				l.Info("device busy (wait timeout)", zap.String("id", deviceID))
-				_ = protocol.SendRespHead(conn, protocol.ActionRelay, protocol.StatusDeviceBusy, "device busy", cipher)
-			}
-			return
+	pool, targetConn, err := r.acquireConnection(deviceID, req.Service)
+	if err != nil {
+		switch {
+		case errors.Is(err, errDeviceDenied):
+			_ = protocol.SendRespHeadError(conn, protocol.ActionRelay, "device denied by admin", cipher)
+		case errors.Is(err, errDeviceOffline):
+			relayOffline = true
+			_ = protocol.SendRespHead(conn, protocol.ActionRelay, protocol.StatusDeviceOffline, "device not online", cipher)
+		default:
+			_ = protocol.SendRespHead(conn, protocol.ActionRelay, protocol.StatusDeviceBusy, "device busy", cipher)
 		}
+		return
 	}
 
-	// targetConn acquired (activeCount already incremented by tryAcquire).
 	// Register deferred cleanup: close connection + activeCount -1 + pool cleanup.
 	defer func() {
 		r.releaseActiveConnection(pool, targetConn)
@@ -623,9 +1026,9 @@ func (r *Relay) handleRelay(conn net.Conn, head protocol.ReqHead, cipher crypto.
 	}
 
 	// Bridge Flutter <-> Rust.
-	err = r.relay(targetConn, conn, &relayDataLen)
-	if err != nil {
-		l.Error("relay data failed", zap.Error(err))
+	bridgeErr = r.relay(pool, targetConn, conn, &relayDataLen)
+	if bridgeErr != nil {
+		l.Error("relay data failed", zap.Error(bridgeErr))
 		return
 	}
 	zap.L().Debug("relay data success", zap.String("targetConn", targetConn.ID),
@@ -633,130 +1036,270 @@ func (r *Relay) handleRelay(conn net.Conn, head protocol.ReqHead, cipher crypto.
 	relaySuccess = true
 }
 
-// waitForConnection blocks until an idle connection is available or timeout.
-// Returns errDeviceBusy or errDeviceOffline on timeout depending on pool state.
+// relayOutcome classifies a relay request for the statistics. bridgeErr is
+// what relay returned, errQuotaExceeded if the relay was refused over quota,
+// nil if no bridge was made otherwise.
+func relayOutcome(success, offline bool, bridgeErr error) storage.RelayOutcome {
+	switch {
+	case success:
+		return storage.RelaySucceeded
+	case offline:
+		return storage.RelayOffline
+	case errors.Is(bridgeErr, errSessionIdle), errors.Is(bridgeErr, errSessionDrain):
+		return storage.RelayIdleTimeout
+	case errors.Is(bridgeErr, errSessionMaxDuration):
+		return storage.RelayMaxDuration
+	case errors.Is(bridgeErr, errSessionKilled):
+		return storage.RelayKilled
+	case errors.Is(bridgeErr, errQuotaExceeded):
+		return storage.RelayQuotaExceeded
+	}
+	return storage.RelayFailed
+}
+
+// acquireConnection takes an idle connection of the given service of
+// deviceID for a relay, waiting for one if the pool is busy. On success activeCount has been
+// incremented; the caller must call releaseActiveConnection and then
+// tryCleanupPool. Otherwise it returns errDeviceDenied, errDeviceOffline or
+// errDeviceBusy.
+func (r *Relay) acquireConnection(deviceID string, service string) (*DeviceConnPool, *Connection, error) {
+	l := zap.L().With(zap.String("id", deviceID), zap.String("service", service))
+
+	// DenyList check: reject relays to administratively denied devices even if
+	// the pool still has leftover connections from before the deny was issued.
+	if r.isDenied(deviceID) {
+		l.Info("Device denied by admin")
+		return nil, nil, errDeviceDenied
+	}
+
+	// Look up the pool.
+	r.connectionsMu.RLock()
+	pool := r.connections[poolKey{id: deviceID, service: service}]
+	r.connectionsMu.RUnlock()
+	if pool == nil {
+		l.Info("device not online")
+		return nil, nil, errDeviceOffline
+	}
+
+	// Try to acquire an idle connection.
+	targetConn := pool.tryAcquire()
+	if targetConn == nil {
+		// Fast offline: if presence would report the device offline, skip
+		// the wait path to avoid a needless waitTimeout delay.
+		if errors.Is(pool.busyOrOffline(), errDeviceOffline) {
+			l.Info("device offline (stale empty pool)")
+			r.tryCleanupPool(deviceID, pool)
+			return nil, nil, errDeviceOffline
+		}
+
+		// Enter wait path.
+		var waitErr error
+		targetConn, waitErr = r.waitForConnection(pool)
+		if waitErr != nil {
+			if errors.Is(waitErr, errDeviceOffline) {
+				l.Info("device offline (wait timeout)")
+			} else {
+				l.Info("device busy (wait timeout)")
+			}
+			return nil, nil, waitErr
+		}
+	}
+
+	// targetConn acquired (activeCount already incremented by tryAcquire).
+	r.notifyPresence(deviceID)
+	return pool, targetConn, nil
+}
+
+// waitForConnection queues the request behind earlier waiters until a
+// connection is handed to it or the wait times out. Returns errDeviceBusy or
+// errDeviceOffline on timeout depending on pool state.
 func (r *Relay) waitForConnection(pool *DeviceConnPool) (*Connection, error) {
-	if pool.waiterCount.Add(1) > maxWaitersPerDevice {
-		pool.waiterCount.Add(-1)
-		return nil, errDeviceBusy
+	pool.mu.Lock()
+	conn, w, err := pool.enqueueWaiterLocked()
+	pool.mu.Unlock()
+	if w == nil {
+		return conn, err
 	}
-	defer pool.waiterCount.Add(-1)
 
-	timer := time.NewTimer(waitTimeout)
+	timer := time.NewTimer(pool.limits.waitTimeout)
 	defer timer.Stop()
 
-	for {
-		select {
-		case <-pool.notifyCh:
-			if conn := pool.tryAcquire(); conn != nil {
-				return conn, nil
-			}
-			// Another goroutine grabbed it; loop back and wait again.
-		case <-timer.C:
-			// Determine BUSY vs OFFLINE based on pool state.
-			active := pool.activeCount.Load()
-			probing := pool.probingCount.Load()
-			pending := pool.pendingCount.Load()
-			if active > 0 || probing > 0 || pending > 0 {
-				return nil, errDeviceBusy
-			}
-			// No active or probing connections. Check lastRelayTime for reconnect window.
-			lrt := pool.lastRelayTime.Load()
-			if lrt > 0 && time.Since(time.UnixMilli(lrt)) < reconnectWindow {
-				return nil, errDeviceBusy
-			}
-			return nil, errDeviceOffline
+	select {
+	case conn := <-w.ch:
+		return conn, nil
+	case <-timer.C:
+		if conn := pool.leaveQueue(w); conn != nil {
+			return conn, nil
 		}
+		// Determine BUSY vs OFFLINE based on pool state.
+		return nil, pool.busyOrOffline()
 	}
 }
 
-func (r *Relay) relay(targetConn *Connection, reqConn net.Conn, relayDataLen *int64) error {
+// relay bridges reqConn and targetConn. The bytes copied in both directions
+// are added to relayDataLen and to the pool's counter as they flow, and
+// charged to the traffic quota of the pool's owner key. A key using up its
+// quota mid-bridge throttles the bridge, or ends it if over quota relays
+// are refused.
+//
+// The bridge keeps TCP half-close semantics: when one side finishes sending,
+// its FIN is passed on with CloseWrite and the other direction drains until
+// its own EOF, or until it is idle for the session idle or drain timeout,
+// whichever is shorter. An error in either direction ends both.
+func (r *Relay) relay(pool *DeviceConnPool, targetConn *Connection, reqConn net.Conn, relayDataLen *atomic.Int64) error {
 	var errCH = make(chan error, 2)
-	var activelyTimeOut atomic.Bool
-	go func() {
-		n, err := io.Copy(targetConn.Conn, reqConn)
-		atomic.AddInt64(relayDataLen, int64(n))
-		activelyTimeOut.Store(true)
-		// Set a deadline in the past to unblock the reverse io.Copy immediately.
-		// Expected to fail when targetConn was already closed by the remote side.
-		if setErr := targetConn.Conn.SetReadDeadline(time.Now().Add(-time.Second)); setErr != nil {
-			zap.L().Debug("set targetConn read deadline (expected if dst closed first)", zap.Error(setErr))
+	// stopped is set once a direction ended the whole bridge; the error the
+	// other direction then gets is expected.
+	var stopped atomic.Bool
+	counters := []*atomic.Int64{relayDataLen, &pool.bytesRelayed}
+	charge := r.quotaCharger(pool.ownerKeyB64)
+	up, down, releaseThrottles := r.bridgeThrottles(targetConn.ID, pool.ownerKeyB64)
+	session := r.startSession(pool, targetConn, reqConn, relayDataLen)
+	watchDone := make(chan struct{})
+	go r.watchSession(session, watchDone)
+	defer func() {
+		close(watchDone)
+		releaseThrottles()
+		r.endSession(session)
+		r.flushQuota(pool.ownerKeyB64)
+	}()
+	pipe := func(name string, dst, src net.Conn, t throttle) {
+		c := copier{counters: counters, throttle: t, charge: charge}
+		_, err := c.copy(dst, src)
+		if err == nil && halfClose(dst) {
+			zap.L().Debug("relay direction finished, FIN passed on", zap.String("direction", name))
+			session.halfClose()
+			errCH <- nil
+			return
 		}
-		if err != nil {
-			errCH <- fmt.Errorf("reqConn -> targetConn: %w", err)
+		if err != nil && stopped.Load() {
+			errCH <- nil
 			return
 		}
-		errCH <- nil
-		zap.L().Debug("reqConn -> targetConn success")
-	}()
-	go func() {
-		n, err := io.Copy(reqConn, targetConn.Conn)
-		atomic.AddInt64(relayDataLen, int64(n))
-		if !activelyTimeOut.Load() {
-			if err != nil {
-				errCH <- fmt.Errorf("targetConn -> reqConn: %w", err)
-			} else {
-				// Clean EOF: the destination (Rust) finished processing and
-				// closed the bridge connection — normal in the use-once
-				// connection model. The requesting side (Flutter) will close
-				// shortly after (~20 ms drain), at which point the forward
-				// goroutine also completes and relay() returns nil.
-				zap.L().Debug("relay dst finished first (clean EOF)",
-					zap.String("reqConn", reqConn.RemoteAddr().String()))
-				errCH <- nil
+		stopped.Store(true)
+		// A deadline in the past unblocks the other direction immediately.
+		// Expected to fail when a side was already closed.
+		for _, conn := range []net.Conn{reqConn, targetConn.Conn} {
+			if setErr := conn.SetDeadline(time.Now().Add(-time.Second)); setErr != nil {
+				zap.L().Debug("set relay deadline (expected if closed)", zap.Error(setErr))
 			}
+		}
+		if err != nil {
+			errCH <- fmt.Errorf("%s: %w", name, err)
 			return
 		}
 		errCH <- nil
-		zap.L().Debug("targetConn -> reqConn success")
-	}()
+	}
+	go pipe("reqConn -> targetConn", targetConn.Conn, reqConn, up)
+	go pipe("targetConn -> reqConn", reqConn, targetConn.Conn, down)
 	zap.L().Debug("relay start", zap.String("targetConn", targetConn.Conn.RemoteAddr().String()),
 		zap.String("reqConn", reqConn.RemoteAddr().String()))
 	var relayErr error
 	for range 2 {
-		relayErr = <-errCH
-		if relayErr != nil {
-			break
+		if err := <-errCH; err != nil && relayErr == nil {
+			relayErr = err
 		}
 	}
+	if err := session.terminated(); err != nil {
+		return err
+	}
 	return relayErr
 }
 
+// halfClose shuts down the writing side of conn, so that the peer reads EOF
+// while it can still send. It returns false if conn cannot be half-closed.
+func halfClose(conn net.Conn) bool {
+	cw, ok := conn.(interface{ CloseWrite() error })
+	if !ok {
+		return false
+	}
+	if err := cw.CloseWrite(); err != nil {
+		zap.L().Debug("relay CloseWrite failed", zap.Error(err))
+		return false
+	}
+	return true
+}
+
 // --- Admin helpers ---
 
-// CloseDevice is called by the admin API to deny a device and close all idle connections.
-func (r *Relay) CloseDevice(id string) {
+// CloseDevice is called by the admin API to deny a device for the default
+// deny TTL and close all idle connections.
+func (r *Relay) CloseDevice(id string, createdBy string) error {
+	return r.DenyDevice(id, r.denyTTL(), "", createdBy)
+}
+
+// DenyDevice denies a device for ttl, or permanently if ttl is 0, and closes
+// all its idle connections. The entry is persisted.
+func (r *Relay) DenyDevice(id string, ttl time.Duration, reason, createdBy string) error {
 	// Step 1: Write denyList.
-	r.denyListMu.Lock()
-	r.denyList[id] = time.Now().UnixMilli()
-	r.denyListMu.Unlock()
+	now := time.Now()
+	e := DenyEntry{ID: id, CreatedAt: now, Reason: reason, CreatedBy: createdBy}
+	if ttl > 0 {
+		e.ExpiresAt = now.Add(ttl)
+	}
+	if err := r.addDenyEntry(e); err != nil {
+		return err
+	}
 
-	// Step 2: Increment epoch + clear pool.
-	r.connectionsMu.RLock()
-	pool := r.connections[id]
-	r.connectionsMu.RUnlock()
-	if pool == nil {
-		return
+	// Step 2: Increment epoch + clear the pool of every service.
+	pools := r.devicePools(id)
+	if len(pools) == 0 {
+		r.notifyPresence(id)
+		return nil
 	}
 
-	pool.mu.Lock()
-	pool.epoch.Add(1)
-	idleConns := pool.conns
-	pool.conns = nil
-	pool.mu.Unlock()
+	for _, pool := range pools {
+		pool.mu.Lock()
+		pool.epoch.Add(1)
+		idleConns := pool.conns
+		pool.conns = nil
+		pool.mu.Unlock()
 
-	// Close all idle connections outside the lock.
-	for _, c := range idleConns {
-		r.releaseConnection(c)
+		// Close all idle connections outside the lock.
+		for _, c := range idleConns {
+			r.releaseConnection(c)
+		}
+
+		// Try to clean up the pool entry.
+		r.tryCleanupPool(id, pool)
 	}
+	return nil
+}
 
-	// Try to clean up the pool entry.
-	r.tryCleanupPool(id, pool)
+// devicePools returns the pools of every service of id.
+func (r *Relay) devicePools(id string) []*DeviceConnPool {
+	r.connectionsMu.RLock()
+	defer r.connectionsMu.RUnlock()
+	var pools []*DeviceConnPool
+	for key, pool := range r.connections {
+		if key.id == id {
+			pools = append(pools, pool)
+		}
+	}
+	return pools
+}
+
+// poolOwner returns the owner key of the pool of the given service of
+// deviceID, empty if there is no such pool.
+func (r *Relay) poolOwner(deviceID string, service string) string {
+	r.connectionsMu.RLock()
+	defer r.connectionsMu.RUnlock()
+	if pool := r.connections[poolKey{id: deviceID, service: service}]; pool != nil {
+		return pool.ownerKeyB64
+	}
+	return ""
 }
 
 // AllowDevice removes a device ID from the denyList (admin manual override).
-func (r *Relay) AllowDevice(id string) {
+// It returns false if the ID was not denied.
+func (r *Relay) AllowDevice(id string) (bool, error) {
+	if err := r.storage.DeleteDenyEntry(id); err != nil {
+		return false, err
+	}
 	r.denyListMu.Lock()
+	e, ok := r.denyList[id]
 	delete(r.denyList, id)
 	r.denyListMu.Unlock()
+	r.notifyPresence(id)
+	return ok && e.active(time.Now()), nil
 }
@@ -0,0 +1,210 @@
+package relay
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/doraemonkeys/WindSend-Relay/server/protocol"
+	"github.com/doraemonkeys/WindSend-Relay/server/tool"
+	"github.com/doraemonkeys/doraemon/crypto"
+	"go.uber.org/zap"
+)
+
+const (
+	// maxRendezvousCandidates caps the addresses a peer may announce.
+	maxRendezvousCandidates = 8
+	// rendezvousPunchDelay is how long both peers wait after the offer
+	// before connecting, so that their attempts overlap.
+	rendezvousPunchDelay = 300 * time.Millisecond
+	// rendezvousAnswerTimeout bounds the device's candidate answer.
+	rendezvousAnswerTimeout = 5 * time.Second
+	// rendezvousResultTimeout bounds the sender's direct connection attempt.
+	rendezvousResultTimeout = 15 * time.Second
+)
+
+var errUnexpectedAction = errors.New("unexpected action")
+
+// readRendezvousFrame reads an ActionRendezvous head and its body.
+func readRendezvousFrame[T any](conn net.Conn, cipher crypto.SymmetricCipher) (T, error) {
+	var zero T
+	head, err := protocol.ReadReqHead(conn, cipher)
+	if err != nil {
+		return zero, err
+	}
+	if head.Action != protocol.ActionRendezvous {
+		return zero, fmt.Errorf("%w: %s", errUnexpectedAction, head.Action)
+	}
+	return protocol.ReadReq[T](conn, head.DataLen, cipher)
+}
+
+// rendezvousCandidates puts the address the server observes for conn first,
+// followed by the valid, distinct addresses the peer announced.
+func rendezvousCandidates(conn net.Conn, announced []string) []string {
+	candidates := make([]string, 0, maxRendezvousCandidates+1)
+	seen := make(map[netip.AddrPort]bool, maxRendezvousCandidates+1)
+	add := func(s string) {
+		ap, err := netip.ParseAddrPort(s)
+		if err != nil || ap.Port() == 0 || seen[ap] {
+			return
+		}
+		seen[ap] = true
+		candidates = append(candidates, ap.String())
+	}
+	add(conn.RemoteAddr().String())
+	for i, s := range announced {
+		if i == maxRendezvousCandidates {
+			break
+		}
+		add(s)
+	}
+	return candidates
+}
+
+// --- handleRendezvous ---
+
+func (r *Relay) handleRendezvous(conn net.Conn, head protocol.ReqHead, cipher crypto.SymmetricCipher, authKey tool.AES192Key) {
+	defer conn.Close()
+
+	now := time.Now()
+	success := false
+	var relayDataLen atomic.Int64
+	relayOffline := false
+	var bridgeErr error
+
+	l := zap.L().With(zap.String("Action", "Rendezvous"), zap.String("ReqAddr", conn.RemoteAddr().String()))
+	req, err := protocol.ReadReq[protocol.RendezvousReq](conn, head.DataLen, cipher)
+	if err != nil {
+		l.Error("Failed to read rendezvous request", zap.Error(err))
+		return
+	}
+
+	if !r.allowID(req.SecretKeyID, authKey) {
+		l.Error("ID rate limit exceeded", zap.String("id", req.SecretKeyID))
+		_ = protocol.SendRespHeadError(conn, head.Action, "ID rate limit exceeded", cipher)
+		return
+	}
+
+	deviceID := req.SecretKeyID
+	l = l.With(zap.String("ID", deviceID))
+	l.Info("Rendezvous request")
+	defer func() {
+		outcome := relayOutcome(success, relayOffline, bridgeErr)
+		r.storage.AddRelayStatistic(deviceID, outcome, int(time.Since(now).Milliseconds()), relayDataLen.Load())
+	}()
+
+	authKeyB64 := ""
+	if authKey != nil {
+		authKeyB64 = base64.StdEncoding.EncodeToString(authKey)
+	}
+	// The offer reveals the device's addresses, so a device registered with
+	// another secret key looks offline, as in ping.
+	owner := r.poolOwner(deviceID, req.Service)
+	if owner != "" && owner != authKeyB64 {
+		relayOffline = true
+		_ = protocol.SendRespHead(conn, protocol.ActionRendezvous, protocol.StatusDeviceOffline, "device not online", cipher)
+		return
+	}
+	// The fallback bridge would count against the quota.
+	if r.overQuota(owner) {
+		l.Info("Traffic quota exceeded")
+		bridgeErr = errQuotaExceeded
+		_ = protocol.SendRespHead(conn, protocol.ActionRendezvous, protocol.StatusQuotaExceeded, "traffic quota exceeded", cipher)
+		return
+	}
+	ip := remoteIP(conn)
+	if !r.reserveIP(ip, true) {
+		l.Info("Too many relays from this address")
+		_ = protocol.SendRespHeadError(conn, protocol.ActionRendezvous, "too many relays from this address", cipher)
+		return
+	}
+	defer r.releaseIP(ip, true)
+
+	pool, targetConn, err := r.acquireConnection(deviceID, req.Service)
+	if err != nil {
+		switch {
+		case errors.Is(err, errDeviceDenied):
+			_ = protocol.SendRespHeadError(conn, protocol.ActionRendezvous, "device denied by admin", cipher)
+		case errors.Is(err, errDeviceOffline):
+			relayOffline = true
+			_ = protocol.SendRespHead(conn, protocol.ActionRendezvous, protocol.StatusDeviceOffline, "device not online", cipher)
+		default:
+			_ = protocol.SendRespHead(conn, protocol.ActionRendezvous, protocol.StatusDeviceBusy, "device busy", cipher)
+		}
+		return
+	}
+	defer func() {
+		r.releaseActiveConnection(pool, targetConn)
+		r.tryCleanupPool(deviceID, pool)
+	}()
+
+	// Ask the device for its candidates.
+	_ = targetConn.Conn.SetDeadline(time.Now().Add(rendezvousAnswerTimeout))
+	err = protocol.SendRendezvousQuery(targetConn.Conn, targetConn.Cipher)
+	if err != nil {
+		l.Error("Failed to send rendezvous query to targetConn", zap.Error(err))
+		_ = protocol.SendRespHeadError(conn, protocol.ActionRendezvous, "device unreachable", cipher)
+		return
+	}
+	answer, err := readRendezvousFrame[protocol.RendezvousCandidates](targetConn.Conn, targetConn.Cipher)
+	if err != nil {
+		l.Error("Failed to read rendezvous answer from targetConn", zap.Error(err))
+		_ = protocol.SendRespHeadError(conn, protocol.ActionRendezvous, "device unreachable", cipher)
+		return
+	}
+
+	// Offer each peer the other's candidates, as close together as possible.
+	delayMs := int(rendezvousPunchDelay.Milliseconds())
+	err = protocol.SendRendezvousOffer(targetConn.Conn, protocol.RendezvousOffer{
+		Candidates: rendezvousCandidates(conn, req.Candidates),
+		DelayMs:    delayMs,
+	}, targetConn.Cipher)
+	_ = targetConn.Conn.SetDeadline(time.Time{})
+	if err != nil {
+		l.Error("Failed to send rendezvous offer to targetConn", zap.Error(err))
+		_ = protocol.SendRespHeadError(conn, protocol.ActionRendezvous, "device unreachable", cipher)
+		return
+	}
+	err = protocol.SendRendezvousOfferResp(conn, protocol.RendezvousOffer{
+		Candidates: rendezvousCandidates(targetConn.Conn, answer.Candidates),
+		DelayMs:    delayMs,
+	}, cipher)
+	if err != nil {
+		l.Error("Failed to send rendezvous offer to client", zap.Error(err))
+		return
+	}
+
+	// Wait for the sender to report the outcome and pass it on.
+	_ = conn.SetReadDeadline(time.Now().Add(rendezvousResultTimeout))
+	result, err := readRendezvousFrame[protocol.RendezvousResult](conn, cipher)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		l.Error("Failed to read rendezvous result", zap.Error(err))
+		return
+	}
+	_ = targetConn.Conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	err = protocol.SendRendezvousResult(targetConn.Conn, result, targetConn.Cipher)
+	_ = targetConn.Conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		l.Error("Failed to send rendezvous result to targetConn", zap.Error(err))
+		return
+	}
+	if result.Direct {
+		l.Info("Rendezvous direct connection established")
+		success = true
+		return
+	}
+
+	// Fall back to the bridge.
+	l.Info("Rendezvous falling back to relay")
+	bridgeErr = r.relay(pool, targetConn, conn, &relayDataLen)
+	if bridgeErr != nil {
+		l.Error("relay data failed", zap.Error(bridgeErr))
+		return
+	}
+	success = true
+}
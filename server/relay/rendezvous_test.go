@@ -0,0 +1,173 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/doraemonkeys/WindSend-Relay/server/protocol"
+	"github.com/doraemonkeys/WindSend-Relay/server/storage"
+	"github.com/doraemonkeys/doraemon/crypto"
+)
+
+// rendezvousDevice plays the device side of a rendezvous on conn. It
+// listens on loopback, announces that address and returns what it received
+// over the direct connection or, on fallback, over the bridge.
+func rendezvousDevice(conn net.Conn, cipher crypto.SymmetricCipher, offerCh chan<- protocol.RendezvousOffer) (string, error) {
+	defer conn.Close()
+	head, err := protocol.ReadReqHead(conn, cipher)
+	if err != nil {
+		return "", err
+	}
+	if head.Action != protocol.ActionRendezvous || head.DataLen != 0 {
+		return "", fmt.Errorf("unexpected query %+v", head)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer ln.Close()
+	err = protocol.SendRendezvousCandidates(conn, protocol.RendezvousCandidates{
+		Candidates: []string{ln.Addr().String(), "not-an-address", "127.0.0.1:0"},
+	}, cipher)
+	if err != nil {
+		return "", err
+	}
+	offer, err := readRendezvousFrame[protocol.RendezvousOffer](conn, cipher)
+	if err != nil {
+		return "", err
+	}
+	offerCh <- offer
+
+	// Accept a direct connection while waiting for the result.
+	direct := make(chan string, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		data, _ := io.ReadAll(c)
+		direct <- string(data)
+	}()
+
+	result, err := readRendezvousFrame[protocol.RendezvousResult](conn, cipher)
+	if err != nil {
+		return "", err
+	}
+	if result.Direct {
+		select {
+		case data := <-direct:
+			return data, nil
+		case <-time.After(2 * time.Second):
+			return "", errors.New("no direct connection")
+		}
+	}
+	data, err := io.ReadAll(conn)
+	return string(data), err
+}
+
+func TestRendezvous(t *testing.T) {
+	for _, direct := range []bool{true, false} {
+		t.Run(fmt.Sprintf("direct=%v", direct), func(t *testing.T) {
+			r := newTestRelay(t)
+			r.storage = storage.NewStorage(filepath.Join(t.TempDir(), "relay.db"))
+			cipher := newTestCipher(t)
+
+			devClient, devServer := tcpPair(t)
+			pool := newDeviceConnPool()
+			pool.conns = append(pool.conns, &Connection{ID: "device", Conn: devServer, Cipher: cipher})
+			r.connections[poolKey{id: "device"}] = pool
+
+			type deviceResult struct {
+				data string
+				err  error
+			}
+			deviceOffer := make(chan protocol.RendezvousOffer, 1)
+			deviceDone := make(chan deviceResult, 1)
+			go func() {
+				data, err := rendezvousDevice(devClient, cipher, deviceOffer)
+				deviceDone <- deviceResult{data, err}
+			}()
+
+			client, server := tcpPair(t)
+			body := encryptBody(t, cipher, protocol.RendezvousReq{
+				CommonReq:  protocol.CommonReq{SecretKeyID: "device"},
+				Candidates: []string{"192.168.1.2:5000"},
+			})
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+				_, _ = client.Write(body)
+				r.handleRendezvous(server, protocol.ReqHead{Action: protocol.ActionRendezvous, DataLen: len(body)}, cipher, nil)
+			}()
+
+			var head protocol.RespHead
+			readFrame(t, client, cipher, &head)
+			if head.Code != protocol.StatusSuccess {
+				t.Fatalf("rendezvous failed: %+v", head)
+			}
+			offer, err := protocol.ReadReq[protocol.RendezvousOffer](client, head.DataLen, cipher)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(offer.Candidates) != 2 || offer.Candidates[0] != devClient.LocalAddr().String() {
+				t.Fatalf("sender offer = %+v", offer)
+			}
+			devOffer := <-deviceOffer
+			if !slices.Equal(devOffer.Candidates, []string{client.LocalAddr().String(), "192.168.1.2:5000"}) {
+				t.Fatalf("device offer = %+v", devOffer)
+			}
+
+			if direct {
+				// The observed address is the device's relay connection and
+				// refuses; the announced listener accepts.
+				var peer net.Conn
+				for _, addr := range offer.Candidates {
+					if peer, err = net.DialTimeout("tcp", addr, time.Second); err == nil {
+						break
+					}
+				}
+				if peer == nil {
+					t.Fatal("no candidate reachable")
+				}
+				if _, err := peer.Write([]byte("direct")); err != nil {
+					t.Fatal(err)
+				}
+				_ = peer.Close()
+			}
+			if err := protocol.SendRendezvousResult(client, protocol.RendezvousResult{Direct: direct}, cipher); err != nil {
+				t.Fatal(err)
+			}
+			if !direct {
+				if _, err := client.Write([]byte("bridged")); err != nil {
+					t.Fatal(err)
+				}
+				_ = client.(*net.TCPConn).CloseWrite()
+			}
+
+			res := <-deviceDone
+			want := "bridged"
+			if direct {
+				want = "direct"
+			}
+			if res.err != nil || res.data != want {
+				t.Fatalf("device got %q, err %v; want %q", res.data, res.err, want)
+			}
+			<-done
+			stat, err := r.storage.GetHistoryStatisticByID("device")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stat.TotalRelayCount != 1 || stat.TotalRelayErrCount != 0 {
+				t.Fatalf("statistic = %+v", stat)
+			}
+		})
+	}
+}
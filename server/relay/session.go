@@ -0,0 +1,194 @@
+package relay
+
+import (
+	"cmp"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errSessionKilled      = errors.New("session killed by admin")
+	errSessionIdle        = errors.New("session idle timeout")
+	errSessionMaxDuration = errors.New("session reached its maximum duration")
+	errSessionDrain       = errors.New("half-closed session did not drain in time")
+)
+
+// relaySession is a bridge in progress, registered for the admin API.
+type relaySession struct {
+	id         uint64
+	deviceID   string
+	service    string
+	start      time.Time
+	reqConn    net.Conn
+	targetConn net.Conn
+	// bytes is the live byte count of the bridge, both directions.
+	bytes *atomic.Int64
+	// activity is the counter watchSession checks for idleness: bytes,
+	// or the sender's stream for the sessions of a multicast.
+	activity *atomic.Int64
+	// halfClosed is closed once one direction finished sending.
+	halfClosed    chan struct{}
+	halfCloseOnce sync.Once
+	// reason is why the session was torn down, nil while it runs its course.
+	reason atomic.Pointer[error]
+}
+
+// terminate tears down both sides of the bridge, unless it was already
+// terminated for another reason.
+func (s *relaySession) terminate(reason error) {
+	if !s.reason.CompareAndSwap(nil, &reason) {
+		return
+	}
+	_ = s.reqConn.Close()
+	_ = s.targetConn.Close()
+}
+
+// halfClose records that one direction of the bridge finished sending.
+func (s *relaySession) halfClose() {
+	s.halfCloseOnce.Do(func() { close(s.halfClosed) })
+}
+
+// terminated returns the reason the session was torn down, nil if it was not.
+func (s *relaySession) terminated() error {
+	if reason := s.reason.Load(); reason != nil {
+		return *reason
+	}
+	return nil
+}
+
+// startSession registers the bridge between reqConn and targetConn. The
+// caller must call endSession when the bridge is over.
+func (r *Relay) startSession(pool *DeviceConnPool, targetConn *Connection, reqConn net.Conn, bytes *atomic.Int64) *relaySession {
+	s := &relaySession{
+		id:         r.nextSessionID.Add(1),
+		deviceID:   targetConn.ID,
+		service:    pool.service,
+		start:      time.Now(),
+		reqConn:    reqConn,
+		targetConn: targetConn.Conn,
+		bytes:      bytes,
+		activity:   bytes,
+		halfClosed: make(chan struct{}),
+	}
+	r.sessionsMu.Lock()
+	r.sessions[s.id] = s
+	r.sessionsMu.Unlock()
+	return s
+}
+
+func (r *Relay) endSession(s *relaySession) {
+	r.sessionsMu.Lock()
+	delete(r.sessions, s.id)
+	r.sessionsMu.Unlock()
+}
+
+// SessionStatus describes a bridge in progress.
+type SessionStatus struct {
+	ID       uint64
+	DeviceID string
+	Service  string
+	ReqAddr  string
+	Start    time.Time
+	Bytes    int64
+}
+
+// GetSessions returns the bridges in progress, oldest first.
+func (r *Relay) GetSessions() []SessionStatus {
+	r.sessionsMu.RLock()
+	sessions := make([]SessionStatus, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		sessions = append(sessions, SessionStatus{
+			ID:       s.id,
+			DeviceID: s.deviceID,
+			Service:  s.service,
+			ReqAddr:  s.reqConn.RemoteAddr().String(),
+			Start:    s.start,
+			Bytes:    s.bytes.Load(),
+		})
+	}
+	r.sessionsMu.RUnlock()
+	slices.SortFunc(sessions, func(a, b SessionStatus) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return sessions
+}
+
+// KillSession tears down both sides of a bridge. It returns false if no
+// such session is in progress.
+func (r *Relay) KillSession(id uint64) bool {
+	r.sessionsMu.RLock()
+	s, ok := r.sessions[id]
+	r.sessionsMu.RUnlock()
+	if !ok {
+		return false
+	}
+	s.terminate(errSessionKilled)
+	return true
+}
+
+// watchSession tears down s once it has been idle for the configured idle
+// timeout or has run for the maximum duration, until done is closed. Once
+// s is half-closed, it is also torn down after the drain timeout without
+// activity, so that a bridge cannot hang on a side that never finishes.
+// Activity is seen through s.activity, which the copier advances with
+// every burst of data.
+func (r *Relay) watchSession(s *relaySession, done <-chan struct{}) {
+	idleTimeout := time.Duration(r.config.Session.IdleTimeoutSeconds) * time.Second
+	maxDuration := time.Duration(r.config.Session.MaxDurationSeconds) * time.Second
+	drainTimeout := time.Duration(r.config.Session.DrainTimeoutSeconds) * time.Second
+	var deadline, tick <-chan time.Time
+	if maxDuration > 0 {
+		timer := time.NewTimer(maxDuration - time.Since(s.start))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	var ticker *time.Ticker
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+	if idleTimeout > 0 {
+		ticker = time.NewTicker(idleTimeout / 4)
+		tick = ticker.C
+	}
+	halfClosed := s.halfClosed
+	if drainTimeout <= 0 {
+		halfClosed = nil
+	}
+	idleErr := errSessionIdle
+	lastBytes, lastActive := s.activity.Load(), s.start
+	for {
+		select {
+		case <-done:
+			return
+		case <-deadline:
+			s.terminate(errSessionMaxDuration)
+			return
+		case <-halfClosed:
+			halfClosed = nil
+			if idleTimeout > 0 && idleTimeout <= drainTimeout {
+				continue
+			}
+			idleTimeout, idleErr = drainTimeout, errSessionDrain
+			lastBytes, lastActive = s.activity.Load(), time.Now()
+			if ticker == nil {
+				ticker = time.NewTicker(idleTimeout / 4)
+				tick = ticker.C
+			} else {
+				ticker.Reset(idleTimeout / 4)
+			}
+		case now := <-tick:
+			if bytes := s.activity.Load(); bytes != lastBytes {
+				lastBytes, lastActive = bytes, now
+			} else if now.Sub(lastActive) >= idleTimeout {
+				s.terminate(idleErr)
+				return
+			}
+		}
+	}
+}
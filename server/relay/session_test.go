@@ -0,0 +1,207 @@
+package relay
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/doraemonkeys/WindSend-Relay/server/storage"
+)
+
+// startBridge runs r.relay between a requester and a device and returns
+// their peers and the result of relay. The device side is TCP; so is the
+// requester side if tcp is set, making the bridge splice.
+func startBridge(t *testing.T, r *Relay, tcp bool) (reqPeer, devPeer net.Conn, done <-chan error) {
+	t.Helper()
+	return startOwnedBridge(t, r, tcp, "")
+}
+
+// startOwnedBridge is startBridge to a device registered with ownerKeyB64.
+func startOwnedBridge(t *testing.T, r *Relay, tcp bool, ownerKeyB64 string) (reqPeer, devPeer net.Conn, done <-chan error) {
+	t.Helper()
+	var reqConn net.Conn
+	if tcp {
+		reqPeer, reqConn = tcpPair(t)
+	} else {
+		reqPeer, reqConn = net.Pipe()
+		t.Cleanup(func() {
+			_ = reqPeer.Close()
+			_ = reqConn.Close()
+		})
+	}
+	targetConn, devPeer := tcpPair(t)
+	pool := newDeviceConnPool()
+	pool.ownerKeyB64 = ownerKeyB64
+	target := &Connection{ID: "dev", Conn: targetConn}
+
+	result := make(chan error, 1)
+	go func() {
+		var relayDataLen atomic.Int64
+		result <- r.relay(pool, target, reqConn, &relayDataLen)
+	}()
+	return reqPeer, devPeer, result
+}
+
+func TestKillSession(t *testing.T) {
+	r := newTestRelay(t)
+	reqPeer, devPeer, done := startBridge(t, r, false)
+
+	if _, err := reqPeer.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(devPeer, buf); err != nil {
+		t.Fatal(err)
+	}
+	sessions := r.GetSessions()
+	if len(sessions) != 1 || sessions[0].DeviceID != "dev" || sessions[0].Bytes != 5 {
+		t.Fatalf("sessions = %+v, want one bridge to dev with 5 bytes", sessions)
+	}
+	if r.KillSession(sessions[0].ID + 1) {
+		t.Fatal("KillSession of an unknown ID succeeded")
+	}
+	if !r.KillSession(sessions[0].ID) {
+		t.Fatal("KillSession failed")
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, errSessionKilled) {
+			t.Fatalf("relay = %v, want errSessionKilled", err)
+		}
+		if got := relayOutcome(false, false, err); got != storage.RelayKilled {
+			t.Fatalf("outcome = %v, want %v", got, storage.RelayKilled)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("relay still running after KillSession")
+	}
+	if sessions := r.GetSessions(); len(sessions) != 0 {
+		t.Fatalf("sessions = %+v after kill, want none", sessions)
+	}
+	// Both peers must see their connection end rather than time out.
+	for name, peer := range map[string]net.Conn{"requester": reqPeer, "device": devPeer} {
+		_ = peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var netErr net.Error
+		if _, err := io.ReadAll(peer); errors.As(err, &netErr) && netErr.Timeout() {
+			t.Fatalf("%s side still open after KillSession", name)
+		}
+	}
+}
+
+func TestSessionLimits(t *testing.T) {
+	tests := []struct {
+		name        string
+		idleTimeout int
+		maxDuration int
+		// trickle keeps bytes flowing while the bridge is up.
+		trickle bool
+		want    error
+		outcome storage.RelayOutcome
+		// after is the earliest the bridge may be torn down.
+		after time.Duration
+	}{
+		{"idle", 1, 0, false, errSessionIdle, storage.RelayIdleTimeout, time.Second},
+		{"max duration", 0, 1, true, errSessionMaxDuration, storage.RelayMaxDuration, time.Second},
+		{"busy within idle timeout", 1, 2, true, errSessionMaxDuration, storage.RelayMaxDuration, 2 * time.Second},
+	}
+	// Over TCP on both sides the bridge splices; a trickle of small writes
+	// must still count as activity.
+	for _, tt := range tests {
+		for _, tcp := range []bool{false, true} {
+			name := tt.name + "/pipe"
+			if tcp {
+				name = tt.name + "/tcp"
+			}
+			t.Run(name, func(t *testing.T) {
+				r := newTestRelay(t)
+				r.config.Session.IdleTimeoutSeconds = tt.idleTimeout
+				r.config.Session.MaxDurationSeconds = tt.maxDuration
+				start := time.Now()
+				reqPeer, devPeer, done := startBridge(t, r, tcp)
+				go func() { _, _ = io.Copy(io.Discard, devPeer) }()
+				if tt.trickle {
+					go func() {
+						for {
+							if _, err := reqPeer.Write([]byte("x")); err != nil {
+								return
+							}
+							time.Sleep(100 * time.Millisecond)
+						}
+					}()
+				}
+
+				var err error
+				select {
+				case err = <-done:
+				case <-time.After(5 * time.Second):
+					t.Fatal("bridge not torn down")
+				}
+				if !errors.Is(err, tt.want) {
+					t.Fatalf("relay = %v, want %v", err, tt.want)
+				}
+				if elapsed := time.Since(start); elapsed < tt.after {
+					t.Fatalf("torn down after %v, want at least %v", elapsed, tt.after)
+				}
+				if got := relayOutcome(false, false, err); got != tt.outcome {
+					t.Fatalf("outcome = %v, want %v", got, tt.outcome)
+				}
+			})
+		}
+	}
+}
+
+func TestHalfClosedSessionDrains(t *testing.T) {
+	for _, busy := range []bool{false, true} {
+		name := "idle"
+		if busy {
+			name = "busy"
+		}
+		t.Run(name, func(t *testing.T) {
+			r := newTestRelay(t)
+			// With the idle timeout disabled, only the drain timeout ends a
+			// bridge whose device never finishes.
+			r.config.Session.IdleTimeoutSeconds = 0
+			r.config.Session.DrainTimeoutSeconds = 1
+			reqPeer, devPeer, done := startBridge(t, r, true)
+			go func() { _, _ = io.Copy(io.Discard, devPeer) }()
+			if busy {
+				// The device keeps sending for 1.5s: a busy drain must not
+				// be cut.
+				go func() {
+					for range 15 {
+						if _, err := devPeer.Write([]byte("x")); err != nil {
+							return
+						}
+						time.Sleep(100 * time.Millisecond)
+					}
+				}()
+			}
+			if err := reqPeer.(*net.TCPConn).CloseWrite(); err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+
+			var err error
+			select {
+			case err = <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("half-closed bridge not torn down")
+			}
+			if !errors.Is(err, errSessionDrain) {
+				t.Fatalf("relay = %v, want errSessionDrain", err)
+			}
+			want := time.Second
+			if busy {
+				want = 2 * time.Second
+			}
+			if elapsed := time.Since(start); elapsed < want {
+				t.Fatalf("torn down after %v, want at least %v", elapsed, want)
+			}
+			if got := relayOutcome(false, false, err); got != storage.RelayIdleTimeout {
+				t.Fatalf("outcome = %v, want idle timeout", got)
+			}
+		})
+	}
+}
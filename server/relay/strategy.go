@@ -0,0 +1,52 @@
+package relay
+
+import (
+	"fmt"
+)
+
+// acquireStrategy decides which idle connection of a pool serves the next
+// relay.
+type acquireStrategy int
+
+const (
+	// acquireFIFO takes the oldest idle connection.
+	acquireFIFO acquireStrategy = iota
+	// acquireLIFO takes the freshest idle connection, the one least likely
+	// to have been dropped silently by a NAT.
+	acquireLIFO
+	// acquireRecentProbe takes the connection that most recently proved
+	// alive, by registering or answering a heartbeat probe.
+	acquireRecentProbe
+)
+
+func parseAcquireStrategy(s string) (acquireStrategy, error) {
+	switch s {
+	case "", "fifo":
+		return acquireFIFO, nil
+	case "lifo":
+		return acquireLIFO, nil
+	case "recent_probe":
+		return acquireRecentProbe, nil
+	}
+	return 0, fmt.Errorf("unknown acquire strategy %q", s)
+}
+
+// pick returns the index in conns of the connection to acquire. conns must
+// not be empty.
+func (s acquireStrategy) pick(conns []*Connection) int {
+	switch s {
+	case acquireLIFO:
+		return len(conns) - 1
+	case acquireRecentProbe:
+		best := 0
+		for i, c := range conns {
+			// On a tie prefer the later, i.e. more recently inserted, one.
+			if !c.LastHeartbeat.Before(conns[best].LastHeartbeat) {
+				best = i
+			}
+		}
+		return best
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,67 @@
+package relay
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAcquireStrategies(t *testing.T) {
+	base := time.Now()
+	// Inserted oldest first; "b" answered the most recent heartbeat probe.
+	newPool := func(strategy acquireStrategy) *DeviceConnPool {
+		pool := newDeviceConnPool()
+		pool.strategy = strategy
+		pool.conns = []*Connection{
+			{ID: "a", LastHeartbeat: base},
+			{ID: "b", LastHeartbeat: base.Add(3 * time.Second)},
+			{ID: "c", LastHeartbeat: base.Add(time.Second)},
+		}
+		return pool
+	}
+
+	tests := []struct {
+		name     string
+		strategy string
+		want     []string
+	}{
+		{"fifo", "fifo", []string{"a", "b", "c"}},
+		{"default", "", []string{"a", "b", "c"}},
+		{"lifo", "lifo", []string{"c", "b", "a"}},
+		{"recent_probe", "recent_probe", []string{"b", "c", "a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strategy, err := parseAcquireStrategy(tt.strategy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pool := newPool(strategy)
+			for i, want := range tt.want {
+				c := pool.tryAcquire()
+				if c == nil || c.ID != want {
+					t.Fatalf("acquire #%d = %v, want %s", i, c, want)
+				}
+			}
+			if pool.tryAcquire() != nil {
+				t.Fatal("pool should be empty")
+			}
+			if got := pool.activeCount.Load(); got != int32(len(tt.want)) {
+				t.Fatalf("activeCount = %d", got)
+			}
+		})
+	}
+}
+
+func TestRecentProbePrefersLaterOnTie(t *testing.T) {
+	at := time.Now()
+	conns := []*Connection{{ID: "a", LastHeartbeat: at}, {ID: "b", LastHeartbeat: at}}
+	if i := acquireRecentProbe.pick(conns); i != 1 {
+		t.Fatalf("pick = %d, want 1", i)
+	}
+}
+
+func TestParseAcquireStrategyRejectsUnknown(t *testing.T) {
+	if _, err := parseAcquireStrategy("random"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,244 @@
+package relay
+
+import (
+	"encoding/base64"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/doraemonkeys/WindSend-Relay/server/protocol"
+	"github.com/doraemonkeys/WindSend-Relay/server/tool"
+	"github.com/doraemonkeys/doraemon/crypto"
+	"go.uber.org/zap"
+)
+
+const (
+	// maxSubscribeIDs caps the number of device IDs in one subscription.
+	maxSubscribeIDs = 64
+	// subscribeHeartbeatInterval is how often an idle subscribe connection
+	// is sent a heartbeat, so that dead subscribers are noticed.
+	subscribeHeartbeatInterval = 30 * time.Second
+	// subscribeWriteTimeout bounds a single event or heartbeat write.
+	subscribeWriteTimeout = 5 * time.Second
+)
+
+// subscriber is one ActionSubscribe connection.
+//
+// Events are coalesced per device ID: publish never blocks, and a slow
+// subscriber only ever receives the latest presence of each device.
+type subscriber struct {
+	ids        []string
+	authKeyB64 string
+
+	mu sync.Mutex
+	// pending holds presence changes not yet written to the connection.
+	pending map[string]protocol.DevicePresence
+	// sent holds the last presence written for each device ID.
+	sent map[string]protocol.DevicePresence
+
+	// notifyCh is a buffered-1 channel that wakes the writer when pending
+	// is not empty.
+	notifyCh chan struct{}
+}
+
+func newSubscriber(ids []string, authKeyB64 string) *subscriber {
+	return &subscriber{
+		ids:        ids,
+		authKeyB64: authKeyB64,
+		pending:    make(map[string]protocol.DevicePresence, len(ids)),
+		sent:       make(map[string]protocol.DevicePresence, len(ids)),
+		notifyCh:   make(chan struct{}, 1),
+	}
+}
+
+// publish queues a presence for deviceID unless it was the last one sent.
+func (s *subscriber) publish(deviceID string, presence protocol.DevicePresence) {
+	s.mu.Lock()
+	if s.sent[deviceID] == presence {
+		delete(s.pending, deviceID)
+		s.mu.Unlock()
+		return
+	}
+	s.pending[deviceID] = presence
+	s.mu.Unlock()
+	select {
+	case s.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+// takePending returns the queued events and records them as sent.
+func (s *subscriber) takePending() []protocol.PresenceEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := make([]protocol.PresenceEvent, 0, len(s.pending))
+	for id, presence := range s.pending {
+		events = append(events, protocol.PresenceEvent{ID: id, Presence: presence})
+		s.sent[id] = presence
+	}
+	clear(s.pending)
+	return events
+}
+
+func (r *Relay) addSubscriber(sub *subscriber) {
+	r.subscribersMu.Lock()
+	defer r.subscribersMu.Unlock()
+	for _, id := range sub.ids {
+		subs := r.subscribers[id]
+		if subs == nil {
+			subs = make(map[*subscriber]struct{})
+			r.subscribers[id] = subs
+		}
+		subs[sub] = struct{}{}
+	}
+}
+
+func (r *Relay) removeSubscriber(sub *subscriber) {
+	r.subscribersMu.Lock()
+	defer r.subscribersMu.Unlock()
+	for _, id := range sub.ids {
+		subs := r.subscribers[id]
+		delete(subs, sub)
+		if len(subs) == 0 {
+			delete(r.subscribers, id)
+		}
+	}
+}
+
+// notifyPresence pushes the current presence of deviceID to its subscribers.
+// It is cheap when nobody subscribes to deviceID, so callers invoke it after
+// any pool change that might alter presence: creation, activation, drain
+// by tryAcquire and cleanup by tryCleanupPool.
+func (r *Relay) notifyPresence(deviceID string) {
+	r.subscribersMu.RLock()
+	subs := r.subscribers[deviceID]
+	if len(subs) == 0 {
+		r.subscribersMu.RUnlock()
+		return
+	}
+	targets := make([]*subscriber, 0, len(subs))
+	for sub := range subs {
+		targets = append(targets, sub)
+	}
+	r.subscribersMu.RUnlock()
+
+	for _, sub := range targets {
+		// Same tenancy rule as ping: a device registered with a secret key is
+		// only visible to callers holding that key.
+		if presence, ok := r.devicePresence(deviceID, sub.authKeyB64); ok {
+			sub.publish(deviceID, presence)
+		}
+	}
+}
+
+// --- handleSubscribe ---
+
+func (r *Relay) handleSubscribe(conn net.Conn, head protocol.ReqHead, cipher crypto.SymmetricCipher, authKey tool.AES192Key) {
+	defer conn.Close()
+
+	l := zap.L().With(zap.String("Action", "Subscribe"), zap.String("addr", conn.RemoteAddr().String()))
+	req, err := protocol.ReadReq[protocol.SubscribeReq](conn, head.DataLen, cipher)
+	if err != nil {
+		l.Error("Failed to read subscribe request", zap.Error(err))
+		return
+	}
+
+	ids := make([]string, 0, len(req.IDs))
+	seen := make(map[string]bool, len(req.IDs))
+	for _, id := range req.IDs {
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 || len(ids) > maxSubscribeIDs {
+		l.Error("Invalid subscribe ID count", zap.Int("count", len(ids)))
+		_ = protocol.SendRespHeadError(conn, head.Action, "invalid subscribe ID count", cipher)
+		return
+	}
+	for _, id := range ids {
+		if !r.allowID(id, authKey) {
+			l.Error("ID rate limit exceeded", zap.String("id", id))
+			_ = protocol.SendRespHeadError(conn, head.Action, "ID rate limit exceeded", cipher)
+			return
+		}
+	}
+
+	// A subscription holds a connection open, so it counts toward MaxConn.
+	if r.globalConnCount.Add(1) > int32(r.config.MaxConn) {
+		r.globalConnCount.Add(-1)
+		l.Error("Too many connections (global)")
+		_ = protocol.SendRespHeadError(conn, head.Action, "Too many connections", cipher)
+		return
+	}
+	defer r.globalConnCount.Add(-1)
+
+	authKeyB64 := ""
+	if authKey != nil {
+		authKeyB64 = base64.StdEncoding.EncodeToString(authKey)
+	}
+	sub := newSubscriber(ids, authKeyB64)
+
+	err = protocol.SendRespHeadOk(conn, head.Action, cipher)
+	if err != nil {
+		l.Error("Failed to send OK", zap.Error(err))
+		return
+	}
+
+	r.addSubscriber(sub)
+	defer r.removeSubscriber(sub)
+	l.Info("Subscription started", zap.Strings("ids", ids))
+
+	// Initial snapshot, so the client does not have to wait for a change.
+	for _, id := range ids {
+		r.notifyPresence(id)
+	}
+
+	// The client sends nothing but heartbeats or ActionClose; any read error
+	// ends the subscription.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			head, err := protocol.ReadReqHead(conn, cipher)
+			if err != nil {
+				return
+			}
+			if head.Action != protocol.ActionHeartbeat {
+				return
+			}
+			if head.DataLen > 0 {
+				if _, err := protocol.ReadReq[protocol.HeartbeatReq](conn, head.DataLen, cipher); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(subscribeHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			l.Info("Subscription ended")
+			return
+		case <-sub.notifyCh:
+			for _, event := range sub.takePending() {
+				_ = conn.SetWriteDeadline(time.Now().Add(subscribeWriteTimeout))
+				if err := protocol.SendPresenceEvent(conn, event, cipher); err != nil {
+					l.Info("Failed to send presence event", zap.Error(err))
+					return
+				}
+			}
+			_ = conn.SetWriteDeadline(time.Time{})
+		case <-ticker.C:
+			_ = conn.SetWriteDeadline(time.Now().Add(subscribeWriteTimeout))
+			if err := protocol.SendHeartbeatNoResp(conn, cipher); err != nil {
+				l.Info("Failed to send subscribe heartbeat", zap.Error(err))
+				return
+			}
+			_ = conn.SetWriteDeadline(time.Time{})
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package relay
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/doraemonkeys/WindSend-Relay/server/config"
+	"github.com/doraemonkeys/WindSend-Relay/server/protocol"
+	"github.com/doraemonkeys/WindSend-Relay/server/tool"
+	"github.com/doraemonkeys/doraemon/crypto"
+)
+
+func newTestRelay(t *testing.T) *Relay {
+	t.Helper()
+	return &Relay{
+		config:         config.Config{MaxConn: 100},
+		connections:    make(map[poolKey]*DeviceConnPool),
+		keyConnLimit:   make(map[string]*SecretLimit),
+		denyList:       make(map[string]DenyEntry),
+		subscribers:    make(map[string]map[*subscriber]struct{}),
+		idRateLimiter:  newRateLimiter(time.Minute),
+		ipRateLimiter:  newRateLimiter(time.Minute),
+		keyRateLimiter: newRateLimiter(time.Minute),
+
+		globalBandwidth:  newBandwidth(0),
+		deviceBandwidths: make(map[string]*deviceLimit),
+		sessions:         make(map[uint64]*relaySession),
+		globalACL:        newACL(nil, nil),
+		ipBans:           make(map[netip.Addr]*ipBan),
+		ipUsage:          make(map[netip.Addr]*ipUsage),
+	}
+}
+
+func newTestCipher(t *testing.T) crypto.SymmetricCipher {
+	t.Helper()
+	c, err := crypto.NewAESGCM(tool.HashToAES192Key([]byte("relay-test")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// readFrame reads one length-prefixed, encrypted JSON frame into v.
+func readFrame(t *testing.T, conn net.Conn, cipher crypto.SymmetricCipher, v any) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, binary.LittleEndian.Uint32(lenBuf[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	plain, err := cipher.Decrypt(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(plain, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readPresenceEvent(t *testing.T, conn net.Conn, cipher crypto.SymmetricCipher) protocol.PresenceEvent {
+	t.Helper()
+	var head protocol.ReqHead
+	readFrame(t, conn, cipher, &head)
+	if head.Action != protocol.ActionPresence {
+		t.Fatalf("action = %q, want %q", head.Action, protocol.ActionPresence)
+	}
+	event, err := protocol.ReadReq[protocol.PresenceEvent](conn, head.DataLen, cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestSubscribePushesPresenceChanges(t *testing.T) {
+	r := newTestRelay(t)
+	cipher := newTestCipher(t)
+
+	pool := newDeviceConnPool()
+	pool.conns = append(pool.conns, &Connection{ID: "device-a"})
+	r.connections[poolKey{id: "device-a"}] = pool
+
+	body, err := json.Marshal(protocol.SubscribeReq{IDs: []string{"device-a", "device-b", "device-a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = cipher.Encrypt(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.handleSubscribe(server, protocol.ReqHead{Action: protocol.ActionSubscribe, DataLen: len(body)}, cipher, nil)
+	}()
+	if _, err := client.Write(body); err != nil {
+		t.Fatal(err)
+	}
+
+	var resp protocol.RespHead
+	readFrame(t, client, cipher, &resp)
+	if resp.Code != protocol.StatusSuccess {
+		t.Fatalf("subscribe failed: %+v", resp)
+	}
+
+	got := map[string]protocol.DevicePresence{}
+	for range 2 {
+		event := readPresenceEvent(t, client, cipher)
+		got[event.ID] = event.Presence
+	}
+	if got["device-a"] != protocol.PresenceIdle || got["device-b"] != protocol.PresenceOffline {
+		t.Fatalf("initial snapshot = %v", got)
+	}
+
+	// Draining the last idle connection makes the device busy.
+	if pool.tryAcquire() == nil {
+		t.Fatal("expected an idle connection")
+	}
+	r.notifyPresence("device-a")
+	if event := readPresenceEvent(t, client, cipher); event != (protocol.PresenceEvent{ID: "device-a", Presence: protocol.PresenceBusy}) {
+		t.Fatalf("unexpected event %+v", event)
+	}
+
+	// Cleanup of the drained pool reports the device offline.
+	pool.activeCount.Store(0)
+	r.tryCleanupPool("device-a", pool)
+	if event := readPresenceEvent(t, client, cipher); event != (protocol.PresenceEvent{ID: "device-a", Presence: protocol.PresenceOffline}) {
+		t.Fatalf("unexpected event %+v", event)
+	}
+
+	_ = client.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscription did not end after the client closed")
+	}
+	if len(r.subscribers) != 0 {
+		t.Fatalf("subscribers left behind: %v", r.subscribers)
+	}
+	if got := r.globalConnCount.Load(); got != 0 {
+		t.Fatalf("globalConnCount = %d after subscription ended", got)
+	}
+}
+
+func TestSubscribeSeesReconnectWindowExpire(t *testing.T) {
+	r := newTestRelay(t)
+	cipher := newTestCipher(t)
+
+	devClient, devServer := net.Pipe()
+	defer devClient.Close()
+	pool := newDeviceConnPool()
+	pool.limits.reconnectWindow = 200 * time.Millisecond
+	pool.activeCount.Store(1)
+	r.connections[poolKey{id: "device-a"}] = pool
+
+	body := encryptBody(t, cipher, protocol.SubscribeReq{IDs: []string{"device-a"}})
+	client, server := net.Pipe()
+	defer client.Close()
+	go r.handleSubscribe(server, protocol.ReqHead{Action: protocol.ActionSubscribe, DataLen: len(body)}, cipher, nil)
+	if _, err := client.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	var resp protocol.RespHead
+	readFrame(t, client, cipher, &resp)
+	if resp.Code != protocol.StatusSuccess {
+		t.Fatalf("subscribe failed: %+v", resp)
+	}
+	if event := readPresenceEvent(t, client, cipher); event.Presence != protocol.PresenceBusy {
+		t.Fatalf("initial event %+v, want busy", event)
+	}
+
+	// The relay ends; the device stays busy while it may reconnect and is
+	// reported offline once the window passes with no new connection.
+	start := time.Now()
+	r.releaseActiveConnection(pool, &Connection{ID: "device-a", Conn: devServer})
+	r.tryCleanupPool("device-a", pool)
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if event := readPresenceEvent(t, client, cipher); event != (protocol.PresenceEvent{ID: "device-a", Presence: protocol.PresenceOffline}) {
+		t.Fatalf("unexpected event %+v", event)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("offline after %v, before the reconnect window ended", elapsed)
+	}
+}
+
+func TestSubscribeHidesDevicesOfOtherKeys(t *testing.T) {
+	r := newTestRelay(t)
+	pool := newDeviceConnPool()
+	pool.ownerKeyB64 = "owner-key"
+	pool.conns = append(pool.conns, &Connection{ID: "device-a"})
+	r.connections[poolKey{id: "device-a"}] = pool
+
+	owner := newSubscriber([]string{"device-a"}, "owner-key")
+	other := newSubscriber([]string{"device-a"}, "other-key")
+	r.addSubscriber(owner)
+	r.addSubscriber(other)
+	r.notifyPresence("device-a")
+
+	if events := owner.takePending(); len(events) != 1 || events[0].Presence != protocol.PresenceIdle {
+		t.Fatalf("owner events = %v", events)
+	}
+	if events := other.takePending(); len(events) != 0 {
+		t.Fatalf("other key received events: %v", events)
+	}
+
+	// Unchanged presence is not sent twice.
+	r.notifyPresence("device-a")
+	if events := owner.takePending(); len(events) != 0 {
+		t.Fatalf("duplicate events: %v", events)
+	}
+}
+
+func TestPresenceCoversNamedServices(t *testing.T) {
+	r := newTestRelay(t)
+	// The device registered only a named service, partly with another key.
+	files := newDeviceConnPool()
+	files.service = "files"
+	files.ownerKeyB64 = "owner-key"
+	files.activeCount.Store(1)
+	r.connections[poolKey{id: "device-a", service: "files"}] = files
+	backup := newDeviceConnPool()
+	backup.service = "backup"
+	backup.ownerKeyB64 = "other-key"
+	backup.conns = append(backup.conns, &Connection{ID: "device-a"})
+	r.connections[poolKey{id: "device-a", service: "backup"}] = backup
+
+	if presence, ok := r.devicePresence("device-a", "owner-key"); !ok || presence != protocol.PresenceBusy {
+		t.Fatalf("presence for owner = %q, %v; want busy", presence, ok)
+	}
+	if presence, ok := r.devicePresence("device-a", "other-key"); !ok || presence != protocol.PresenceIdle {
+		t.Fatalf("presence for other key = %q, %v; want idle", presence, ok)
+	}
+	if _, ok := r.devicePresence("device-a", "stranger"); ok {
+		t.Fatal("device visible to a key it is not registered with")
+	}
+
+	sub := newSubscriber([]string{"device-a"}, "owner-key")
+	r.addSubscriber(sub)
+	files.activeCount.Store(0)
+	files.conns = append(files.conns, &Connection{ID: "device-a"})
+	r.notifyPresence("device-a")
+	if events := sub.takePending(); len(events) != 1 || events[0].Presence != protocol.PresenceIdle {
+		t.Fatalf("events = %v, want the named service going idle", events)
+	}
+}
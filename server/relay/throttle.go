@@ -0,0 +1,249 @@
+package relay
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// tokenBucket limits a byte rate. Bytes are taken after they were copied,
+// so the bucket may go into debt; the copier then sleeps until it is paid
+// off. The rate can change at runtime.
+type tokenBucket struct {
+	mu sync.Mutex
+	// rate is in bytes per second; 0 means unlimited.
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+// bucketBurstSeconds is how many seconds of rate an idle bucket saves up.
+const bucketBurstSeconds = 1
+
+func (b *tokenBucket) setRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = max(rate, 0)
+	b.tokens = min(b.tokens, float64(b.rate*bucketBurstSeconds))
+}
+
+func (b *tokenBucket) getRate() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate
+}
+
+// take removes n tokens and returns how long the caller must wait before
+// copying more.
+func (b *tokenBucket) take(n int64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	now := time.Now()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+	}
+	b.last = now
+	b.tokens = min(b.tokens, float64(b.rate*bucketBurstSeconds))
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+}
+
+// bandwidth is a limit applied separately to each direction of a bridge:
+// up is sender to device, down is device to sender.
+type bandwidth struct {
+	up, down tokenBucket
+}
+
+func newBandwidth(rate int64) *bandwidth {
+	bw := &bandwidth{}
+	bw.setRate(rate)
+	return bw
+}
+
+func (bw *bandwidth) setRate(rate int64) {
+	bw.up.setRate(rate)
+	bw.down.setRate(rate)
+}
+
+func (bw *bandwidth) getRate() int64 {
+	return bw.up.getRate()
+}
+
+// throttle is the set of buckets one direction of a bridge draws from.
+type throttle []*tokenBucket
+
+// minRate is the lowest limit among the buckets, 0 if none is limited.
+func (t throttle) minRate() int64 {
+	var rate int64
+	for _, b := range t {
+		if r := b.getRate(); r > 0 && (rate == 0 || r < rate) {
+			rate = r
+		}
+	}
+	return rate
+}
+
+// wait takes n tokens from every bucket and sleeps for the longest debt.
+func (t throttle) wait(n int64) {
+	var d time.Duration
+	for _, b := range t {
+		d = max(d, b.take(n))
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// throttleChunk is how many bytes to copy between two waits, about a
+// quarter second at rate, so that the copy stays smooth.
+func throttleChunk(rate int64, maxChunk int64) int64 {
+	if rate <= 0 {
+		return maxChunk
+	}
+	return min(max(rate/4, 1024), maxChunk)
+}
+
+// --- Relay bandwidth limits ---
+
+// deviceLimit is the bandwidth limit of one device ID.
+type deviceLimit struct {
+	bw *bandwidth
+	// override is set once the limit was changed by SetDeviceBandwidth;
+	// other limits have the default rate and only live while bridges use
+	// them.
+	override bool
+	// users counts the bridges drawing from bw.
+	users int
+}
+
+// acquireDeviceBandwidth returns the limit of a device ID for a bridge,
+// creating it with the configured default. The bridge must call
+// releaseDeviceBandwidth when it is over.
+func (r *Relay) acquireDeviceBandwidth(id string) *bandwidth {
+	r.bandwidthMu.Lock()
+	defer r.bandwidthMu.Unlock()
+	l, ok := r.deviceBandwidths[id]
+	if !ok {
+		l = &deviceLimit{bw: newBandwidth(r.config.Bandwidth.DeviceBytesPerSec)}
+		r.deviceBandwidths[id] = l
+	}
+	l.users++
+	return l.bw
+}
+
+// releaseDeviceBandwidth undoes acquireDeviceBandwidth, forgetting a
+// default limit no bridge uses any more.
+func (r *Relay) releaseDeviceBandwidth(id string) {
+	r.bandwidthMu.Lock()
+	defer r.bandwidthMu.Unlock()
+	l, ok := r.deviceBandwidths[id]
+	if !ok {
+		return
+	}
+	l.users--
+	if l.users <= 0 && !l.override {
+		delete(r.deviceBandwidths, id)
+	}
+}
+
+// bridgeThrottles returns the buckets of each direction of a bridge to a
+// device registered with ownerKeyB64. The bridge must call release when it
+// is over.
+func (r *Relay) bridgeThrottles(deviceID, ownerKeyB64 string) (up, down throttle, release func()) {
+	bws := []*bandwidth{r.globalBandwidth, r.acquireDeviceBandwidth(deviceID)}
+	if sl := r.getSecretLimit(ownerKeyB64); sl != nil && sl.bandwidth != nil {
+		bws = append(bws, sl.bandwidth)
+	}
+	if bw := r.quotaThrottle(ownerKeyB64); bw != nil {
+		bws = append(bws, bw)
+	}
+	for _, bw := range bws {
+		up = append(up, &bw.up)
+		down = append(down, &bw.down)
+	}
+	return up, down, func() { r.releaseDeviceBandwidth(deviceID) }
+}
+
+// merge adds the buckets of o that t does not draw from yet.
+func (t throttle) merge(o throttle) throttle {
+	for _, b := range o {
+		if !slices.Contains(t, b) {
+			t = append(t, b)
+		}
+	}
+	return t
+}
+
+// BandwidthStatus reports the bandwidth limits in bytes per second; 0
+// means unlimited.
+type BandwidthStatus struct {
+	Global int64
+	// DeviceDefault applies to devices without their own limit.
+	DeviceDefault int64
+	// Keys lists the limit of each secret key, in config order.
+	Keys []int64
+	// Devices maps the device IDs with their own limit to it.
+	Devices map[string]int64
+}
+
+func (r *Relay) GetBandwidth() BandwidthStatus {
+	status := BandwidthStatus{
+		Global:        r.globalBandwidth.getRate(),
+		DeviceDefault: r.config.Bandwidth.DeviceBytesPerSec,
+		Devices:       make(map[string]int64),
+	}
+	for _, key := range r.secretKeyOrder {
+		var rate int64
+		if sl := r.getSecretLimit(key); sl != nil && sl.bandwidth != nil {
+			rate = sl.bandwidth.getRate()
+		}
+		status.Keys = append(status.Keys, rate)
+	}
+	r.bandwidthMu.Lock()
+	for id, l := range r.deviceBandwidths {
+		if rate := l.bw.getRate(); rate != status.DeviceDefault {
+			status.Devices[id] = rate
+		}
+	}
+	r.bandwidthMu.Unlock()
+	return status
+}
+
+// SetGlobalBandwidth changes the limit shared by all bridges.
+func (r *Relay) SetGlobalBandwidth(rate int64) {
+	r.globalBandwidth.setRate(rate)
+}
+
+// SetKeyBandwidth changes the limit shared by the devices of the secret key
+// at index in the config. It returns false if there is no such key.
+func (r *Relay) SetKeyBandwidth(index int, rate int64) bool {
+	if index < 0 || index >= len(r.secretKeyOrder) {
+		return false
+	}
+	sl := r.getSecretLimit(r.secretKeyOrder[index])
+	if sl == nil || sl.bandwidth == nil {
+		return false
+	}
+	sl.bandwidth.setRate(rate)
+	return true
+}
+
+// SetDeviceBandwidth changes the limit of a device ID. It applies to the
+// bridges in progress too.
+func (r *Relay) SetDeviceBandwidth(id string, rate int64) {
+	r.bandwidthMu.Lock()
+	defer r.bandwidthMu.Unlock()
+	l, ok := r.deviceBandwidths[id]
+	if !ok {
+		l = &deviceLimit{bw: newBandwidth(rate)}
+		r.deviceBandwidths[id] = l
+	}
+	l.override = true
+	l.bw.setRate(rate)
+}
@@ -0,0 +1,87 @@
+package relay
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCopierThrottleRate(t *testing.T) {
+	const rate = 1 << 20
+	const payloadSize = 1 << 20
+	payload := make([]byte, payloadSize)
+	for _, tcp := range []bool{false, true} {
+		name := "pipe"
+		if tcp {
+			name = "tcp"
+		}
+		t.Run(name, func(t *testing.T) {
+			src, dst, feed, drain := bridgePair(t, tcp)
+			go func() {
+				_, _ = feed.Write(payload)
+				closeWrite(feed)
+			}()
+			go func() { _, _ = io.Copy(io.Discard, drain) }()
+
+			bw := newBandwidth(rate)
+			var counter atomic.Int64
+			c := copier{counters: []*atomic.Int64{&counter}, throttle: throttle{&bw.up}}
+			start := time.Now()
+			n, err := c.copy(dst, src)
+			elapsed := time.Since(start)
+			if err != nil || n != payloadSize {
+				t.Fatalf("copy = %d, %v", n, err)
+			}
+			measured := float64(n) / elapsed.Seconds()
+			if measured < rate*0.8 || measured > rate*1.25 {
+				t.Fatalf("measured %.0f B/s in %v, limit %d B/s", measured, elapsed, rate)
+			}
+		})
+	}
+}
+
+func TestBridgeThrottlesCombineLimits(t *testing.T) {
+	r := newTestRelay(t)
+	r.config.Bandwidth.DeviceBytesPerSec = 4000
+	r.keyConnLimit["key"] = &SecretLimit{bandwidth: newBandwidth(3000)}
+	r.secretKeyOrder = []string{"key"}
+
+	up, down, release := r.bridgeThrottles("device", "key")
+	if up.minRate() != 3000 || down.minRate() != 3000 {
+		t.Fatalf("min rates = %d, %d; want the key limit", up.minRate(), down.minRate())
+	}
+
+	// Runtime changes apply to throttles already handed out.
+	r.SetDeviceBandwidth("device", 2000)
+	r.SetGlobalBandwidth(1000)
+	if up.minRate() != 1000 {
+		t.Fatalf("min rate = %d after the global change", up.minRate())
+	}
+	r.SetGlobalBandwidth(0)
+	if !r.SetKeyBandwidth(0, 0) || r.SetKeyBandwidth(1, 0) {
+		t.Fatal("SetKeyBandwidth accepted a wrong index")
+	}
+	if down.minRate() != 2000 {
+		t.Fatalf("min rate = %d, want the device limit", down.minRate())
+	}
+
+	status := r.GetBandwidth()
+	if status.Global != 0 || status.DeviceDefault != 4000 || len(status.Keys) != 1 ||
+		status.Keys[0] != 0 || status.Devices["device"] != 2000 {
+		t.Fatalf("status = %+v", status)
+	}
+
+	// Default limits only live while bridges use them; overrides stay.
+	_, _, releaseOther := r.bridgeThrottles("other", "")
+	_, _, releaseOther2 := r.bridgeThrottles("other", "")
+	release()
+	releaseOther()
+	if len(r.deviceBandwidths) != 2 {
+		t.Fatalf("device limits = %v, want device and other", r.deviceBandwidths)
+	}
+	releaseOther2()
+	if _, ok := r.deviceBandwidths["other"]; ok || len(r.deviceBandwidths) != 1 {
+		t.Fatalf("device limits = %v, want only the override", r.deviceBandwidths)
+	}
+}
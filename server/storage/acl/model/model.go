@@ -26,6 +26,24 @@ type RelayStatistic struct {
 	TotalRelayOfflineCount int    `gorm:"column:total_relay_offline_count;default:0"`
 	TotalRelayMs           int64  `gorm:"column:total_relay_ms;default:0"`
 	TotalRelayBytes        int64  `gorm:"column:total_relay_bytes;default:0"`
+	// TotalRelayIdleTimeoutCount, TotalRelayMaxDurationCount,
+	// TotalRelayKilledCount and TotalRelayQuotaCount count the bridges torn
+	// down or refused by the relay; they are not errors.
+	TotalRelayIdleTimeoutCount int `gorm:"column:total_relay_idle_timeout_count;default:0"`
+	TotalRelayMaxDurationCount int `gorm:"column:total_relay_max_duration_count;default:0"`
+	TotalRelayKilledCount      int `gorm:"column:total_relay_killed_count;default:0"`
+	TotalRelayQuotaCount       int `gorm:"column:total_relay_quota_count;default:0"`
+	// DeviceMeta is the metadata last reported by the device on connect.
+	DeviceMeta `gorm:"embedded"`
+}
+
+// DeviceMeta is the optional self-description a device sends on connect.
+type DeviceMeta struct {
+	Hostname        string    `gorm:"column:hostname;default:''"`
+	OS              string    `gorm:"column:os;default:''"`
+	AppVersion      string    `gorm:"column:app_version;default:''"`
+	ProtocolVersion string    `gorm:"column:protocol_version;default:''"`
+	SeenAt          time.Time `gorm:"column:meta_seen_at"`
 }
 
 type KeyValue struct {
@@ -33,3 +51,40 @@ type KeyValue struct {
 	Key   string `gorm:"column:key;unique;not null;index"`
 	Value string `gorm:"column:value;not null;default:''"`
 }
+
+// MailboxBlob is an end-to-end encrypted message held for an offline device.
+type MailboxBlob struct {
+	ID        uint64 `gorm:"column:id;primaryKey;autoIncrement"`
+	CreatedAt time.Time
+	DeviceID  string `gorm:"column:device_id;not null;index"`
+	// KeyTag identifies the secret key of the sender, empty if it did not
+	// authenticate. A blob is only delivered to a device with the same key.
+	KeyTag     string    `gorm:"column:key_tag;not null;default:''"`
+	SenderAddr string    `gorm:"column:sender_addr;not null;default:''"`
+	Size       int       `gorm:"column:size;not null"`
+	Data       []byte    `gorm:"column:data"`
+	ExpiresAt  time.Time `gorm:"column:expires_at;index"`
+}
+
+// KeyTraffic is the number of bytes relayed for a secret key in one quota
+// period.
+type KeyTraffic struct {
+	// KeyTag identifies the secret key without storing it.
+	KeyTag string `gorm:"column:key_tag;primaryKey"`
+	// Period is the quota period, "2006-01-02" for daily and "2006-01" for
+	// monthly quotas, in UTC.
+	Period    string `gorm:"column:period;primaryKey"`
+	UpdatedAt time.Time
+	Bytes     int64 `gorm:"column:bytes;not null;default:0"`
+}
+
+// DenyEntry is a device ID denied by an admin.
+type DenyEntry struct {
+	ID        string `gorm:"column:id;primaryKey"`
+	CreatedAt time.Time
+	// ExpiresAt is when the entry lapses; zero means never.
+	ExpiresAt time.Time `gorm:"column:expires_at;index"`
+	Reason    string    `gorm:"column:reason;not null;default:''"`
+	// CreatedBy is the admin user who denied the ID.
+	CreatedBy string `gorm:"column:created_by;not null;default:''"`
+}
@@ -0,0 +1,399 @@
+// Code generated by gorm.io/gen. DO NOT EDIT.
+// Code generated by gorm.io/gen. DO NOT EDIT.
+// Code generated by gorm.io/gen. DO NOT EDIT.
+
+package query
+
+import (
+	"context"
+	"database/sql"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+
+	"gorm.io/gen"
+	"gorm.io/gen/field"
+
+	"gorm.io/plugin/dbresolver"
+
+	"github.com/doraemonkeys/WindSend-Relay/server/storage/acl/model"
+)
+
+func newDenyEntry(db *gorm.DB, opts ...gen.DOOption) denyEntry {
+	_denyEntry := denyEntry{}
+
+	_denyEntry.denyEntryDo.UseDB(db, opts...)
+	_denyEntry.denyEntryDo.UseModel(&model.DenyEntry{})
+
+	tableName := _denyEntry.denyEntryDo.TableName()
+	_denyEntry.ALL = field.NewAsterisk(tableName)
+	_denyEntry.ID = field.NewString(tableName, "id")
+	_denyEntry.CreatedAt = field.NewTime(tableName, "created_at")
+	_denyEntry.ExpiresAt = field.NewTime(tableName, "expires_at")
+	_denyEntry.Reason = field.NewString(tableName, "reason")
+	_denyEntry.CreatedBy = field.NewString(tableName, "created_by")
+
+	_denyEntry.fillFieldMap()
+
+	return _denyEntry
+}
+
+type denyEntry struct {
+	denyEntryDo
+
+	ALL       field.Asterisk
+	ID        field.String
+	CreatedAt field.Time
+	ExpiresAt field.Time
+	Reason    field.String
+	CreatedBy field.String
+
+	fieldMap map[string]field.Expr
+}
+
+func (d denyEntry) Table(newTableName string) *denyEntry {
+	d.denyEntryDo.UseTable(newTableName)
+	return d.updateTableName(newTableName)
+}
+
+func (d denyEntry) As(alias string) *denyEntry {
+	d.denyEntryDo.DO = *(d.denyEntryDo.As(alias).(*gen.DO))
+	return d.updateTableName(alias)
+}
+
+func (d *denyEntry) updateTableName(table string) *denyEntry {
+	d.ALL = field.NewAsterisk(table)
+	d.ID = field.NewString(table, "id")
+	d.CreatedAt = field.NewTime(table, "created_at")
+	d.ExpiresAt = field.NewTime(table, "expires_at")
+	d.Reason = field.NewString(table, "reason")
+	d.CreatedBy = field.NewString(table, "created_by")
+
+	d.fillFieldMap()
+
+	return d
+}
+
+func (d *denyEntry) GetFieldByName(fieldName string) (field.OrderExpr, bool) {
+	_f, ok := d.fieldMap[fieldName]
+	if !ok || _f == nil {
+		return nil, false
+	}
+	_oe, ok := _f.(field.OrderExpr)
+	return _oe, ok
+}
+
+func (d *denyEntry) fillFieldMap() {
+	d.fieldMap = make(map[string]field.Expr, 5)
+	d.fieldMap["id"] = d.ID
+	d.fieldMap["created_at"] = d.CreatedAt
+	d.fieldMap["expires_at"] = d.ExpiresAt
+	d.fieldMap["reason"] = d.Reason
+	d.fieldMap["created_by"] = d.CreatedBy
+}
+
+func (d denyEntry) clone(db *gorm.DB) denyEntry {
+	d.denyEntryDo.ReplaceConnPool(db.Statement.ConnPool)
+	return d
+}
+
+func (d denyEntry) replaceDB(db *gorm.DB) denyEntry {
+	d.denyEntryDo.ReplaceDB(db)
+	return d
+}
+
+type denyEntryDo struct{ gen.DO }
+
+type IDenyEntryDo interface {
+	gen.SubQuery
+	Debug() IDenyEntryDo
+	WithContext(ctx context.Context) IDenyEntryDo
+	WithResult(fc func(tx gen.Dao)) gen.ResultInfo
+	ReplaceDB(db *gorm.DB)
+	ReadDB() IDenyEntryDo
+	WriteDB() IDenyEntryDo
+	As(alias string) gen.Dao
+	Session(config *gorm.Session) IDenyEntryDo
+	Columns(cols ...field.Expr) gen.Columns
+	Clauses(conds ...clause.Expression) IDenyEntryDo
+	Not(conds ...gen.Condition) IDenyEntryDo
+	Or(conds ...gen.Condition) IDenyEntryDo
+	Select(conds ...field.Expr) IDenyEntryDo
+	Where(conds ...gen.Condition) IDenyEntryDo
+	Order(conds ...field.Expr) IDenyEntryDo
+	Distinct(cols ...field.Expr) IDenyEntryDo
+	Omit(cols ...field.Expr) IDenyEntryDo
+	Join(table schema.Tabler, on ...field.Expr) IDenyEntryDo
+	LeftJoin(table schema.Tabler, on ...field.Expr) IDenyEntryDo
+	RightJoin(table schema.Tabler, on ...field.Expr) IDenyEntryDo
+	Group(cols ...field.Expr) IDenyEntryDo
+	Having(conds ...gen.Condition) IDenyEntryDo
+	Limit(limit int) IDenyEntryDo
+	Offset(offset int) IDenyEntryDo
+	Count() (count int64, err error)
+	Scopes(funcs ...func(gen.Dao) gen.Dao) IDenyEntryDo
+	Unscoped() IDenyEntryDo
+	Create(values ...*model.DenyEntry) error
+	CreateInBatches(values []*model.DenyEntry, batchSize int) error
+	Save(values ...*model.DenyEntry) error
+	First() (*model.DenyEntry, error)
+	Take() (*model.DenyEntry, error)
+	Last() (*model.DenyEntry, error)
+	Find() ([]*model.DenyEntry, error)
+	FindInBatch(batchSize int, fc func(tx gen.Dao, batch int) error) (results []*model.DenyEntry, err error)
+	FindInBatches(result *[]*model.DenyEntry, batchSize int, fc func(tx gen.Dao, batch int) error) error
+	Pluck(column field.Expr, dest interface{}) error
+	Delete(...*model.DenyEntry) (info gen.ResultInfo, err error)
+	Update(column field.Expr, value interface{}) (info gen.ResultInfo, err error)
+	UpdateSimple(columns ...field.AssignExpr) (info gen.ResultInfo, err error)
+	Updates(value interface{}) (info gen.ResultInfo, err error)
+	UpdateColumn(column field.Expr, value interface{}) (info gen.ResultInfo, err error)
+	UpdateColumnSimple(columns ...field.AssignExpr) (info gen.ResultInfo, err error)
+	UpdateColumns(value interface{}) (info gen.ResultInfo, err error)
+	UpdateFrom(q gen.SubQuery) gen.Dao
+	Attrs(attrs ...field.AssignExpr) IDenyEntryDo
+	Assign(attrs ...field.AssignExpr) IDenyEntryDo
+	Joins(fields ...field.RelationField) IDenyEntryDo
+	Preload(fields ...field.RelationField) IDenyEntryDo
+	FirstOrInit() (*model.DenyEntry, error)
+	FirstOrCreate() (*model.DenyEntry, error)
+	FindByPage(offset int, limit int) (result []*model.DenyEntry, count int64, err error)
+	ScanByPage(result interface{}, offset int, limit int) (count int64, err error)
+	Rows() (*sql.Rows, error)
+	Row() *sql.Row
+	Scan(result interface{}) (err error)
+	Returning(value interface{}, columns ...string) IDenyEntryDo
+	UnderlyingDB() *gorm.DB
+	schema.Tabler
+}
+
+func (d denyEntryDo) Debug() IDenyEntryDo {
+	return d.withDO(d.DO.Debug())
+}
+
+func (d denyEntryDo) WithContext(ctx context.Context) IDenyEntryDo {
+	return d.withDO(d.DO.WithContext(ctx))
+}
+
+func (d denyEntryDo) ReadDB() IDenyEntryDo {
+	return d.Clauses(dbresolver.Read)
+}
+
+func (d denyEntryDo) WriteDB() IDenyEntryDo {
+	return d.Clauses(dbresolver.Write)
+}
+
+func (d denyEntryDo) Session(config *gorm.Session) IDenyEntryDo {
+	return d.withDO(d.DO.Session(config))
+}
+
+func (d denyEntryDo) Clauses(conds ...clause.Expression) IDenyEntryDo {
+	return d.withDO(d.DO.Clauses(conds...))
+}
+
+func (d denyEntryDo) Returning(value interface{}, columns ...string) IDenyEntryDo {
+	return d.withDO(d.DO.Returning(value, columns...))
+}
+
+func (d denyEntryDo) Not(conds ...gen.Condition) IDenyEntryDo {
+	return d.withDO(d.DO.Not(conds...))
+}
+
+func (d denyEntryDo) Or(conds ...gen.Condition) IDenyEntryDo {
+	return d.withDO(d.DO.Or(conds...))
+}
+
+func (d denyEntryDo) Select(conds ...field.Expr) IDenyEntryDo {
+	return d.withDO(d.DO.Select(conds...))
+}
+
+func (d denyEntryDo) Where(conds ...gen.Condition) IDenyEntryDo {
+	return d.withDO(d.DO.Where(conds...))
+}
+
+func (d denyEntryDo) Order(conds ...field.Expr) IDenyEntryDo {
+	return d.withDO(d.DO.Order(conds...))
+}
+
+func (d denyEntryDo) Distinct(cols ...field.Expr) IDenyEntryDo {
+	return d.withDO(d.DO.Distinct(cols...))
+}
+
+func (d denyEntryDo) Omit(cols ...field.Expr) IDenyEntryDo {
+	return d.withDO(d.DO.Omit(cols...))
+}
+
+func (d denyEntryDo) Join(table schema.Tabler, on ...field.Expr) IDenyEntryDo {
+	return d.withDO(d.DO.Join(table, on...))
+}
+
+func (d denyEntryDo) LeftJoin(table schema.Tabler, on ...field.Expr) IDenyEntryDo {
+	return d.withDO(d.DO.LeftJoin(table, on...))
+}
+
+func (d denyEntryDo) RightJoin(table schema.Tabler, on ...field.Expr) IDenyEntryDo {
+	return d.withDO(d.DO.RightJoin(table, on...))
+}
+
+func (d denyEntryDo) Group(cols ...field.Expr) IDenyEntryDo {
+	return d.withDO(d.DO.Group(cols...))
+}
+
+func (d denyEntryDo) Having(conds ...gen.Condition) IDenyEntryDo {
+	return d.withDO(d.DO.Having(conds...))
+}
+
+func (d denyEntryDo) Limit(limit int) IDenyEntryDo {
+	return d.withDO(d.DO.Limit(limit))
+}
+
+func (d denyEntryDo) Offset(offset int) IDenyEntryDo {
+	return d.withDO(d.DO.Offset(offset))
+}
+
+func (d denyEntryDo) Scopes(funcs ...func(gen.Dao) gen.Dao) IDenyEntryDo {
+	return d.withDO(d.DO.Scopes(funcs...))
+}
+
+func (d denyEntryDo) Unscoped() IDenyEntryDo {
+	return d.withDO(d.DO.Unscoped())
+}
+
+func (d denyEntryDo) Create(values ...*model.DenyEntry) error {
+	if len(values) == 0 {
+		return nil
+	}
+	return d.DO.Create(values)
+}
+
+func (d denyEntryDo) CreateInBatches(values []*model.DenyEntry, batchSize int) error {
+	return d.DO.CreateInBatches(values, batchSize)
+}
+
+// Save : !!! underlying implementation is different with GORM
+// The method is equivalent to executing the statement: db.Clauses(clause.OnConflict{UpdateAll: true}).Create(values)
+func (d denyEntryDo) Save(values ...*model.DenyEntry) error {
+	if len(values) == 0 {
+		return nil
+	}
+	return d.DO.Save(values)
+}
+
+func (d denyEntryDo) First() (*model.DenyEntry, error) {
+	if result, err := d.DO.First(); err != nil {
+		return nil, err
+	} else {
+		return result.(*model.DenyEntry), nil
+	}
+}
+
+func (d denyEntryDo) Take() (*model.DenyEntry, error) {
+	if result, err := d.DO.Take(); err != nil {
+		return nil, err
+	} else {
+		return result.(*model.DenyEntry), nil
+	}
+}
+
+func (d denyEntryDo) Last() (*model.DenyEntry, error) {
+	if result, err := d.DO.Last(); err != nil {
+		return nil, err
+	} else {
+		return result.(*model.DenyEntry), nil
+	}
+}
+
+func (d denyEntryDo) Find() ([]*model.DenyEntry, error) {
+	result, err := d.DO.Find()
+	return result.([]*model.DenyEntry), err
+}
+
+func (d denyEntryDo) FindInBatch(batchSize int, fc func(tx gen.Dao, batch int) error) (results []*model.DenyEntry, err error) {
+	buf := make([]*model.DenyEntry, 0, batchSize)
+	err = d.DO.FindInBatches(&buf, batchSize, func(tx gen.Dao, batch int) error {
+		defer func() { results = append(results, buf...) }()
+		return fc(tx, batch)
+	})
+	return results, err
+}
+
+func (d denyEntryDo) FindInBatches(result *[]*model.DenyEntry, batchSize int, fc func(tx gen.Dao, batch int) error) error {
+	return d.DO.FindInBatches(result, batchSize, fc)
+}
+
+func (d denyEntryDo) Attrs(attrs ...field.AssignExpr) IDenyEntryDo {
+	return d.withDO(d.DO.Attrs(attrs...))
+}
+
+func (d denyEntryDo) Assign(attrs ...field.AssignExpr) IDenyEntryDo {
+	return d.withDO(d.DO.Assign(attrs...))
+}
+
+func (d denyEntryDo) Joins(fields ...field.RelationField) IDenyEntryDo {
+	for _, _f := range fields {
+		d = *d.withDO(d.DO.Joins(_f))
+	}
+	return &d
+}
+
+func (d denyEntryDo) Preload(fields ...field.RelationField) IDenyEntryDo {
+	for _, _f := range fields {
+		d = *d.withDO(d.DO.Preload(_f))
+	}
+	return &d
+}
+
+func (d denyEntryDo) FirstOrInit() (*model.DenyEntry, error) {
+	if result, err := d.DO.FirstOrInit(); err != nil {
+		return nil, err
+	} else {
+		return result.(*model.DenyEntry), nil
+	}
+}
+
+func (d denyEntryDo) FirstOrCreate() (*model.DenyEntry, error) {
+	if result, err := d.DO.FirstOrCreate(); err != nil {
+		return nil, err
+	} else {
+		return result.(*model.DenyEntry), nil
+	}
+}
+
+func (d denyEntryDo) FindByPage(offset int, limit int) (result []*model.DenyEntry, count int64, err error) {
+	result, err = d.Offset(offset).Limit(limit).Find()
+	if err != nil {
+		return
+	}
+
+	if size := len(result); 0 < limit && 0 < size && size < limit {
+		count = int64(size + offset)
+		return
+	}
+
+	count, err = d.Offset(-1).Limit(-1).Count()
+	return
+}
+
+func (d denyEntryDo) ScanByPage(result interface{}, offset int, limit int) (count int64, err error) {
+	count, err = d.Count()
+	if err != nil {
+		return
+	}
+
+	err = d.Offset(offset).Limit(limit).Scan(result)
+	return
+}
+
+func (d denyEntryDo) Scan(result interface{}) (err error) {
+	return d.DO.Scan(result)
+}
+
+func (d denyEntryDo) Delete(models ...*model.DenyEntry) (result gen.ResultInfo, err error) {
+	return d.DO.Delete(models)
+}
+
+func (d *denyEntryDo) withDO(do gen.Dao) *denyEntryDo {
+	d.DO = *do.(*gen.DO)
+	return d
+}
@@ -17,20 +17,29 @@ import (
 
 var (
 	Q              = new(Query)
+	DenyEntry      *denyEntry
+	KeyTraffic     *keyTraffic
 	KeyValue       *keyValue
+	MailboxBlob    *mailboxBlob
 	RelayStatistic *relayStatistic
 )
 
 func SetDefault(db *gorm.DB, opts ...gen.DOOption) {
 	*Q = *Use(db, opts...)
+	DenyEntry = &Q.DenyEntry
+	KeyTraffic = &Q.KeyTraffic
 	KeyValue = &Q.KeyValue
+	MailboxBlob = &Q.MailboxBlob
 	RelayStatistic = &Q.RelayStatistic
 }
 
 func Use(db *gorm.DB, opts ...gen.DOOption) *Query {
 	return &Query{
 		db:             db,
+		DenyEntry:      newDenyEntry(db, opts...),
+		KeyTraffic:     newKeyTraffic(db, opts...),
 		KeyValue:       newKeyValue(db, opts...),
+		MailboxBlob:    newMailboxBlob(db, opts...),
 		RelayStatistic: newRelayStatistic(db, opts...),
 	}
 }
@@ -38,7 +47,10 @@ func Use(db *gorm.DB, opts ...gen.DOOption) *Query {
 type Query struct {
 	db *gorm.DB
 
+	DenyEntry      denyEntry
+	KeyTraffic     keyTraffic
 	KeyValue       keyValue
+	MailboxBlob    mailboxBlob
 	RelayStatistic relayStatistic
 }
 
@@ -47,7 +59,10 @@ func (q *Query) Available() bool { return q.db != nil }
 func (q *Query) clone(db *gorm.DB) *Query {
 	return &Query{
 		db:             db,
+		DenyEntry:      q.DenyEntry.clone(db),
+		KeyTraffic:     q.KeyTraffic.clone(db),
 		KeyValue:       q.KeyValue.clone(db),
+		MailboxBlob:    q.MailboxBlob.clone(db),
 		RelayStatistic: q.RelayStatistic.clone(db),
 	}
 }
@@ -63,19 +78,28 @@ func (q *Query) WriteDB() *Query {
 func (q *Query) ReplaceDB(db *gorm.DB) *Query {
 	return &Query{
 		db:             db,
+		DenyEntry:      q.DenyEntry.replaceDB(db),
+		KeyTraffic:     q.KeyTraffic.replaceDB(db),
 		KeyValue:       q.KeyValue.replaceDB(db),
+		MailboxBlob:    q.MailboxBlob.replaceDB(db),
 		RelayStatistic: q.RelayStatistic.replaceDB(db),
 	}
 }
 
 type queryCtx struct {
+	DenyEntry      IDenyEntryDo
+	KeyTraffic     IKeyTrafficDo
 	KeyValue       IKeyValueDo
+	MailboxBlob    IMailboxBlobDo
 	RelayStatistic IRelayStatisticDo
 }
 
 func (q *Query) WithContext(ctx context.Context) *queryCtx {
 	return &queryCtx{
+		DenyEntry:      q.DenyEntry.WithContext(ctx),
+		KeyTraffic:     q.KeyTraffic.WithContext(ctx),
 		KeyValue:       q.KeyValue.WithContext(ctx),
+		MailboxBlob:    q.MailboxBlob.WithContext(ctx),
 		RelayStatistic: q.RelayStatistic.WithContext(ctx),
 	}
 }
@@ -0,0 +1,395 @@
+// Code generated by gorm.io/gen. DO NOT EDIT.
+// Code generated by gorm.io/gen. DO NOT EDIT.
+// Code generated by gorm.io/gen. DO NOT EDIT.
+
+package query
+
+import (
+	"context"
+	"database/sql"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+
+	"gorm.io/gen"
+	"gorm.io/gen/field"
+
+	"gorm.io/plugin/dbresolver"
+
+	"github.com/doraemonkeys/WindSend-Relay/server/storage/acl/model"
+)
+
+func newKeyTraffic(db *gorm.DB, opts ...gen.DOOption) keyTraffic {
+	_keyTraffic := keyTraffic{}
+
+	_keyTraffic.keyTrafficDo.UseDB(db, opts...)
+	_keyTraffic.keyTrafficDo.UseModel(&model.KeyTraffic{})
+
+	tableName := _keyTraffic.keyTrafficDo.TableName()
+	_keyTraffic.ALL = field.NewAsterisk(tableName)
+	_keyTraffic.KeyTag = field.NewString(tableName, "key_tag")
+	_keyTraffic.Period = field.NewString(tableName, "period")
+	_keyTraffic.UpdatedAt = field.NewTime(tableName, "updated_at")
+	_keyTraffic.Bytes = field.NewInt64(tableName, "bytes")
+
+	_keyTraffic.fillFieldMap()
+
+	return _keyTraffic
+}
+
+type keyTraffic struct {
+	keyTrafficDo
+
+	ALL       field.Asterisk
+	KeyTag    field.String
+	Period    field.String
+	UpdatedAt field.Time
+	Bytes     field.Int64
+
+	fieldMap map[string]field.Expr
+}
+
+func (k keyTraffic) Table(newTableName string) *keyTraffic {
+	k.keyTrafficDo.UseTable(newTableName)
+	return k.updateTableName(newTableName)
+}
+
+func (k keyTraffic) As(alias string) *keyTraffic {
+	k.keyTrafficDo.DO = *(k.keyTrafficDo.As(alias).(*gen.DO))
+	return k.updateTableName(alias)
+}
+
+func (k *keyTraffic) updateTableName(table string) *keyTraffic {
+	k.ALL = field.NewAsterisk(table)
+	k.KeyTag = field.NewString(table, "key_tag")
+	k.Period = field.NewString(table, "period")
+	k.UpdatedAt = field.NewTime(table, "updated_at")
+	k.Bytes = field.NewInt64(table, "bytes")
+
+	k.fillFieldMap()
+
+	return k
+}
+
+func (k *keyTraffic) GetFieldByName(fieldName string) (field.OrderExpr, bool) {
+	_f, ok := k.fieldMap[fieldName]
+	if !ok || _f == nil {
+		return nil, false
+	}
+	_oe, ok := _f.(field.OrderExpr)
+	return _oe, ok
+}
+
+func (k *keyTraffic) fillFieldMap() {
+	k.fieldMap = make(map[string]field.Expr, 4)
+	k.fieldMap["key_tag"] = k.KeyTag
+	k.fieldMap["period"] = k.Period
+	k.fieldMap["updated_at"] = k.UpdatedAt
+	k.fieldMap["bytes"] = k.Bytes
+}
+
+func (k keyTraffic) clone(db *gorm.DB) keyTraffic {
+	k.keyTrafficDo.ReplaceConnPool(db.Statement.ConnPool)
+	return k
+}
+
+func (k keyTraffic) replaceDB(db *gorm.DB) keyTraffic {
+	k.keyTrafficDo.ReplaceDB(db)
+	return k
+}
+
+type keyTrafficDo struct{ gen.DO }
+
+type IKeyTrafficDo interface {
+	gen.SubQuery
+	Debug() IKeyTrafficDo
+	WithContext(ctx context.Context) IKeyTrafficDo
+	WithResult(fc func(tx gen.Dao)) gen.ResultInfo
+	ReplaceDB(db *gorm.DB)
+	ReadDB() IKeyTrafficDo
+	WriteDB() IKeyTrafficDo
+	As(alias string) gen.Dao
+	Session(config *gorm.Session) IKeyTrafficDo
+	Columns(cols ...field.Expr) gen.Columns
+	Clauses(conds ...clause.Expression) IKeyTrafficDo
+	Not(conds ...gen.Condition) IKeyTrafficDo
+	Or(conds ...gen.Condition) IKeyTrafficDo
+	Select(conds ...field.Expr) IKeyTrafficDo
+	Where(conds ...gen.Condition) IKeyTrafficDo
+	Order(conds ...field.Expr) IKeyTrafficDo
+	Distinct(cols ...field.Expr) IKeyTrafficDo
+	Omit(cols ...field.Expr) IKeyTrafficDo
+	Join(table schema.Tabler, on ...field.Expr) IKeyTrafficDo
+	LeftJoin(table schema.Tabler, on ...field.Expr) IKeyTrafficDo
+	RightJoin(table schema.Tabler, on ...field.Expr) IKeyTrafficDo
+	Group(cols ...field.Expr) IKeyTrafficDo
+	Having(conds ...gen.Condition) IKeyTrafficDo
+	Limit(limit int) IKeyTrafficDo
+	Offset(offset int) IKeyTrafficDo
+	Count() (count int64, err error)
+	Scopes(funcs ...func(gen.Dao) gen.Dao) IKeyTrafficDo
+	Unscoped() IKeyTrafficDo
+	Create(values ...*model.KeyTraffic) error
+	CreateInBatches(values []*model.KeyTraffic, batchSize int) error
+	Save(values ...*model.KeyTraffic) error
+	First() (*model.KeyTraffic, error)
+	Take() (*model.KeyTraffic, error)
+	Last() (*model.KeyTraffic, error)
+	Find() ([]*model.KeyTraffic, error)
+	FindInBatch(batchSize int, fc func(tx gen.Dao, batch int) error) (results []*model.KeyTraffic, err error)
+	FindInBatches(result *[]*model.KeyTraffic, batchSize int, fc func(tx gen.Dao, batch int) error) error
+	Pluck(column field.Expr, dest interface{}) error
+	Delete(...*model.KeyTraffic) (info gen.ResultInfo, err error)
+	Update(column field.Expr, value interface{}) (info gen.ResultInfo, err error)
+	UpdateSimple(columns ...field.AssignExpr) (info gen.ResultInfo, err error)
+	Updates(value interface{}) (info gen.ResultInfo, err error)
+	UpdateColumn(column field.Expr, value interface{}) (info gen.ResultInfo, err error)
+	UpdateColumnSimple(columns ...field.AssignExpr) (info gen.ResultInfo, err error)
+	UpdateColumns(value interface{}) (info gen.ResultInfo, err error)
+	UpdateFrom(q gen.SubQuery) gen.Dao
+	Attrs(attrs ...field.AssignExpr) IKeyTrafficDo
+	Assign(attrs ...field.AssignExpr) IKeyTrafficDo
+	Joins(fields ...field.RelationField) IKeyTrafficDo
+	Preload(fields ...field.RelationField) IKeyTrafficDo
+	FirstOrInit() (*model.KeyTraffic, error)
+	FirstOrCreate() (*model.KeyTraffic, error)
+	FindByPage(offset int, limit int) (result []*model.KeyTraffic, count int64, err error)
+	ScanByPage(result interface{}, offset int, limit int) (count int64, err error)
+	Rows() (*sql.Rows, error)
+	Row() *sql.Row
+	Scan(result interface{}) (err error)
+	Returning(value interface{}, columns ...string) IKeyTrafficDo
+	UnderlyingDB() *gorm.DB
+	schema.Tabler
+}
+
+func (k keyTrafficDo) Debug() IKeyTrafficDo {
+	return k.withDO(k.DO.Debug())
+}
+
+func (k keyTrafficDo) WithContext(ctx context.Context) IKeyTrafficDo {
+	return k.withDO(k.DO.WithContext(ctx))
+}
+
+func (k keyTrafficDo) ReadDB() IKeyTrafficDo {
+	return k.Clauses(dbresolver.Read)
+}
+
+func (k keyTrafficDo) WriteDB() IKeyTrafficDo {
+	return k.Clauses(dbresolver.Write)
+}
+
+func (k keyTrafficDo) Session(config *gorm.Session) IKeyTrafficDo {
+	return k.withDO(k.DO.Session(config))
+}
+
+func (k keyTrafficDo) Clauses(conds ...clause.Expression) IKeyTrafficDo {
+	return k.withDO(k.DO.Clauses(conds...))
+}
+
+func (k keyTrafficDo) Returning(value interface{}, columns ...string) IKeyTrafficDo {
+	return k.withDO(k.DO.Returning(value, columns...))
+}
+
+func (k keyTrafficDo) Not(conds ...gen.Condition) IKeyTrafficDo {
+	return k.withDO(k.DO.Not(conds...))
+}
+
+func (k keyTrafficDo) Or(conds ...gen.Condition) IKeyTrafficDo {
+	return k.withDO(k.DO.Or(conds...))
+}
+
+func (k keyTrafficDo) Select(conds ...field.Expr) IKeyTrafficDo {
+	return k.withDO(k.DO.Select(conds...))
+}
+
+func (k keyTrafficDo) Where(conds ...gen.Condition) IKeyTrafficDo {
+	return k.withDO(k.DO.Where(conds...))
+}
+
+func (k keyTrafficDo) Order(conds ...field.Expr) IKeyTrafficDo {
+	return k.withDO(k.DO.Order(conds...))
+}
+
+func (k keyTrafficDo) Distinct(cols ...field.Expr) IKeyTrafficDo {
+	return k.withDO(k.DO.Distinct(cols...))
+}
+
+func (k keyTrafficDo) Omit(cols ...field.Expr) IKeyTrafficDo {
+	return k.withDO(k.DO.Omit(cols...))
+}
+
+func (k keyTrafficDo) Join(table schema.Tabler, on ...field.Expr) IKeyTrafficDo {
+	return k.withDO(k.DO.Join(table, on...))
+}
+
+func (k keyTrafficDo) LeftJoin(table schema.Tabler, on ...field.Expr) IKeyTrafficDo {
+	return k.withDO(k.DO.LeftJoin(table, on...))
+}
+
+func (k keyTrafficDo) RightJoin(table schema.Tabler, on ...field.Expr) IKeyTrafficDo {
+	return k.withDO(k.DO.RightJoin(table, on...))
+}
+
+func (k keyTrafficDo) Group(cols ...field.Expr) IKeyTrafficDo {
+	return k.withDO(k.DO.Group(cols...))
+}
+
+func (k keyTrafficDo) Having(conds ...gen.Condition) IKeyTrafficDo {
+	return k.withDO(k.DO.Having(conds...))
+}
+
+func (k keyTrafficDo) Limit(limit int) IKeyTrafficDo {
+	return k.withDO(k.DO.Limit(limit))
+}
+
+func (k keyTrafficDo) Offset(offset int) IKeyTrafficDo {
+	return k.withDO(k.DO.Offset(offset))
+}
+
+func (k keyTrafficDo) Scopes(funcs ...func(gen.Dao) gen.Dao) IKeyTrafficDo {
+	return k.withDO(k.DO.Scopes(funcs...))
+}
+
+func (k keyTrafficDo) Unscoped() IKeyTrafficDo {
+	return k.withDO(k.DO.Unscoped())
+}
+
+func (k keyTrafficDo) Create(values ...*model.KeyTraffic) error {
+	if len(values) == 0 {
+		return nil
+	}
+	return k.DO.Create(values)
+}
+
+func (k keyTrafficDo) CreateInBatches(values []*model.KeyTraffic, batchSize int) error {
+	return k.DO.CreateInBatches(values, batchSize)
+}
+
+// Save : !!! underlying implementation is different with GORM
+// The method is equivalent to executing the statement: db.Clauses(clause.OnConflict{UpdateAll: true}).Create(values)
+func (k keyTrafficDo) Save(values ...*model.KeyTraffic) error {
+	if len(values) == 0 {
+		return nil
+	}
+	return k.DO.Save(values)
+}
+
+func (k keyTrafficDo) First() (*model.KeyTraffic, error) {
+	if result, err := k.DO.First(); err != nil {
+		return nil, err
+	} else {
+		return result.(*model.KeyTraffic), nil
+	}
+}
+
+func (k keyTrafficDo) Take() (*model.KeyTraffic, error) {
+	if result, err := k.DO.Take(); err != nil {
+		return nil, err
+	} else {
+		return result.(*model.KeyTraffic), nil
+	}
+}
+
+func (k keyTrafficDo) Last() (*model.KeyTraffic, error) {
+	if result, err := k.DO.Last(); err != nil {
+		return nil, err
+	} else {
+		return result.(*model.KeyTraffic), nil
+	}
+}
+
+func (k keyTrafficDo) Find() ([]*model.KeyTraffic, error) {
+	result, err := k.DO.Find()
+	return result.([]*model.KeyTraffic), err
+}
+
+func (k keyTrafficDo) FindInBatch(batchSize int, fc func(tx gen.Dao, batch int) error) (results []*model.KeyTraffic, err error) {
+	buf := make([]*model.KeyTraffic, 0, batchSize)
+	err = k.DO.FindInBatches(&buf, batchSize, func(tx gen.Dao, batch int) error {
+		defer func() { results = append(results, buf...) }()
+		return fc(tx, batch)
+	})
+	return results, err
+}
+
+func (k keyTrafficDo) FindInBatches(result *[]*model.KeyTraffic, batchSize int, fc func(tx gen.Dao, batch int) error) error {
+	return k.DO.FindInBatches(result, batchSize, fc)
+}
+
+func (k keyTrafficDo) Attrs(attrs ...field.AssignExpr) IKeyTrafficDo {
+	return k.withDO(k.DO.Attrs(attrs...))
+}
+
+func (k keyTrafficDo) Assign(attrs ...field.AssignExpr) IKeyTrafficDo {
+	return k.withDO(k.DO.Assign(attrs...))
+}
+
+func (k keyTrafficDo) Joins(fields ...field.RelationField) IKeyTrafficDo {
+	for _, _f := range fields {
+		k = *k.withDO(k.DO.Joins(_f))
+	}
+	return &k
+}
+
+func (k keyTrafficDo) Preload(fields ...field.RelationField) IKeyTrafficDo {
+	for _, _f := range fields {
+		k = *k.withDO(k.DO.Preload(_f))
+	}
+	return &k
+}
+
+func (k keyTrafficDo) FirstOrInit() (*model.KeyTraffic, error) {
+	if result, err := k.DO.FirstOrInit(); err != nil {
+		return nil, err
+	} else {
+		return result.(*model.KeyTraffic), nil
+	}
+}
+
+func (k keyTrafficDo) FirstOrCreate() (*model.KeyTraffic, error) {
+	if result, err := k.DO.FirstOrCreate(); err != nil {
+		return nil, err
+	} else {
+		return result.(*model.KeyTraffic), nil
+	}
+}
+
+func (k keyTrafficDo) FindByPage(offset int, limit int) (result []*model.KeyTraffic, count int64, err error) {
+	result, err = k.Offset(offset).Limit(limit).Find()
+	if err != nil {
+		return
+	}
+
+	if size := len(result); 0 < limit && 0 < size && size < limit {
+		count = int64(size + offset)
+		return
+	}
+
+	count, err = k.Offset(-1).Limit(-1).Count()
+	return
+}
+
+func (k keyTrafficDo) ScanByPage(result interface{}, offset int, limit int) (count int64, err error) {
+	count, err = k.Count()
+	if err != nil {
+		return
+	}
+
+	err = k.Offset(offset).Limit(limit).Scan(result)
+	return
+}
+
+func (k keyTrafficDo) Scan(result interface{}) (err error) {
+	return k.DO.Scan(result)
+}
+
+func (k keyTrafficDo) Delete(models ...*model.KeyTraffic) (result gen.ResultInfo, err error) {
+	return k.DO.Delete(models)
+}
+
+func (k *keyTrafficDo) withDO(do gen.Dao) *keyTrafficDo {
+	k.DO = *do.(*gen.DO)
+	return k
+}
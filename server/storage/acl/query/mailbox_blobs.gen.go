@@ -0,0 +1,411 @@
+// Code generated by gorm.io/gen. DO NOT EDIT.
+// Code generated by gorm.io/gen. DO NOT EDIT.
+// Code generated by gorm.io/gen. DO NOT EDIT.
+
+package query
+
+import (
+	"context"
+	"database/sql"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+
+	"gorm.io/gen"
+	"gorm.io/gen/field"
+
+	"gorm.io/plugin/dbresolver"
+
+	"github.com/doraemonkeys/WindSend-Relay/server/storage/acl/model"
+)
+
+func newMailboxBlob(db *gorm.DB, opts ...gen.DOOption) mailboxBlob {
+	_mailboxBlob := mailboxBlob{}
+
+	_mailboxBlob.mailboxBlobDo.UseDB(db, opts...)
+	_mailboxBlob.mailboxBlobDo.UseModel(&model.MailboxBlob{})
+
+	tableName := _mailboxBlob.mailboxBlobDo.TableName()
+	_mailboxBlob.ALL = field.NewAsterisk(tableName)
+	_mailboxBlob.ID = field.NewUint64(tableName, "id")
+	_mailboxBlob.CreatedAt = field.NewTime(tableName, "created_at")
+	_mailboxBlob.DeviceID = field.NewString(tableName, "device_id")
+	_mailboxBlob.KeyTag = field.NewString(tableName, "key_tag")
+	_mailboxBlob.SenderAddr = field.NewString(tableName, "sender_addr")
+	_mailboxBlob.Size = field.NewInt(tableName, "size")
+	_mailboxBlob.Data = field.NewBytes(tableName, "data")
+	_mailboxBlob.ExpiresAt = field.NewTime(tableName, "expires_at")
+
+	_mailboxBlob.fillFieldMap()
+
+	return _mailboxBlob
+}
+
+type mailboxBlob struct {
+	mailboxBlobDo
+
+	ALL        field.Asterisk
+	ID         field.Uint64
+	CreatedAt  field.Time
+	DeviceID   field.String
+	KeyTag     field.String
+	SenderAddr field.String
+	Size       field.Int
+	Data       field.Bytes
+	ExpiresAt  field.Time
+
+	fieldMap map[string]field.Expr
+}
+
+func (m mailboxBlob) Table(newTableName string) *mailboxBlob {
+	m.mailboxBlobDo.UseTable(newTableName)
+	return m.updateTableName(newTableName)
+}
+
+func (m mailboxBlob) As(alias string) *mailboxBlob {
+	m.mailboxBlobDo.DO = *(m.mailboxBlobDo.As(alias).(*gen.DO))
+	return m.updateTableName(alias)
+}
+
+func (m *mailboxBlob) updateTableName(table string) *mailboxBlob {
+	m.ALL = field.NewAsterisk(table)
+	m.ID = field.NewUint64(table, "id")
+	m.CreatedAt = field.NewTime(table, "created_at")
+	m.DeviceID = field.NewString(table, "device_id")
+	m.KeyTag = field.NewString(table, "key_tag")
+	m.SenderAddr = field.NewString(table, "sender_addr")
+	m.Size = field.NewInt(table, "size")
+	m.Data = field.NewBytes(table, "data")
+	m.ExpiresAt = field.NewTime(table, "expires_at")
+
+	m.fillFieldMap()
+
+	return m
+}
+
+func (m *mailboxBlob) GetFieldByName(fieldName string) (field.OrderExpr, bool) {
+	_f, ok := m.fieldMap[fieldName]
+	if !ok || _f == nil {
+		return nil, false
+	}
+	_oe, ok := _f.(field.OrderExpr)
+	return _oe, ok
+}
+
+func (m *mailboxBlob) fillFieldMap() {
+	m.fieldMap = make(map[string]field.Expr, 8)
+	m.fieldMap["id"] = m.ID
+	m.fieldMap["created_at"] = m.CreatedAt
+	m.fieldMap["device_id"] = m.DeviceID
+	m.fieldMap["key_tag"] = m.KeyTag
+	m.fieldMap["sender_addr"] = m.SenderAddr
+	m.fieldMap["size"] = m.Size
+	m.fieldMap["data"] = m.Data
+	m.fieldMap["expires_at"] = m.ExpiresAt
+}
+
+func (m mailboxBlob) clone(db *gorm.DB) mailboxBlob {
+	m.mailboxBlobDo.ReplaceConnPool(db.Statement.ConnPool)
+	return m
+}
+
+func (m mailboxBlob) replaceDB(db *gorm.DB) mailboxBlob {
+	m.mailboxBlobDo.ReplaceDB(db)
+	return m
+}
+
+type mailboxBlobDo struct{ gen.DO }
+
+type IMailboxBlobDo interface {
+	gen.SubQuery
+	Debug() IMailboxBlobDo
+	WithContext(ctx context.Context) IMailboxBlobDo
+	WithResult(fc func(tx gen.Dao)) gen.ResultInfo
+	ReplaceDB(db *gorm.DB)
+	ReadDB() IMailboxBlobDo
+	WriteDB() IMailboxBlobDo
+	As(alias string) gen.Dao
+	Session(config *gorm.Session) IMailboxBlobDo
+	Columns(cols ...field.Expr) gen.Columns
+	Clauses(conds ...clause.Expression) IMailboxBlobDo
+	Not(conds ...gen.Condition) IMailboxBlobDo
+	Or(conds ...gen.Condition) IMailboxBlobDo
+	Select(conds ...field.Expr) IMailboxBlobDo
+	Where(conds ...gen.Condition) IMailboxBlobDo
+	Order(conds ...field.Expr) IMailboxBlobDo
+	Distinct(cols ...field.Expr) IMailboxBlobDo
+	Omit(cols ...field.Expr) IMailboxBlobDo
+	Join(table schema.Tabler, on ...field.Expr) IMailboxBlobDo
+	LeftJoin(table schema.Tabler, on ...field.Expr) IMailboxBlobDo
+	RightJoin(table schema.Tabler, on ...field.Expr) IMailboxBlobDo
+	Group(cols ...field.Expr) IMailboxBlobDo
+	Having(conds ...gen.Condition) IMailboxBlobDo
+	Limit(limit int) IMailboxBlobDo
+	Offset(offset int) IMailboxBlobDo
+	Count() (count int64, err error)
+	Scopes(funcs ...func(gen.Dao) gen.Dao) IMailboxBlobDo
+	Unscoped() IMailboxBlobDo
+	Create(values ...*model.MailboxBlob) error
+	CreateInBatches(values []*model.MailboxBlob, batchSize int) error
+	Save(values ...*model.MailboxBlob) error
+	First() (*model.MailboxBlob, error)
+	Take() (*model.MailboxBlob, error)
+	Last() (*model.MailboxBlob, error)
+	Find() ([]*model.MailboxBlob, error)
+	FindInBatch(batchSize int, fc func(tx gen.Dao, batch int) error) (results []*model.MailboxBlob, err error)
+	FindInBatches(result *[]*model.MailboxBlob, batchSize int, fc func(tx gen.Dao, batch int) error) error
+	Pluck(column field.Expr, dest interface{}) error
+	Delete(...*model.MailboxBlob) (info gen.ResultInfo, err error)
+	Update(column field.Expr, value interface{}) (info gen.ResultInfo, err error)
+	UpdateSimple(columns ...field.AssignExpr) (info gen.ResultInfo, err error)
+	Updates(value interface{}) (info gen.ResultInfo, err error)
+	UpdateColumn(column field.Expr, value interface{}) (info gen.ResultInfo, err error)
+	UpdateColumnSimple(columns ...field.AssignExpr) (info gen.ResultInfo, err error)
+	UpdateColumns(value interface{}) (info gen.ResultInfo, err error)
+	UpdateFrom(q gen.SubQuery) gen.Dao
+	Attrs(attrs ...field.AssignExpr) IMailboxBlobDo
+	Assign(attrs ...field.AssignExpr) IMailboxBlobDo
+	Joins(fields ...field.RelationField) IMailboxBlobDo
+	Preload(fields ...field.RelationField) IMailboxBlobDo
+	FirstOrInit() (*model.MailboxBlob, error)
+	FirstOrCreate() (*model.MailboxBlob, error)
+	FindByPage(offset int, limit int) (result []*model.MailboxBlob, count int64, err error)
+	ScanByPage(result interface{}, offset int, limit int) (count int64, err error)
+	Rows() (*sql.Rows, error)
+	Row() *sql.Row
+	Scan(result interface{}) (err error)
+	Returning(value interface{}, columns ...string) IMailboxBlobDo
+	UnderlyingDB() *gorm.DB
+	schema.Tabler
+}
+
+func (m mailboxBlobDo) Debug() IMailboxBlobDo {
+	return m.withDO(m.DO.Debug())
+}
+
+func (m mailboxBlobDo) WithContext(ctx context.Context) IMailboxBlobDo {
+	return m.withDO(m.DO.WithContext(ctx))
+}
+
+func (m mailboxBlobDo) ReadDB() IMailboxBlobDo {
+	return m.Clauses(dbresolver.Read)
+}
+
+func (m mailboxBlobDo) WriteDB() IMailboxBlobDo {
+	return m.Clauses(dbresolver.Write)
+}
+
+func (m mailboxBlobDo) Session(config *gorm.Session) IMailboxBlobDo {
+	return m.withDO(m.DO.Session(config))
+}
+
+func (m mailboxBlobDo) Clauses(conds ...clause.Expression) IMailboxBlobDo {
+	return m.withDO(m.DO.Clauses(conds...))
+}
+
+func (m mailboxBlobDo) Returning(value interface{}, columns ...string) IMailboxBlobDo {
+	return m.withDO(m.DO.Returning(value, columns...))
+}
+
+func (m mailboxBlobDo) Not(conds ...gen.Condition) IMailboxBlobDo {
+	return m.withDO(m.DO.Not(conds...))
+}
+
+func (m mailboxBlobDo) Or(conds ...gen.Condition) IMailboxBlobDo {
+	return m.withDO(m.DO.Or(conds...))
+}
+
+func (m mailboxBlobDo) Select(conds ...field.Expr) IMailboxBlobDo {
+	return m.withDO(m.DO.Select(conds...))
+}
+
+func (m mailboxBlobDo) Where(conds ...gen.Condition) IMailboxBlobDo {
+	return m.withDO(m.DO.Where(conds...))
+}
+
+func (m mailboxBlobDo) Order(conds ...field.Expr) IMailboxBlobDo {
+	return m.withDO(m.DO.Order(conds...))
+}
+
+func (m mailboxBlobDo) Distinct(cols ...field.Expr) IMailboxBlobDo {
+	return m.withDO(m.DO.Distinct(cols...))
+}
+
+func (m mailboxBlobDo) Omit(cols ...field.Expr) IMailboxBlobDo {
+	return m.withDO(m.DO.Omit(cols...))
+}
+
+func (m mailboxBlobDo) Join(table schema.Tabler, on ...field.Expr) IMailboxBlobDo {
+	return m.withDO(m.DO.Join(table, on...))
+}
+
+func (m mailboxBlobDo) LeftJoin(table schema.Tabler, on ...field.Expr) IMailboxBlobDo {
+	return m.withDO(m.DO.LeftJoin(table, on...))
+}
+
+func (m mailboxBlobDo) RightJoin(table schema.Tabler, on ...field.Expr) IMailboxBlobDo {
+	return m.withDO(m.DO.RightJoin(table, on...))
+}
+
+func (m mailboxBlobDo) Group(cols ...field.Expr) IMailboxBlobDo {
+	return m.withDO(m.DO.Group(cols...))
+}
+
+func (m mailboxBlobDo) Having(conds ...gen.Condition) IMailboxBlobDo {
+	return m.withDO(m.DO.Having(conds...))
+}
+
+func (m mailboxBlobDo) Limit(limit int) IMailboxBlobDo {
+	return m.withDO(m.DO.Limit(limit))
+}
+
+func (m mailboxBlobDo) Offset(offset int) IMailboxBlobDo {
+	return m.withDO(m.DO.Offset(offset))
+}
+
+func (m mailboxBlobDo) Scopes(funcs ...func(gen.Dao) gen.Dao) IMailboxBlobDo {
+	return m.withDO(m.DO.Scopes(funcs...))
+}
+
+func (m mailboxBlobDo) Unscoped() IMailboxBlobDo {
+	return m.withDO(m.DO.Unscoped())
+}
+
+func (m mailboxBlobDo) Create(values ...*model.MailboxBlob) error {
+	if len(values) == 0 {
+		return nil
+	}
+	return m.DO.Create(values)
+}
+
+func (m mailboxBlobDo) CreateInBatches(values []*model.MailboxBlob, batchSize int) error {
+	return m.DO.CreateInBatches(values, batchSize)
+}
+
+// Save : !!! underlying implementation is different with GORM
+// The method is equivalent to executing the statement: db.Clauses(clause.OnConflict{UpdateAll: true}).Create(values)
+func (m mailboxBlobDo) Save(values ...*model.MailboxBlob) error {
+	if len(values) == 0 {
+		return nil
+	}
+	return m.DO.Save(values)
+}
+
+func (m mailboxBlobDo) First() (*model.MailboxBlob, error) {
+	if result, err := m.DO.First(); err != nil {
+		return nil, err
+	} else {
+		return result.(*model.MailboxBlob), nil
+	}
+}
+
+func (m mailboxBlobDo) Take() (*model.MailboxBlob, error) {
+	if result, err := m.DO.Take(); err != nil {
+		return nil, err
+	} else {
+		return result.(*model.MailboxBlob), nil
+	}
+}
+
+func (m mailboxBlobDo) Last() (*model.MailboxBlob, error) {
+	if result, err := m.DO.Last(); err != nil {
+		return nil, err
+	} else {
+		return result.(*model.MailboxBlob), nil
+	}
+}
+
+func (m mailboxBlobDo) Find() ([]*model.MailboxBlob, error) {
+	result, err := m.DO.Find()
+	return result.([]*model.MailboxBlob), err
+}
+
+func (m mailboxBlobDo) FindInBatch(batchSize int, fc func(tx gen.Dao, batch int) error) (results []*model.MailboxBlob, err error) {
+	buf := make([]*model.MailboxBlob, 0, batchSize)
+	err = m.DO.FindInBatches(&buf, batchSize, func(tx gen.Dao, batch int) error {
+		defer func() { results = append(results, buf...) }()
+		return fc(tx, batch)
+	})
+	return results, err
+}
+
+func (m mailboxBlobDo) FindInBatches(result *[]*model.MailboxBlob, batchSize int, fc func(tx gen.Dao, batch int) error) error {
+	return m.DO.FindInBatches(result, batchSize, fc)
+}
+
+func (m mailboxBlobDo) Attrs(attrs ...field.AssignExpr) IMailboxBlobDo {
+	return m.withDO(m.DO.Attrs(attrs...))
+}
+
+func (m mailboxBlobDo) Assign(attrs ...field.AssignExpr) IMailboxBlobDo {
+	return m.withDO(m.DO.Assign(attrs...))
+}
+
+func (m mailboxBlobDo) Joins(fields ...field.RelationField) IMailboxBlobDo {
+	for _, _f := range fields {
+		m = *m.withDO(m.DO.Joins(_f))
+	}
+	return &m
+}
+
+func (m mailboxBlobDo) Preload(fields ...field.RelationField) IMailboxBlobDo {
+	for _, _f := range fields {
+		m = *m.withDO(m.DO.Preload(_f))
+	}
+	return &m
+}
+
+func (m mailboxBlobDo) FirstOrInit() (*model.MailboxBlob, error) {
+	if result, err := m.DO.FirstOrInit(); err != nil {
+		return nil, err
+	} else {
+		return result.(*model.MailboxBlob), nil
+	}
+}
+
+func (m mailboxBlobDo) FirstOrCreate() (*model.MailboxBlob, error) {
+	if result, err := m.DO.FirstOrCreate(); err != nil {
+		return nil, err
+	} else {
+		return result.(*model.MailboxBlob), nil
+	}
+}
+
+func (m mailboxBlobDo) FindByPage(offset int, limit int) (result []*model.MailboxBlob, count int64, err error) {
+	result, err = m.Offset(offset).Limit(limit).Find()
+	if err != nil {
+		return
+	}
+
+	if size := len(result); 0 < limit && 0 < size && size < limit {
+		count = int64(size + offset)
+		return
+	}
+
+	count, err = m.Offset(-1).Limit(-1).Count()
+	return
+}
+
+func (m mailboxBlobDo) ScanByPage(result interface{}, offset int, limit int) (count int64, err error) {
+	count, err = m.Count()
+	if err != nil {
+		return
+	}
+
+	err = m.Offset(offset).Limit(limit).Scan(result)
+	return
+}
+
+func (m mailboxBlobDo) Scan(result interface{}) (err error) {
+	return m.DO.Scan(result)
+}
+
+func (m mailboxBlobDo) Delete(models ...*model.MailboxBlob) (result gen.ResultInfo, err error) {
+	return m.DO.Delete(models)
+}
+
+func (m *mailboxBlobDo) withDO(do gen.Dao) *mailboxBlobDo {
+	m.DO = *do.(*gen.DO)
+	return m
+}
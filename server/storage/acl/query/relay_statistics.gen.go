@@ -37,6 +37,15 @@ func newRelayStatistic(db *gorm.DB, opts ...gen.DOOption) relayStatistic {
 	_relayStatistic.TotalRelayOfflineCount = field.NewInt(tableName, "total_relay_offline_count")
 	_relayStatistic.TotalRelayMs = field.NewInt64(tableName, "total_relay_ms")
 	_relayStatistic.TotalRelayBytes = field.NewInt64(tableName, "total_relay_bytes")
+	_relayStatistic.TotalRelayIdleTimeoutCount = field.NewInt(tableName, "total_relay_idle_timeout_count")
+	_relayStatistic.TotalRelayMaxDurationCount = field.NewInt(tableName, "total_relay_max_duration_count")
+	_relayStatistic.TotalRelayKilledCount = field.NewInt(tableName, "total_relay_killed_count")
+	_relayStatistic.TotalRelayQuotaCount = field.NewInt(tableName, "total_relay_quota_count")
+	_relayStatistic.DeviceMetaHostname = field.NewString(tableName, "hostname")
+	_relayStatistic.DeviceMetaOS = field.NewString(tableName, "os")
+	_relayStatistic.DeviceMetaAppVersion = field.NewString(tableName, "app_version")
+	_relayStatistic.DeviceMetaProtocolVersion = field.NewString(tableName, "protocol_version")
+	_relayStatistic.DeviceMetaSeenAt = field.NewTime(tableName, "meta_seen_at")
 
 	_relayStatistic.fillFieldMap()
 
@@ -46,16 +55,25 @@ func newRelayStatistic(db *gorm.DB, opts ...gen.DOOption) relayStatistic {
 type relayStatistic struct {
 	relayStatisticDo
 
-	ALL                    field.Asterisk
-	ID                     field.String
-	CreatedAt              field.Time
-	UpdatedAt              field.Time
-	CustomName             field.String
-	TotalRelayCount        field.Int
-	TotalRelayErrCount     field.Int
-	TotalRelayOfflineCount field.Int
-	TotalRelayMs           field.Int64
-	TotalRelayBytes        field.Int64
+	ALL                        field.Asterisk
+	ID                         field.String
+	CreatedAt                  field.Time
+	UpdatedAt                  field.Time
+	CustomName                 field.String
+	TotalRelayCount            field.Int
+	TotalRelayErrCount         field.Int
+	TotalRelayOfflineCount     field.Int
+	TotalRelayMs               field.Int64
+	TotalRelayBytes            field.Int64
+	TotalRelayIdleTimeoutCount field.Int
+	TotalRelayMaxDurationCount field.Int
+	TotalRelayKilledCount      field.Int
+	TotalRelayQuotaCount       field.Int
+	DeviceMetaHostname         field.String
+	DeviceMetaOS               field.String
+	DeviceMetaAppVersion       field.String
+	DeviceMetaProtocolVersion  field.String
+	DeviceMetaSeenAt           field.Time
 
 	fieldMap map[string]field.Expr
 }
@@ -81,6 +99,15 @@ func (r *relayStatistic) updateTableName(table string) *relayStatistic {
 	r.TotalRelayOfflineCount = field.NewInt(table, "total_relay_offline_count")
 	r.TotalRelayMs = field.NewInt64(table, "total_relay_ms")
 	r.TotalRelayBytes = field.NewInt64(table, "total_relay_bytes")
+	r.TotalRelayIdleTimeoutCount = field.NewInt(table, "total_relay_idle_timeout_count")
+	r.TotalRelayMaxDurationCount = field.NewInt(table, "total_relay_max_duration_count")
+	r.TotalRelayKilledCount = field.NewInt(table, "total_relay_killed_count")
+	r.TotalRelayQuotaCount = field.NewInt(table, "total_relay_quota_count")
+	r.DeviceMetaHostname = field.NewString(table, "hostname")
+	r.DeviceMetaOS = field.NewString(table, "os")
+	r.DeviceMetaAppVersion = field.NewString(table, "app_version")
+	r.DeviceMetaProtocolVersion = field.NewString(table, "protocol_version")
+	r.DeviceMetaSeenAt = field.NewTime(table, "meta_seen_at")
 
 	r.fillFieldMap()
 
@@ -97,7 +124,7 @@ func (r *relayStatistic) GetFieldByName(fieldName string) (field.OrderExpr, bool
 }
 
 func (r *relayStatistic) fillFieldMap() {
-	r.fieldMap = make(map[string]field.Expr, 9)
+	r.fieldMap = make(map[string]field.Expr, 18)
 	r.fieldMap["id"] = r.ID
 	r.fieldMap["created_at"] = r.CreatedAt
 	r.fieldMap["updated_at"] = r.UpdatedAt
@@ -107,6 +134,15 @@ func (r *relayStatistic) fillFieldMap() {
 	r.fieldMap["total_relay_offline_count"] = r.TotalRelayOfflineCount
 	r.fieldMap["total_relay_ms"] = r.TotalRelayMs
 	r.fieldMap["total_relay_bytes"] = r.TotalRelayBytes
+	r.fieldMap["total_relay_idle_timeout_count"] = r.TotalRelayIdleTimeoutCount
+	r.fieldMap["total_relay_max_duration_count"] = r.TotalRelayMaxDurationCount
+	r.fieldMap["total_relay_killed_count"] = r.TotalRelayKilledCount
+	r.fieldMap["total_relay_quota_count"] = r.TotalRelayQuotaCount
+	r.fieldMap["hostname"] = r.DeviceMetaHostname
+	r.fieldMap["os"] = r.DeviceMetaOS
+	r.fieldMap["app_version"] = r.DeviceMetaAppVersion
+	r.fieldMap["protocol_version"] = r.DeviceMetaProtocolVersion
+	r.fieldMap["meta_seen_at"] = r.DeviceMetaSeenAt
 }
 
 func (r relayStatistic) clone(db *gorm.DB) relayStatistic {
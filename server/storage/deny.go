@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/doraemonkeys/WindSend-Relay/server/storage/acl/model"
+	"github.com/doraemonkeys/WindSend-Relay/server/storage/acl/query"
+)
+
+// SaveDenyEntry creates or replaces the deny entry of entry.ID.
+func (s Storage) SaveDenyEntry(entry *model.DenyEntry) error {
+	q := query.Use(s.db)
+	return q.DenyEntry.Save(entry)
+}
+
+func (s Storage) DeleteDenyEntry(id string) error {
+	q := query.Use(s.db)
+	_, err := q.DenyEntry.Where(q.DenyEntry.ID.Eq(id)).Delete()
+	return err
+}
+
+// ListDenyEntries returns the deny entries that have not expired.
+func (s Storage) ListDenyEntries() ([]*model.DenyEntry, error) {
+	q := query.Use(s.db)
+	var zero time.Time
+	return q.DenyEntry.Where(q.DenyEntry.Where(q.DenyEntry.ExpiresAt.Eq(zero)).Or(q.DenyEntry.ExpiresAt.Gt(time.Now()))).Find()
+}
+
+// PurgeExpiredDenyEntries deletes the deny entries that have expired.
+func (s Storage) PurgeExpiredDenyEntries() (int64, error) {
+	q := query.Use(s.db)
+	var zero time.Time
+	r, err := q.DenyEntry.Where(q.DenyEntry.ExpiresAt.Neq(zero), q.DenyEntry.ExpiresAt.Lte(time.Now())).Delete()
+	if err != nil {
+		return 0, err
+	}
+	return r.RowsAffected, nil
+}
@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"errors"
+	"time"
+
+	"github.com/doraemonkeys/WindSend-Relay/server/storage/acl/model"
+	"github.com/doraemonkeys/WindSend-Relay/server/storage/acl/query"
+	"gorm.io/gen"
+)
+
+var (
+	// ErrMailboxFull is returned by AddMailboxBlob when the device already
+	// holds the maximum number of blobs.
+	ErrMailboxFull = errors.New("mailbox full")
+	// ErrMailboxOverBudget is returned by AddMailboxBlob when the blob does
+	// not fit in the bytes left to its key or to the whole mailbox.
+	ErrMailboxOverBudget = errors.New("mailbox storage budget exceeded")
+)
+
+// MailboxLimits bounds what AddMailboxBlob stores. Only unexpired blobs
+// count against the limits.
+type MailboxLimits struct {
+	MaxBlobsPerDevice int
+	MaxBytesPerKey    int64
+	MaxTotalBytes     int64
+}
+
+// AddMailboxBlob stores blob if it fits within limits. The checks and the
+// insert run in one transaction, so concurrent puts cannot exceed them.
+func (s Storage) AddMailboxBlob(blob *model.MailboxBlob, limits MailboxLimits) error {
+	q := query.Use(s.db)
+	return q.Transaction(func(tx *query.Query) error {
+		now := time.Now()
+		count, err := tx.MailboxBlob.Where(tx.MailboxBlob.DeviceID.Eq(blob.DeviceID), tx.MailboxBlob.ExpiresAt.Gt(now)).Count()
+		if err != nil {
+			return err
+		}
+		if count >= int64(limits.MaxBlobsPerDevice) {
+			return ErrMailboxFull
+		}
+		keyBytes, err := mailboxBytes(tx, tx.MailboxBlob.KeyTag.Eq(blob.KeyTag), tx.MailboxBlob.ExpiresAt.Gt(now))
+		if err != nil {
+			return err
+		}
+		totalBytes, err := mailboxBytes(tx, tx.MailboxBlob.ExpiresAt.Gt(now))
+		if err != nil {
+			return err
+		}
+		size := int64(blob.Size)
+		if keyBytes+size > limits.MaxBytesPerKey || totalBytes+size > limits.MaxTotalBytes {
+			return ErrMailboxOverBudget
+		}
+		return tx.MailboxBlob.Create(blob)
+	})
+}
+
+// mailboxBytes sums the size of the blobs matching conds.
+func mailboxBytes(tx *query.Query, conds ...gen.Condition) (int64, error) {
+	var r struct{ Total int64 }
+	err := tx.MailboxBlob.Select(tx.MailboxBlob.Size.Sum().IfNull(0).As("total")).Where(conds...).Scan(&r)
+	return r.Total, err
+}
+
+// CountMailboxBlobs returns the number of unexpired blobs held for deviceID.
+func (s Storage) CountMailboxBlobs(deviceID string) (int64, error) {
+	q := query.Use(s.db)
+	return q.MailboxBlob.Where(q.MailboxBlob.DeviceID.Eq(deviceID), q.MailboxBlob.ExpiresAt.Gt(time.Now())).Count()
+}
+
+// GetMailboxBlobs returns the unexpired blobs for deviceID sent with keyTag,
+// oldest first.
+func (s Storage) GetMailboxBlobs(deviceID string, keyTag string) ([]*model.MailboxBlob, error) {
+	q := query.Use(s.db)
+	return q.MailboxBlob.Where(
+		q.MailboxBlob.DeviceID.Eq(deviceID),
+		q.MailboxBlob.KeyTag.Eq(keyTag),
+		q.MailboxBlob.ExpiresAt.Gt(time.Now()),
+	).Order(q.MailboxBlob.ID).Find()
+}
+
+// ListMailboxBlobs pages through all held blobs without their data.
+// An empty deviceID lists blobs of every device.
+func (s Storage) ListMailboxBlobs(deviceID string, page, pageSize int) ([]*model.MailboxBlob, int64, error) {
+	q := query.Use(s.db)
+	do := q.MailboxBlob.Select(
+		q.MailboxBlob.ID,
+		q.MailboxBlob.CreatedAt,
+		q.MailboxBlob.DeviceID,
+		q.MailboxBlob.SenderAddr,
+		q.MailboxBlob.Size,
+		q.MailboxBlob.ExpiresAt,
+	)
+	if deviceID != "" {
+		do = do.Where(q.MailboxBlob.DeviceID.Eq(deviceID))
+	}
+	return do.Order(q.MailboxBlob.ID).FindByPage((page-1)*pageSize, pageSize)
+}
+
+func (s Storage) DeleteMailboxBlob(id uint64) (bool, error) {
+	q := query.Use(s.db)
+	r, err := q.MailboxBlob.Where(q.MailboxBlob.ID.Eq(id)).Delete()
+	if err != nil {
+		return false, err
+	}
+	return r.RowsAffected > 0, nil
+}
+
+// PurgeMailbox deletes every blob held for deviceID.
+func (s Storage) PurgeMailbox(deviceID string) (int64, error) {
+	q := query.Use(s.db)
+	r, err := q.MailboxBlob.Where(q.MailboxBlob.DeviceID.Eq(deviceID)).Delete()
+	if err != nil {
+		return 0, err
+	}
+	return r.RowsAffected, nil
+}
+
+func (s Storage) PurgeExpiredMailboxBlobs() (int64, error) {
+	q := query.Use(s.db)
+	r, err := q.MailboxBlob.Where(q.MailboxBlob.ExpiresAt.Lte(time.Now())).Delete()
+	if err != nil {
+		return 0, err
+	}
+	return r.RowsAffected, nil
+}
@@ -27,6 +27,9 @@ func NewStorage(path string) Storage {
 	err := db.AutoMigrate(
 		&model.RelayStatistic{},
 		&model.KeyValue{},
+		&model.MailboxBlob{},
+		&model.KeyTraffic{},
+		&model.DenyEntry{},
 	)
 	if err != nil {
 		panic(err)
@@ -105,7 +108,26 @@ func (s Storage) GetRelayStatistic(id string) (*model.RelayStatistic, error) {
 	return stat, nil
 }
 
-func (s Storage) AddRelayStatistic(id string, success bool, offline bool, ms int, bytes int64) {
+// RelayOutcome is how a relay request ended.
+type RelayOutcome int
+
+const (
+	RelaySucceeded RelayOutcome = iota
+	RelayFailed
+	RelayOffline
+	// RelayIdleTimeout is a bridge torn down after relaying nothing for the
+	// idle timeout.
+	RelayIdleTimeout
+	// RelayMaxDuration is a bridge torn down at its maximum duration.
+	RelayMaxDuration
+	// RelayKilled is a bridge killed by the admin.
+	RelayKilled
+	// RelayQuotaExceeded is a relay refused or cut off by the traffic quota
+	// of the device's key.
+	RelayQuotaExceeded
+)
+
+func (s Storage) AddRelayStatistic(id string, outcome RelayOutcome, ms int, bytes int64) {
 	q := query.Use(s.db)
 	q.Transaction(func(tx *query.Query) error {
 		stat, err := tx.RelayStatistic.Where(tx.RelayStatistic.ID.Eq(id)).FirstOrCreate()
@@ -116,11 +138,19 @@ func (s Storage) AddRelayStatistic(id string, success bool, offline bool, ms int
 		stat.TotalRelayCount++
 		stat.TotalRelayMs += int64(ms)
 		stat.TotalRelayBytes += bytes
-		if !success && !offline {
+		switch outcome {
+		case RelayFailed:
 			stat.TotalRelayErrCount++
-		}
-		if offline {
+		case RelayOffline:
 			stat.TotalRelayOfflineCount++
+		case RelayIdleTimeout:
+			stat.TotalRelayIdleTimeoutCount++
+		case RelayMaxDuration:
+			stat.TotalRelayMaxDurationCount++
+		case RelayKilled:
+			stat.TotalRelayKilledCount++
+		case RelayQuotaExceeded:
+			stat.TotalRelayQuotaCount++
 		}
 		r, err := tx.RelayStatistic.Where(tx.RelayStatistic.ID.Eq(id)).Updates(stat)
 		if err != nil {
@@ -298,3 +328,30 @@ func (s Storage) UpdateConnectionCustomName(id string, customName string) error
 	})
 	return nil
 }
+
+// UpdateDeviceMeta records the metadata a device reported on connect.
+func (s Storage) UpdateDeviceMeta(id string, meta model.DeviceMeta) error {
+	q := query.Use(s.db)
+	return q.Transaction(func(tx *query.Query) error {
+		_, err := tx.RelayStatistic.Where(tx.RelayStatistic.ID.Eq(id)).FirstOrCreate()
+		if err != nil {
+			zap.L().Error("update device meta failed", zap.Error(err))
+			return err
+		}
+		r, err := tx.RelayStatistic.Where(tx.RelayStatistic.ID.Eq(id)).UpdateSimple(
+			tx.RelayStatistic.DeviceMetaHostname.Value(meta.Hostname),
+			tx.RelayStatistic.DeviceMetaOS.Value(meta.OS),
+			tx.RelayStatistic.DeviceMetaAppVersion.Value(meta.AppVersion),
+			tx.RelayStatistic.DeviceMetaProtocolVersion.Value(meta.ProtocolVersion),
+			tx.RelayStatistic.DeviceMetaSeenAt.Value(meta.SeenAt),
+		)
+		if err != nil {
+			zap.L().Error("save device meta failed", zap.Error(err))
+			return err
+		}
+		if r.RowsAffected == 0 {
+			zap.L().Error("unexpected: relay statistic record not found", zap.String("id", id))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"errors"
+
+	"github.com/doraemonkeys/WindSend-Relay/server/storage/acl/query"
+	"gorm.io/gorm"
+)
+
+// AddKeyTraffic adds bytes to the traffic of keyTag in period.
+func (s Storage) AddKeyTraffic(keyTag string, period string, bytes int64) error {
+	q := query.Use(s.db)
+	return q.Transaction(func(tx *query.Query) error {
+		_, err := tx.KeyTraffic.Where(tx.KeyTraffic.KeyTag.Eq(keyTag), tx.KeyTraffic.Period.Eq(period)).FirstOrCreate()
+		if err != nil {
+			return err
+		}
+		_, err = tx.KeyTraffic.Where(tx.KeyTraffic.KeyTag.Eq(keyTag), tx.KeyTraffic.Period.Eq(period)).
+			UpdateSimple(tx.KeyTraffic.Bytes.Add(bytes))
+		return err
+	})
+}
+
+// GetKeyTraffic returns the traffic of keyTag in period, 0 if none was
+// recorded.
+func (s Storage) GetKeyTraffic(keyTag string, period string) (int64, error) {
+	q := query.Use(s.db)
+	traffic, err := q.KeyTraffic.Where(q.KeyTraffic.KeyTag.Eq(keyTag), q.KeyTraffic.Period.Eq(period)).First()
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return traffic.Bytes, nil
+}